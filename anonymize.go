@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Anonymizer replaces the value of a field in an anonymized export. It
+// is given the value as decoded from the record, with numbers as
+// json.Number, and returns the value to export instead.
+type Anonymizer func(v interface{}) interface{}
+
+// AnonymizeHash replaces a value with the first 16 hex digits of the
+// SHA-256 of salt and the value. Equal values hash alike, so fields used
+// to join records, such as emails, still join after export, while the
+// salt keeps the hashes of guessable values from being looked up.
+func AnonymizeHash(salt string) Anonymizer {
+	return func(v interface{}) interface{} {
+		return hex.EncodeToString(anonymizeSum(salt, v)[:8])
+	}
+}
+
+// AnonymizeTruncate keeps the first n characters of string values, such
+// as the outward code of a postcode, and leaves other values alone.
+func AnonymizeTruncate(n int) Anonymizer {
+	return func(v interface{}) interface{} {
+		s, ok := v.(string)
+		if !ok {
+			return v
+		}
+		if r := []rune(s); len(r) > n {
+			return string(r[:n])
+		}
+		return s
+	}
+}
+
+// AnonymizeMask applies a Masker to string values, leaving other values
+// alone.
+func AnonymizeMask(m Masker) Anonymizer {
+	return func(v interface{}) interface{} {
+		if s, ok := v.(string); ok {
+			return m(s)
+		}
+		return v
+	}
+}
+
+// AnonymizeRemove replaces a value with null.
+func AnonymizeRemove() Anonymizer {
+	return func(interface{}) interface{} { return nil }
+}
+
+var (
+	fakeFirstNames = []string{"Alex", "Sam", "Robin", "Jordan", "Taylor", "Morgan", "Casey", "Jamie", "Riley", "Avery", "Quinn", "Charlie"}
+	fakeLastNames  = []string{"Smith", "Jones", "Garcia", "Brown", "Miller", "Davis", "Wilson", "Moore", "Clark", "Lewis", "Walker", "Young"}
+	fakeCities     = []string{"Springfield", "Riverton", "Fairview", "Greenville", "Madison", "Franklin", "Clinton", "Georgetown"}
+)
+
+// AnonymizeName replaces a value with a made-up "First Last" name.
+func AnonymizeName(salt string) Anonymizer {
+	return anonymizeFake(salt, func(n uint64) string {
+		return fakeFirstNames[n%uint64(len(fakeFirstNames))] + " " + fakeLastNames[n/uint64(len(fakeFirstNames))%uint64(len(fakeLastNames))]
+	})
+}
+
+// AnonymizeEmail replaces a value with a made-up address under the
+// reserved example.com domain.
+func AnonymizeEmail(salt string) Anonymizer {
+	return anonymizeFake(salt, func(n uint64) string {
+		return fmt.Sprintf("user%d@example.com", n%1000000)
+	})
+}
+
+// AnonymizePhone replaces the digits of a string value with made-up ones,
+// keeping its length and punctuation so that it still looks like a phone
+// number, e.g. "+1 555-0100" becomes "+4 817-2093". Other values become a
+// made-up ten-digit number.
+func AnonymizePhone(salt string) Anonymizer {
+	return func(v interface{}) interface{} {
+		sum := anonymizeSum(salt, v)
+		s, ok := v.(string)
+		if !ok {
+			s = "0000000000"
+		}
+		out := []byte(s)
+		i := 0
+		for j, c := range out {
+			if c >= '0' && c <= '9' {
+				out[j] = '0' + sum[i%len(sum)]%10
+				i++
+			}
+		}
+		return string(out)
+	}
+}
+
+// AnonymizeCity replaces a value with a made-up city name.
+func AnonymizeCity(salt string) Anonymizer {
+	return anonymizeFake(salt, func(n uint64) string {
+		return fakeCities[n%uint64(len(fakeCities))]
+	})
+}
+
+// anonymizeFake returns an Anonymizer replacing values with the fake
+// picks for a number derived from salt and the value, so that equal
+// values get the same fake one.
+func anonymizeFake(salt string, pick func(n uint64) string) Anonymizer {
+	return func(v interface{}) interface{} {
+		return pick(binary.BigEndian.Uint64(anonymizeSum(salt, v)[:8]))
+	}
+}
+
+func anonymizeSum(salt string, v interface{}) []byte {
+	b, _ := json.Marshal(v)
+	sum := sha256.Sum256(append([]byte(salt+"\x00"), b...))
+	return sum[:]
+}
+
+// ExportAnonymized writes every record of collection to w like
+// ExportNDJSON, after replacing the fields named in rules, dotted paths
+// such as "Address.City", with what their Anonymizer returns, so that the
+// export can be loaded into a staging environment with ImportNDJSON
+// without carrying real user data. Paths crossing arrays apply to every
+// element; fields missing from a record are left out. Anonymizers see the
+// stored values; masks are applied afterwards to the remaining fields.
+func (d *Driver) ExportAnonymized(collection string, w io.Writer, rules map[string]Anonymizer) (int, error) {
+	paths := make(map[string][]string, len(rules))
+	for field := range rules {
+		paths[field] = strings.Split(field, ".")
+	}
+	return d.exportNDJSON(collection, w, func(b []byte) ([]byte, error) {
+		doc, err := decodeDoc(b)
+		if err != nil {
+			return nil, err
+		}
+		for field, a := range rules {
+			anonymizeField(doc, paths[field], a)
+		}
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(doc); err != nil {
+			return nil, err
+		}
+		return d.mask(collection, buf.Bytes())
+	})
+}
+
+// anonymizeField walks path through nested objects and arrays and
+// replaces the values found at its end.
+func anonymizeField(v interface{}, path []string, a Anonymizer) {
+	switch v := v.(type) {
+	case []interface{}:
+		for _, item := range v {
+			anonymizeField(item, path, a)
+		}
+	case map[string]interface{}:
+		child, ok := v[path[0]]
+		if !ok {
+			return
+		}
+		if len(path) == 1 {
+			v[path[0]] = a(child)
+			return
+		}
+		anonymizeField(child, path[1:], a)
+	}
+}
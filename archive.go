@@ -0,0 +1,183 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Archive moves the records of collection that have not been modified for
+// olderThan into a new gzip-compressed tar file at dest, then removes them
+// from the collection. Records are only removed once the archive has been
+// written and synced. It returns the number of records archived. Use
+// ReadArchive to query an archive and RestoreArchive to bring its records
+// back. Records pinned with Pin are never archived.
+func (d *Driver) Archive(collection string, olderThan time.Duration, dest string) (int, error) {
+	if err := checkCollection(collection); err != nil {
+		return 0, err
+	}
+	if err := d.checkWritable(); err != nil {
+		return 0, err
+	}
+	cutoff := d.now().Add(-olderThan)
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	records, err := d.scan(collection)
+	if err != nil {
+		return 0, err
+	}
+	var stale []Record[json.RawMessage]
+	for _, r := range records {
+		if r.Meta.ModTime.Before(cutoff) && !d.Pinned(collection, r.Key) {
+			stale = append(stale, r)
+		}
+	}
+	if len(stale) == 0 {
+		return 0, nil
+	}
+
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeArchive(f, collection, stale); err != nil {
+		f.Close()
+		os.Remove(dest)
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	for i, r := range stale {
+		if err := d.delete(collection, r.Key); err != nil {
+			return i, err
+		}
+	}
+	return len(stale), nil
+}
+
+func writeArchive(w io.Writer, collection string, records []Record[json.RawMessage]) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, r := range records {
+		hdr := &tar.Header{
+			Name:    path.Join(collection, r.Key+".json"),
+			Mode:    0644,
+			Size:    int64(len(r.Value)),
+			ModTime: r.Meta.ModTime,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(r.Value); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// ReadArchive returns the records of collection stored in the archive at
+// src. An empty collection returns the records of every collection, with
+// keys in "collection/key" form.
+func ReadArchive(src, collection string) ([]Record[json.RawMessage], error) {
+	var out []Record[json.RawMessage]
+	err := walkArchive(src, func(c string, r Record[json.RawMessage]) error {
+		if collection == "" {
+			r.Key = c + "/" + r.Key
+			out = append(out, r)
+		} else if c == collection {
+			out = append(out, r)
+		}
+		return nil
+	})
+	return out, err
+}
+
+// RestoreArchive writes every record of the archive at src back into its
+// collection and returns the number of records restored. Records that exist
+// in the database are only replaced when overwrite is set. An archive
+// with an entry that does not name a valid collection and key, such as one
+// reaching outside the database, is refused before anything is restored.
+func (d *Driver) RestoreArchive(src string, overwrite bool) (int, error) {
+	err := walkArchive(src, func(collection string, r Record[json.RawMessage]) error {
+		if err := d.checkKey(collection, r.Key, "restore archive entry"); err != nil {
+			return fmt.Errorf("%s: %w", src, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	d.settle()
+	n := 0
+	err = walkArchive(src, func(collection string, r Record[json.RawMessage]) error {
+		mutex := d.getOrCreateMutex(collection)
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !overwrite {
+			if _, err := os.Stat(d.recordPath(collection, r.Key)); err == nil {
+				return nil
+			}
+		}
+		n++
+		return d.write(collection, r.Key, r.Value)
+	})
+	return n, err
+}
+
+func walkArchive(src string, fn func(collection string, r Record[json.RawMessage]) error) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		collection, file := path.Split(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || !strings.HasSuffix(file, ".json") {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		err = fn(strings.TrimSuffix(collection, "/"), Record[json.RawMessage]{
+			Key:   strings.TrimSuffix(file, ".json"),
+			Meta:  Meta{Size: hdr.Size, ModTime: hdr.ModTime},
+			Value: data,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
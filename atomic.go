@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// writeFile atomically replaces path with b. The data is written to a
+// temporary sibling which is then moved over path in a single step, so
+// readers see either the old or the new contents, never a partial file.
+func (d *Driver) writeFile(path string, b []byte) error {
+	if err := d.replace(path, b); err != nil {
+		return err
+	}
+	if d.sync {
+		return d.backend.SyncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// replace is writeFile without the final sync of the directory, which the
+// caller takes care of.
+func (d *Driver) replace(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := d.withRetry(func() error { return d.backend.WriteFile(tmp, b, d.sync) }); err != nil {
+		os.Remove(tmp)
+		return diskError(err)
+	}
+	if err := d.withRetry(func() error { return d.backend.Rename(tmp, path) }); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// syncParent makes the creation, rename or removal of path survive a crash
+// when Options.SyncWrites is set, by syncing the directory holding it.
+func (d *Driver) syncParent(path string) error {
+	if !d.sync {
+		return nil
+	}
+	return d.backend.SyncDir(filepath.Dir(path))
+}
+
+// mkdirAll is os.MkdirAll that, when Options.SyncWrites is set, also syncs
+// the parent of every directory it creates, so that the files later
+// written inside are not lost with a directory entry that never reached
+// the disk.
+func (d *Driver) mkdirAll(dir string) error {
+	if !d.sync {
+		return os.MkdirAll(dir, 0755)
+	}
+	var created []string
+	for p := dir; ; p = filepath.Dir(p) {
+		if _, err := os.Stat(p); err == nil || filepath.Dir(p) == p {
+			break
+		}
+		created = append(created, p)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, p := range created {
+		if err := d.backend.SyncDir(filepath.Dir(p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncTree flushes every file and directory under dir when
+// Options.SyncWrites is set. Trees staged aside are synced before they are
+// renamed into place, so that the rename cannot outlive a crash that the
+// staged contents did not.
+func (d *Driver) syncTree(dir string) error {
+	if !d.sync {
+		return nil
+	}
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case fi.IsDir():
+			return d.backend.SyncDir(path)
+		case fi.Mode().IsRegular():
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				return err
+			}
+			if err := f.Sync(); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		}
+		return nil
+	})
+}
+
+func writeTemp(path string, b []byte, sync bool) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// writeFileFrom is the streaming counterpart of writeFile, for files under
+// the metadata directory. It returns the number of bytes copied from r.
+// The copy is staged in the tmp directory of the metadata rather than
+// beside path, where it could be another file: the blob of key "k.tmp" is
+// the staging path of key "k".
+func (d *Driver) writeFileFrom(path string, r io.Reader) (int64, error) {
+	if err := os.MkdirAll(d.metaPath("tmp"), 0755); err != nil {
+		return 0, err
+	}
+	f, err := os.CreateTemp(d.metaPath("tmp"), "stream-*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	tmp := f.Name()
+	n, err := io.Copy(f, r)
+	if err == nil && d.sync {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return n, diskError(err)
+	}
+	if err := d.withRetry(func() error { return replaceFile(tmp, path) }); err != nil {
+		os.Remove(tmp)
+		return n, err
+	}
+	if d.sync {
+		return n, syncDir(filepath.Dir(path))
+	}
+	return n, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// errCrash makes crashBackend crash instead of failing.
+var errCrash = errors.New("crash")
+
+// crashBackend stops the operations its FaultBackend fails with errCrash
+// by panicking, so that the driver gets no chance to clean up, as if the
+// process died at that point.
+type crashBackend struct {
+	*FaultBackend
+}
+
+func crashOn(err error) error {
+	if errors.Is(err, errCrash) {
+		panic(errCrash)
+	}
+	return err
+}
+
+func (b crashBackend) WriteFile(path string, data []byte, sync bool) error {
+	return crashOn(b.FaultBackend.WriteFile(path, data, sync))
+}
+
+func (b crashBackend) Rename(src, dst string) error { return crashOn(b.FaultBackend.Rename(src, dst)) }
+func (b crashBackend) Remove(path string) error     { return crashOn(b.FaultBackend.Remove(path)) }
+func (b crashBackend) SyncDir(dir string) error     { return crashOn(b.FaultBackend.SyncDir(dir)) }
+
+type user struct{ Name string }
+
+// writeSteps are the steps of an atomic write, in order: the temporary
+// file is written, flushed with it, renamed over the record, and the
+// directory is synced.
+var writeSteps = []struct {
+	name  string
+	fault Fault
+	// done is set for faults after the rename, which leave the new
+	// record in place.
+	done bool
+}{
+	{name: "temp write", fault: Fault{Op: OpWrite, Path: "*.tmp"}},
+	{name: "partial temp write", fault: Fault{Op: OpWrite, Path: "*.tmp", Partial: 5}},
+	{name: "rename", fault: Fault{Op: OpRename, Path: "*.tmp"}},
+	{name: "dir sync", fault: Fault{Op: OpSync, Path: "users"}, done: true},
+}
+
+func openFaulty(t *testing.T, dir string, b Backend, repair bool) *Driver {
+	t.Helper()
+	d, err := New(dir, &Options{Logger: NopLogger{}, Backend: b, SyncWrites: true, RepairOnOpen: repair})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// checkUser fails unless users/ada reads back as want, is listed once and
+// has no temporary file beside it.
+func checkUser(t *testing.T, d *Driver, want string) {
+	t.Helper()
+	var got user
+	if err := d.Read("users", "ada", &got); err != nil {
+		t.Fatalf("read users/ada: %v", err)
+	}
+	if got.Name != want {
+		t.Fatalf("users/ada = %q, want %q", got.Name, want)
+	}
+	keys, err := d.Keys("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "ada" {
+		t.Fatalf("Keys(users) = %q, want [ada]", keys)
+	}
+	files, err := os.ReadDir(d.collectionDir("users"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".tmp") {
+			t.Fatalf("temporary file left behind: %s", f.Name())
+		}
+	}
+}
+
+func TestWriteFaults(t *testing.T) {
+	for _, step := range writeSteps {
+		t.Run(step.name, func(t *testing.T) {
+			fb := NewFaultBackend(nil)
+			d := openFaulty(t, t.TempDir(), fb, false)
+			defer d.Close()
+			if err := d.Write("users", "ada", user{"v1"}); err != nil {
+				t.Fatal(err)
+			}
+			f := step.fault
+			f.Times = 1
+			fb.Inject(f)
+			if err := d.Write("users", "ada", user{"v2"}); !errors.Is(err, ErrInjected) {
+				t.Fatalf("Write = %v, want ErrInjected", err)
+			}
+			want := "v1"
+			if step.done {
+				want = "v2"
+			}
+			checkUser(t, d, want)
+			if err := d.Write("users", "ada", user{"v3"}); err != nil {
+				t.Fatalf("Write after the fault: %v", err)
+			}
+			checkUser(t, d, "v3")
+		})
+	}
+}
+
+func TestWriteCrashRecovery(t *testing.T) {
+	for _, step := range writeSteps {
+		t.Run(step.name, func(t *testing.T) {
+			dir := t.TempDir()
+			fb := NewFaultBackend(nil)
+			d := openFaulty(t, dir, crashBackend{fb}, false)
+			if err := d.Write("users", "ada", user{"v1"}); err != nil {
+				t.Fatal(err)
+			}
+			f := step.fault
+			f.Times, f.Err = 1, errCrash
+			fb.Inject(f)
+			func() {
+				defer func() {
+					if v := recover(); v != errCrash {
+						t.Fatalf("Write did not crash: %v", v)
+					}
+				}()
+				d.Write("users", "ada", user{"v2"})
+			}()
+			d.Close()
+
+			d = openFaulty(t, dir, nil, true)
+			defer d.Close()
+			want := "v1"
+			if step.done {
+				want = "v2"
+			}
+			checkUser(t, d, want)
+			if err := d.Write("users", "ada", user{"v3"}); err != nil {
+				t.Fatalf("Write after recovery: %v", err)
+			}
+			checkUser(t, d, "v3")
+		})
+	}
+}
+
+func TestCrashLeavesTempFileForRepair(t *testing.T) {
+	dir := t.TempDir()
+	fb := NewFaultBackend(nil)
+	d := openFaulty(t, dir, crashBackend{fb}, false)
+	if err := d.Write("users", "ada", user{"v1"}); err != nil {
+		t.Fatal(err)
+	}
+	fb.Inject(Fault{Op: OpWrite, Path: "*.tmp", Partial: 5, Err: errCrash, Times: 1})
+	func() {
+		defer func() { recover() }()
+		d.Write("users", "ada", user{"v2"})
+	}()
+	d.Close()
+	tmp := filepath.Join(dir, "users", "ada.json.tmp")
+	if _, err := os.Stat(tmp); err != nil {
+		t.Fatalf("the crash left no temporary file: %v", err)
+	}
+
+	d = openFaulty(t, dir, nil, true)
+	defer d.Close()
+	r := d.OpenReport()
+	if r == nil || len(r.Anomalies) != 1 || r.Anomalies[0].Kind != AnomalyTempFile || !r.Anomalies[0].Repaired {
+		t.Fatalf("OpenReport = %+v, want one repaired %s", r, AnomalyTempFile)
+	}
+	checkUser(t, d, "v1")
+}
+
+func TestDeleteFaults(t *testing.T) {
+	for _, f := range []Fault{{Op: OpRemove, Path: "users/*.json"}, {Op: OpSync, Path: "users"}} {
+		t.Run(f.Op, func(t *testing.T) {
+			fb := NewFaultBackend(nil)
+			d := openFaulty(t, t.TempDir(), fb, false)
+			defer d.Close()
+			if err := d.Write("users", "ada", user{"v1"}); err != nil {
+				t.Fatal(err)
+			}
+			f.Times = 1
+			fb.Inject(f)
+			err := d.Delete("users", "ada")
+			if !errors.Is(err, ErrInjected) {
+				t.Fatalf("Delete = %v, want ErrInjected", err)
+			}
+			if f.Op == OpRemove {
+				checkUser(t, d, "v1")
+			} else if err := d.Read("users", "ada", new(user)); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("read after the synced delete failed: %v, want a missing record", err)
+			}
+			if err := d.Write("users", "ada", user{"v2"}); err != nil {
+				t.Fatal(err)
+			}
+			checkUser(t, d, "v2")
+		})
+	}
+}
+
+// commitOrder commits a transaction updating orders/o0, creating orders/o1
+// and outbox/m1, after storing orders/o0 as v0, with fault injected.
+func commitOrder(t *testing.T, d *Driver, fb *FaultBackend, fault Fault) error {
+	t.Helper()
+	if err := d.Write("orders", "o0", user{"v0"}); err != nil {
+		t.Fatal(err)
+	}
+	tx := d.Begin(ReadCommitted)
+	for _, op := range []struct{ collection, key string }{{"orders", "o0"}, {"orders", "o1"}, {"outbox", "m1"}} {
+		if err := tx.Write(op.collection, op.key, user{"v1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fb.Inject(fault)
+	return tx.Commit()
+}
+
+// checkRolledBack fails unless the transaction of commitOrder left no
+// trace.
+func checkRolledBack(t *testing.T, d *Driver) {
+	t.Helper()
+	var got user
+	if err := d.Read("orders", "o0", &got); err != nil || got.Name != "v0" {
+		t.Fatalf("orders/o0 = %q, %v, want v0", got.Name, err)
+	}
+	for _, r := range []struct{ collection, key string }{{"orders", "o1"}, {"outbox", "m1"}} {
+		if err := d.Read(r.collection, r.key, &got); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("%s/%s after the failed commit: %v, want a missing record", r.collection, r.key, err)
+		}
+	}
+	if files, _ := os.ReadDir(d.metaPath("tx", "commit")); len(files) != 0 {
+		t.Fatalf("journal left behind: %s", files[0].Name())
+	}
+}
+
+func TestCommitFaultRollsBack(t *testing.T) {
+	fb := NewFaultBackend(nil)
+	d := openFaulty(t, t.TempDir(), fb, false)
+	defer d.Close()
+	err := commitOrder(t, d, fb, Fault{Op: OpRename, Path: "outbox/*.tmp", Times: 1})
+	if !errors.Is(err, ErrInjected) {
+		t.Fatalf("Commit = %v, want ErrInjected", err)
+	}
+	checkRolledBack(t, d)
+}
+
+func TestCommitCrashRollsBack(t *testing.T) {
+	dir := t.TempDir()
+	fb := NewFaultBackend(nil)
+	d := openFaulty(t, dir, crashBackend{fb}, false)
+	func() {
+		defer func() {
+			if v := recover(); v != errCrash {
+				t.Fatalf("Commit did not crash: %v", v)
+			}
+		}()
+		commitOrder(t, d, fb, Fault{Op: OpRename, Path: "outbox/*.tmp", Err: errCrash, Times: 1})
+	}()
+	d.Close()
+
+	d = openFaulty(t, dir, nil, false)
+	defer d.Close()
+	checkRolledBack(t, d)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Attachment describes a binary file stored alongside a record. The contents
+// are kept in a content-addressable store keyed by SHA256, so identical files
+// attached to many records occupy disk space once.
+type Attachment struct {
+	Name        string
+	ContentType string
+	Size        int64
+	SHA256      string
+	Created     time.Time
+}
+
+// attachmentDir is where the attachments of collection/key are kept. They
+// live in the metadata area so that ReadAll never mistakes them for records.
+func (d *Driver) attachmentDir(collection, key string) string {
+	return d.metaPath("attachments", collection, key)
+}
+
+func (d *Driver) checkAttachmentArgs(collection, key, name string) error {
+	if err := d.checkKey(collection, key, "attach file"); err != nil {
+		return err
+	}
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return fmt.Errorf("invalid attachment name %q", name)
+	}
+	return nil
+}
+
+// PutAttachment stores the contents of r as the attachment name of the
+// record collection/key, replacing any previous attachment of that name. The
+// content type is guessed from the name's extension, falling back to
+// sniffing the first bytes of the data.
+func (d *Driver) PutAttachment(collection, key, name string, r io.Reader) error {
+	if err := d.checkAttachmentArgs(collection, key, name); err != nil {
+		return err
+	}
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if err := d.checkFrozen(collection); err != nil {
+		return err
+	}
+
+	dir := d.attachmentDir(collection, key)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	br := bufio.NewReaderSize(r, 512)
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		head, _ := br.Peek(512)
+		contentType = http.DetectContentType(head)
+	}
+	sum, size, err := d.casPut(br)
+	if err != nil {
+		return err
+	}
+
+	metaPath := filepath.Join(dir, name+".meta")
+	old, err := readAttachmentMeta(metaPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	meta := Attachment{
+		Name:        name,
+		ContentType: contentType,
+		Size:        size,
+		SHA256:      sum,
+		Created:     d.now().UTC(),
+	}
+	b, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := d.writeFile(metaPath, append(b, byte('\n'))); err != nil {
+		return err
+	}
+	if old != nil {
+		_, err = d.casRelease(old.SHA256)
+	}
+	return err
+}
+
+// GetAttachment opens the attachment name of collection/key. The caller must
+// close the returned reader.
+func (d *Driver) GetAttachment(collection, key, name string) (io.ReadCloser, *Attachment, error) {
+	if err := d.checkAttachmentArgs(collection, key, name); err != nil {
+		return nil, nil, err
+	}
+	dir := d.attachmentDir(collection, key)
+	meta, err := readAttachmentMeta(filepath.Join(dir, name+".meta"))
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(d.casPath(meta.SHA256))
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, meta, nil
+}
+
+// Attachments lists the attachments of collection/key.
+func (d *Driver) Attachments(collection, key string) ([]Attachment, error) {
+	if err := d.checkKey(collection, key, "list attachments"); err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(d.attachmentDir(collection, key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []Attachment
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".meta") {
+			continue
+		}
+		meta, err := readAttachmentMeta(filepath.Join(d.attachmentDir(collection, key), file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *meta)
+	}
+	return list, nil
+}
+
+// DeleteAttachment removes the attachment name of collection/key.
+func (d *Driver) DeleteAttachment(collection, key, name string) error {
+	if err := d.checkAttachmentArgs(collection, key, name); err != nil {
+		return err
+	}
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if err := d.checkFrozen(collection); err != nil {
+		return err
+	}
+
+	path := filepath.Join(d.attachmentDir(collection, key), name+".meta")
+	meta, err := readAttachmentMeta(path)
+	if err != nil {
+		return err
+	}
+	if err := d.withRetry(func() error { return os.Remove(path) }); err != nil {
+		return err
+	}
+	if err := d.syncParent(path); err != nil {
+		return err
+	}
+	_, err = d.casRelease(meta.SHA256)
+	return err
+}
+
+// dropAttachments releases every attachment below the attachment directory
+// of collection/key and removes their metadata. An empty key drops the
+// attachments of the whole collection.
+func (d *Driver) dropAttachments(collection, key string) error {
+	dir := d.attachmentDir(collection, key)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || !strings.HasSuffix(path, ".meta") {
+			return err
+		}
+		meta, err := readAttachmentMeta(path)
+		if err != nil {
+			return err
+		}
+		_, err = d.casRelease(meta.SHA256)
+		return err
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func readAttachmentMeta(path string) (*Attachment, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var meta Attachment
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backend is the filesystem the driver keeps records in. Record files are
+// written, renamed into place, removed and made durable through it, and
+// read through it by Read; scans, such as those of ReadAll and Query, and
+// other files, such as metadata, blobs and backups, go to the operating
+// system directly. Implementations must be safe for concurrent use.
+type Backend interface {
+	// ReadFile returns the contents of the file at path.
+	ReadFile(path string) ([]byte, error)
+	// WriteFile creates or truncates the file at path and writes b to it,
+	// flushing it to stable storage when sync is set.
+	WriteFile(path string, b []byte, sync bool) error
+	// Rename atomically replaces dst with src.
+	Rename(src, dst string) error
+	// Remove removes the file at path.
+	Remove(path string) error
+	// SyncDir flushes the entries of the directory dir to stable storage.
+	SyncDir(dir string) error
+}
+
+// OSBackend is the Backend of the operating system, used unless
+// Options.Backend says otherwise. Built with GOOS=js GOARCH=wasm, the
+// operating system is the JavaScript host: the os package calls the
+// Node.js-style fs object of its global scope for every file, records and
+// metadata alike. Node.js provides one; in browsers, wasm/opfs.mjs installs
+// one keeping the files in the origin private file system, and has to run
+// before the program starts. A Backend alone would not cover scans and
+// metadata.
+type OSBackend struct{}
+
+func (OSBackend) ReadFile(path string) ([]byte, error)             { return os.ReadFile(path) }
+func (OSBackend) WriteFile(path string, b []byte, sync bool) error { return writeTemp(path, b, sync) }
+func (OSBackend) Rename(src, dst string) error                     { return replaceFile(src, dst) }
+func (OSBackend) Remove(path string) error                         { return os.Remove(path) }
+func (OSBackend) SyncDir(dir string) error                         { return syncDir(dir) }
+
+// ErrInjected is the error a FaultBackend fails operations with when a
+// Fault gives no other.
+var ErrInjected = errors.New("injected fault")
+
+// Backend operations a Fault can target.
+const (
+	OpRead   = "read"
+	OpWrite  = "write"
+	OpRename = "rename"
+	OpRemove = "remove"
+	OpSync   = "sync"
+)
+
+// Fault describes a failure for FaultBackend to inject.
+type Fault struct {
+	// Op is the operation to fail, one of the Op constants; empty means
+	// every operation.
+	Op string
+	// Path is a filepath.Match pattern the path operated on must match,
+	// compared to as many trailing elements of the path as the pattern
+	// has, so "*.tmp" matches temporary files anywhere and "users/*.json"
+	// the records of users. For renames the source is matched. Empty
+	// matches every path.
+	Path string
+	// Delay is how long the operation waits before it runs or fails.
+	Delay time.Duration
+	// Err is the error the operation fails with, ErrInjected if nil. A
+	// fault setting only Delay slows the operation down without failing
+	// it.
+	Err error
+	// Partial makes a write store only its first Partial bytes before
+	// failing, like a crash or full disk midway. It only applies to
+	// writes.
+	Partial int
+	// Times is how many operations the fault hits before it is spent;
+	// zero means every matching operation.
+	Times int
+}
+
+// FaultBackend wraps a Backend and injects the faults registered with
+// Inject into matching operations, to exercise how the driver and the
+// applications built on it recover from filesystem failures:
+//
+//	fb := NewFaultBackend(nil)
+//	db, _ := New(dir, &Options{Backend: fb})
+//	fb.Inject(Fault{Op: OpRename, Path: "users/*", Times: 1})
+//	err := db.Write("users", "ada", user) // fails with ErrInjected
+type FaultBackend struct {
+	inner  Backend
+	mu     sync.Mutex
+	faults []*Fault
+}
+
+// NewFaultBackend returns a FaultBackend over inner, or over the operating
+// system if inner is nil.
+func NewFaultBackend(inner Backend) *FaultBackend {
+	if inner == nil {
+		inner = OSBackend{}
+	}
+	return &FaultBackend{inner: inner}
+}
+
+// Inject registers f. Faults are tried in the order they were injected and
+// the first matching one applies.
+func (b *FaultBackend) Inject(f Fault) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.faults = append(b.faults, &f)
+}
+
+// Clear removes every fault.
+func (b *FaultBackend) Clear() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.faults = nil
+}
+
+// fault returns the fault that applies to op on path, if any, counting the
+// hit, after waiting out its delay.
+func (b *FaultBackend) fault(op, path string) *Fault {
+	b.mu.Lock()
+	var hit *Fault
+	for i, f := range b.faults {
+		if (f.Op != "" && f.Op != op) || !matchTail(f.Path, path) {
+			continue
+		}
+		c := *f
+		hit = &c
+		if f.Times > 0 {
+			if f.Times--; f.Times == 0 {
+				b.faults = append(b.faults[:i:i], b.faults[i+1:]...)
+			}
+		}
+		break
+	}
+	b.mu.Unlock()
+	if hit != nil && hit.Delay > 0 {
+		time.Sleep(hit.Delay)
+	}
+	return hit
+}
+
+// matchTail matches pattern against as many trailing elements of path as
+// it has.
+func matchTail(pattern, path string) bool {
+	if pattern == "" {
+		return true
+	}
+	elems := strings.Split(filepath.ToSlash(path), "/")
+	n := strings.Count(pattern, "/") + 1
+	if n > len(elems) {
+		return false
+	}
+	ok, _ := filepath.Match(pattern, strings.Join(elems[len(elems)-n:], "/"))
+	return ok
+}
+
+func (f *Fault) err() error {
+	if f.Err == nil && (f.Partial > 0 || f.Delay == 0) {
+		return ErrInjected
+	}
+	return f.Err
+}
+
+func (b *FaultBackend) ReadFile(path string) ([]byte, error) {
+	if f := b.fault(OpRead, path); f != nil && f.err() != nil {
+		return nil, f.err()
+	}
+	return b.inner.ReadFile(path)
+}
+
+func (b *FaultBackend) WriteFile(path string, data []byte, sync bool) error {
+	f := b.fault(OpWrite, path)
+	if f == nil || f.err() == nil {
+		return b.inner.WriteFile(path, data, sync)
+	}
+	if f.Partial > 0 {
+		if f.Partial < len(data) {
+			data = data[:f.Partial]
+		}
+		if err := b.inner.WriteFile(path, data, sync); err != nil {
+			return err
+		}
+	}
+	return f.err()
+}
+
+func (b *FaultBackend) Rename(src, dst string) error {
+	if f := b.fault(OpRename, src); f != nil && f.err() != nil {
+		return f.err()
+	}
+	return b.inner.Rename(src, dst)
+}
+
+func (b *FaultBackend) Remove(path string) error {
+	if f := b.fault(OpRemove, path); f != nil && f.err() != nil {
+		return f.err()
+	}
+	return b.inner.Remove(path)
+}
+
+func (b *FaultBackend) SyncDir(dir string) error {
+	if f := b.fault(OpSync, dir); f != nil && f.err() != nil {
+		return f.err()
+	}
+	return b.inner.SyncDir(dir)
+}
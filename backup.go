@@ -0,0 +1,426 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// manifestName is the tar entry holding a backup's manifest. It is always
+// the last entry.
+const manifestName = "MANIFEST.json"
+
+// BackupOptions controls how Backup encodes a backup. Restoring and
+// verifying detect compression and encryption by themselves but need the
+// same keys.
+type BackupOptions struct {
+	// Compress gzips the backup. gzip is used rather than zstd to keep the
+	// module free of dependencies.
+	Compress bool
+
+	// EncryptionKey encrypts the backup with AES-GCM when set. It must be
+	// 16, 24 or 32 bytes long.
+	EncryptionKey []byte
+
+	// SigningKey signs the manifest with HMAC-SHA256 when set, so that
+	// tampering with the backup is detected even without encryption.
+	SigningKey []byte
+}
+
+// Manifest lists every file in a backup with its checksum.
+type Manifest struct {
+	Created   time.Time
+	Files     []ManifestFile
+	Signature string `json:",omitempty"`
+}
+
+// ManifestFile is a file in a backup, by path relative to the database
+// directory.
+type ManifestFile struct {
+	Path   string
+	Size   int64
+	SHA256 string
+}
+
+// Backup writes a tar archive of the database to w. Each collection is
+// locked while it is copied, so the copy of a collection is consistent;
+// the metadata directory is copied without locks. The archive ends with a
+// manifest of per-file SHA-256 checksums, which is returned.
+func (d *Driver) Backup(w io.Writer, opts BackupOptions) (*Manifest, error) {
+	d.settle()
+	return d.writeBackup(w, opts, func(tw *tar.Writer, m *Manifest) error {
+		names, err := d.Collections()
+		if err != nil {
+			return err
+		}
+		for _, collection := range names {
+			mutex := d.getOrCreateMutex(collection)
+			mutex.Lock()
+			err := backupTree(tw, m, d.collectionRoot(collection), collection)
+			mutex.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		return backupTree(tw, m, d.dir, metaDirName)
+	})
+}
+
+// writeBackup sets up the compression and encryption layers, lets add fill
+// the archive and finishes it with the manifest.
+func (d *Driver) writeBackup(w io.Writer, opts BackupOptions, add func(*tar.Writer, *Manifest) error) (*Manifest, error) {
+	out := w
+	var closers []io.Closer
+	if opts.EncryptionKey != nil {
+		cw, err := newCryptWriter(out, opts.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		out, closers = cw, append(closers, cw)
+	}
+	if opts.Compress {
+		gz := gzip.NewWriter(out)
+		out, closers = gz, append(closers, gz)
+	}
+	tw := tar.NewWriter(out)
+	m := &Manifest{Created: d.now().UTC()}
+	if err := add(tw, m); err != nil {
+		return nil, err
+	}
+	if err := writeManifest(tw, m, opts.SigningKey); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err := closers[i].Close(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// backupTree adds the files below root/rel to the archive under their path
+// relative to root, skipping temporary and scratch files.
+func backupTree(tw *tar.Writer, m *Manifest, root, rel string) error {
+	return filepath.Walk(filepath.Join(root, rel), func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name, _ := filepath.Rel(root, path)
+		if fi.IsDir() {
+			if skipBackupDir(name) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if skipBackupFile(name, fi) {
+			return nil
+		}
+		return addToArchive(tw, m, filepath.ToSlash(name), path)
+	})
+}
+
+// skipBackupDir reports metadata directories that only hold scratch data.
+func skipBackupDir(name string) bool {
+	switch filepath.ToSlash(name) {
+	case metaDirName + "/tmp", metaDirName + "/snapshots", metaDirName + "/pitr", metaDirName + "/trash":
+		return true
+	}
+	return false
+}
+
+// skipBackupFile reports temporary files left by writes in progress and the
+// LOCK file, which belongs to the driver holding the directory open.
+func skipBackupFile(name string, fi os.FileInfo) bool {
+	return !fi.Mode().IsRegular() || strings.HasSuffix(fi.Name(), ".tmp") || strings.HasPrefix(fi.Name(), "incoming-") || isLockFile(name)
+}
+
+// isLockFile reports whether name, relative to the database directory, is
+// the LOCK file of lockDir.
+func isLockFile(name string) bool {
+	return filepath.ToSlash(name) == metaDirName+"/LOCK"
+}
+
+func addToArchive(tw *tar.Writer, m *Manifest, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: fi.Size(), ModTime: fi.ModTime()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.CopyN(tw, io.TeeReader(f, h), fi.Size()); err != nil {
+		return err
+	}
+	m.Files = append(m.Files, ManifestFile{Path: name, Size: fi.Size(), SHA256: hex.EncodeToString(h.Sum(nil))})
+	return nil
+}
+
+func writeManifest(tw *tar.Writer, m *Manifest, key []byte) error {
+	if key != nil {
+		sig, err := m.sign(key)
+		if err != nil {
+			return err
+		}
+		m.Signature = sig
+	}
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: manifestName, Mode: 0644, Size: int64(len(b)), ModTime: m.Created}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = tw.Write(b)
+	return err
+}
+
+// sign computes the HMAC of the manifest without its signature.
+func (m *Manifest) sign(key []byte) (string, error) {
+	unsigned := *m
+	unsigned.Signature = ""
+	b, err := json.Marshal(unsigned)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// VerifyBackup reads a backup to its end, checking every file against the
+// manifest and, if opts.SigningKey is set, the manifest's signature.
+func VerifyBackup(r io.Reader, opts BackupOptions) (*Manifest, error) {
+	return readBackup(r, opts, func(string, io.Reader) error { return nil })
+}
+
+// readBackup calls fn for every file of a backup and then verifies the
+// files seen against the manifest.
+func readBackup(r io.Reader, opts BackupOptions, fn func(name string, r io.Reader) error) (*Manifest, error) {
+	br := bufio.NewReader(r)
+	if head, _ := br.Peek(len(cryptMagic)); isEncrypted(head) {
+		if opts.EncryptionKey == nil {
+			return nil, fmt.Errorf("backup is encrypted but no key was given")
+		}
+		cr, err := newCryptReader(br, opts.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReader(cr)
+	}
+	var in io.Reader = br
+	if head, _ := br.Peek(2); len(head) == 2 && head[0] == 0x1f && head[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	seen := make(map[string]ManifestFile)
+	var m *Manifest
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == manifestName {
+			b, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			m = &Manifest{}
+			if err := json.Unmarshal(b, m); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		h := sha256.New()
+		if err := fn(hdr.Name, io.TeeReader(tr, h)); err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(h, tr); err != nil {
+			return nil, err
+		}
+		seen[hdr.Name] = ManifestFile{Path: hdr.Name, Size: hdr.Size, SHA256: hex.EncodeToString(h.Sum(nil))}
+	}
+
+	if m == nil {
+		return nil, fmt.Errorf("backup has no manifest")
+	}
+	if opts.SigningKey != nil {
+		sig, err := m.sign(opts.SigningKey)
+		if err != nil {
+			return nil, err
+		}
+		if !hmac.Equal([]byte(sig), []byte(m.Signature)) {
+			return nil, fmt.Errorf("backup manifest signature does not match")
+		}
+	}
+	if len(seen) != len(m.Files) {
+		return nil, fmt.Errorf("backup holds %d files but its manifest lists %d", len(seen), len(m.Files))
+	}
+	for _, f := range m.Files {
+		if seen[f.Path] != f {
+			return nil, fmt.Errorf("backup file %s does not match its manifest", f.Path)
+		}
+	}
+	return m, nil
+}
+
+// RestoreBackup replaces the contents of the database with a backup. The
+// backup is extracted and verified in a staging directory first, so a
+// corrupt backup leaves the database untouched. Collections not present in
+// the backup are removed. The driver should be reopened afterwards so that
+// in-memory state such as key indexes is rebuilt.
+func (d *Driver) RestoreBackup(r io.Reader, opts BackupOptions) (*Manifest, error) {
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
+	d.settle()
+	staging, err := os.MkdirTemp(d.dir, ".restore-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	m, err := readBackup(r, opts, func(name string, r io.Reader) error {
+		path := filepath.Join(staging, filepath.FromSlash(name))
+		if !strings.HasPrefix(path, staging+string(filepath.Separator)) {
+			return fmt.Errorf("backup contains invalid path %q", name)
+		}
+		if isLockFile(name) {
+			// Taken by backups made before LOCK was skipped.
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := d.syncTree(staging); err != nil {
+		return nil, err
+	}
+
+	current, err := d.Collections()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(staging)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{metaDirName: true}
+	for _, e := range entries {
+		names[e.Name()] = true
+	}
+	for _, collection := range current {
+		names[collection] = true
+	}
+	for name := range names {
+		if err := d.restoreEntry(staging, name); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// restoreEntry swaps the top-level entry name of the database for its
+// staged copy, if any.
+func (d *Driver) restoreEntry(staging, name string) error {
+	if name == metaDirName {
+		return d.restoreMeta(staging)
+	}
+	mutex := d.getOrCreateMutex(name)
+	mutex.Lock()
+	defer mutex.Unlock()
+	dst := d.collectionDir(name)
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	src := filepath.Join(staging, name)
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return d.syncParent(dst)
+	}
+	return d.moveDir(src, dst)
+}
+
+// restoreMeta swaps the entries of the metadata directory for their staged
+// copies one by one, keeping the LOCK file, which the driver holds.
+func (d *Driver) restoreMeta(staging string) error {
+	dst := filepath.Join(d.dir, metaDirName)
+	entries, err := os.ReadDir(dst)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, e := range entries {
+		if isLockFile(filepath.Join(metaDirName, e.Name())) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dst, e.Name())); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	staged, err := os.ReadDir(filepath.Join(staging, metaDirName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, e := range staged {
+		src := filepath.Join(staging, metaDirName, e.Name())
+		if !e.IsDir() {
+			if err := os.Rename(src, filepath.Join(dst, e.Name())); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.moveDir(src, filepath.Join(dst, e.Name())); err != nil {
+			return err
+		}
+	}
+	return d.syncParent(filepath.Join(dst, "LOCK"))
+}
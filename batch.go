@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+)
+
+type batchKey struct{}
+
+// WithBatch returns a copy of ctx carrying a batch, a read-committed
+// transaction that the writes and deletes of one unit of work, typically
+// an HTTP request, are buffered in through BatchFrom, and the transaction
+// itself, which the caller commits or rolls back at the end. If ctx
+// already carries a batch, that one is returned, so nested calls join the
+// outer batch. See BatchMiddleware for HTTP servers.
+func (d *Driver) WithBatch(ctx context.Context) (context.Context, *Tx) {
+	if tx := BatchFrom(ctx); tx != nil {
+		return ctx, tx
+	}
+	tx := d.Begin(ReadCommitted)
+	return context.WithValue(ctx, batchKey{}, tx), tx
+}
+
+// BatchFrom returns the batch ctx carries, nil if none.
+func BatchFrom(ctx context.Context) *Tx {
+	tx, _ := ctx.Value(batchKey{}).(*Tx)
+	return tx
+}
+
+// BatchMiddleware runs every request of next in a batch, see WithBatch,
+// so that handlers writing through BatchFrom(r.Context()) either have all
+// their writes committed or none. The batch is committed when the handler
+// returns with a status below 400, and rolled back when it fails the
+// request, panics, or the client goes away first. The response is held
+// until the commit, so that a commit failing, such as on a frozen
+// collection or a failing disk, is answered with 500 Internal Server Error
+// instead of the handler's response; Tx.Commit puts back what it wrote
+// when it fails, so none of the writes remain. Handlers that stream
+// should not be wrapped.
+func (d *Driver) BatchMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, tx := d.WithBatch(r.Context())
+		if ctx == r.Context() {
+			// Already in a batch, committed further out.
+			next.ServeHTTP(w, r)
+			return
+		}
+		bw := &batchWriter{header: make(http.Header), status: http.StatusOK}
+		done := false
+		defer func() {
+			if !done {
+				tx.Rollback() // the handler panicked
+			}
+		}()
+		next.ServeHTTP(bw, r.WithContext(ctx))
+		done = true
+
+		if bw.status >= http.StatusBadRequest || ctx.Err() != nil {
+			tx.Rollback()
+		} else if err := tx.Commit(); err != nil {
+			d.log.Error("Batch of %s %s failed: %v\n", r.Method, r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for k, v := range bw.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(bw.status)
+		w.Write(bw.body.Bytes())
+	})
+}
+
+// batchWriter holds the response of a batched request until its batch is
+// committed.
+type batchWriter struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (bw *batchWriter) Header() http.Header {
+	return bw.header
+}
+
+func (bw *batchWriter) WriteHeader(status int) {
+	if !bw.wroteHeader {
+		bw.status, bw.wroteHeader = status, true
+	}
+}
+
+func (bw *batchWriter) Write(b []byte) (int, error) {
+	bw.WriteHeader(http.StatusOK)
+	return bw.body.Write(b)
+}
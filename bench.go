@@ -0,0 +1,192 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type benchConfig struct {
+	dir         string
+	duration    time.Duration
+	reads       float64
+	size        int
+	keys        int
+	dist        string
+	concurrency int
+	opts        Options
+}
+
+type benchRecord struct {
+	Key     string
+	Payload string
+}
+
+// bench runs a load test against a database:
+//
+//	bench [-dir path] [-duration 10s] [-reads 0.8] [-size 512] [-keys 10000]
+//	      [-dist uniform|zipf] [-concurrency 8] [-sync] [-group-commit]
+//	      [-bloom] [-keyindex] [-open-files n] [-mmap bytes]
+//
+// Without -dir a temporary database is created and removed afterwards.
+func bench(args []string, out io.Writer) error {
+	var cfg benchConfig
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.StringVar(&cfg.dir, "dir", "", "database directory (default: a temporary directory)")
+	fs.DurationVar(&cfg.duration, "duration", 10*time.Second, "how long to run")
+	fs.Float64Var(&cfg.reads, "reads", 0.8, "fraction of operations that are reads")
+	fs.IntVar(&cfg.size, "size", 512, "payload size of a record in bytes")
+	fs.IntVar(&cfg.keys, "keys", 10000, "number of distinct keys")
+	fs.StringVar(&cfg.dist, "dist", "uniform", "key distribution: uniform or zipf")
+	fs.IntVar(&cfg.concurrency, "concurrency", 8, "number of concurrent workers")
+	fs.BoolVar(&cfg.opts.SyncWrites, "sync", false, "sync every write to disk")
+	fs.BoolVar(&cfg.opts.GroupCommit, "group-commit", false, "share directory syncs between concurrent writers")
+	fs.BoolVar(&cfg.opts.BloomFilters, "bloom", false, "enable bloom filters")
+	fs.BoolVar(&cfg.opts.KeyIndex, "keyindex", false, "enable the in-memory key index")
+	fs.IntVar(&cfg.opts.MaxOpenFiles, "open-files", 0, "size of the open file handle pool")
+	fs.Int64Var(&cfg.opts.MmapThreshold, "mmap", 0, "memory-map records of at least this many bytes")
+	fs.Parse(args)
+
+	if cfg.reads < 0 || cfg.reads > 1 {
+		return fmt.Errorf("-reads must be between 0 and 1")
+	}
+	if cfg.keys < 1 || cfg.concurrency < 1 || cfg.size < 0 {
+		return fmt.Errorf("-keys and -concurrency must be positive and -size not negative")
+	}
+	if cfg.dist != "uniform" && cfg.dist != "zipf" {
+		return fmt.Errorf("unknown key distribution %q", cfg.dist)
+	}
+	if cfg.dir == "" {
+		dir, err := os.MkdirTemp("", "go-database-bench-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		cfg.dir = dir
+	}
+	return runBench(cfg, out)
+}
+
+func runBench(cfg benchConfig, out io.Writer) error {
+	cfg.opts.Logger = quietLogger{}
+	db, err := New(cfg.dir, &cfg.opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	const collection = "bench"
+	payload := strings.Repeat("x", cfg.size)
+	fmt.Fprintf(out, "seeding %d records of %d bytes...\n", cfg.keys, cfg.size)
+	for i := 0; i < cfg.keys; i++ {
+		k := strconv.Itoa(i)
+		if err := db.Write(collection, k, benchRecord{k, payload}); err != nil {
+			return err
+		}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		reads    []time.Duration
+		writes   []time.Duration
+		failures int
+		firstErr error
+	)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	deadline := time.Now().Add(cfg.duration)
+	start := time.Now()
+	for w := 0; w < cfg.concurrency; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			next := func() int { return rng.Intn(cfg.keys) }
+			if cfg.dist == "zipf" {
+				z := rand.NewZipf(rng, 1.1, 1, uint64(cfg.keys-1))
+				next = func() int { return int(z.Uint64()) }
+			}
+			var r, wr []time.Duration
+			var failed int
+			var ferr error
+			for time.Now().Before(deadline) {
+				k := strconv.Itoa(next())
+				t := time.Now()
+				var err error
+				if rng.Float64() < cfg.reads {
+					var rec benchRecord
+					err = db.Read(collection, k, &rec)
+					r = append(r, time.Since(t))
+				} else {
+					err = db.Write(collection, k, benchRecord{k, payload})
+					wr = append(wr, time.Since(t))
+				}
+				if err != nil {
+					failed++
+					if ferr == nil {
+						ferr = err
+					}
+				}
+			}
+			mu.Lock()
+			reads = append(reads, r...)
+			writes = append(writes, wr...)
+			failures += failed
+			if firstErr == nil {
+				firstErr = ferr
+			}
+			mu.Unlock()
+		}(time.Now().UnixNano() + int64(w))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	total := len(reads) + len(writes)
+	fmt.Fprintf(out, "%d operations in %v: %.0f ops/s, %d errors\n",
+		total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds(), failures)
+	printLatencies(out, "read", reads, elapsed)
+	printLatencies(out, "write", writes, elapsed)
+	if total > 0 {
+		// The counts include the benchmark's own bookkeeping, a few
+		// bytes per operation.
+		fmt.Fprintf(out, "memory %.1f allocs/op %.0f B/op, %d GC cycles, %v paused\n",
+			float64(after.Mallocs-before.Mallocs)/float64(total),
+			float64(after.TotalAlloc-before.TotalAlloc)/float64(total),
+			after.NumGC-before.NumGC, time.Duration(after.PauseTotalNs-before.PauseTotalNs))
+	}
+	if firstErr != nil {
+		fmt.Fprintf(out, "first error: %v\n", firstErr)
+	}
+	return nil
+}
+
+func printLatencies(out io.Writer, name string, d []time.Duration, elapsed time.Duration) {
+	if len(d) == 0 {
+		return
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	p := func(q float64) time.Duration { return d[int(q*float64(len(d)-1))] }
+	fmt.Fprintf(out, "%-5s %8d ops %9.0f ops/s  p50 %-10v p90 %-10v p99 %-10v max %v\n",
+		name, len(d), float64(len(d))/elapsed.Seconds(), p(0.5), p(0.9), p(0.99), d[len(d)-1])
+}
+
+// quietLogger discards log output so it does not interleave with reports.
+type quietLogger struct{}
+
+func (quietLogger) Fatal(string, ...interface{}) {}
+func (quietLogger) Error(string, ...interface{}) {}
+func (quietLogger) Warn(string, ...interface{})  {}
+func (quietLogger) Info(string, ...interface{})  {}
+func (quietLogger) Debug(string, ...interface{}) {}
+func (quietLogger) Trace(string, ...interface{}) {}
@@ -0,0 +1,183 @@
+// Package blevesearch is a search index for the database, backed by an
+// embedded Bleve index, giving ranked full-text search with facets
+// without running a search engine. It lives in a module of its own so
+// that the database does not depend on Bleve. Set it as Options.Search:
+//
+//	idx, err := blevesearch.Open(filepath.Join(dir, "search.bleve"))
+//	db, err := New(dir, &Options{Search: idx})
+//	res, err := db.SearchQuery("users", "Address.City:Bangalore")
+//	hits := res.(*bleve.SearchResult).Hits
+//
+// All collections share the index; hits carry the record keys as IDs.
+package blevesearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+// collectionField is the field each document records its collection in.
+const collectionField = "_collection"
+
+// deleteBatch is how many documents a collection-wide Delete removes per
+// batch.
+const deleteBatch = 1000
+
+// Index is a SearchIndex over a Bleve index.
+type Index struct {
+	idx bleve.Index
+}
+
+// Open opens the Bleve index at path, creating it with NewMapping if it
+// does not exist.
+func Open(path string) (*Index, error) {
+	idx, err := bleve.Open(path)
+	if err == bleve.ErrorIndexPathDoesNotExist {
+		idx, err = bleve.New(path, NewMapping())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Index{idx: idx}, nil
+}
+
+// NewMemOnly returns an Index kept in memory only, for tests and for
+// indexes rebuilt at every start with RebuildSearch.
+func NewMemOnly() (*Index, error) {
+	idx, err := bleve.NewMemOnly(NewMapping())
+	if err != nil {
+		return nil, err
+	}
+	return &Index{idx: idx}, nil
+}
+
+// New wraps an index opened by the caller, for example with a custom
+// mapping. The mapping must index the _collection field unanalyzed, as
+// NewMapping does.
+func New(idx bleve.Index) *Index {
+	return &Index{idx: idx}
+}
+
+// NewMapping returns the default Bleve mapping, with the collection of
+// each document indexed as a keyword. Customize it to pick analyzers for
+// the fields of the records or to map them to numbers and dates.
+func NewMapping() *mapping.IndexMappingImpl {
+	m := bleve.NewIndexMapping()
+	fm := bleve.NewTextFieldMapping()
+	fm.Analyzer = keyword.Name
+	fm.Store = false
+	m.DefaultMapping.AddFieldMappingsAt(collectionField, fm)
+	return m
+}
+
+// Bleve returns the underlying index.
+func (i *Index) Bleve() bleve.Index {
+	return i.idx
+}
+
+// Close closes the underlying index.
+func (i *Index) Close() error {
+	return i.idx.Close()
+}
+
+func docID(collection, key string) string {
+	return collection + "/" + key
+}
+
+// Index adds or replaces the record key of collection.
+func (i *Index) Index(collection, key string, doc map[string]interface{}) error {
+	d := numbers(doc).(map[string]interface{})
+	d[collectionField] = collection
+	return i.idx.Index(docID(collection, key), d)
+}
+
+// numbers turns the json.Number values of a record, which Bleve would
+// index as text, into float64s, copying the maps and slices it walks.
+func numbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v)+1)
+		for k, e := range v {
+			m[k] = numbers(e)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for j, e := range v {
+			s[j] = numbers(e)
+		}
+		return s
+	}
+	return v
+}
+
+// Delete removes the record key of collection, or every record of
+// collection when key is empty.
+func (i *Index) Delete(collection, key string) error {
+	if key != "" {
+		return i.idx.Delete(docID(collection, key))
+	}
+	for {
+		req := bleve.NewSearchRequestOptions(inCollection(collection), deleteBatch, 0, false)
+		res, err := i.idx.Search(req)
+		if err != nil {
+			return err
+		}
+		if len(res.Hits) == 0 {
+			return nil
+		}
+		b := i.idx.NewBatch()
+		for _, h := range res.Hits {
+			b.Delete(h.ID)
+		}
+		if err := i.idx.Batch(b); err != nil {
+			return err
+		}
+	}
+}
+
+func inCollection(collection string) query.Query {
+	q := bleve.NewTermQuery(collection)
+	q.SetField(collectionField)
+	return q
+}
+
+// Search runs q against the records of collection. q is a query string
+// in Bleve's query string syntax, a query.Query, or a *bleve.SearchRequest
+// for control over paging, sorting, highlighting and facets. The result
+// is a *bleve.SearchResult whose hits have record keys as IDs.
+func (i *Index) Search(collection string, q interface{}) (interface{}, error) {
+	var req *bleve.SearchRequest
+	switch q := q.(type) {
+	case string:
+		req = bleve.NewSearchRequest(bleve.NewQueryStringQuery(q))
+	case query.Query:
+		req = bleve.NewSearchRequest(q)
+	case *bleve.SearchRequest:
+		r := *q
+		req = &r
+	default:
+		return nil, fmt.Errorf("blevesearch: unsupported query type %T", q)
+	}
+	req.Query = bleve.NewConjunctionQuery(req.Query, inCollection(collection))
+	res, err := i.idx.Search(req)
+	if err != nil {
+		return nil, err
+	}
+	prefix := collection + "/"
+	for _, h := range res.Hits {
+		h.ID = strings.TrimPrefix(h.ID, prefix)
+	}
+	return res, nil
+}
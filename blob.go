@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// metaDirName is the directory inside the database root that holds data the
+// driver keeps alongside user collections.
+const metaDirName = ".db"
+
+// metaPath joins elem onto the driver's metadata directory.
+func (d *Driver) metaPath(elem ...string) string {
+	return filepath.Join(append([]string{d.dir, metaDirName}, elem...)...)
+}
+
+// WriteFrom streams r into a blob stored under collection/resource. Unlike
+// Write the value is never held in memory as a whole, so it suits values too
+// large for a JSON record. Blobs live outside the collection directory and
+// are not returned by ReadAll.
+func (d *Driver) WriteFrom(collection, resource string, r io.Reader) error {
+	if err := d.checkKey(collection, resource, "save blob"); err != nil {
+		return err
+	}
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if err := d.checkFrozen(collection); err != nil {
+		return err
+	}
+
+	if err := d.checkSpace(0); err != nil {
+		return err
+	}
+	path := d.metaPath("blobs", collection, resource)
+	if err := d.mkdirAll(filepath.Dir(path)); err != nil {
+		return err
+	}
+	_, err := d.writeFileFrom(path, r)
+	return err
+}
+
+// ReadTo copies the blob stored under collection/resource into w.
+func (d *Driver) ReadTo(collection, resource string, w io.Writer) error {
+	if err := d.checkKey(collection, resource, "read blob"); err != nil {
+		return err
+	}
+	f, err := os.Open(d.metaPath("blobs", collection, resource))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// DeleteBlob removes the blob stored under collection/resource.
+func (d *Driver) DeleteBlob(collection, resource string) error {
+	if err := d.checkKey(collection, resource, "delete blob"); err != nil {
+		return err
+	}
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if err := d.checkFrozen(collection); err != nil {
+		return err
+	}
+
+	path := d.metaPath("blobs", collection, resource)
+	if err := d.withRetry(func() error { return os.Remove(path) }); err != nil {
+		return err
+	}
+	return d.syncParent(path)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// bloom is a fixed-size bloom filter over the keys of one collection.
+type bloom struct {
+	Bits     []uint64
+	K        uint32
+	N        int
+	Capacity int
+	// DirModTime is the modification time of the collection directory when
+	// the filter was saved. A filter whose directory changed since is stale.
+	DirModTime time.Time
+}
+
+func newBloom(capacity int) *bloom {
+	if capacity < 64 {
+		capacity = 64
+	}
+	// Sized for a 1% false positive rate at capacity.
+	m := int(math.Ceil(-float64(capacity) * math.Log(0.01) / (math.Ln2 * math.Ln2)))
+	k := uint32(math.Round(float64(m) / float64(capacity) * math.Ln2))
+	return &bloom{Bits: make([]uint64, (m+63)/64), K: k, Capacity: capacity}
+}
+
+func (b *bloom) hashes(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum(nil)
+	h1 := binary.BigEndian.Uint64(sum)
+	return h1, h1>>33 | h1<<31 | 1
+}
+
+func (b *bloom) add(key string) {
+	h1, h2 := b.hashes(key)
+	m := uint64(len(b.Bits) * 64)
+	for i := uint64(0); i < uint64(b.K); i++ {
+		bit := (h1 + i*h2) % m
+		b.Bits[bit/64] |= 1 << (bit % 64)
+	}
+	b.N++
+}
+
+func (b *bloom) mayContain(key string) bool {
+	h1, h2 := b.hashes(key)
+	m := uint64(len(b.Bits) * 64)
+	for i := uint64(0); i < uint64(b.K); i++ {
+		bit := (h1 + i*h2) % m
+		if b.Bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// openBlooms loads the saved filter of every collection, rebuilding those
+// that are missing or stale.
+func (d *Driver) openBlooms() error {
+	names, err := d.Collections()
+	if err != nil {
+		return err
+	}
+	d.blooms = make(map[string]*bloom)
+	for _, collection := range names {
+		fi, err := os.Stat(d.collectionDir(collection))
+		if err != nil {
+			return err
+		}
+		if b, err := d.loadBloom(collection, fi.ModTime()); err == nil {
+			d.blooms[collection] = b
+			continue
+		}
+		if err := d.rebuildBloom(collection, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Driver) loadBloom(collection string, modTime time.Time) (*bloom, error) {
+	data, err := os.ReadFile(d.metaPath("bloom", collection))
+	if err != nil {
+		return nil, err
+	}
+	var b bloom
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, err
+	}
+	if !b.DirModTime.Equal(modTime) || len(b.Bits) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return &b, nil
+}
+
+// rebuildBloom recreates the filter of collection from its directory
+// listing, sized for at least capacity keys. d.mu must not be held.
+func (d *Driver) rebuildBloom(collection string, capacity int) error {
+	files, err := os.ReadDir(d.collectionDir(collection))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if capacity < 2*len(files) {
+		capacity = 2 * len(files)
+	}
+	b := newBloom(capacity)
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".json") {
+			b.add(strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+	d.mu.Lock()
+	d.blooms[collection] = b
+	d.mu.Unlock()
+	return nil
+}
+
+// saveBlooms writes every filter to the metadata directory, stamped with the
+// current modification time of its collection directory.
+func (d *Driver) saveBlooms() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := os.MkdirAll(d.metaPath("bloom"), 0755); err != nil {
+		return err
+	}
+	for collection, b := range d.blooms {
+		fi, err := os.Stat(d.collectionDir(collection))
+		if os.IsNotExist(err) {
+			os.Remove(d.metaPath("bloom", collection))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		b.DirModTime = fi.ModTime()
+		data, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		if err := d.writeFile(d.metaPath("bloom", collection), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bloomMissing reports whether the filter proves that collection has no
+// record named key. It is always false when filters are disabled.
+func (d *Driver) bloomMissing(collection, key string) bool {
+	if d.blooms == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	b, ok := d.blooms[collection]
+	return ok && !b.mayContain(key)
+}
+
+func (d *Driver) bloomAdd(collection, key string) {
+	if d.blooms == nil {
+		return
+	}
+	d.mu.Lock()
+	b, ok := d.blooms[collection]
+	if !ok {
+		b = newBloom(0)
+		d.blooms[collection] = b
+	}
+	b.add(key)
+	n, full := b.N, b.N > b.Capacity
+	d.mu.Unlock()
+	if full {
+		if err := d.rebuildBloom(collection, 2*n); err != nil {
+			d.log.Warn("unable to resize bloom filter of '%s': %v\n", collection, err)
+		}
+	}
+}
+
+func (d *Driver) bloomReset(collection string) {
+	if d.blooms == nil {
+		return
+	}
+	d.mu.Lock()
+	d.blooms[collection] = newBloom(0)
+	d.mu.Unlock()
+}
+
+// Has reports whether collection contains a record named resource. With
+// Options.BloomFilters most misses are answered without touching the disk,
+// and with Options.KeyIndex no lookup touches it. Mutations queued by
+// Options.WriteBehind are taken into account.
+func (d *Driver) Has(collection, resource string) (bool, error) {
+	if err := checkCollection(collection); err != nil {
+		return false, err
+	}
+	if err := d.checkResource(resource); err != nil {
+		return false, err
+	}
+	if b, ok := d.pendingRecord(collection, resource); ok {
+		return b != nil, nil
+	}
+	if d.bloomMissing(collection, resource) {
+		return false, nil
+	}
+	if d.keys != nil {
+		_, err := d.Stat(collection, resource)
+		return err == nil, nil
+	}
+	_, err := os.Stat(d.recordPath(collection, resource))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// maxPooledBuffer is the largest buffer returned to the pools. The buffers
+// of rare huge records are left to the garbage collector instead of
+// keeping that much memory around for every pooled buffer.
+const maxPooledBuffer = 1 << 20
+
+// readBuffers holds the buffers Read loads record files into. Their
+// contents only live for the decode, so they are reused right away.
+var readBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// streamReaders holds the buffered readers streamRecord decodes records
+// through, which are as large as streamBufferSize.
+var streamReaders = sync.Pool{New: func() interface{} { return bufio.NewReaderSize(nil, streamBufferSize) }}
+
+// encoder is a buffer with a JSON encoder writing to it, reused by encode.
+type encoder struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+var encoders = sync.Pool{New: func() interface{} {
+	e := &encoder{}
+	e.enc = json.NewEncoder(&e.buf)
+	e.enc.SetIndent("", "\t")
+	return e
+}}
+
+func getBuffer() *bytes.Buffer {
+	buf := readBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		readBuffers.Put(buf)
+	}
+}
+
+func getStreamReader(r io.Reader) *bufio.Reader {
+	br := streamReaders.Get().(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
+func putStreamReader(br *bufio.Reader) {
+	br.Reset(nil)
+	streamReaders.Put(br)
+}
+
+// readInto appends the contents of the file at path to buf, growing it
+// once to the size of the file.
+func readInto(path string, buf *bytes.Buffer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil {
+		buf.Grow(int(fi.Size()) + bytes.MinRead)
+	}
+	_, err = buf.ReadFrom(f)
+	return err
+}
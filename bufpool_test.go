@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func benchDriver(b *testing.B) *Driver {
+	b.Helper()
+	d, err := New(b.TempDir(), &Options{Logger: NopLogger{}})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { d.Close() })
+	return d
+}
+
+// newBenchRecord returns a record of the size bench uses by default.
+func newBenchRecord(i int) benchRecord {
+	return benchRecord{Key: fmt.Sprint(i), Payload: strings.Repeat("x", 512)}
+}
+
+func BenchmarkRead(b *testing.B) {
+	d := benchDriver(b)
+	const n = 100
+	for i := 0; i < n; i++ {
+		if err := d.Write("users", fmt.Sprint(i), newBenchRecord(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprint(i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var r benchRecord
+		if err := d.Read("users", keys[i%n], &r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	d := benchDriver(b)
+	const n = 100
+	records := make([]benchRecord, n)
+	keys := make([]string, n)
+	for i := range records {
+		records[i], keys[i] = newBenchRecord(i), fmt.Sprint(i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := d.Write("users", keys[i%n], records[i%n]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadParallel(b *testing.B) {
+	d := benchDriver(b)
+	const n = 100
+	for i := 0; i < n; i++ {
+		if err := d.Write("users", fmt.Sprint(i), newBenchRecord(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			var r benchRecord
+			if err := d.Read("users", fmt.Sprint(i%n), &r); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
@@ -0,0 +1,253 @@
+// Package cache provides a memcached-style cache of byte values with
+// expiry and a size limit, stored as records of a dedicated collection.
+// It lets an application keep an overflow-to-disk cache in the same
+// database directory as its durable data:
+//
+//	c, err := cache.New(db, "cache", &cache.Options{MaxBytes: 64 << 20})
+//	err = c.Set("page:/home", html, 10*time.Minute)
+//	html, err := c.Get("page:/home")
+//
+// The cache keeps the expiry, size and last use of every entry in memory,
+// so a collection should be used by one Cache at a time. When a limit is
+// exceeded, expired entries are dropped first, then the least recently
+// used ones.
+package cache
+
+import (
+	"container/list"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrCacheMiss is returned by Get and Delete when there is no unexpired
+// entry for the key.
+var ErrCacheMiss = errors.New("cache miss")
+
+// Store is the subset of the database driver the cache needs.
+type Store interface {
+	Read(collection, resource string, v interface{}) error
+	Write(collection, resource string, v interface{}) error
+	Delete(collection, resource string) error
+	Keys(collection string) ([]string, error)
+}
+
+// Options configures a Cache. The zero value is an unlimited cache whose
+// entries only expire when given a TTL.
+type Options struct {
+	// MaxEntries and MaxBytes, when positive, limit the number of entries
+	// and the total size of their values.
+	MaxEntries int
+	MaxBytes   int64
+	// DefaultTTL is the TTL of entries set with a TTL of zero. Zero means
+	// that they do not expire.
+	DefaultTTL time.Duration
+}
+
+// entry is an entry as stored.
+type entry struct {
+	Value   []byte
+	Expires time.Time `json:",omitempty"`
+}
+
+// item is the in-memory bookkeeping of an entry, kept in a list ordered
+// from most to least recently used.
+type item struct {
+	key     string
+	size    int64
+	expires time.Time
+}
+
+// Cache is a cache stored in one collection.
+type Cache struct {
+	store      Store
+	collection string
+	opts       Options
+
+	mu    sync.Mutex
+	items map[string]*list.Element
+	lru   *list.List
+	bytes int64
+}
+
+// New returns the cache stored in collection, reading the entries left in
+// it to learn their sizes and expiries. Expired entries are removed, and
+// entries over the limits of opts evicted; how recently entries were used
+// is not stored, so until used again they are evicted in key order. A nil
+// opts is the zero Options.
+func New(store Store, collection string, opts *Options) (*Cache, error) {
+	c := &Cache{store: store, collection: collection, items: make(map[string]*list.Element), lru: list.New()}
+	if opts != nil {
+		c.opts = *opts
+	}
+	keys, err := store.Keys(collection)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	now := time.Now()
+	for _, key := range keys {
+		var e entry
+		if err := store.Read(collection, key, &e); err != nil {
+			return nil, err
+		}
+		if expired(e.Expires, now) {
+			if err := store.Delete(collection, key); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		c.add(key, int64(len(e.Value)), e.Expires)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.evict(0, 0, now); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Get returns the value stored for key, failing with ErrCacheMiss if
+// there is none or it has expired.
+func (c *Cache) Get(key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	if expired(el.Value.(*item).expires, time.Now()) {
+		if err := c.remove(el); err != nil {
+			return nil, err
+		}
+		return nil, ErrCacheMiss
+	}
+	var e entry
+	if err := c.store.Read(c.collection, key, &e); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			c.forget(el)
+			return nil, ErrCacheMiss
+		}
+		return nil, err
+	}
+	c.lru.MoveToFront(el)
+	return e.Value, nil
+}
+
+// Set stores value for key, replacing any earlier entry, to expire after
+// ttl. A ttl of zero means Options.DefaultTTL, a negative one no expiry.
+// Entries are evicted as needed to stay within the limits; a value larger
+// than MaxBytes is not stored at all.
+func (c *Cache) Set(key string, value []byte, ttl time.Duration) error {
+	if ttl == 0 {
+		ttl = c.opts.DefaultTTL
+	}
+	now := time.Now()
+	e := entry{Value: value}
+	if ttl > 0 {
+		e.Expires = now.Add(ttl).UTC()
+	}
+	size := int64(len(value))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.forget(el)
+	}
+	if c.opts.MaxBytes > 0 && size > c.opts.MaxBytes {
+		if err := c.store.Delete(c.collection, key); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if err := c.evict(1, size, now); err != nil {
+		return err
+	}
+	if err := c.store.Write(c.collection, key, e); err != nil {
+		return err
+	}
+	c.add(key, size, e.Expires)
+	return nil
+}
+
+// Delete removes the entry for key, failing with ErrCacheMiss if there is
+// none or it has expired.
+func (c *Cache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return ErrCacheMiss
+	}
+	live := !expired(el.Value.(*item).expires, time.Now())
+	if err := c.remove(el); err != nil {
+		return err
+	}
+	if !live {
+		return ErrCacheMiss
+	}
+	return nil
+}
+
+// Len returns the number of entries and the total size of their values,
+// counting entries that have expired but not been removed yet.
+func (c *Cache) Len() (entries int, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len(), c.bytes
+}
+
+// add records an entry as the most recently used one. Only New calls it
+// without c.mu held, before the cache is shared.
+func (c *Cache) add(key string, size int64, expires time.Time) {
+	c.items[key] = c.lru.PushFront(&item{key: key, size: size, expires: expires})
+	c.bytes += size
+}
+
+// forget drops the bookkeeping of an entry.
+func (c *Cache) forget(el *list.Element) {
+	it := c.lru.Remove(el).(*item)
+	delete(c.items, it.key)
+	c.bytes -= it.size
+}
+
+// remove deletes an entry from the store and forgets it.
+func (c *Cache) remove(el *list.Element) error {
+	key := el.Value.(*item).key
+	if err := c.store.Delete(c.collection, key); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	c.forget(el)
+	return nil
+}
+
+// evict removes entries until n more holding size bytes fit within the
+// limits: expired ones first, then from the least recently used end.
+func (c *Cache) evict(n int, size int64, now time.Time) error {
+	full := func() bool {
+		return (c.opts.MaxEntries > 0 && c.lru.Len()+n > c.opts.MaxEntries) ||
+			(c.opts.MaxBytes > 0 && c.bytes+size > c.opts.MaxBytes)
+	}
+	if !full() {
+		return nil
+	}
+	for el := c.lru.Back(); el != nil; {
+		prev := el.Prev()
+		if expired(el.Value.(*item).expires, now) {
+			if err := c.remove(el); err != nil {
+				return err
+			}
+		}
+		el = prev
+	}
+	for full() && c.lru.Len() > 0 {
+		if err := c.remove(c.lru.Back()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func expired(expires, now time.Time) bool {
+	return !expires.IsZero() && !now.Before(expires)
+}
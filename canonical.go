@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// canonicalJSON reformats a record with the keys of every object sorted,
+// tab indentation and no HTML escaping, so that equal documents are stored
+// byte for byte the same. Numbers keep their exact text.
+func canonicalJSON(b []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// format returns a record as it is to be stored: canonical with
+// Options.CanonicalJSON and untouched otherwise.
+func (d *Driver) format(b []byte) ([]byte, error) {
+	if !d.canonical {
+		return b, nil
+	}
+	return canonicalJSON(b)
+}
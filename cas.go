@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// staleUpload is how long the temporary file of an upload to the
+// content-addressable store must go untouched before CollectGarbage takes
+// it to be left over from an interrupted one. Uploads of the driver itself
+// are never collected; this covers other processes sharing the directory.
+const staleUpload = time.Hour
+
+// casPath is where the blob with the given SHA-256 hex digest is stored.
+// Blobs are fanned out by the first two digits of their hash.
+func (d *Driver) casPath(sum string) string {
+	return d.metaPath("cas", sum[:2], sum)
+}
+
+// casPut stores the contents of r in the content-addressable store and takes
+// a reference on it. Identical contents are only kept on disk once.
+func (d *Driver) casPut(r io.Reader) (sum string, size int64, err error) {
+	dir := d.metaPath("cas")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", 0, err
+	}
+	// The file is registered under casMu as it is created, so that
+	// CollectGarbage never sees it unregistered.
+	d.casMu.Lock()
+	f, err := os.CreateTemp(dir, "incoming-*")
+	if err != nil {
+		d.casMu.Unlock()
+		return "", 0, err
+	}
+	tmp := f.Name()
+	if d.casUploads == nil {
+		d.casUploads = make(map[string]bool)
+	}
+	d.casUploads[tmp] = true
+	d.casMu.Unlock()
+	defer func() {
+		d.casMu.Lock()
+		delete(d.casUploads, tmp)
+		d.casMu.Unlock()
+		os.Remove(tmp)
+	}()
+
+	h := sha256.New()
+	size, err = io.Copy(io.MultiWriter(f, h), r)
+	if err == nil && d.sync {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	sum = hex.EncodeToString(h.Sum(nil))
+
+	d.casMu.Lock()
+	defer d.casMu.Unlock()
+	path := d.casPath(sum)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return "", 0, err
+		}
+		if err := d.withRetry(func() error { return replaceFile(tmp, path) }); err != nil {
+			return "", 0, err
+		}
+	} else if err != nil {
+		return "", 0, err
+	}
+	if _, err := d.casRef(sum, 1); err != nil {
+		return "", 0, err
+	}
+	return sum, size, nil
+}
+
+// casRelease drops a reference on a blob and returns the references left.
+// Unreferenced blobs stay on disk until CollectGarbage runs.
+func (d *Driver) casRelease(sum string) (int, error) {
+	d.casMu.Lock()
+	defer d.casMu.Unlock()
+	return d.casRef(sum, -1)
+}
+
+// casPurge drops a reference like casRelease, but erases the blob right
+// away once nothing references it any more. Blobs shared with other records
+// are left alone.
+func (d *Driver) casPurge(sum string) error {
+	d.casMu.Lock()
+	defer d.casMu.Unlock()
+	refs, err := d.casRef(sum, -1)
+	if err != nil || refs > 0 {
+		return err
+	}
+	if err := d.erase(d.casPath(sum)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(d.casPath(sum) + ".refs"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// casRef adjusts the reference count of a blob by delta. casMu must be held.
+func (d *Driver) casRef(sum string, delta int) (int, error) {
+	path := d.casPath(sum) + ".refs"
+	refs := 0
+	if b, err := os.ReadFile(path); err == nil {
+		if refs, err = strconv.Atoi(strings.TrimSpace(string(b))); err != nil {
+			return 0, err
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	if refs += delta; refs < 0 {
+		refs = 0
+	}
+	return refs, d.writeFile(path, []byte(strconv.Itoa(refs)+"\n"))
+}
+
+// CollectGarbage removes blobs from the content-addressable store that are no
+// longer referenced by any attachment, along with leftovers of interrupted
+// uploads: temporary files no upload in progress is writing, untouched for
+// an hour. It returns the number of blobs removed.
+func (d *Driver) CollectGarbage() (int, error) {
+	if err := d.checkWritable(); err != nil {
+		return 0, err
+	}
+	d.casMu.Lock()
+	defer d.casMu.Unlock()
+
+	root := d.metaPath("cas")
+	removed := 0
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		name := fi.Name()
+		if strings.HasPrefix(name, "incoming-") || strings.HasSuffix(name, ".tmp") {
+			if d.casUploads[path] || time.Since(fi.ModTime()) < staleUpload {
+				return nil
+			}
+			return os.Remove(path)
+		}
+		if strings.HasSuffix(name, ".refs") {
+			return nil
+		}
+		b, err := os.ReadFile(path + ".refs")
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if refs, _ := strconv.Atoi(strings.TrimSpace(string(b))); refs > 0 {
+			return nil
+		}
+		if err := os.Remove(path + ".refs"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+		return os.Remove(path)
+	})
+	return removed, err
+}
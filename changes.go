@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// changeSet collects the records changed while it is being watched. An
+// empty key stands for the whole collection.
+type changeSet struct {
+	mu      sync.Mutex
+	changed map[string]map[string]bool
+}
+
+// watch starts recording every record written or deleted until unwatch is
+// called.
+func (d *Driver) watch() *changeSet {
+	cs := &changeSet{changed: make(map[string]map[string]bool)}
+	d.watchMu.Lock()
+	if d.watchers == nil {
+		d.watchers = make(map[*changeSet]struct{})
+	}
+	d.watchers[cs] = struct{}{}
+	d.watchMu.Unlock()
+	return cs
+}
+
+func (d *Driver) unwatch(cs *changeSet) {
+	d.watchMu.Lock()
+	delete(d.watchers, cs)
+	d.watchMu.Unlock()
+}
+
+// notify records a change with every active watcher.
+func (d *Driver) notify(collection, key string) {
+	d.watchMu.Lock()
+	defer d.watchMu.Unlock()
+	for cs := range d.watchers {
+		cs.mu.Lock()
+		keys := cs.changed[collection]
+		if keys == nil {
+			keys = make(map[string]bool)
+			cs.changed[collection] = keys
+		}
+		keys[key] = true
+		cs.mu.Unlock()
+	}
+}
+
+// collections returns the collections with changes recorded.
+func (cs *changeSet) collections() []string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	names := make([]string, 0, len(cs.changed))
+	for collection := range cs.changed {
+		names = append(names, collection)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// take returns the keys of collection changed so far and forgets them. An
+// empty key stands for the whole collection.
+func (cs *changeSet) take(collection string) map[string]bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	keys := cs.changed[collection]
+	delete(cs.changed, collection)
+	return keys
+}
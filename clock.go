@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock tells the driver the time for the timestamps it records and the
+// deadlines it checks: expiry times and sweeps, change-log entries and
+// checkpoints, backup manifests, attachment and webhook times, archiving
+// cutoffs and the key index. It also times the waits that depend on those:
+// scheduled jobs, the write-behind coalescing window and retry backoff.
+// Intervals between background runs, such as Options.ExpiryInterval, are
+// timed by the system clock whatever the Clock; tests drive those runs
+// directly, e.g. with SweepExpired.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f in its own goroutine once the clock has moved d
+	// on, unless the returned Timer is stopped first.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a call waiting in Clock.AfterFunc. Stop cancels it, reporting
+// whether it had not run yet. *time.Timer is a Timer.
+type Timer interface {
+	Stop() bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// ManualClock is a Clock that only moves when told to, for tests of
+// expiry, versioning, backups and scheduled jobs:
+//
+//	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+//	db, _ := New(dir, &Options{Clock: clock})
+//	db.Expire("sessions", "abc", time.Hour)
+//	clock.Advance(2 * time.Hour)
+//	db.SweepExpired() // removes sessions/abc
+//
+// Set and Advance run the AfterFunc calls that have come due, so a
+// scheduled job or a retry after a transient error waits until the clock
+// is moved past its time.
+type ManualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiting []*manualTimer
+}
+
+type manualTimer struct {
+	c  *ManualClock
+	at time.Time
+	f  func()
+}
+
+// NewManualClock returns a ManualClock set to t.
+func NewManualClock(t time.Time) *ManualClock {
+	return &ManualClock{now: t}
+}
+
+// Now returns the time the clock was last set to.
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AfterFunc calls f once the clock is set to d past now or later; at once
+// if d is not positive.
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &manualTimer{c: c, at: c.now.Add(d), f: f}
+	if d <= 0 {
+		go f()
+		return t
+	}
+	c.waiting = append(c.waiting, t)
+	return t
+}
+
+func (t *manualTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	for i, w := range t.c.waiting {
+		if w == t {
+			t.c.waiting = append(t.c.waiting[:i], t.c.waiting[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Set sets the clock to t.
+func (c *ManualClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+	c.fire()
+}
+
+// Advance moves the clock forward by d.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.fire()
+}
+
+// fire runs the timers that are due. c.mu must be held.
+func (c *ManualClock) fire() {
+	waiting := c.waiting[:0]
+	for _, t := range c.waiting {
+		if t.at.After(c.now) {
+			waiting = append(waiting, t)
+		} else {
+			go t.f()
+		}
+	}
+	for i := len(waiting); i < len(c.waiting); i++ {
+		c.waiting[i] = nil
+	}
+	c.waiting = waiting
+}
+
+// randomID is the default Options.IDGenerator: 16 random hex digits.
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// SequentialIDs returns an ID generator for Options.IDGenerator yielding
+// prefix followed by 1, 2, 3 and so on, zero-padded so that the IDs sort
+// in the order they were made.
+func SequentialIDs(prefix string) func() string {
+	var n uint64
+	return func() string {
+		return fmt.Sprintf("%s%016d", prefix, atomic.AddUint64(&n, 1))
+	}
+}
+
+// now returns the time of Options.Clock.
+func (d *Driver) now() time.Time {
+	return d.clock.Now()
+}
+
+// sleep waits for d to pass on Options.Clock.
+func (d *Driver) sleep(dur time.Duration) {
+	done := make(chan struct{})
+	d.clock.AfterFunc(dur, func() { close(done) })
+	<-done
+}
+
+// newID returns an ID from Options.IDGenerator.
+func (d *Driver) newID() string {
+	return d.ids()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CloneCollection copies collection src to a new collection dst, with its
+// blobs and attachments. Files are hard-linked where the filesystem allows
+// it, and copied otherwise. Writes replace files rather than modify them,
+// and Options.Shred only overwrites files without other links, so a change
+// to either collection never reaches the other. Geo and secondary indexes
+// registered on src are registered on dst as well. dst must not exist yet.
+func (d *Driver) CloneCollection(src, dst string) error {
+	for _, name := range []string{src, dst} {
+		if err := checkCollection(name); err != nil {
+			return err
+		}
+	}
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	if src == dst {
+		return fmt.Errorf("cannot clone collection %s onto itself", src)
+	}
+	d.settle()
+	unlock := d.lockNames(src, dst)
+	defer unlock()
+
+	srcDir, dstDir := d.collectionDir(src), d.collectionDir(dst)
+	if _, err := os.Stat(srcDir); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrNotFound, src)
+		}
+		return err
+	}
+	if _, err := os.Stat(dstDir); !os.IsNotExist(err) {
+		return fmt.Errorf("collection %s already exists", dst)
+	}
+
+	// Build the copy next to the metadata and move it into place in one
+	// step, so readers never see a partial clone.
+	if err := os.MkdirAll(d.metaPath("tmp"), 0755); err != nil {
+		return err
+	}
+	staging, err := os.MkdirTemp(d.metaPath("tmp"), "clone-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	if err := os.Chmod(staging, 0755); err != nil {
+		return err
+	}
+	if err := stageTree(srcDir, staging, ""); err != nil {
+		return err
+	}
+	if err := d.cloneMeta(src, dst); err != nil {
+		return err
+	}
+	if err := d.syncTree(staging); err != nil {
+		return err
+	}
+	if err := d.moveDir(staging, dstDir); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	if geo := d.geo[src]; geo != nil {
+		d.geo[dst] = &geoIndex{latField: geo.latField, lngField: geo.lngField}
+	}
+	if len(d.indexes[src]) > 0 {
+		d.indexes[dst] = make(map[string]*index)
+		for name, idx := range d.indexes[src] {
+			d.indexes[dst][name] = &index{extract: idx.extract, field: idx.field, values: map[string]map[string]bool{}, byKey: map[string]string{}}
+		}
+	}
+	d.mu.Unlock()
+
+	// Record the new records with the change log and every index.
+	return filepath.Walk(dstDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || !strings.HasSuffix(path, ".json") {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dstDir, path)
+		key := filepath.ToSlash(strings.TrimSuffix(rel, ".json"))
+		if err := d.logChange(dst, key, b); err != nil {
+			return err
+		}
+		d.afterWrite(dst, key, b)
+		d.emit(dst, key, b, false)
+		return nil
+	})
+}
+
+// cloneMeta copies the blobs and attachment metadata of src to dst, taking
+// a reference on every attached blob for the copies.
+func (d *Driver) cloneMeta(src, dst string) error {
+	if err := stageTree(d.metaPath("blobs", src), d.metaPath("blobs", dst), ""); err != nil {
+		return err
+	}
+
+	srcDir, dstDir := d.attachmentDir(src, ""), d.attachmentDir(dst, "")
+	return filepath.Walk(srcDir, func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || fi.IsDir() || !strings.HasSuffix(path, ".meta") {
+			return err
+		}
+		meta, err := readAttachmentMeta(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(srcDir, path)
+		if err := stageFile(path, filepath.Join(dstDir, rel)); err != nil {
+			return err
+		}
+		d.casMu.Lock()
+		defer d.casMu.Unlock()
+		_, err = d.casRef(meta.SHA256, 1)
+		return err
+	})
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Codec controls how values of one Go type are stored, for types whose
+// default JSON form is unstable or hard to query. Encode receives a value
+// of the type and returns what to store in its place; Decode receives the
+// stored JSON and returns a value of the type. Register codecs with
+// Options.Codecs, keyed by the exact type (e.g. reflect.TypeOf(time.Time{})
+// or reflect.TypeOf((*big.Int)(nil))).
+//
+// Codecs apply to the values passed to Write, WriteIf and Tx.Write and to
+// the values filled in by Read, Tx.Read, Snapshot.Read, ReadAllMap, All and
+// the As helpers. Structs holding a codec type are encoded field by field,
+// honouring json names, omitempty, "-" and exported embedded structs;
+// other struct tag options do not apply to them. Types implementing
+// json.Marshaler or encoding.TextMarshaler without a codec keep their own
+// encoding.
+type Codec struct {
+	Encode func(v interface{}) (interface{}, error)
+	Decode func(data json.RawMessage) (interface{}, error)
+}
+
+// TimeLayout stores time.Time values as strings in the given layout, such
+// as time.RFC3339. Register it for reflect.TypeOf(time.Time{}).
+func TimeLayout(layout string) Codec {
+	return Codec{
+		Encode: func(v interface{}) (interface{}, error) {
+			return v.(time.Time).Format(layout), nil
+		},
+		Decode: func(data json.RawMessage) (interface{}, error) {
+			var s string
+			if err := json.Unmarshal(data, &s); err != nil {
+				return nil, err
+			}
+			return time.Parse(layout, s)
+		},
+	}
+}
+
+// TimeUnix stores time.Time values as whole seconds since the Unix epoch,
+// which sort and compare as numbers in filters. Register it for
+// reflect.TypeOf(time.Time{}).
+func TimeUnix() Codec {
+	return Codec{
+		Encode: func(v interface{}) (interface{}, error) {
+			return v.(time.Time).Unix(), nil
+		},
+		Decode: func(data json.RawMessage) (interface{}, error) {
+			var sec int64
+			if err := json.Unmarshal(data, &sec); err != nil {
+				return nil, err
+			}
+			return time.Unix(sec, 0), nil
+		},
+	}
+}
+
+// BigIntString stores *big.Int values as decimal strings, so they survive
+// readers that parse JSON numbers as float64. Register it for
+// reflect.TypeOf((*big.Int)(nil)).
+func BigIntString() Codec {
+	return Codec{
+		Encode: func(v interface{}) (interface{}, error) {
+			n := v.(*big.Int)
+			if n == nil {
+				return nil, nil
+			}
+			return n.String(), nil
+		},
+		Decode: func(data json.RawMessage) (interface{}, error) {
+			var s string
+			if err := json.Unmarshal(data, &s); err != nil {
+				return nil, err
+			}
+			n, ok := new(big.Int).SetString(s, 10)
+			if !ok {
+				return nil, fmt.Errorf("invalid big integer %q", s)
+			}
+			return n, nil
+		},
+	}
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// encode marshals v the way records are stored on disk, applying codecs.
+func (d *Driver) encode(v interface{}) ([]byte, error) {
+	if len(d.codecs) == 0 {
+		return encode(v)
+	}
+	ev, err := d.encodeValue(reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return encode(ev)
+}
+
+// decode unmarshals a stored record into v, applying codecs.
+func (d *Driver) decode(b []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if len(d.codecs) == 0 || rv.Kind() != reflect.Ptr || rv.IsNil() || !d.hasCodec(rv.Type().Elem()) {
+		return d.unmarshal(b, &v)
+	}
+	return d.decodeValue(b, rv.Elem())
+}
+
+// mayNeedCodec reports whether values of t may hold a value with a codec,
+// counting interfaces, whose dynamic values are only known when encoding.
+func (d *Driver) mayNeedCodec(t reflect.Type) bool {
+	return d.codecNeeded(t, true)
+}
+
+// hasCodec reports whether values of t hold a value with a codec.
+func (d *Driver) hasCodec(t reflect.Type) bool {
+	return d.codecNeeded(t, false)
+}
+
+type codecQuery struct {
+	t       reflect.Type
+	dynamic bool
+}
+
+func (d *Driver) codecNeeded(t reflect.Type, dynamic bool) bool {
+	q := codecQuery{t, dynamic}
+	if v, ok := d.codecTypes.Load(q); ok {
+		return v.(bool)
+	}
+	need := d.codecWalk(t, dynamic, make(map[reflect.Type]bool))
+	d.codecTypes.Store(q, need)
+	return need
+}
+
+func (d *Driver) codecWalk(t reflect.Type, dynamic bool, seen map[reflect.Type]bool) bool {
+	if _, ok := d.codecs[t]; ok {
+		return true
+	}
+	if seen[t] {
+		return false
+	}
+	seen[t] = true
+	switch t.Kind() {
+	case reflect.Interface:
+		return dynamic
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return d.codecWalk(t.Elem(), dynamic, seen)
+	case reflect.Struct:
+		if t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType) {
+			return false
+		}
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.IsExported() && d.codecWalk(f.Type, dynamic, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// encodeValue returns rv with every value that has a codec replaced by its
+// encoding. Parts without such values are returned as they are.
+func (d *Driver) encodeValue(rv reflect.Value) (interface{}, error) {
+	if !rv.IsValid() {
+		return nil, nil
+	}
+	t := rv.Type()
+	if c, ok := d.codecs[t]; ok {
+		return c.Encode(rv.Interface())
+	}
+	if !d.mayNeedCodec(t) {
+		return rv.Interface(), nil
+	}
+	switch t.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if rv.IsNil() {
+			return nil, nil
+		}
+		return d.encodeValue(rv.Elem())
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && rv.IsNil() {
+			return nil, nil
+		}
+		out := make([]interface{}, rv.Len())
+		for i := range out {
+			v, err := d.encodeValue(rv.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			out[i] = v
+		}
+		return out, nil
+	case reflect.Map:
+		if rv.IsNil() {
+			return nil, nil
+		}
+		out := reflect.MakeMapWithSize(reflect.MapOf(t.Key(), reflect.TypeOf((*interface{})(nil)).Elem()), rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			v, err := d.encodeValue(iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			if v == nil {
+				out.SetMapIndex(iter.Key(), reflect.Zero(out.Type().Elem()))
+			} else {
+				out.SetMapIndex(iter.Key(), reflect.ValueOf(v))
+			}
+		}
+		return out.Interface(), nil
+	case reflect.Struct:
+		out := make(map[string]interface{})
+		err := d.encodeStruct(rv, out)
+		return out, err
+	}
+	return rv.Interface(), nil
+}
+
+// encodeStruct adds the fields of a struct to out, flattening embedded
+// structs. Fields set at a shallower depth win over promoted ones.
+func (d *Driver) encodeStruct(rv reflect.Value, out map[string]interface{}) error {
+	t := rv.Type()
+	var embedded []reflect.Value
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, opts, skip := jsonField(f)
+		if skip {
+			continue
+		}
+		fv := rv.Field(i)
+		if name == "" {
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			embedded = append(embedded, fv)
+			continue
+		}
+		if strings.Contains(opts, "omitempty") && isEmptyValue(fv) {
+			continue
+		}
+		v, err := d.encodeValue(fv)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		out[name] = v
+	}
+	for _, fv := range embedded {
+		inner := make(map[string]interface{})
+		if err := d.encodeStruct(fv, inner); err != nil {
+			return err
+		}
+		for k, v := range inner {
+			if _, ok := out[k]; !ok {
+				out[k] = v
+			}
+		}
+	}
+	return nil
+}
+
+// jsonField returns the JSON name and options of a struct field. An empty
+// name means an untagged embedded struct whose fields are promoted.
+func jsonField(f reflect.StructField) (name, opts string, skip bool) {
+	tag := f.Tag.Get("json")
+	if tag == "-" || !f.IsExported() {
+		return "", "", true
+	}
+	name, opts, _ = strings.Cut(tag, ",")
+	if f.Anonymous && name == "" {
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct {
+			return "", opts, false
+		}
+	}
+	if name == "" {
+		name = f.Name
+	}
+	return name, opts, false
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// decodeValue unmarshals data into rv, which must be settable, applying
+// codecs.
+func (d *Driver) decodeValue(data []byte, rv reflect.Value) error {
+	t := rv.Type()
+	null := bytes.Equal(bytes.TrimSpace(data), []byte("null"))
+	if c, ok := d.codecs[t]; ok {
+		if null {
+			return nil
+		}
+		v, err := c.Decode(data)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			rv.Set(reflect.Zero(t))
+			return nil
+		}
+		val := reflect.ValueOf(v)
+		if !val.Type().AssignableTo(t) {
+			return fmt.Errorf("codec for %v decoded a %T", t, v)
+		}
+		rv.Set(val)
+		return nil
+	}
+	if !d.hasCodec(t) {
+		return d.unmarshal(data, rv.Addr().Interface())
+	}
+	if null {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Map:
+			rv.Set(reflect.Zero(t))
+		}
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			rv.Set(reflect.New(t.Elem()))
+		}
+		return d.decodeValue(data, rv.Elem())
+	case reflect.Slice, reflect.Array:
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return err
+		}
+		if t.Kind() == reflect.Slice {
+			rv.Set(reflect.MakeSlice(t, len(items), len(items)))
+		}
+		for i := 0; i < len(items) && i < rv.Len(); i++ {
+			if err := d.decodeValue(items[i], rv.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return fmt.Errorf("codecs support only maps with string keys, not %v", t)
+		}
+		var items map[string]json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return err
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.MakeMapWithSize(t, len(items)))
+		}
+		for k, raw := range items {
+			elem := reflect.New(t.Elem()).Elem()
+			if err := d.decodeValue(raw, elem); err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+			rv.SetMapIndex(reflect.ValueOf(k).Convert(t.Key()), elem)
+		}
+		return nil
+	case reflect.Struct:
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return err
+		}
+		return d.decodeStruct(fields, rv)
+	}
+	return d.unmarshal(data, rv.Addr().Interface())
+}
+
+// decodeStruct fills the fields of a struct from the members of a JSON
+// object, matching names like encoding/json does.
+func (d *Driver) decodeStruct(fields map[string]json.RawMessage, rv reflect.Value) error {
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, skip := jsonField(f)
+		if skip {
+			continue
+		}
+		fv := rv.Field(i)
+		if name == "" {
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					fv.Set(reflect.New(fv.Type().Elem()))
+				}
+				fv = fv.Elem()
+			}
+			if err := d.decodeStruct(fields, fv); err != nil {
+				return err
+			}
+			continue
+		}
+		raw, ok := fields[name]
+		if !ok {
+			for k, v := range fields {
+				if strings.EqualFold(k, name) {
+					raw, ok = v, true
+					break
+				}
+			}
+		}
+		if !ok {
+			continue
+		}
+		if err := d.decodeValue(raw, fv); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
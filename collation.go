@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Collator orders strings. *collate.Collator from golang.org/x/text/collate
+// satisfies it, giving locale-aware ordering; CaseFold is built in.
+type Collator interface {
+	CompareString(a, b string) int
+}
+
+// CaseFold compares strings ignoring case under Unicode case folding, so
+// "straße" and "STRASSE" still differ but "Ärger" equals "äRGER".
+var CaseFold Collator = caseFold{}
+
+type caseFold struct{}
+
+func (caseFold) CompareString(a, b string) int {
+	return strings.Compare(foldString(a), foldString(b))
+}
+
+// foldString maps every rune to the smallest rune it case-folds to.
+func foldString(s string) string {
+	return strings.Map(func(r rune) rune {
+		min := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f < min {
+				min = f
+			}
+		}
+		return min
+	}, s)
+}
+
+// Collate makes the conditions in f compare strings with c, for
+// case-insensitive or locale-aware matching: Collate(CaseFold,
+// Eq("City", "paris")) matches "Paris". Filters built with FilterFunc are
+// left as they are.
+func Collate(c Collator, f Filter) Filter {
+	switch f := f.(type) {
+	case condition:
+		f.coll = c
+		return f
+	case and:
+		out := make(and, len(f))
+		for i, g := range f {
+			out[i] = Collate(c, g)
+		}
+		return out
+	case or:
+		out := make(or, len(f))
+		for i, g := range f {
+			out[i] = Collate(c, g)
+		}
+		return out
+	case not:
+		return not{Collate(c, f.f)}
+	}
+	return f
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CollectionConfig holds the settings of a collection created with
+// CreateCollection.
+type CollectionConfig struct {
+	// MaxRecordSize, when non-zero, replaces Options.MaxRecordSize for
+	// the records of the collection.
+	MaxRecordSize int64 `json:",omitempty"`
+
+	// Frozen makes the collection read-only; see FreezeCollection.
+	Frozen bool `json:",omitempty"`
+}
+
+// reservedNames are collection names kept for the driver's own use.
+// Everything the driver stores besides records lives in the metadata
+// directory, which the leading-dot rule already keeps out of reach.
+var reservedNames = map[string]bool{"_meta": true, "_system": true}
+
+// checkCollection validates a collection name. Names must be non-empty,
+// must not start with a dot, contain a path separator or control
+// character, or be one of the reserved names, so that they always map to
+// a directory directly below the database root that no driver metadata
+// can collide with.
+func checkCollection(name string) error {
+	if name == "" {
+		return fmt.Errorf("collection name cannot be empty")
+	}
+	var reason string
+	switch {
+	case strings.HasPrefix(name, "."):
+		reason = "starts with a dot"
+	case strings.ContainsAny(name, `/\`):
+		reason = "contains a path separator"
+	case strings.IndexFunc(name, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0:
+		reason = "contains a control character"
+	case reservedNames[name]:
+		reason = "is reserved"
+	default:
+		return nil
+	}
+	return fmt.Errorf("%w %q: %s", ErrInvalidCollection, name, reason)
+}
+
+// checkResource validates a record key, which must name a file directly
+// inside its collection directory: it may not contain a path separator or
+// control character, nor start with a dot unless Options.HiddenRecords is
+// set, since such records would be skipped by every listing. Empty keys
+// are left to the callers, which report them in their own words.
+func (d *Driver) checkResource(key string) error {
+	var reason string
+	switch {
+	case key == "":
+		return nil
+	case key == "." || key == "..":
+		reason = "is a relative path"
+	case strings.HasPrefix(key, ".") && !d.hidden:
+		reason = "starts with a dot"
+	case strings.ContainsAny(key, `/\`):
+		reason = "contains a path separator"
+	case strings.IndexFunc(key, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0:
+		reason = "contains a control character"
+	default:
+		return nil
+	}
+	return fmt.Errorf("%w %q: %s", ErrInvalidKey, key, reason)
+}
+
+// checkKey validates the collection and record key given to an operation,
+// described by what for a missing key, such as "save blob".
+func (d *Driver) checkKey(collection, key, what string) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+	if key == "" {
+		return fmt.Errorf("missing resource - unable to %s (no name)", what)
+	}
+	return d.checkResource(key)
+}
+
+// Collections returns the names of the collections in the database, in
+// sorted order, including those kept elsewhere by Options.Placement.
+func (d *Driver) Collections() ([]string, error) {
+	var names []string
+	for i, root := range d.collectionRoots() {
+		files, err := os.ReadDir(root)
+		if err != nil {
+			if i > 0 && os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, file := range files {
+			name := file.Name()
+			if file.IsDir() && !strings.HasPrefix(name, ".") && d.collectionRoot(name) == root {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// CreateCollection creates the collection name, or updates the config of
+// an existing one. Writes create collections on the fly unless
+// Options.Strict is set, in which case collections must be created here
+// first.
+func (d *Driver) CreateCollection(name string, config CollectionConfig) error {
+	if err := checkCollection(name); err != nil {
+		return err
+	}
+	mutex := d.getOrCreateMutex(name)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	if d.CollectionConfig(name).Frozen && !config.Frozen {
+		return fmt.Errorf("%w: %s", ErrFrozen, name)
+	}
+	if err := d.mkdirAll(d.collectionDir(name)); err != nil {
+		return err
+	}
+	return d.saveConfig(name, config)
+}
+
+// saveConfig stores the config of collection. The collection lock must be
+// held.
+func (d *Driver) saveConfig(name string, config CollectionConfig) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	d.configMu.Lock()
+	defer d.configMu.Unlock()
+	path := d.metaPath("collections", name+".json")
+	if config == (CollectionConfig{}) {
+		delete(d.configs, name)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b, err := encode(config)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.metaPath("collections"), 0755); err != nil {
+		return err
+	}
+	if err := d.writeFile(path, b); err != nil {
+		return err
+	}
+	d.configs[name] = config
+	return nil
+}
+
+// FreezeCollection makes the existing collection name read-only: until
+// UnfreezeCollection, every write, delete, purge, truncation, expiry and
+// blob or attachment change to it fails with ErrFrozen, as does updating
+// its config with CreateCollection. The flag is saved with the config of
+// the collection, so it survives restarts. Use it for reference data and
+// for collections a completed migration must leave alone.
+func (d *Driver) FreezeCollection(name string) error {
+	return d.setFrozen(name, true)
+}
+
+// UnfreezeCollection makes a collection frozen with FreezeCollection
+// writable again.
+func (d *Driver) UnfreezeCollection(name string) error {
+	return d.setFrozen(name, false)
+}
+
+func (d *Driver) setFrozen(name string, frozen bool) error {
+	if err := checkCollection(name); err != nil {
+		return err
+	}
+	d.settle()
+	mutex := d.getOrCreateMutex(name)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if fi, err := os.Stat(d.collectionDir(name)); err != nil || !fi.IsDir() {
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	config := d.CollectionConfig(name)
+	if config.Frozen == frozen {
+		return nil
+	}
+	config.Frozen = frozen
+	if err := d.saveConfig(name, config); err != nil {
+		return err
+	}
+	d.log.Info("Collection '%s' frozen: %v\n", name, frozen)
+	return nil
+}
+
+// checkFrozen fails with ErrFrozen if collection is frozen.
+func (d *Driver) checkFrozen(collection string) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	if d.CollectionConfig(collection).Frozen {
+		return fmt.Errorf("%w: %s", ErrFrozen, collection)
+	}
+	return nil
+}
+
+// CollectionConfig returns the config collection was created with.
+func (d *Driver) CollectionConfig(collection string) CollectionConfig {
+	d.configMu.Lock()
+	defer d.configMu.Unlock()
+	return d.configs[collection]
+}
+
+// openConfigs loads the saved collection configs.
+func (d *Driver) openConfigs() error {
+	d.configs = make(map[string]CollectionConfig)
+	files, err := os.ReadDir(d.metaPath("collections"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		b, err := os.ReadFile(d.metaPath("collections", file.Name()))
+		if err != nil {
+			return err
+		}
+		var config CollectionConfig
+		if err := json.Unmarshal(b, &config); err != nil {
+			return fmt.Errorf("collection config %s: %v", file.Name(), err)
+		}
+		d.configs[strings.TrimSuffix(file.Name(), ".json")] = config
+	}
+	return nil
+}
+
+// dropConfig forgets the config of a deleted collection.
+func (d *Driver) dropConfig(collection string) error {
+	d.configMu.Lock()
+	defer d.configMu.Unlock()
+	if _, ok := d.configs[collection]; !ok {
+		return nil
+	}
+	delete(d.configs, collection)
+	if err := os.Remove(d.metaPath("collections", collection+".json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// checkWrite fails a write of b to collection that Options.Strict, the
+// size limits or a freeze forbid.
+func (d *Driver) checkWrite(collection string, b []byte) error {
+	if err := d.checkFrozen(collection); err != nil {
+		return err
+	}
+	if d.strict {
+		if fi, err := os.Stat(d.collectionDir(collection)); err != nil || !fi.IsDir() {
+			return fmt.Errorf("%w: %s", ErrUnknownCollection, collection)
+		}
+	}
+	limit := d.maxSize
+	if size := d.CollectionConfig(collection).MaxRecordSize; size != 0 {
+		limit = size
+	}
+	if limit > 0 && int64(len(b)) > limit {
+		return fmt.Errorf("%w: %d bytes exceeds limit of %d", ErrRecordTooLarge, len(b), limit)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// WriteIf writes v to collection/resource only if the record currently
+// stored there matches cond, returning ErrConditionFailed otherwise. A
+// missing record never matches. The check and the write happen under the
+// collection lock, so no other write can slip in between.
+func (d *Driver) WriteIf(collection, resource string, v interface{}, cond Filter) error {
+	if err := d.checkKey(collection, resource, "save record"); err != nil {
+		return err
+	}
+	b, err := d.encode(v)
+	if err != nil {
+		return err
+	}
+	d.settle()
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if err := d.check(collection, resource, cond); err != nil {
+		return err
+	}
+	return d.write(collection, resource, b)
+}
+
+// Swap writes v to collection/resource and returns the record it replaced,
+// masked like Read returns it, with existed false if there was none. The
+// read and the write happen under the collection lock, so every previous
+// value is handed to exactly one caller.
+func (d *Driver) Swap(collection, resource string, v interface{}) (previous json.RawMessage, existed bool, err error) {
+	if err := d.checkKey(collection, resource, "save record"); err != nil {
+		return nil, false, err
+	}
+	b, err := d.encode(v)
+	if err != nil {
+		return nil, false, err
+	}
+	d.settle()
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	current, err := os.ReadFile(d.recordPath(collection, resource))
+	switch {
+	case err == nil:
+		if previous, err = d.mask(collection, current); err != nil {
+			return nil, false, err
+		}
+		existed = true
+	case !os.IsNotExist(err):
+		return nil, false, err
+	}
+	if err := d.write(collection, resource, b); err != nil {
+		return nil, false, err
+	}
+	return previous, existed, nil
+}
+
+// Version returns the version of collection/resource, a string derived
+// from the stored contents that changes whenever the record does. Pass it
+// to DeleteIfVersion to delete the record only in the state it was read
+// in.
+func (d *Driver) Version(collection, resource string) (string, error) {
+	if err := d.checkKey(collection, resource, "read record"); err != nil {
+		return "", err
+	}
+	b, err := d.rawRecord(collection, resource)
+	if err != nil {
+		return "", err
+	}
+	return recordVersion(b), nil
+}
+
+func recordVersion(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:16])
+}
+
+// DeleteIf deletes collection/resource only if the stored record matches
+// cond, returning ErrConditionFailed otherwise. Like WriteIf, the check
+// and the delete happen under the collection lock.
+func (d *Driver) DeleteIf(collection, resource string, cond Filter) error {
+	if err := d.checkKey(collection, resource, "delete record"); err != nil {
+		return err
+	}
+	d.settle()
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if err := d.check(collection, resource, cond); err != nil {
+		return err
+	}
+	return d.delete(collection, resource)
+}
+
+// DeleteIfVersion deletes collection/resource only if its version, as
+// returned by Version, is still version, so that a delete based on a stale
+// read cannot discard a concurrent update. It returns ErrConditionFailed
+// otherwise, and when the record does not exist.
+func (d *Driver) DeleteIfVersion(collection, resource, version string) error {
+	if err := d.checkKey(collection, resource, "delete record"); err != nil {
+		return err
+	}
+	d.settle()
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	current, err := os.ReadFile(d.recordPath(collection, resource))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s/%s does not exist", ErrConditionFailed, collection, resource)
+	}
+	if err != nil {
+		return err
+	}
+	if recordVersion(current) != version {
+		return fmt.Errorf("%w: %s/%s is at another version", ErrConditionFailed, collection, resource)
+	}
+	return d.delete(collection, resource)
+}
+
+// check fails with ErrConditionFailed unless the stored record matches
+// cond. The collection lock must be held.
+func (d *Driver) check(collection, resource string, cond Filter) error {
+	current, err := os.ReadFile(d.recordPath(collection, resource))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s/%s does not exist", ErrConditionFailed, collection, resource)
+	}
+	if err != nil {
+		return err
+	}
+	doc, err := decodeDoc(current)
+	if err != nil {
+		return err
+	}
+	if !cond.Match(doc) {
+		return fmt.Errorf("%w: %s/%s", ErrConditionFailed, collection, resource)
+	}
+	return nil
+}
@@ -0,0 +1,402 @@
+// Package config stores layered application configuration as records of a
+// dedicated collection, one JSON object per layer, and merges the layers
+// when read: values of a later layer override those of earlier ones, so
+// that defaults shipped with the application, settings of the environment
+// and overrides of one instance can be kept and changed apart:
+//
+//	c, err := config.New(db, "config")
+//	err = c.SetLayer(config.Defaults, map[string]interface{}{"http": map[string]interface{}{"port": 8080}})
+//	err = c.Set(config.Instance, "http.port", 9090)
+//	var cfg struct{ HTTP struct{ Port int } }
+//	err = c.Get(&cfg) // cfg.HTTP.Port == 9090
+//
+// Objects merge field by field, other values replace the value below
+// them, and a null removes it, so that a layer can unset a default.
+// Watchers are told which paths of the merged configuration changed.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The layers of New, from the lowest precedence to the highest.
+const (
+	Defaults    = "defaults"
+	Environment = "environment"
+	Instance    = "instance"
+)
+
+// Store is the subset of the database driver the configuration needs.
+type Store interface {
+	Read(collection, resource string, v interface{}) error
+	Write(collection, resource string, v interface{}) error
+	Delete(collection, resource string) error
+}
+
+// Change describes a change of the merged configuration. Paths are the
+// dotted paths of the values added, changed or removed, in sorted order.
+type Change struct {
+	Paths    []string
+	Old, New map[string]interface{}
+}
+
+// Config is a layered configuration stored in one collection.
+type Config struct {
+	store      Store
+	collection string
+	layers     []string
+
+	mu       sync.Mutex // serializes changes and their notifications
+	merged   map[string]interface{}
+	watchers map[int]func(Change)
+	next     int
+}
+
+// New returns the configuration stored in collection with the given
+// layers, from the lowest precedence to the highest; without layers they
+// are Defaults, Environment and Instance. Layers that were never set are
+// empty.
+func New(store Store, collection string, layers ...string) (*Config, error) {
+	if len(layers) == 0 {
+		layers = []string{Defaults, Environment, Instance}
+	}
+	c := &Config{store: store, collection: collection, layers: layers, watchers: make(map[int]func(Change))}
+	merged, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	c.merged = merged
+	return c, nil
+}
+
+// Layers returns the names of the layers, from the lowest precedence to
+// the highest.
+func (c *Config) Layers() []string {
+	return append([]string(nil), c.layers...)
+}
+
+// Get decodes the merged configuration into v, reading every layer.
+func (c *Config) Get(v interface{}) error {
+	merged, err := c.refresh()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Value returns the value at the dotted path of the merged configuration,
+// such as "http.port", reading every layer. Numbers are json.Number.
+func (c *Config) Value(path string) (interface{}, bool, error) {
+	merged, err := c.refresh()
+	if err != nil {
+		return nil, false, err
+	}
+	v, ok := lookup(merged, path)
+	return v, ok, nil
+}
+
+// Layer returns the document of one layer, empty if it was never set.
+func (c *Config) Layer(layer string) (map[string]interface{}, error) {
+	if err := c.checkLayer(layer); err != nil {
+		return nil, err
+	}
+	return c.readLayer(layer)
+}
+
+// SetLayer replaces the document of layer with doc, which must encode to
+// a JSON object.
+func (c *Config) SetLayer(layer string, doc interface{}) error {
+	if err := c.checkLayer(layer); err != nil {
+		return err
+	}
+	m, err := toObject(doc)
+	if err != nil {
+		return fmt.Errorf("config: layer %s: %w", layer, err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.store.Write(c.collection, layer, m); err != nil {
+		return err
+	}
+	return c.reload()
+}
+
+// Set sets the value at the dotted path of layer, creating the objects on
+// the way. A nil v stores a null, which removes the value of lower layers
+// from the merged configuration; use Unset to fall back to them instead.
+func (c *Config) Set(layer, path string, v interface{}) error {
+	return c.update(layer, func(doc map[string]interface{}) error {
+		norm, err := normalize(v)
+		if err != nil {
+			return err
+		}
+		return setPath(doc, path, norm)
+	})
+}
+
+// Unset removes the value at the dotted path of layer, so that the merged
+// configuration falls back to the lower layers.
+func (c *Config) Unset(layer, path string) error {
+	return c.update(layer, func(doc map[string]interface{}) error {
+		deletePath(doc, path)
+		return nil
+	})
+}
+
+// DeleteLayer removes the document of layer.
+func (c *Config) DeleteLayer(layer string) error {
+	if err := c.checkLayer(layer); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.store.Delete(c.collection, layer); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return c.reload()
+}
+
+// Watch calls fn after every change of the merged configuration, with the
+// paths changed, until the returned function is called. Changes made
+// through c are seen at once; changes made otherwise, such as by another
+// process, are seen by the next Get, Value or Refresh. Calls of fn do not
+// overlap and are made by the call that saw the change, so fn must not
+// change the configuration itself.
+func (c *Config) Watch(fn func(Change)) (stop func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := c.next
+	c.next++
+	c.watchers[id] = fn
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.watchers, id)
+	}
+}
+
+// Refresh reads every layer and notifies the watchers if the merged
+// configuration changed, for changes made other than through c. Call it
+// periodically to learn of them without reading the configuration.
+func (c *Config) Refresh() error {
+	_, err := c.refresh()
+	return err
+}
+
+func (c *Config) refresh() (map[string]interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c.merged, nil
+}
+
+// update changes the document of layer with fn. Callers in other processes
+// can interleave; c only serializes its own changes.
+func (c *Config) update(layer string, fn func(doc map[string]interface{}) error) error {
+	if err := c.checkLayer(layer); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	doc, err := c.readLayer(layer)
+	if err != nil {
+		return err
+	}
+	if err := fn(doc); err != nil {
+		return fmt.Errorf("config: layer %s: %w", layer, err)
+	}
+	if err := c.store.Write(c.collection, layer, doc); err != nil {
+		return err
+	}
+	return c.reload()
+}
+
+// reload merges the layers and notifies the watchers of what changed.
+// c.mu must be held.
+func (c *Config) reload() error {
+	merged, err := c.read()
+	if err != nil {
+		return err
+	}
+	var paths []string
+	diff(c.merged, merged, "", &paths)
+	old := c.merged
+	c.merged = merged
+	if len(paths) == 0 {
+		return nil
+	}
+	sort.Strings(paths)
+	ids := make([]int, 0, len(c.watchers))
+	for id := range c.watchers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		c.watchers[id](Change{Paths: paths, Old: old, New: merged})
+	}
+	return nil
+}
+
+// read merges the layers as stored.
+func (c *Config) read() (map[string]interface{}, error) {
+	merged := make(map[string]interface{})
+	for _, layer := range c.layers {
+		doc, err := c.readLayer(layer)
+		if err != nil {
+			return nil, err
+		}
+		merge(merged, doc)
+	}
+	return merged, nil
+}
+
+func (c *Config) readLayer(layer string) (map[string]interface{}, error) {
+	var raw json.RawMessage
+	err := c.store.Read(c.collection, layer, &raw)
+	if errors.Is(err, os.ErrNotExist) {
+		return make(map[string]interface{}), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc, err := toObject(raw)
+	if err != nil {
+		return nil, fmt.Errorf("config: layer %s: %w", layer, err)
+	}
+	return doc, nil
+}
+
+func (c *Config) checkLayer(layer string) error {
+	for _, l := range c.layers {
+		if l == layer {
+			return nil
+		}
+	}
+	return fmt.Errorf("config: no layer %q", layer)
+}
+
+// merge merges src into dst: objects field by field, nulls removing the
+// value of dst, and other values replacing it.
+func merge(dst, src map[string]interface{}) {
+	for k, v := range src {
+		switch v := v.(type) {
+		case nil:
+			delete(dst, k)
+		case map[string]interface{}:
+			sub, ok := dst[k].(map[string]interface{})
+			if !ok {
+				sub = make(map[string]interface{})
+				dst[k] = sub
+			}
+			merge(sub, v)
+		default:
+			dst[k] = v
+		}
+	}
+}
+
+// diff appends the dotted paths whose values differ between a and b,
+// descending into the objects both hold.
+func diff(a, b map[string]interface{}, prefix string, paths *[]string) {
+	for k, va := range a {
+		vb, ok := b[k]
+		ma, okA := va.(map[string]interface{})
+		mb, okB := vb.(map[string]interface{})
+		switch {
+		case ok && okA && okB:
+			diff(ma, mb, prefix+k+".", paths)
+		case !ok || !reflect.DeepEqual(va, vb):
+			*paths = append(*paths, prefix+k)
+		}
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			*paths = append(*paths, prefix+k)
+		}
+	}
+}
+
+func lookup(doc map[string]interface{}, path string) (interface{}, bool) {
+	var v interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func setPath(doc map[string]interface{}, path string, v interface{}) error {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		switch child := doc[part].(type) {
+		case map[string]interface{}:
+			doc = child
+		case nil:
+			m := make(map[string]interface{})
+			doc[part] = m
+			doc = m
+		default:
+			return fmt.Errorf("cannot set %q: %s is not an object", path, part)
+		}
+	}
+	doc[parts[len(parts)-1]] = v
+	return nil
+}
+
+func deletePath(doc map[string]interface{}, path string) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := doc[part].(map[string]interface{})
+		if !ok {
+			return
+		}
+		doc = child
+	}
+	delete(doc, parts[len(parts)-1])
+}
+
+// normalize round-trips v through JSON, so that stored and merged values
+// are of the types decoded from records.
+func normalize(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return out, dec.Decode(&out)
+}
+
+func toObject(v interface{}) (map[string]interface{}, error) {
+	norm, err := normalize(v)
+	if err != nil {
+		return nil, err
+	}
+	switch m := norm.(type) {
+	case map[string]interface{}:
+		return m, nil
+	case nil:
+		return make(map[string]interface{}), nil
+	}
+	return nil, errors.New("not a JSON object")
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Kinds of Anomaly.
+const (
+	// AnomalyUnreadable is a record file that could not be read.
+	AnomalyUnreadable = "unreadable"
+	// AnomalyEmpty is a zero-byte record file.
+	AnomalyEmpty = "empty"
+	// AnomalyCorrupt is a record file that does not hold valid JSON.
+	AnomalyCorrupt = "corrupt"
+	// AnomalyTempFile is a temporary file left by a write that never
+	// completed.
+	AnomalyTempFile = "temp-file"
+	// AnomalyIndexDrift is a disagreement between an index and the
+	// records, as reported by VerifyIndexes.
+	AnomalyIndexDrift = "index-drift"
+)
+
+// Report is the outcome of Check.
+type Report struct {
+	Checked time.Time
+	// Records is how many record files were examined.
+	Records   int
+	Anomalies []Anomaly
+}
+
+// Anomaly is a problem found by Check.
+type Anomaly struct {
+	Kind       string
+	Collection string
+	// Key is the record concerned, if any.
+	Key string
+	// Path is the file concerned, if any.
+	Path    string
+	Problem string
+	// Repaired is set when Check repaired the anomaly: temporary files
+	// are removed, empty and corrupt records moved to the quarantine
+	// directory under the metadata directory, and drifted indexes
+	// rebuilt. Unreadable records are left for an operator.
+	Repaired bool
+}
+
+func (a Anomaly) String() string {
+	s := fmt.Sprintf("%s: %s/%s: %s", a.Kind, a.Collection, a.Key, a.Problem)
+	if a.Key == "" {
+		s = fmt.Sprintf("%s: %s: %s", a.Kind, a.Path, a.Problem)
+	}
+	if a.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// OK reports whether nothing was found.
+func (r *Report) OK() bool {
+	return len(r.Anomalies) == 0
+}
+
+// OpenReport returns the report of the check run by New when
+// Options.CheckOnOpen or Options.RepairOnOpen is set, nil otherwise.
+func (d *Driver) OpenReport() *Report {
+	return d.openReport
+}
+
+// Check scans every collection for unreadable, empty and corrupt record
+// files and for temporary files left by interrupted writes, and compares
+// the key index and bloom filters, if enabled, with the records. With
+// repair set, it also repairs what it can; see Anomaly.Repaired. Reading
+// every record makes it as slow as reading the whole database.
+func (d *Driver) Check(repair bool) (*Report, error) {
+	if repair {
+		if err := d.checkWritable(); err != nil {
+			return nil, err
+		}
+	}
+	r := &Report{Checked: d.now()}
+	var drift []IndexIssue
+	if d.keys != nil || d.blooms != nil {
+		var err error
+		if drift, err = d.VerifyIndexes(); err != nil {
+			return nil, err
+		}
+	}
+	names, err := d.Collections()
+	if err != nil {
+		return nil, err
+	}
+	quarantined := false
+	for _, collection := range names {
+		q, err := d.checkCollectionFiles(collection, repair, r)
+		if err != nil {
+			return r, err
+		}
+		quarantined = quarantined || q
+	}
+
+	reindexed := false
+	if repair && (len(drift) > 0 || quarantined) && (d.keys != nil || d.blooms != nil) {
+		if err := d.ReindexAll(); err != nil {
+			return r, err
+		}
+		reindexed = true
+	}
+	for _, issue := range drift {
+		r.Anomalies = append(r.Anomalies, Anomaly{
+			Kind:       AnomalyIndexDrift,
+			Collection: issue.Collection,
+			Key:        issue.Key,
+			Problem:    fmt.Sprintf("%s index: %s", issue.Index, issue.Problem),
+			Repaired:   reindexed,
+		})
+	}
+	return r, nil
+}
+
+// checkCollectionFiles checks the files of collection for Check, and
+// reports whether records were quarantined.
+func (d *Driver) checkCollectionFiles(collection string, repair bool, r *Report) (bool, error) {
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	dir := d.collectionDir(collection)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	quarantined := false
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+		if file.Type().IsRegular() && strings.HasSuffix(file.Name(), ".tmp") {
+			a := Anomaly{Kind: AnomalyTempFile, Collection: collection, Path: path, Problem: "temporary file of an interrupted write"}
+			if repair {
+				if err := os.Remove(path); err != nil {
+					return quarantined, err
+				}
+				a.Repaired = true
+			}
+			r.Anomalies = append(r.Anomalies, a)
+			continue
+		}
+		key, ok := d.recordKey(file)
+		if !ok {
+			continue
+		}
+		r.Records++
+		a := Anomaly{Collection: collection, Key: key, Path: path}
+		b, err := os.ReadFile(path)
+		switch {
+		case err != nil:
+			a.Kind, a.Problem = AnomalyUnreadable, err.Error()
+		case len(b) == 0:
+			a.Kind, a.Problem = AnomalyEmpty, "record file is empty"
+		case !json.Valid(b):
+			a.Kind, a.Problem = AnomalyCorrupt, "record file is not valid JSON"
+		default:
+			continue
+		}
+		if repair && a.Kind != AnomalyUnreadable {
+			if err := d.quarantine(collection, path); err != nil {
+				return quarantined, err
+			}
+			a.Repaired, quarantined = true, true
+		}
+		r.Anomalies = append(r.Anomalies, a)
+	}
+	if repair && d.sync && len(r.Anomalies) > 0 {
+		return quarantined, d.backend.SyncDir(dir)
+	}
+	return quarantined, nil
+}
+
+// quarantine moves a damaged record file of collection out of the way,
+// into the quarantine directory, where it can be inspected.
+func (d *Driver) quarantine(collection, path string) error {
+	dir := d.metaPath("quarantine", collection)
+	if err := d.mkdirAll(dir); err != nil {
+		return err
+	}
+	dst := filepath.Join(dir, d.now().UTC().Format("20060102T150405.000000000Z")+"-"+filepath.Base(path))
+	err := d.withRetry(func() error { return os.Rename(path, dst) })
+	if err == nil {
+		return nil
+	}
+	// Collections kept elsewhere by Options.Placement may be on another
+	// volume than the quarantine.
+	if err := copyFile(path, dst); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// checkOnOpen runs Check for New and logs what it found.
+func (d *Driver) checkOnOpen(repair bool) error {
+	r, err := d.Check(repair)
+	if err != nil {
+		return fmt.Errorf("consistency check: %w", err)
+	}
+	d.openReport = r
+	for _, a := range r.Anomalies {
+		d.log.Warn("%s\n", a)
+	}
+	if !r.OK() {
+		d.log.Warn("Consistency check of '%s' found %d anomalies in %d records\n", d.dir, len(r.Anomalies), r.Records)
+	}
+	return nil
+}
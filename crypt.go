@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypted streams are a magic header and random nonce prefix followed by
+// AES-GCM sealed chunks, each preceded by its length. The chunk counter and
+// a final-chunk flag are folded into every nonce and seal, so chunks cannot
+// be reordered, dropped or truncated without detection.
+const (
+	cryptMagic     = "GODBENC1"
+	cryptChunkSize = 64 * 1024
+)
+
+var errCorrupt = errors.New("encrypted stream is corrupt or the key is wrong")
+
+type cryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	n      uint64
+	buf    []byte
+}
+
+// newCryptWriter encrypts everything written to it with key (16, 24 or 32
+// bytes for AES-128/192/256). Close must be called to write the final
+// chunk.
+func newCryptWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, aead.NonceSize()-8)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, cryptMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+	return &cryptWriter{w: w, aead: aead, prefix: prefix}, nil
+}
+
+func (c *cryptWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		take := cryptChunkSize - len(c.buf)
+		if take > len(p) {
+			take = len(p)
+		}
+		c.buf = append(c.buf, p[:take]...)
+		p = p[take:]
+		if len(c.buf) == cryptChunkSize {
+			if err := c.flush(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (c *cryptWriter) Close() error {
+	return c.flush(true)
+}
+
+func (c *cryptWriter) flush(final bool) error {
+	sealed := c.aead.Seal(nil, c.nonce(), c.buf, chunkAD(final))
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(sealed)))
+	if _, err := c.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(sealed); err != nil {
+		return err
+	}
+	c.n++
+	c.buf = c.buf[:0]
+	return nil
+}
+
+func (c *cryptWriter) nonce() []byte {
+	nonce := make([]byte, len(c.prefix)+8)
+	copy(nonce, c.prefix)
+	binary.BigEndian.PutUint64(nonce[len(c.prefix):], c.n)
+	return nonce
+}
+
+type cryptReader struct {
+	cryptWriter
+	r    io.Reader
+	out  []byte
+	done bool
+}
+
+// newCryptReader decrypts a stream written by newCryptWriter.
+func newCryptReader(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, len(cryptMagic)+aead.NonceSize()-8)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if string(hdr[:len(cryptMagic)]) != cryptMagic {
+		return nil, fmt.Errorf("not an encrypted stream")
+	}
+	return &cryptReader{cryptWriter: cryptWriter{aead: aead, prefix: hdr[len(cryptMagic):]}, r: r}, nil
+}
+
+func (c *cryptReader) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		var hdr [4]byte
+		if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+			return 0, errCorrupt
+		}
+		sealed := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+		if _, err := io.ReadFull(c.r, sealed); err != nil {
+			return 0, errCorrupt
+		}
+		var err error
+		if c.out, err = c.aead.Open(nil, c.nonce(), sealed, chunkAD(false)); err != nil {
+			if c.out, err = c.aead.Open(nil, c.nonce(), sealed, chunkAD(true)); err != nil {
+				return 0, errCorrupt
+			}
+			c.done = true
+		}
+		c.n++
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// isEncrypted reports whether head starts like an encrypted stream.
+func isEncrypted(head []byte) bool {
+	return bytes.HasPrefix(head, []byte(cryptMagic))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Page is one page of query results. Next resumes the query after the last
+// record of the page and is empty once the results are exhausted.
+type Page struct {
+	Records []Record[json.RawMessage]
+	Next    string
+}
+
+// cursor is the decoded form of a page token: the position of the last
+// record returned, plus the sort order it is a position in.
+type cursor struct {
+	Sort string
+	Key  string
+	Doc  map[string]interface{}
+}
+
+// Paginate returns up to size records of q starting after cursor, which is
+// either empty for the first page or the Next token of the previous page.
+// Pages are positioned by the sort values and key of the last record rather
+// than by offset, so records inserted or deleted between calls never cause
+// surviving records to be skipped or repeated. q's Skip and Limit are
+// ignored.
+func (d *Driver) Paginate(collection string, q *Query, token string, size int) (*Page, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("page size must be positive")
+	}
+	if q == nil {
+		q = &Query{}
+	}
+	page := *q
+	page.offset, page.limit = 0, size
+	page.after = nil
+	if token != "" {
+		c, err := decodeCursor(token)
+		if err != nil {
+			return nil, err
+		}
+		if c.Sort != q.signature() {
+			return nil, fmt.Errorf("%w: cursor belongs to a query with a different sort order", ErrInvalidCursor)
+		}
+		page.after = &queryItem{rec: Record[json.RawMessage]{Key: c.Key}, doc: c.Doc}
+	}
+
+	records, err := d.Query(collection, &page)
+	if err != nil {
+		return nil, err
+	}
+	p := &Page{Records: records}
+	if len(records) == size {
+		last := records[len(records)-1]
+		doc, err := decodeDoc(last.Value)
+		if err != nil {
+			return nil, err
+		}
+		if p.Next, err = q.encodeCursor(last.Key, doc); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// signature identifies the sort order of q, so a cursor cannot be replayed
+// against a query ordered differently.
+func (q *Query) signature() string {
+	parts := make([]string, len(q.sort))
+	for i, k := range q.sort {
+		parts[i] = fmt.Sprintf("%s:%d", k.field, k.dir)
+	}
+	if q.less != nil {
+		parts = append(parts, "func")
+	}
+	if q.coll != nil {
+		parts = append(parts, fmt.Sprintf("%T", q.coll))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (q *Query) encodeCursor(key string, doc map[string]interface{}) (string, error) {
+	c := cursor{Sort: q.signature(), Key: key, Doc: doc}
+	if q.less == nil {
+		// Only the sort fields are needed to find the position again.
+		c.Doc = make(map[string]interface{})
+		for _, k := range q.sort {
+			if v, ok := lookup(doc, k.field); ok {
+				setField(c.Doc, k.field, v)
+			}
+		}
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeCursor(token string) (*cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	var c cursor
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	return &c, nil
+}
@@ -0,0 +1,630 @@
+// Command dbgen generates a typed repository for the records of one
+// collection, so that applications call GetUser and FindUsersByCompany
+// instead of passing collection names and interface{} values around.
+//
+// Usage:
+//
+//	dbgen -type User [-collection users] [-index Company] [-fields] [-o user_repo.go] user.go
+//	dbgen -type User schema.json
+//
+// The input is either a Go file declaring the struct type, or a JSON Schema
+// such as the one InferSchema produces, from which the struct type is
+// generated too. Indexed fields are declared with -index, repeatable, with
+// a `db:"index"` struct tag, or with "x-index": true on a schema property;
+// each gets a FindXsByField method backed by Lookup, for an index that the
+// application registers under the field's JSON name, e.g.
+//
+//	db.CreateIndex("users", "company", Field("company"))
+//
+// With -fields, dbgen also generates UserFields, holding a TypedField for
+// every field of User, nested structs included, so that queries name
+// fields the compiler checks:
+//
+//	db.Query("users", Where(UserFields.Address.City.Eq("Pune")))
+//
+// TypedField is declared by the driver, so the output must then be in the
+// package of the driver.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+)
+
+// field is a field of the record type.
+type field struct {
+	Name     string // Go name
+	JSON     string // JSON name, the name of its index
+	Type     string
+	Optional bool
+	Index    bool
+}
+
+// model is what the repository is generated from.
+type model struct {
+	Package    string
+	Type       string
+	Plural     string
+	Collection string
+	Decl       string // the struct type to declare, for schema input
+	Fields     []field
+	FieldsDecl string // UserFields and its types, with -fields
+
+	st      *ast.StructType            // the record type
+	specs   map[string]*ast.StructType // the struct types declared with it
+	imports map[string]string          // the imports of the input, by name
+	uses    map[string]bool            // the imports FieldsDecl uses
+}
+
+// fieldRef is a field of the record type in UserFields: a leaf with a
+// TypedField of type Type, or a struct with fields of its own.
+type fieldRef struct {
+	Name string
+	Path string
+	Type string
+	Sub  []fieldRef
+}
+
+func (m *model) Indexes() []field {
+	var indexes []field
+	for _, f := range m.Fields {
+		if f.Index {
+			indexes = append(indexes, f)
+		}
+	}
+	return indexes
+}
+
+// Imports returns the packages the generated file imports.
+func (m *model) Imports() []string {
+	var paths []string
+	if len(m.Indexes()) > 0 {
+		paths = append(paths, "fmt")
+	}
+	for path := range m.uses {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("dbgen: ")
+	var indexes stringList
+	typeName := flag.String("type", "", "record type name; defaults to the schema title")
+	collection := flag.String("collection", "", "collection name; defaults to the lowercased plural of the type")
+	pkg := flag.String("package", "", "package of the generated file; defaults to that of a Go input, or main")
+	out := flag.String("o", "", "output file; defaults to <type>_repo.go next to the input")
+	flag.Var(&indexes, "index", "indexed field, by Go or JSON name (repeatable)")
+	fields := flag.Bool("fields", false, "also generate <type>Fields for typed query filters")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	input := flag.Arg(0)
+
+	var m *model
+	var err error
+	if filepath.Ext(input) == ".go" {
+		m, err = fromGo(input, *typeName)
+	} else {
+		m, err = fromSchema(input, *typeName)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *pkg != "" {
+		m.Package = *pkg
+	}
+	for _, name := range indexes {
+		found := false
+		for i := range m.Fields {
+			if m.Fields[i].Name == name || m.Fields[i].JSON == name {
+				m.Fields[i].Index, found = true, true
+			}
+		}
+		if !found {
+			log.Fatalf("-index %s: %s has no such field", name, m.Type)
+		}
+	}
+	if *fields {
+		m.FieldsDecl = fieldsDecl(m)
+	}
+	m.Plural = plural(m.Type)
+	m.Collection = *collection
+	if m.Collection == "" {
+		m.Collection = strings.ToLower(m.Plural)
+	}
+
+	src, err := generate(m)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *out == "" {
+		*out = filepath.Join(filepath.Dir(input), strings.ToLower(m.Type)+"_repo.go")
+	}
+	if err := os.WriteFile(*out, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// fromGo reads the struct type typeName declared in a Go file.
+func fromGo(path, typeName string) (*model, error) {
+	if typeName == "" {
+		return nil, fmt.Errorf("-type is required for Go input")
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, path, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	m := &model{Package: f.Name.Name, Type: typeName, specs: structTypes(f)}
+	st := m.specs[typeName]
+	if st == nil {
+		return nil, fmt.Errorf("%s: no struct type %s", path, typeName)
+	}
+	m.st = st
+	m.imports = make(map[string]string)
+	for _, imp := range f.Imports {
+		path := strings.Trim(imp.Path.Value, `"`)
+		name := filepath.Base(path)
+		if imp.Name != nil {
+			name = imp.Name.Name
+		}
+		m.imports[name] = path
+	}
+	for _, fl := range st.Fields.List {
+		var tag reflect.StructTag
+		if fl.Tag != nil {
+			tag = reflect.StructTag(strings.Trim(fl.Tag.Value, "`"))
+		}
+		jsonName, opts, _ := strings.Cut(tag.Get("json"), ",")
+		if jsonName == "-" {
+			continue
+		}
+		for _, name := range fl.Names {
+			if !name.IsExported() {
+				continue
+			}
+			f := field{
+				Name:     name.Name,
+				JSON:     jsonName,
+				Type:     types.ExprString(fl.Type),
+				Optional: strings.Contains(opts, "omitempty"),
+				Index:    tag.Get("db") == "index",
+			}
+			if f.JSON == "" {
+				f.JSON = name.Name
+			}
+			m.Fields = append(m.Fields, f)
+		}
+	}
+	return m, nil
+}
+
+// fromSchema reads a JSON Schema describing an object and generates the
+// struct type for it.
+func fromSchema(path, typeName string) (*model, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(b, &schema); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if typeName == "" {
+		title, _ := schema["title"].(string)
+		if title == "" {
+			return nil, fmt.Errorf("%s: no title, use -type", path)
+		}
+		typeName = goName(singular(title))
+	}
+	if t, _ := schema["type"].(string); t != "object" {
+		return nil, fmt.Errorf("%s: schema does not describe an object", path)
+	}
+	m := &model{Package: "main", Type: typeName}
+	required := stringSet(schema["required"])
+	props, _ := schema["properties"].(map[string]interface{})
+	for _, name := range sortedKeys(props) {
+		prop, _ := props[name].(map[string]interface{})
+		index, _ := prop["x-index"].(bool)
+		m.Fields = append(m.Fields, field{
+			Name:     goName(name),
+			JSON:     name,
+			Type:     schemaType(prop),
+			Optional: !required[name],
+			Index:    index,
+		})
+	}
+	m.Decl = structType(m.Fields)
+	f, err := parser.ParseFile(token.NewFileSet(), "", "package p\ntype "+typeName+" "+m.Decl, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	m.specs = structTypes(f)
+	m.st = m.specs[typeName]
+	return m, nil
+}
+
+// structTypes returns the struct types declared in a file, by name.
+func structTypes(f *ast.File) map[string]*ast.StructType {
+	specs := make(map[string]*ast.StructType)
+	ast.Inspect(f, func(n ast.Node) bool {
+		if ts, ok := n.(*ast.TypeSpec); ok {
+			if st, ok := ts.Type.(*ast.StructType); ok {
+				specs[ts.Name.Name] = st
+			}
+		}
+		return true
+	})
+	return specs
+}
+
+// fieldRefs returns the fields of st, at the JSON path prefix, recursing
+// into the struct types written inline or declared in the same file.
+// Embedded structs without a JSON name are flattened, as encoding/json
+// does. seen holds the named types on the way, to stop at recursive ones.
+func fieldRefs(m *model, st *ast.StructType, prefix string, seen map[string]bool) []fieldRef {
+	var refs []fieldRef
+	for _, fl := range st.Fields.List {
+		var tag reflect.StructTag
+		if fl.Tag != nil {
+			tag = reflect.StructTag(strings.Trim(fl.Tag.Value, "`"))
+		}
+		jsonName, _, _ := strings.Cut(tag.Get("json"), ",")
+		if jsonName == "-" {
+			continue
+		}
+		typ := fl.Type
+		if star, ok := typ.(*ast.StarExpr); ok {
+			typ = star.X
+		}
+		sub, _ := typ.(*ast.StructType)
+		subName := ""
+		if id, ok := typ.(*ast.Ident); ok && m.specs[id.Name] != nil && !seen[id.Name] {
+			sub, subName = m.specs[id.Name], id.Name
+		}
+		walk := func(prefix string) []fieldRef {
+			if subName != "" {
+				seen[subName] = true
+				defer delete(seen, subName)
+			}
+			return fieldRefs(m, sub, prefix, seen)
+		}
+		if len(fl.Names) == 0 {
+			if sub != nil && jsonName == "" {
+				refs = append(refs, walk(prefix)...)
+			}
+			continue
+		}
+		for _, name := range fl.Names {
+			if !name.IsExported() {
+				continue
+			}
+			ref := fieldRef{Name: name.Name, Path: prefix + jsonName}
+			if jsonName == "" {
+				ref.Path = prefix + name.Name
+			}
+			if sub != nil {
+				ref.Sub = walk(ref.Path + ".")
+			} else {
+				ref.Type = types.ExprString(typ)
+				m.use(typ)
+			}
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// use records the imports the type expression refers to.
+func (m *model) use(typ ast.Expr) {
+	ast.Inspect(typ, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok && m.imports[id.Name] != "" {
+				if m.uses == nil {
+					m.uses = make(map[string]bool)
+				}
+				m.uses[m.imports[id.Name]] = true
+			}
+		}
+		return true
+	})
+}
+
+// fieldsDecl declares UserFields and the struct types it is made of,
+// named after the path of Go names leading to them, such as
+// userAddressFields.
+func fieldsDecl(m *model) string {
+	var decls []string
+	var declare func(typeName string, refs []fieldRef) string
+	declare = func(typeName string, refs []fieldRef) string {
+		i := len(decls)
+		decls = append(decls, "")
+		var fields, value strings.Builder
+		for _, r := range refs {
+			if r.Sub == nil {
+				fmt.Fprintf(&fields, "%s TypedField[%s]\n", r.Name, r.Type)
+				fmt.Fprintf(&value, "%s: NewTypedField[%s](%q),\n", r.Name, r.Type, r.Path)
+				continue
+			}
+			sub := strings.TrimSuffix(typeName, "Fields") + r.Name + "Fields"
+			fmt.Fprintf(&fields, "%s %s\n", r.Name, sub)
+			fmt.Fprintf(&value, "%s: %s,\n", r.Name, declare(sub, r.Sub))
+		}
+		decls[i] = fmt.Sprintf("\ntype %s struct {\n%s}\n", typeName, fields.String())
+		return fmt.Sprintf("%s{\n%s}", typeName, value.String())
+	}
+	first, size := utf8.DecodeRuneInString(m.Type)
+	root := string(unicode.ToLower(first)) + m.Type[size:] + "Fields"
+	value := declare(root, fieldRefs(m, m.st, "", map[string]bool{m.Type: true}))
+	return fmt.Sprintf("\n// %sFields names the fields of %s, for filters the compiler checks.\nvar %sFields = %s\n%s",
+		m.Type, m.Type, m.Type, value, strings.Join(decls, ""))
+}
+
+// schemaType returns the Go type for a schema.
+func schemaType(schema map[string]interface{}) string {
+	var kinds []string
+	nullable := false
+	switch t := schema["type"].(type) {
+	case string:
+		kinds = []string{t}
+	case []interface{}:
+		for _, k := range t {
+			if k == "null" {
+				nullable = true
+			} else if s, ok := k.(string); ok {
+				kinds = append(kinds, s)
+			}
+		}
+	}
+	if len(kinds) == 2 && kinds[0] == "integer" && kinds[1] == "number" {
+		kinds = kinds[1:]
+	}
+	if len(kinds) != 1 {
+		return "interface{}"
+	}
+	var t string
+	switch kinds[0] {
+	case "string":
+		t = "string"
+	case "integer":
+		t = "int64"
+	case "number":
+		t = "float64"
+	case "boolean":
+		t = "bool"
+	case "array":
+		items, _ := schema["items"].(map[string]interface{})
+		return "[]" + schemaType(items)
+	case "object":
+		props, ok := schema["properties"].(map[string]interface{})
+		if !ok {
+			t = "map[string]interface{}"
+			break
+		}
+		required := stringSet(schema["required"])
+		var fields []field
+		for _, name := range sortedKeys(props) {
+			prop, _ := props[name].(map[string]interface{})
+			fields = append(fields, field{Name: goName(name), JSON: name, Type: schemaType(prop), Optional: !required[name]})
+		}
+		t = structType(fields)
+	default:
+		return "interface{}"
+	}
+	if nullable {
+		return "*" + t
+	}
+	return t
+}
+
+func structType(fields []field) string {
+	var sb strings.Builder
+	sb.WriteString("struct {\n")
+	for _, f := range fields {
+		tag := f.JSON
+		if f.Optional {
+			tag += ",omitempty"
+		}
+		fmt.Fprintf(&sb, "%s %s `json:%q`\n", f.Name, f.Type, tag)
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
+
+var repo = template.Must(template.New("repo").Parse(`// Code generated by dbgen; DO NOT EDIT.
+
+package {{.Package}}
+
+{{- with .Imports}}
+{{- if eq (len .) 1}}
+
+import {{printf "%q" (index . 0)}}
+{{- else}}
+
+import (
+{{- range .}}
+	{{printf "%q" .}}
+{{- end}}
+)
+{{- end}}
+{{- end}}
+
+{{- if .Decl}}
+
+// {{.Type}} is a record of the {{printf "%q" .Collection}} collection.
+type {{.Type}} {{.Decl}}
+{{- end}}
+
+{{- if .FieldsDecl}}
+{{.FieldsDecl}}
+{{- end}}
+
+// {{.Type}}Store is the subset of the database driver {{.Type}}Repo needs.
+type {{.Type}}Store interface {
+	Read(collection, resource string, v interface{}) error
+	Write(collection, resource string, v interface{}) error
+	Delete(collection, resource string) error
+	Keys(collection string) ([]string, error)
+{{- if .Indexes}}
+	Lookup(collection, name string, value interface{}) ([]string, error)
+{{- end}}
+}
+
+// {{.Type}}Repo reads and writes {{.Type}} records in the {{printf "%q" .Collection}} collection.
+type {{.Type}}Repo struct {
+	db {{.Type}}Store
+}
+
+// New{{.Type}}Repo returns a repository of the {{.Type}} records of db.
+func New{{.Type}}Repo(db {{.Type}}Store) *{{.Type}}Repo {
+	return &{{.Type}}Repo{db: db}
+}
+
+// Get{{.Type}} reads the {{.Type}} stored under key.
+func (r *{{.Type}}Repo) Get{{.Type}}(key string) ({{.Type}}, error) {
+	var v {{.Type}}
+	err := r.db.Read({{printf "%q" .Collection}}, key, &v)
+	return v, err
+}
+
+// Put{{.Type}} stores v under key.
+func (r *{{.Type}}Repo) Put{{.Type}}(key string, v {{.Type}}) error {
+	return r.db.Write({{printf "%q" .Collection}}, key, v)
+}
+
+// Delete{{.Type}} removes the {{.Type}} stored under key.
+func (r *{{.Type}}Repo) Delete{{.Type}}(key string) error {
+	return r.db.Delete({{printf "%q" .Collection}}, key)
+}
+
+// All{{.Plural}} returns every {{.Type}}, in key order.
+func (r *{{.Type}}Repo) All{{.Plural}}() ([]{{.Type}}, error) {
+	keys, err := r.db.Keys({{printf "%q" .Collection}})
+	if err != nil {
+		return nil, err
+	}
+	return r.read(keys)
+}
+{{range .Indexes}}
+// Find{{$.Plural}}By{{.Name}} returns the {{$.Plural}} whose {{.Name}} is value, using
+// the {{printf "%q" .JSON}} index.
+func (r *{{$.Type}}Repo) Find{{$.Plural}}By{{.Name}}(value {{.Type}}) ([]{{$.Type}}, error) {
+	keys, err := r.db.Lookup({{printf "%q" $.Collection}}, {{printf "%q" .JSON}}, value)
+	if err != nil {
+		return nil, fmt.Errorf("find {{$.Plural}} by {{.Name}}: %w", err)
+	}
+	return r.read(keys)
+}
+{{end}}
+func (r *{{.Type}}Repo) read(keys []string) ([]{{.Type}}, error) {
+	out := make([]{{.Type}}, len(keys))
+	for i, key := range keys {
+		if err := r.db.Read({{printf "%q" .Collection}}, key, &out[i]); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+`))
+
+func generate(m *model) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := repo.Execute(&buf, m); err != nil {
+		return nil, err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting generated code: %v\n%s", err, buf.Bytes())
+	}
+	return src, nil
+}
+
+// goName turns a JSON name into an exported Go identifier.
+func goName(s string) string {
+	var sb strings.Builder
+	upper := true
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if sb.Len() == 0 && !unicode.IsLetter(r) {
+			sb.WriteString("F")
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		sb.WriteRune(r)
+	}
+	if sb.Len() == 0 {
+		return "F"
+	}
+	return sb.String()
+}
+
+func plural(s string) string {
+	switch {
+	case strings.HasSuffix(s, "y") && !strings.HasSuffix(s, "ey"):
+		return s[:len(s)-1] + "ies"
+	case strings.HasSuffix(s, "s"), strings.HasSuffix(s, "x"), strings.HasSuffix(s, "ch"), strings.HasSuffix(s, "sh"):
+		return s + "es"
+	}
+	return s + "s"
+}
+
+func singular(s string) string {
+	switch {
+	case strings.HasSuffix(s, "ies"):
+		return s[:len(s)-3] + "y"
+	case strings.HasSuffix(s, "s") && !strings.HasSuffix(s, "ss"):
+		return s[:len(s)-1]
+	}
+	return s
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func stringSet(v interface{}) map[string]bool {
+	set := make(map[string]bool)
+	list, _ := v.([]interface{})
+	for _, s := range list {
+		if s, ok := s.(string); ok {
+			set[s] = true
+		}
+	}
+	return set
+}
+
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(s string) error { *l = append(*l, s); return nil }
@@ -0,0 +1,179 @@
+// Package dbtest helps testing code built on the database: it seeds
+// collections from Go values or JSON fixtures, asserts their contents and
+// compares them against golden files. Run tests with -update to rewrite
+// golden files from the current contents.
+package dbtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite dbtest golden files")
+
+// Store is the subset of the database driver the helpers need.
+type Store interface {
+	Write(collection, resource string, v interface{}) error
+	Read(collection, resource string, v interface{}) error
+	Keys(collection string) ([]string, error)
+}
+
+// Open gives a test its own empty database by calling open with a fresh
+// temporary directory, which is removed when the test ends.
+func Open(t testing.TB, open func(dir string) (Store, error)) Store {
+	t.Helper()
+	db, err := open(t.TempDir())
+	if err != nil {
+		t.Fatalf("dbtest: open database: %v", err)
+	}
+	return db
+}
+
+// Seed writes records, keyed by resource name, to collection.
+func Seed(t testing.TB, db Store, collection string, records map[string]interface{}) {
+	t.Helper()
+	for _, key := range sortedKeys(records) {
+		if err := db.Write(collection, key, records[key]); err != nil {
+			t.Fatalf("dbtest: seed %s/%s: %v", collection, key, err)
+		}
+	}
+}
+
+// SeedFS writes the fixtures found in fsys, typically an embed.FS. Each
+// file matching pattern (e.g. "testdata/*.json") holds a JSON object
+// mapping resource names to records and seeds the collection named after
+// the file without its extension.
+func SeedFS(t testing.TB, db Store, fsys fs.FS, pattern string) {
+	t.Helper()
+	names, err := fs.Glob(fsys, pattern)
+	if err != nil {
+		t.Fatalf("dbtest: %v", err)
+	}
+	if len(names) == 0 {
+		t.Fatalf("dbtest: no fixtures match %q", pattern)
+	}
+	for _, name := range names {
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatalf("dbtest: %v", err)
+		}
+		var records map[string]json.RawMessage
+		if err := json.Unmarshal(b, &records); err != nil {
+			t.Fatalf("dbtest: fixture %s: %v", name, err)
+		}
+		collection := strings.TrimSuffix(path.Base(name), path.Ext(name))
+		seed := make(map[string]interface{}, len(records))
+		for key, rec := range records {
+			seed[key] = rec
+		}
+		Seed(t, db, collection, seed)
+	}
+}
+
+// Contents returns the records of collection keyed by resource name, as
+// generic JSON values.
+func Contents(t testing.TB, db Store, collection string) map[string]interface{} {
+	t.Helper()
+	keys, err := db.Keys(collection)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("dbtest: list %s: %v", collection, err)
+	}
+	got := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		var v interface{}
+		if err := db.Read(collection, key, &v); err != nil {
+			t.Fatalf("dbtest: read %s/%s: %v", collection, key, err)
+		}
+		got[key] = v
+	}
+	return got
+}
+
+// AssertCollection fails the test unless collection holds exactly the
+// records in want, keyed by resource name. Records are compared as JSON, so
+// want may hold structs, maps or raw JSON.
+func AssertCollection(t testing.TB, db Store, collection string, want map[string]interface{}) {
+	t.Helper()
+	got := Contents(t, db, collection)
+	for _, key := range sortedKeys(want) {
+		g, ok := got[key]
+		if !ok {
+			t.Errorf("dbtest: %s/%s is missing", collection, key)
+			continue
+		}
+		w, err := normalize(want[key])
+		if err != nil {
+			t.Fatalf("dbtest: %s/%s: %v", collection, key, err)
+		}
+		if !reflect.DeepEqual(g, w) {
+			t.Errorf("dbtest: %s/%s = %s, want %s", collection, key, marshal(g), marshal(w))
+		}
+	}
+	for _, key := range sortedKeys(got) {
+		if _, ok := want[key]; !ok {
+			t.Errorf("dbtest: unexpected record %s/%s = %s", collection, key, marshal(got[key]))
+		}
+	}
+}
+
+// Golden compares the contents of collection with the golden file at
+// file, rewriting it instead when tests run with -update.
+func Golden(t testing.TB, db Store, collection, file string) {
+	t.Helper()
+	got, err := json.MarshalIndent(Contents(t, db, collection), "", "\t")
+	if err != nil {
+		t.Fatalf("dbtest: %v", err)
+	}
+	got = append(got, '\n')
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatalf("dbtest: %v", err)
+		}
+		if err := os.WriteFile(file, got, 0644); err != nil {
+			t.Fatalf("dbtest: %v", err)
+		}
+		return
+	}
+	want, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("dbtest: %v (run with -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("dbtest: collection %s differs from %s (run with -update to accept):\ngot:\n%s\nwant:\n%s", collection, file, got, want)
+	}
+}
+
+// normalize round-trips v through JSON so it compares equal to records
+// read back from the database.
+func normalize(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	err = json.Unmarshal(b, &out)
+	return out, err
+}
+
+func marshal(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,193 @@
+package dbtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// FuzzNames fuzzes the collection and resource names a Store accepts.
+// Call it from a fuzz test in the package under test:
+//
+//	func FuzzNames(f *testing.F) { dbtest.FuzzNames(f, open) }
+//
+// Every write must either fail or be read back intact and listed by Keys,
+// and no write, accepted or not, may create files outside the database
+// directory.
+func FuzzNames(f *testing.F, open func(dir string) (Store, error)) {
+	for _, name := range []string{"users", "a b", "ünïcode", "..", "../escape", "a/b", `a\b`, ".hidden", "", "x.json", "CON", "\x00"} {
+		f.Add(name, name)
+		f.Add("users", name)
+		f.Add(name, "key")
+	}
+	root := f.TempDir()
+	db := openIn(f, root, open)
+	f.Fuzz(func(t *testing.T, collection, resource string) {
+		err := db.Write(collection, resource, map[string]string{"Name": resource})
+		checkContained(t, root)
+		if err != nil {
+			return
+		}
+		CheckRecord(t, db, collection, resource, map[string]string{"Name": resource})
+	})
+}
+
+// FuzzValues fuzzes the JSON values a Store round-trips. Each valid JSON
+// input is written as a record and must read back equal to itself, while
+// a neighbouring record stays untouched.
+func FuzzValues(f *testing.F, open func(dir string) (Store, error)) {
+	for _, seed := range []string{`{}`, `{"a":1}`, `{"a":[1,"2",null,true]}`, `{"nested":{"deep":{"x":-0.5e10}}}`, `{"s":" <&>"}`, `[]`, `"text"`, `0`, `null`} {
+		f.Add([]byte(seed))
+	}
+	root := f.TempDir()
+	db := openIn(f, root, open)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var want interface{}
+		if err := json.Unmarshal(data, &want); err != nil {
+			t.Skip()
+		}
+		CheckIsolation(t, db, "fuzz", "value", json.RawMessage(data))
+	})
+}
+
+// Properties checks random records against a fresh Store: n random JSON
+// documents under random printable names must round-trip, and writing one
+// must leave the others unchanged. The seed is logged so a failure can be
+// replayed with rand.NewSource.
+func Properties(t *testing.T, open func(dir string) (Store, error), n int, seed int64) {
+	t.Helper()
+	t.Logf("dbtest: properties with seed %d", seed)
+	rng := rand.New(rand.NewSource(seed))
+	db := Open(t, open)
+	for i := 0; i < n; i++ {
+		collection := fmt.Sprintf("c%d", rng.Intn(4))
+		key := randomName(rng)
+		CheckIsolation(t, db, collection, key, randomDocument(rng, 3))
+	}
+}
+
+// CheckRecord fails the test unless collection/resource reads back as
+// want, compared as JSON, and is listed by Keys.
+func CheckRecord(t testing.TB, db Store, collection, resource string, want interface{}) {
+	t.Helper()
+	w, err := normalize(want)
+	if err != nil {
+		t.Fatalf("dbtest: %s/%s: %v", collection, resource, err)
+	}
+	var got interface{}
+	if err := db.Read(collection, resource, &got); err != nil {
+		t.Fatalf("dbtest: read back %q/%q: %v", collection, resource, err)
+	}
+	if !reflect.DeepEqual(got, w) {
+		t.Fatalf("dbtest: %q/%q = %s, want %s", collection, resource, marshal(got), marshal(w))
+	}
+	keys, err := db.Keys(collection)
+	if err != nil {
+		t.Fatalf("dbtest: list %q: %v", collection, err)
+	}
+	for _, key := range keys {
+		if key == resource {
+			return
+		}
+	}
+	t.Fatalf("dbtest: Keys(%q) does not list %q", collection, resource)
+}
+
+// CheckIsolation writes v to collection/resource and fails the test unless
+// it reads back intact while every other record of the collection keeps
+// its contents.
+func CheckIsolation(t testing.TB, db Store, collection, resource string, v interface{}) {
+	t.Helper()
+	before := Contents(t, db, collection)
+	delete(before, resource)
+	if err := db.Write(collection, resource, v); err != nil {
+		t.Fatalf("dbtest: write %q/%q: %v", collection, resource, err)
+	}
+	CheckRecord(t, db, collection, resource, v)
+	after := Contents(t, db, collection)
+	for key, want := range before {
+		if got, ok := after[key]; !ok || !reflect.DeepEqual(got, want) {
+			t.Fatalf("dbtest: writing %q/%q changed %q/%q from %s to %s", collection, resource, collection, key, marshal(want), marshal(got))
+		}
+	}
+}
+
+// openIn opens a Store in a "db" directory under root, so that
+// checkContained can tell files written outside it.
+func openIn(tb testing.TB, root string, open func(dir string) (Store, error)) Store {
+	db, err := open(filepath.Join(root, "db"))
+	if err != nil {
+		tb.Fatalf("dbtest: open database: %v", err)
+	}
+	return db
+}
+
+// checkContained fails the test if root holds anything but the database
+// directory.
+func checkContained(t testing.TB, root string) {
+	t.Helper()
+	entries, err := os.ReadDir(root)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("dbtest: %v", err)
+	}
+	for _, e := range entries {
+		if e.Name() != "db" {
+			t.Fatalf("dbtest: a write escaped the database directory: %s", filepath.Join(root, e.Name()))
+		}
+	}
+}
+
+func randomName(rng *rand.Rand) string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_ .~é"
+	runes := []rune(alphabet)
+	var sb strings.Builder
+	for n := 1 + rng.Intn(12); sb.Len() == 0 || utf8.RuneCountInString(sb.String()) < n; {
+		r := runes[rng.Intn(len(runes))]
+		if sb.Len() == 0 && (r == '.' || r == ' ') {
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// randomDocument returns a random JSON object nested up to depth levels.
+func randomDocument(rng *rand.Rand, depth int) map[string]interface{} {
+	doc := make(map[string]interface{})
+	for i := rng.Intn(6); i >= 0; i-- {
+		doc[randomName(rng)] = randomValue(rng, depth)
+	}
+	return doc
+}
+
+func randomValue(rng *rand.Rand, depth int) interface{} {
+	kinds := 5
+	if depth > 0 {
+		kinds = 7
+	}
+	switch rng.Intn(kinds) {
+	case 0:
+		return nil
+	case 1:
+		return rng.Intn(2) == 0
+	case 2:
+		return rng.NormFloat64() * 1e6
+	case 3:
+		return rng.Int63n(1<<53) - 1<<52
+	case 4:
+		return randomName(rng) + "\"\\\n\t<>& "
+	case 5:
+		items := make([]interface{}, rng.Intn(4))
+		for i := range items {
+			items[i] = randomValue(rng, depth-1)
+		}
+		return items
+	}
+	return randomDocument(rng, depth-1)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// DuplicateSet is a group of records of a collection that hold equal
+// values in every field FindDuplicates compared.
+type DuplicateSet struct {
+	// Values are the shared values, one per field, in the order the
+	// fields were given.
+	Values []interface{}
+	// Keys are the keys of the records of the set, in key order.
+	Keys []string
+}
+
+// DuplicateResolver decides what becomes of a set of duplicates, given
+// the set and its records in key order. It returns the key of the record
+// to keep, and the value to store under it, such as the records merged
+// into one, or nil to leave the kept record unchanged. The other records
+// of the set are deleted. An empty keep leaves the set alone. Resolvers
+// run with the collection locked and must not use the driver on it.
+type DuplicateResolver func(set DuplicateSet, records []Record[json.RawMessage]) (keep string, merged interface{}, err error)
+
+// FindDuplicates groups the records of collection by the values of the
+// dotted field paths fields and returns every group of two records or
+// more, in the key order of their first record. Records lacking one of
+// the fields belong to no group. Values compare the way filters compare
+// them for equality, so 1 and 1.0 are duplicates but "Ada" and "ada" are
+// not. Like Find, it sees records after masking.
+func (d *Driver) FindDuplicates(collection string, fields ...string) ([]DuplicateSet, error) {
+	if err := checkCollection(collection); err != nil {
+		return nil, err
+	}
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+	sets, _, err := d.duplicates(collection, fields, true)
+	return sets, err
+}
+
+// ResolveDuplicates finds the duplicates of collection like
+// FindDuplicates and hands each set to resolve, deleting the records it
+// does not keep. It returns the number of records deleted. The first
+// error stops it; the sets resolved until then stay resolved. Unlike
+// FindDuplicates, it compares and hands resolvers the records as stored,
+// before masking, since what they merge is written back.
+func (d *Driver) ResolveDuplicates(collection string, resolve DuplicateResolver, fields ...string) (int, error) {
+	if err := checkCollection(collection); err != nil {
+		return 0, err
+	}
+	d.settle()
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	sets, records, err := d.duplicates(collection, fields, false)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, set := range sets {
+		recs := make([]Record[json.RawMessage], len(set.Keys))
+		for i, key := range set.Keys {
+			recs[i] = records[key]
+		}
+		keep, merged, err := resolve(set, recs)
+		if err != nil {
+			return n, err
+		}
+		if keep == "" {
+			continue
+		}
+		if _, ok := records[keep]; !ok {
+			return n, fmt.Errorf("duplicate resolver kept %q, which is not in the set %s", keep, strings.Join(set.Keys, ", "))
+		}
+		if merged != nil {
+			b, err := d.encode(merged)
+			if err != nil {
+				return n, err
+			}
+			if err := d.write(collection, keep, b); err != nil {
+				return n, err
+			}
+		}
+		for _, key := range set.Keys {
+			if key == keep {
+				continue
+			}
+			if err := d.delete(collection, key); err != nil {
+				return n, err
+			}
+			n++
+		}
+		d.log.Debug("Resolved %d duplicates of '%s/%s'\n", len(set.Keys)-1, collection, keep)
+	}
+	return n, nil
+}
+
+// duplicates returns the duplicate sets of collection, and the records
+// in them by key, masked if masked is set. The collection lock must be
+// held.
+func (d *Driver) duplicates(collection string, fields []string, masked bool) ([]DuplicateSet, map[string]Record[json.RawMessage], error) {
+	if len(fields) == 0 {
+		return nil, nil, fmt.Errorf("no fields to find duplicates by")
+	}
+	records, err := d.scan(collection)
+	if err != nil {
+		return nil, nil, err
+	}
+	groups := make(map[string]*DuplicateSet)
+	var order []string
+	byKey := make(map[string]Record[json.RawMessage])
+	for _, r := range records {
+		if masked {
+			if r.Value, err = d.mask(collection, r.Value); err != nil {
+				return nil, nil, err
+			}
+		}
+		doc, err := decodeDoc(r.Value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s/%s: %w", collection, r.Key, err)
+		}
+		values := make([]interface{}, len(fields))
+		ivs := make([]string, len(fields))
+		complete := true
+		for i, field := range fields {
+			v, ok := lookup(doc, field)
+			if !ok {
+				complete = false
+				break
+			}
+			values[i], ivs[i] = v, indexValue(v)
+		}
+		if !complete {
+			continue
+		}
+		// The values are prefixed with their length so that no two
+		// tuples join to the same group key.
+		var gk strings.Builder
+		for _, iv := range ivs {
+			fmt.Fprintf(&gk, "%d:%s", len(iv), iv)
+		}
+		g, ok := groups[gk.String()]
+		if !ok {
+			g = &DuplicateSet{Values: values}
+			groups[gk.String()] = g
+			order = append(order, gk.String())
+		}
+		g.Keys = append(g.Keys, r.Key)
+		byKey[r.Key] = r
+	}
+
+	var sets []DuplicateSet
+	for _, gk := range order {
+		if g := groups[gk]; len(g.Keys) > 1 {
+			sets = append(sets, *g)
+		}
+	}
+	return sets, byKey, nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// FieldChange is one difference between two versions of a document. Path
+// is the dotted path of the field, with array indexes as elements (e.g.
+// "Tags.2"); an empty Path means the documents differ as a whole. Op is
+// "add", "remove" or "change".
+type FieldChange struct {
+	Path string
+	Op   string
+	Old  interface{} `json:",omitempty"`
+	New  interface{} `json:",omitempty"`
+}
+
+// Change describes a change to one record between two versions of a
+// collection. Op is "create", "update" or "delete", and Diff lists the
+// fields that changed.
+type Change struct {
+	Collection string
+	Key        string
+	Op         string
+	Diff       []FieldChange
+}
+
+// Diff returns the field changes that lead from other to the current
+// record key of collection, so that other is the older version. other may
+// be a *Snapshot holding the record, the stored bytes of a version as
+// []byte or json.RawMessage, or any value, which is encoded like Write
+// encodes it; nil stands for an empty document. Both versions are masked
+// before they are compared.
+func (d *Driver) Diff(collection, key string, other interface{}) ([]FieldChange, error) {
+	if err := d.checkKey(collection, key, "diff record"); err != nil {
+		return nil, err
+	}
+	cur, err := d.rawRecord(collection, key)
+	if err != nil {
+		return nil, err
+	}
+	var old []byte
+	od, oc := d, collection
+	switch o := other.(type) {
+	case nil:
+	case *Snapshot:
+		if old, err = o.raw(key); err != nil {
+			return nil, err
+		}
+		od, oc = o.d, o.collection
+	case json.RawMessage:
+		old = o
+	case []byte:
+		old = o
+	default:
+		if old, err = d.encode(o); err != nil {
+			return nil, err
+		}
+	}
+	a, err := od.maskedDoc(oc, old)
+	if err != nil {
+		return nil, err
+	}
+	b, err := d.maskedDoc(collection, cur)
+	if err != nil {
+		return nil, err
+	}
+	return diffDocs(a, b), nil
+}
+
+// DiffSnapshots returns the records created, updated and deleted between
+// snapshot a and snapshot b, in key order, with field-level diffs. The
+// snapshots may come from different collections or drivers, for instance
+// a backup restored into a scratch directory and the live database; the
+// changes are reported under the collection of b.
+func (d *Driver) DiffSnapshots(a, b *Snapshot) ([]Change, error) {
+	keys := make(map[string]bool, len(a.keys)+len(b.keys))
+	for _, key := range a.keys {
+		keys[key] = true
+	}
+	for _, key := range b.keys {
+		keys[key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	var changes []Change
+	for _, key := range sorted {
+		old, err := snapshotRaw(a, key)
+		if err != nil {
+			return nil, err
+		}
+		cur, err := snapshotRaw(b, key)
+		if err != nil {
+			return nil, err
+		}
+		c := Change{Collection: b.collection, Key: key, Op: "update"}
+		switch {
+		case old == nil:
+			c.Op = "create"
+		case cur == nil:
+			c.Op = "delete"
+		}
+		x, err := a.d.maskedDoc(a.collection, old)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b.d.maskedDoc(b.collection, cur)
+		if err != nil {
+			return nil, err
+		}
+		if c.Diff = diffDocs(x, y); c.Op == "update" && len(c.Diff) == 0 {
+			continue
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// snapshotRaw returns the bytes of key in s, or nil if s does not hold it.
+func snapshotRaw(s *Snapshot, key string) ([]byte, error) {
+	i := sort.SearchStrings(s.keys, key)
+	if i == len(s.keys) || s.keys[i] != key {
+		return nil, nil
+	}
+	return s.raw(key)
+}
+
+// rawRecord returns the stored bytes of a record, queued writes included.
+func (d *Driver) rawRecord(collection, key string) ([]byte, error) {
+	if b, ok := d.pendingRecord(collection, key); ok {
+		if b == nil {
+			return nil, notExist(d.recordPath(collection, key))
+		}
+		return b, nil
+	}
+	return os.ReadFile(d.recordPath(collection, key))
+}
+
+// diffRaw returns the field changes between two stored records of
+// collection, after masking. A nil record counts as an empty document.
+func (d *Driver) diffRaw(collection string, a, b []byte) ([]FieldChange, error) {
+	x, err := d.maskedDoc(collection, a)
+	if err != nil {
+		return nil, err
+	}
+	y, err := d.maskedDoc(collection, b)
+	if err != nil {
+		return nil, err
+	}
+	return diffDocs(x, y), nil
+}
+
+// maskedDoc masks a stored record of collection and decodes it for
+// diffDocs. A nil record decodes to an empty document.
+func (d *Driver) maskedDoc(collection string, raw []byte) (interface{}, error) {
+	if raw == nil {
+		return map[string]interface{}{}, nil
+	}
+	masked, err := d.mask(collection, raw)
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON(masked)
+}
+
+// decodeJSON decodes any JSON value the way decodeDoc decodes documents.
+func decodeJSON(b []byte) (interface{}, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// diffDocs returns the differences from a to b, decoded documents as
+// produced by decodeDoc, in path order.
+func diffDocs(a, b interface{}) []FieldChange {
+	var changes []FieldChange
+	diffValues("", a, b, &changes)
+	return changes
+}
+
+func diffValues(path string, a, b interface{}, changes *[]FieldChange) {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := joinPath(path, k)
+			old, inA := av[k]
+			new, inB := bv[k]
+			switch {
+			case !inA:
+				*changes = append(*changes, FieldChange{Path: p, Op: "add", New: new})
+			case !inB:
+				*changes = append(*changes, FieldChange{Path: p, Op: "remove", Old: old})
+			default:
+				diffValues(p, old, new, changes)
+			}
+		}
+		return
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(av) || i < len(bv); i++ {
+			p := joinPath(path, fmt.Sprint(i))
+			switch {
+			case i >= len(av):
+				*changes = append(*changes, FieldChange{Path: p, Op: "add", New: bv[i]})
+			case i >= len(bv):
+				*changes = append(*changes, FieldChange{Path: p, Op: "remove", Old: av[i]})
+			default:
+				diffValues(p, av[i], bv[i], changes)
+			}
+		}
+		return
+	}
+	if !sameValue(a, b) {
+		*changes = append(*changes, FieldChange{Path: path, Op: "change", Old: a, New: b})
+	}
+}
+
+// sameValue compares two decoded scalars or mismatched values. Numbers
+// are equal when they denote the same value, whatever their spelling.
+func sameValue(a, b interface{}) bool {
+	if x, ok := toNumber(a); ok {
+		if y, ok := toNumber(b); ok {
+			return x == y
+		}
+	}
+	switch a.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	switch b.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	return a == b
+}
+
+func joinPath(path, elem string) string {
+	if path == "" {
+		return elem
+	}
+	return path + "." + elem
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// errLocked is returned by lockFile when another open file holds the
+// lock.
+var errLocked = errors.New("locked")
+
+// openDirs are the database directories opened by drivers of this
+// process, which catches a second open even where lockFile cannot.
+var openDirs = struct {
+	mu   sync.Mutex
+	dirs map[string]bool
+}{dirs: make(map[string]bool)}
+
+// dirLock is the exclusive hold of a driver on its database directory:
+// the directory is registered in openDirs and, where the platform
+// supports it, the LOCK file of the metadata directory is locked, with
+// the ID of the holding process written into it.
+type dirLock struct {
+	dir string
+	f   *os.File
+}
+
+// lockDir takes the hold on dir, failing with ErrAlreadyOpen if another
+// driver has it.
+func (d *Driver) lockDir() (*dirLock, error) {
+	dir, err := filepath.Abs(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	openDirs.mu.Lock()
+	defer openDirs.mu.Unlock()
+	if openDirs.dirs[dir] {
+		return nil, fmt.Errorf("%w: %s is in use by another driver of this process", ErrAlreadyOpen, d.dir)
+	}
+	if err := os.MkdirAll(d.metaPath(), 0755); err != nil {
+		return nil, err
+	}
+	path := d.metaPath("LOCK")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if err != errLocked {
+			return nil, fmt.Errorf("locking %s: %w", path, err)
+		}
+		if b, rerr := os.ReadFile(path); rerr == nil {
+			if pid, perr := strconv.Atoi(string(bytes.TrimSpace(b))); perr == nil {
+				return nil, fmt.Errorf("%w: %s is in use by process %d", ErrAlreadyOpen, d.dir, pid)
+			}
+		}
+		return nil, fmt.Errorf("%w: %s is in use by another process", ErrAlreadyOpen, d.dir)
+	}
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	openDirs.dirs[dir] = true
+	return &dirLock{dir: dir, f: f}, nil
+}
+
+// release gives up the hold. The LOCK file is left in place; it is the
+// lock, not the file, that marks the directory in use.
+func (l *dirLock) release() {
+	if l == nil {
+		return
+	}
+	openDirs.mu.Lock()
+	defer openDirs.mu.Unlock()
+	unlockFile(l.f)
+	l.f.Close()
+	delete(openDirs.dirs, l.dir)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+// lockRegion is the offset of the byte range locked, past the process ID
+// written at the start of the file, which stays readable by the processes
+// that fail to take the lock.
+const lockRegion = 1 << 32
+
+func lockOverlapped() *syscall.Overlapped {
+	return &syscall.Overlapped{Offset: uint32(lockRegion & 0xffffffff), OffsetHigh: uint32(lockRegion >> 32)}
+}
+
+// lockFile takes an exclusive byte-range lock on f with LockFileEx.
+func lockFile(f *os.File) error {
+	r, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(lockOverlapped())))
+	if r != 0 {
+		return nil
+	}
+	if err == errorLockViolation {
+		return errLocked
+	}
+	return err
+}
+
+func unlockFile(f *os.File) error {
+	r, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(lockOverlapped())))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
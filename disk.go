@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// diskCheckInterval is how long a measurement of the free space is trusted.
+// In between, the space taken by each write is subtracted from it instead
+// of asking the filesystem again.
+const diskCheckInterval = time.Second
+
+// DiskAlert is passed to Options.OnDiskAlert when the free space of the
+// volume holding the database crosses a threshold.
+type DiskAlert struct {
+	// Dir is the database directory.
+	Dir string
+	// Free is the number of bytes available at the time of the alert.
+	Free int64
+	// Threshold is the limit that was crossed: Options.MinFreeSpace when
+	// Full is set, Options.FreeSpaceWarning otherwise.
+	Threshold int64
+	// Full is set when writes are being refused with ErrDiskFull.
+	Full bool
+	// Recovered is set when the free space is back above Threshold.
+	Recovered bool
+}
+
+// diskGuard keeps track of the free space of the database volume for
+// Options.MinFreeSpace and Options.FreeSpaceWarning.
+type diskGuard struct {
+	dir     string
+	min     int64
+	warn    int64
+	alert   func(DiskAlert)
+	log     Logger
+	mu      sync.Mutex
+	free    int64
+	checked time.Time
+	warned  bool
+	full    bool
+}
+
+func newDiskGuard(dir string, opts Options) *diskGuard {
+	if opts.MinFreeSpace <= 0 && opts.FreeSpaceWarning <= 0 {
+		return nil
+	}
+	if _, ok := freeSpace(dir); !ok {
+		opts.Logger.Warn("free disk space of '%s' is unknown on this platform, disk limits are disabled\n", dir)
+		return nil
+	}
+	return &diskGuard{dir: dir, min: opts.MinFreeSpace, warn: opts.FreeSpaceWarning, alert: opts.OnDiskAlert, log: opts.Logger}
+}
+
+// checkSpace fails with ErrDiskFull when writing n more bytes would leave
+// less than Options.MinFreeSpace available, and raises the alerts of the
+// thresholds crossed.
+func (d *Driver) checkSpace(n int64) error {
+	g := d.disk
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	now := time.Now()
+	if now.Sub(g.checked) >= diskCheckInterval || g.free-n < g.min || g.free-n < g.warn {
+		if free, ok := freeSpace(g.dir); ok {
+			g.free, g.checked = free, now
+		}
+	}
+	free := g.free - n
+	var alerts []DiskAlert
+	if full := g.min > 0 && free < g.min; full != g.full {
+		g.full = full
+		alerts = append(alerts, DiskAlert{Dir: g.dir, Free: g.free, Threshold: g.min, Full: true, Recovered: !full})
+	}
+	if warned := g.warn > 0 && free < g.warn; warned != g.warned {
+		g.warned = warned
+		alerts = append(alerts, DiskAlert{Dir: g.dir, Free: g.free, Threshold: g.warn, Recovered: !warned})
+	}
+	if !g.full {
+		g.free = free
+	}
+	full := g.full
+	g.mu.Unlock()
+
+	for _, a := range alerts {
+		g.raise(a)
+	}
+	if full {
+		return fmt.Errorf("%w: %d bytes free, %d required", ErrDiskFull, free+n, g.min)
+	}
+	return nil
+}
+
+func (g *diskGuard) raise(a DiskAlert) {
+	switch {
+	case a.Recovered:
+		g.log.Info("free disk space of '%s' is back above %d bytes\n", a.Dir, a.Threshold)
+	case a.Full:
+		g.log.Error("free disk space of '%s' is below %d bytes, refusing writes\n", a.Dir, a.Threshold)
+	default:
+		g.log.Warn("free disk space of '%s' is below %d bytes\n", a.Dir, a.Threshold)
+	}
+	if g.alert != nil {
+		go g.alert(a)
+	}
+}
+
+// checkDisk is the health check of the free space, failing while writes
+// are refused.
+func (d *Driver) checkDisk() error {
+	return d.checkSpace(0)
+}
+
+// diskError returns ErrDiskFull, wrapping err, if err reports that the
+// volume ran out of space.
+func diskError(err error) error {
+	if err != nil && isDiskFull(err) {
+		return fmt.Errorf("%w: %v", ErrDiskFull, err)
+	}
+	return err
+}
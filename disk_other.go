@@ -0,0 +1,16 @@
+//go:build !(linux || darwin || freebsd || windows)
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func freeSpace(dir string) (int64, bool) {
+	return 0, false
+}
+
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+)
+
+// DryRun reports exactly what Commit would change, without touching the
+// disk: the records that would be created, updated or deleted, in
+// collection and key order, with field-level diffs. Writes that leave a
+// record as it is and deletes of missing records are left out. The
+// transaction stays open, so a bulk change can be checked before it is
+// committed or rolled back. Records are compared as the transaction sees
+// them, after masking.
+func (tx *Tx) DryRun() ([]Change, error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return nil, ErrTxDone
+	}
+
+	type target struct{ collection, key string }
+	final := make(map[target]json.RawMessage)
+	for _, op := range tx.ops {
+		final[target{op.Collection, op.Key}] = op.Value
+	}
+
+	var changes []Change
+	for t, value := range final {
+		old, err := tx.base(t.collection, t.key)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		c := Change{Collection: t.collection, Key: t.key}
+		switch {
+		case old == nil && value == nil:
+			continue
+		case old == nil:
+			c.Op = "create"
+		case value == nil:
+			c.Op = "delete"
+		default:
+			c.Op = "update"
+		}
+		if c.Diff, err = tx.d.diffRaw(t.collection, old, value); err != nil {
+			return nil, err
+		}
+		if c.Op == "update" && len(c.Diff) == 0 {
+			continue
+		}
+		changes = append(changes, c)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Collection != changes[j].Collection {
+			return changes[i].Collection < changes[j].Collection
+		}
+		return changes[i].Key < changes[j].Key
+	})
+	return changes, nil
+}
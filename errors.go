@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+)
+
+var (
+	// ErrNotFound is returned when the record or collection an operation
+	// targets does not exist. It also matches fs.ErrNotExist.
+	ErrNotFound error = notFoundError{}
+
+	// ErrRecordTooLarge is returned by Write when the encoded record exceeds
+	// Options.MaxRecordSize.
+	ErrRecordTooLarge = errors.New("record exceeds maximum size")
+
+	// ErrSchemaMismatch is returned by reads of records that do not match
+	// the type registered for their collection with RegisterType.
+	ErrSchemaMismatch = errors.New("record does not match its registered type")
+
+	// ErrInvalidCollection is returned for collection names that start
+	// with a dot, contain a path separator or control character, or are
+	// reserved for the driver.
+	ErrInvalidCollection = errors.New("invalid collection name")
+
+	// ErrInvalidKey is returned for record keys that contain a path
+	// separator or control character, or start with a dot.
+	ErrInvalidKey = errors.New("invalid record key")
+
+	// ErrDiskFull is returned by writes when the volume holding the
+	// database has run out of space, or would be left with less than
+	// Options.MinFreeSpace.
+	ErrDiskFull = errors.New("disk full")
+
+	// ErrUnknownCollection is returned by writes to a collection that was
+	// not created with CreateCollection when Options.Strict is set.
+	ErrUnknownCollection = errors.New("unknown collection")
+
+	// ErrFrozen is returned by operations that would change a collection
+	// frozen with FreezeCollection.
+	ErrFrozen = errors.New("collection is frozen")
+
+	// ErrAlreadyOpen is returned by New when another Driver, in this
+	// process or another, has the directory open, unless
+	// Options.SharedAccess is set.
+	ErrAlreadyOpen = errors.New("database is already open")
+
+	// ErrReadOnly is returned by operations that would change a database
+	// opened with Options.ReadOnly.
+	ErrReadOnly = errors.New("database is read-only")
+
+	// ErrPurgeUnsupported is returned by Purge when the database keeps
+	// earlier versions of records where Purge cannot erase them, as in git
+	// mode.
+	ErrPurgeUnsupported = errors.New("purge is not supported")
+
+	// ErrTxDone is returned when a transaction is used after Commit or
+	// Rollback.
+	ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+	// ErrTxConflict is returned by Commit under SnapshotIsolation when a
+	// record written by the transaction was changed after the transaction
+	// first read its collection.
+	ErrTxConflict = errors.New("transaction conflicts with a concurrent write")
+
+	// ErrTxPrepared is returned when a prepared transaction is asked to
+	// buffer more mutations or change its savepoints.
+	ErrTxPrepared = errors.New("transaction has been prepared")
+
+	// ErrConditionFailed is returned by conditional writes when the stored
+	// record does not satisfy the condition.
+	ErrConditionFailed = errors.New("condition not satisfied")
+
+	// ErrInvalidCursor is returned by Paginate for a malformed page token or
+	// one issued for a different query.
+	ErrInvalidCursor = errors.New("invalid cursor")
+
+	// ErrLockTimeout is returned by LockTimeout when the record stays
+	// locked for longer than the timeout.
+	ErrLockTimeout = errors.New("timed out waiting for record lock")
+)
+
+type notFoundError struct{}
+
+func (notFoundError) Error() string { return "not found" }
+
+func (notFoundError) Is(target error) bool { return target == fs.ErrNotExist }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// evolveBatch is how many records Evolve handles between saving its
+// progress and reporting it.
+const evolveBatch = 100
+
+// Transform changes the shape of a decoded record for Evolve, in place,
+// and reports whether it changed anything. Transforms should leave
+// records already in the new shape alone, so that runs can be resumed and
+// repeated.
+type Transform func(doc map[string]interface{}) (changed bool, err error)
+
+// RenameField renames the field at the dotted path from, keeping it in the
+// same object: RenameField("Address.Pincode", "PostalCode") moves it to
+// Address.PostalCode. Use MoveField to move a field elsewhere.
+func RenameField(from, to string) Transform {
+	if i := strings.LastIndex(from, "."); i >= 0 {
+		to = from[:i+1] + to
+	}
+	return MoveField(from, to)
+}
+
+// MoveField moves the field at the dotted path from to the dotted path to,
+// creating the objects on the way, such as MoveField("Address.City",
+// "City"). Records without the field are left alone; records holding both
+// fail the run, rather than losing one of the values.
+func MoveField(from, to string) Transform {
+	return func(doc map[string]interface{}) (bool, error) {
+		v, ok := lookup(doc, from)
+		if !ok {
+			return false, nil
+		}
+		if _, ok := lookup(doc, to); ok {
+			return false, fmt.Errorf("cannot move %q to %q: field exists", from, to)
+		}
+		if err := setField(doc, to, v); err != nil {
+			return false, err
+		}
+		deleteField(doc, from)
+		return true, nil
+	}
+}
+
+// deleteField removes the field at a dotted path, if present.
+func deleteField(doc map[string]interface{}, path string) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := doc[part].(map[string]interface{})
+		if !ok {
+			return
+		}
+		doc = child
+	}
+	delete(doc, parts[len(parts)-1])
+}
+
+// Progress is how far a run of Evolve has got. Key is the last record
+// handled, in key order; runs resume after it.
+type Progress struct {
+	Name       string
+	Collection string
+	Key        string
+	// Done counts the records handled and Changed those rewritten, across
+	// every run of the same name. Total is the number of records in the
+	// collection when the current run started.
+	Done, Changed, Total int
+	Started              time.Time
+	Finished             time.Time
+}
+
+// Evolve applies transforms, in order, to every record of collection and
+// rewrites the records they change, through the usual write path, so
+// indexes and hooks follow. progress, if not nil, is called after every
+// hundred records and at the end.
+//
+// Progress is saved under the metadata directory under name, so a run that
+// fails or is interrupted resumes after the last record handled when
+// Evolve is called again with the same name, and a finished run is not
+// repeated: Evolve returns its final Progress at once. Each record is
+// rewritten under the collection lock, but the collection is not locked
+// for the whole run, so records written meanwhile before the resume point
+// are not transformed; writers should already use the new shape.
+func (d *Driver) Evolve(name, collection string, progress func(Progress), transforms ...Transform) (Progress, error) {
+	if err := checkCollection(collection); err != nil {
+		return Progress{}, err
+	}
+	if err := checkCollection(name); err != nil {
+		return Progress{}, fmt.Errorf("invalid evolution name: %w", err)
+	}
+	if err := d.checkWritable(); err != nil {
+		return Progress{}, err
+	}
+	p, err := d.EvolveProgress(collection, name)
+	if err != nil || !p.Finished.IsZero() {
+		return p, err
+	}
+	if p.Name == "" {
+		p = Progress{Name: name, Collection: collection, Started: d.now().UTC()}
+	}
+	keys, err := d.Keys(collection)
+	if err != nil {
+		return p, err
+	}
+	p.Total = len(keys)
+	report := func() error {
+		if err := d.saveEvolveProgress(p); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(p)
+		}
+		return nil
+	}
+
+	for i, key := range keys {
+		if key <= p.Key {
+			continue
+		}
+		changed, err := d.evolveRecord(collection, key, transforms)
+		if err != nil {
+			d.saveEvolveProgress(p)
+			return p, fmt.Errorf("evolve %s/%s: %w", collection, key, err)
+		}
+		p.Key = key
+		p.Done++
+		if changed {
+			p.Changed++
+		}
+		if (i+1)%evolveBatch == 0 {
+			if err := report(); err != nil {
+				return p, err
+			}
+		}
+	}
+	p.Finished = d.now().UTC()
+	return p, report()
+}
+
+// evolveRecord applies transforms to one record, which may have been
+// deleted since it was listed.
+func (d *Driver) evolveRecord(collection, key string, transforms []Transform) (bool, error) {
+	d.settle()
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	current, err := os.ReadFile(d.recordPath(collection, key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	doc, err := decodeDoc(current)
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	for _, t := range transforms {
+		c, err := t(doc)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || c
+	}
+	if !changed {
+		return false, nil
+	}
+	b, err := encode(doc)
+	if err != nil {
+		return false, err
+	}
+	return true, d.write(collection, key, b)
+}
+
+// EvolveProgress returns the saved progress of the evolution name of
+// collection, the zero Progress if it never ran.
+func (d *Driver) EvolveProgress(collection, name string) (Progress, error) {
+	var p Progress
+	b, err := os.ReadFile(d.metaPath("evolve", collection, name+".json"))
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return p, fmt.Errorf("evolution %s/%s: %v", collection, name, err)
+	}
+	return p, nil
+}
+
+func (d *Driver) saveEvolveProgress(p Progress) error {
+	dir := d.metaPath("evolve", p.Collection)
+	if err := d.mkdirAll(dir); err != nil {
+		return err
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return d.writeFile(d.metaPath("evolve", p.Collection, p.Name+".json"), b)
+}
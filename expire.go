@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExpireFunc is called with the masked value of a record removed because
+// it expired. An error makes the call, and the calls of the other
+// callbacks for that record, be retried at the next sweep.
+type ExpireFunc func(collection, key string, value json.RawMessage) error
+
+// expiry holds the expiry time of every record given one with Expire,
+// saved per collection under the metadata directory, and the callbacks
+// registered with OnExpire. Records removed by a sweep are queued under
+// .db/expired until every callback accepted them, so each callback sees
+// each expired record at least once, even across a crash.
+type expiry struct {
+	mu      sync.Mutex
+	at      map[string]map[string]time.Time
+	fns     []ExpireFunc
+	seq     uint64
+	sweepMu sync.Mutex // serializes sweeps, and so deliveries
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// expiredRecord is an expired record waiting for its callbacks.
+type expiredRecord struct {
+	ID         string `json:"-"`
+	Collection string
+	Key        string
+	Value      json.RawMessage
+	Expired    time.Time
+}
+
+// openExpiry loads the saved expiry times and starts sweeping every
+// interval.
+func (d *Driver) openExpiry(interval time.Duration) error {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	e := &expiry{at: make(map[string]map[string]time.Time), stop: make(chan struct{}), done: make(chan struct{})}
+	files, err := os.ReadDir(d.metaPath("expiry"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		b, err := os.ReadFile(d.metaPath("expiry", file.Name()))
+		if err != nil {
+			return err
+		}
+		var keys map[string]time.Time
+		if err := json.Unmarshal(b, &keys); err != nil {
+			return fmt.Errorf("expiry %s: %v", file.Name(), err)
+		}
+		e.at[strings.TrimSuffix(file.Name(), ".json")] = keys
+	}
+	d.ttl = e
+	if d.readOnly {
+		close(e.done)
+		return nil
+	}
+	go d.runExpiry(interval)
+	return nil
+}
+
+func (d *Driver) runExpiry(interval time.Duration) {
+	defer close(d.ttl.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-d.ttl.stop:
+			return
+		case <-t.C:
+			if _, err := d.SweepExpired(); err != nil {
+				d.log.Error("sweeping expired records: %v\n", err)
+			}
+		}
+	}
+}
+
+func (d *Driver) stopExpiry() {
+	if d.ttl == nil {
+		return
+	}
+	close(d.ttl.stop)
+	<-d.ttl.done
+}
+
+// Expire makes the record key of collection expire after ttl, replacing
+// any earlier expiry; a ttl of zero or less removes it. Expired records
+// are removed by a sweep every Options.ExpiryInterval, or by
+// SweepExpired. Writes keep the expiry of a record, deleting it drops it.
+func (d *Driver) Expire(collection, key string, ttl time.Duration) error {
+	if err := d.checkKey(collection, key, "expire record"); err != nil {
+		return err
+	}
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if err := d.checkFrozen(collection); err != nil {
+		return err
+	}
+	if _, err := d.rawRecord(collection, key); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %v", ErrNotFound, filepath.Join(collection, key))
+		}
+		return err
+	}
+
+	e := d.ttl
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if ttl <= 0 {
+		if _, ok := e.at[collection][key]; !ok {
+			return nil
+		}
+		delete(e.at[collection], key)
+	} else {
+		if e.at[collection] == nil {
+			e.at[collection] = make(map[string]time.Time)
+		}
+		e.at[collection][key] = d.now().Add(ttl).UTC()
+	}
+	return d.saveExpiry(collection)
+}
+
+// ExpiresAt returns when the record key of collection expires. ok is false
+// if the record has no expiry.
+func (d *Driver) ExpiresAt(collection, key string) (t time.Time, ok bool) {
+	d.ttl.mu.Lock()
+	defer d.ttl.mu.Unlock()
+	t, ok = d.ttl.at[collection][key]
+	return t, ok
+}
+
+// OnExpire registers fn to be called for every record removed because it
+// expired. Records that expire while no callback is registered are removed
+// without notice.
+func (d *Driver) OnExpire(fn ExpireFunc) {
+	d.ttl.mu.Lock()
+	defer d.ttl.mu.Unlock()
+	d.ttl.fns = append(d.ttl.fns, fn)
+}
+
+// saveExpiry writes the expiry times of collection. d.ttl.mu must be held.
+func (d *Driver) saveExpiry(collection string) error {
+	path := d.metaPath("expiry", collection+".json")
+	keys := d.ttl.at[collection]
+	if len(keys) == 0 {
+		delete(d.ttl.at, collection)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b, err := encode(keys)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.metaPath("expiry"), 0755); err != nil {
+		return err
+	}
+	return d.writeFile(path, b)
+}
+
+// expiryRemove drops the expiry of a deleted record, or of every record
+// of collection when key is empty.
+func (d *Driver) expiryRemove(collection, key string) {
+	if d.ttl == nil {
+		return
+	}
+	d.ttl.mu.Lock()
+	defer d.ttl.mu.Unlock()
+	keys, ok := d.ttl.at[collection]
+	if !ok {
+		return
+	}
+	if key == "" {
+		delete(d.ttl.at, collection)
+	} else if _, ok := keys[key]; ok {
+		delete(keys, key)
+	} else {
+		return
+	}
+	if err := d.saveExpiry(collection); err != nil {
+		d.log.Error("saving expiry of '%s': %v\n", collection, err)
+	}
+}
+
+// SweepExpired removes the records whose expiry has passed and calls the
+// OnExpire callbacks for them and for records removed earlier whose
+// callbacks failed. It returns how many records were removed, and the
+// first error met; records left by an error are retried at the next sweep.
+func (d *Driver) SweepExpired() (int, error) {
+	if err := d.checkWritable(); err != nil {
+		return 0, err
+	}
+	e := d.ttl
+	e.sweepMu.Lock()
+	defer e.sweepMu.Unlock()
+	d.settle()
+
+	now := d.now()
+	type target struct{ collection, key string }
+	var due []target
+	e.mu.Lock()
+	for collection, keys := range e.at {
+		for key, t := range keys {
+			if !t.After(now) {
+				due = append(due, target{collection, key})
+			}
+		}
+	}
+	notify := len(e.fns) > 0
+	e.mu.Unlock()
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].collection != due[j].collection {
+			return due[i].collection < due[j].collection
+		}
+		return due[i].key < due[j].key
+	})
+
+	n := 0
+	for _, t := range due {
+		ok, err := d.expireRecord(t.collection, t.key, now, notify)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, d.deliverExpired()
+}
+
+// expireRecord removes a record if it is still due at now, first queueing
+// it for the callbacks when notify is set. It reports whether the record
+// was removed.
+func (d *Driver) expireRecord(collection, key string, now time.Time, notify bool) (bool, error) {
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	d.ttl.mu.Lock()
+	t, ok := d.ttl.at[collection][key]
+	d.ttl.mu.Unlock()
+	if !ok || t.After(now) || d.Pinned(collection, key) {
+		return false, nil
+	}
+	if _, queued := d.pendingRecord(collection, key); queued {
+		// A write-behind mutation arrived since the sweep settled; leave
+		// the record to the next sweep.
+		return false, nil
+	}
+	b, err := os.ReadFile(d.recordPath(collection, key))
+	if os.IsNotExist(err) {
+		d.expiryRemove(collection, key)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if notify {
+		if b, err = d.mask(collection, b); err != nil {
+			return false, err
+		}
+		rec := expiredRecord{ID: d.expiredID(), Collection: collection, Key: key, Value: b, Expired: t}
+		if err := d.saveExpired(rec); err != nil {
+			return false, err
+		}
+	}
+	if err := d.delete(collection, key); err != nil {
+		return false, err
+	}
+	d.log.Debug("Expired '%s/%s'\n", collection, key)
+	return true, nil
+}
+
+// expiredID returns a unique ID that sorts in expiry order.
+func (d *Driver) expiredID() string {
+	d.ttl.mu.Lock()
+	d.ttl.seq++
+	seq := d.ttl.seq
+	d.ttl.mu.Unlock()
+	return fmt.Sprintf("%020d-%06d", d.now().UnixNano(), seq%1000000)
+}
+
+func (d *Driver) saveExpired(rec expiredRecord) error {
+	b, err := encode(rec)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.metaPath("expired"), 0755); err != nil {
+		return err
+	}
+	return d.writeFile(d.metaPath("expired", rec.ID+".json"), b)
+}
+
+// deliverExpired calls the callbacks for the queued expired records,
+// oldest first, and unqueues each once every callback returned nil. It
+// stops at the first failure so that records are seen in expiry order.
+func (d *Driver) deliverExpired() error {
+	d.ttl.mu.Lock()
+	fns := append([]ExpireFunc(nil), d.ttl.fns...)
+	d.ttl.mu.Unlock()
+	if len(fns) == 0 {
+		return nil
+	}
+	files, err := os.ReadDir(d.metaPath("expired"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		path := d.metaPath("expired", file.Name())
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var rec expiredRecord
+		if err := json.Unmarshal(b, &rec); err != nil {
+			return fmt.Errorf("expired record %s: %v", file.Name(), err)
+		}
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, rec.Value); err != nil {
+			return fmt.Errorf("expired record %s: %v", file.Name(), err)
+		}
+		rec.Value = buf.Bytes()
+		for _, fn := range fns {
+			if err := fn(rec.Collection, rec.Key, rec.Value); err != nil {
+				return fmt.Errorf("expiry callback for %s/%s: %w", rec.Collection, rec.Key, err)
+			}
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Filter selects records by their decoded contents. Documents are decoded
+// with numbers kept as json.Number.
+type Filter interface {
+	Match(doc map[string]interface{}) bool
+}
+
+// FilterFunc adapts an ordinary function to a Filter.
+type FilterFunc func(doc map[string]interface{}) bool
+
+// Match calls f(doc).
+func (f FilterFunc) Match(doc map[string]interface{}) bool {
+	return f(doc)
+}
+
+// condition compares the value at a dotted field path with a constant.
+type condition struct {
+	field string
+	op    string
+	value interface{}
+	coll  Collator
+}
+
+// Eq matches records whose field equals value. Numbers compare by value
+// regardless of their Go type, so Eq("Age", 30) matches a stored 30.
+func Eq(field string, value interface{}) Filter { return condition{field, "==", value, nil} }
+
+// Ne matches records whose field is missing or differs from value.
+func Ne(field string, value interface{}) Filter { return condition{field, "!=", value, nil} }
+
+// Gt matches records whose field is greater than value.
+func Gt(field string, value interface{}) Filter { return condition{field, ">", value, nil} }
+
+// Gte matches records whose field is greater than or equal to value.
+func Gte(field string, value interface{}) Filter { return condition{field, ">=", value, nil} }
+
+// Lt matches records whose field is less than value.
+func Lt(field string, value interface{}) Filter { return condition{field, "<", value, nil} }
+
+// Lte matches records whose field is less than or equal to value.
+func Lte(field string, value interface{}) Filter { return condition{field, "<=", value, nil} }
+
+// Exists matches records that have field, whatever its value.
+func Exists(field string) Filter { return condition{field, "exists", nil, nil} }
+
+func (c condition) Match(doc map[string]interface{}) bool {
+	v, ok := lookup(doc, c.field)
+	return c.test(v, ok)
+}
+
+// test reports whether a field holding v, or missing if ok is false,
+// satisfies the condition.
+func (c condition) test(v interface{}, ok bool) bool {
+	switch c.op {
+	case "exists":
+		return ok
+	case "!=":
+		return !ok || !equal(v, c.value, c.coll)
+	}
+	if !ok {
+		return false
+	}
+	if c.op == "==" {
+		return equal(v, c.value, c.coll)
+	}
+	cmp, ok := compare(v, c.value, c.coll)
+	if !ok {
+		return false
+	}
+	switch c.op {
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+func (c condition) String() string {
+	return fmt.Sprintf("%s %s %v", c.field, c.op, c.value)
+}
+
+type and []Filter
+
+// And matches records matched by every filter.
+func And(filters ...Filter) Filter { return and(filters) }
+
+func (fs and) Match(doc map[string]interface{}) bool {
+	for _, f := range fs {
+		if !f.Match(doc) {
+			return false
+		}
+	}
+	return true
+}
+
+type or []Filter
+
+// Or matches records matched by at least one filter.
+func Or(filters ...Filter) Filter { return or(filters) }
+
+func (fs or) Match(doc map[string]interface{}) bool {
+	for _, f := range fs {
+		if f.Match(doc) {
+			return true
+		}
+	}
+	return false
+}
+
+type not struct{ f Filter }
+
+// Not matches records not matched by f.
+func Not(f Filter) Filter { return not{f} }
+
+func (n not) Match(doc map[string]interface{}) bool { return !n.f.Match(doc) }
+
+func equal(a, b interface{}, coll Collator) bool {
+	if cmp, ok := compare(a, b, coll); ok {
+		return cmp == 0
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+// compare orders two scalar values. Numbers compare numerically, strings
+// with coll or, if it is nil, bytewise; other combinations are not
+// comparable.
+func compare(a, b interface{}, coll Collator) (int, bool) {
+	x, okx := toNumber(a)
+	y, oky := toNumber(b)
+	// A numeric string compares as a number against a number, so that
+	// Gt("Age", "29") works on a stored 30.
+	if okx && !oky {
+		y, oky = parseNumber(b)
+	} else if oky && !okx {
+		x, okx = parseNumber(a)
+	}
+	if okx && oky {
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	s, ok1 := a.(string)
+	t, ok2 := b.(string)
+	if !ok1 || !ok2 {
+		return 0, false
+	}
+	if coll != nil {
+		return coll.CompareString(s, t), true
+	}
+	switch {
+	case s < t:
+		return -1, true
+	case s > t:
+		return 1, true
+	}
+	return 0, true
+}
+
+func parseNumber(v interface{}) (float64, bool) {
+	s, ok := v.(string)
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// TypedField is a field of a record type whose values are of type V, for
+// building filters the compiler checks: dbgen -fields generates a
+// value such as UserFields holding one per field of User, so that
+// Where(UserFields.Company.Eq("Google")) fails to compile when the field
+// is renamed or compared with a value of the wrong type, where
+// Eq("company", "Google") silently matches nothing.
+type TypedField[V any] struct {
+	path string
+}
+
+// NewTypedField returns the field at the dotted JSON path, such as
+// "address.city".
+func NewTypedField[V any](path string) TypedField[V] {
+	return TypedField[V]{path: path}
+}
+
+// Path returns the dotted JSON path of the field, for SortBy, IndexField
+// and the other functions taking field names.
+func (f TypedField[V]) Path() string { return f.path }
+
+// Eq is Eq(f.Path(), value).
+func (f TypedField[V]) Eq(value V) Filter { return Eq(f.path, stored(value)) }
+
+// Ne is Ne(f.Path(), value).
+func (f TypedField[V]) Ne(value V) Filter { return Ne(f.path, stored(value)) }
+
+// Gt is Gt(f.Path(), value).
+func (f TypedField[V]) Gt(value V) Filter { return Gt(f.path, stored(value)) }
+
+// Gte is Gte(f.Path(), value).
+func (f TypedField[V]) Gte(value V) Filter { return Gte(f.path, stored(value)) }
+
+// Lt is Lt(f.Path(), value).
+func (f TypedField[V]) Lt(value V) Filter { return Lt(f.path, stored(value)) }
+
+// Lte is Lte(f.Path(), value).
+func (f TypedField[V]) Lte(value V) Filter { return Lte(f.path, stored(value)) }
+
+// In matches records whose field equals one of values.
+func (f TypedField[V]) In(values ...V) Filter {
+	fs := make([]Filter, len(values))
+	for i, v := range values {
+		fs[i] = f.Eq(v)
+	}
+	return Or(fs...)
+}
+
+// Exists is Exists(f.Path()).
+func (f TypedField[V]) Exists() Filter { return Exists(f.path) }
+
+// stored returns v as it compares against decoded records: values of the
+// predeclared scalar types as they are, and others, such as time.Time or
+// a named string type with a MarshalJSON method, as they are stored.
+func stored(v interface{}) interface{} {
+	switch v.(type) {
+	case string, bool, float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, json.Number:
+		return v
+	}
+	if norm, err := normalize([]interface{}{v}); err == nil {
+		return norm[0]
+	}
+	return v
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FS returns a read-only view of the database as an fs.FS, laid out as
+// collection/key.json whatever the layout on disk, so that tools such as
+// http.FileServer(http.FS(db.FS())) or fs.WalkDir can browse the data.
+// Records are served as Read sees them, queued writes included and masks
+// applied. The metadata directory is not part of the view.
+func (d *Driver) FS() fs.FS {
+	return dbFS{d}
+}
+
+type dbFS struct {
+	d *Driver
+}
+
+func (f dbFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	switch collection, file, nested := strings.Cut(name, "/"); {
+	case name == ".":
+		entries, err := f.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &fsDir{info: fsInfo{name: ".", dir: true}, entries: entries}, nil
+	case !nested:
+		entries, err := f.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &fsDir{info: fsInfo{name: collection, dir: true}, entries: entries}, nil
+	default:
+		b, info, err := f.record(collection, file)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &fsFile{info: info, Reader: bytes.NewReader(b)}, nil
+	}
+}
+
+func (f dbFS) Stat(name string) (fs.FileInfo, error) {
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return file.Stat()
+}
+
+// ReadDir lists the collections at the root and the records of a
+// collection below it, sorted by name.
+func (f dbFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		names, err := f.d.Collections()
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[string]bool, len(names))
+		for _, collection := range append(names, f.d.pendingCollections()...) {
+			seen[collection] = checkCollection(collection) == nil
+		}
+		var entries []fs.DirEntry
+		for collection, ok := range seen {
+			if ok {
+				entries = append(entries, fs.FileInfoToDirEntry(fsInfo{name: collection, dir: true}))
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+		return entries, nil
+	}
+	if strings.Contains(name, "/") || checkCollection(name) != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	mutex := f.d.getOrCreateMutex(name)
+	mutex.Lock()
+	records, err := f.d.scan(name)
+	mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		if _, err := os.Stat(f.d.collectionDir(name)); err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	entries := make([]fs.DirEntry, 0, len(records))
+	for _, r := range records {
+		b, err := f.d.mask(name, r.Value)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(fsInfo{name: r.Key + ".json", size: int64(len(b)), modTime: r.Meta.ModTime}))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// record returns the masked contents of collection/file and their info.
+func (f dbFS) record(collection, file string) ([]byte, fsInfo, error) {
+	key := strings.TrimSuffix(file, ".json")
+	if key == file || key == "" || f.d.checkResource(key) != nil || checkCollection(collection) != nil {
+		return nil, fsInfo{}, fs.ErrNotExist
+	}
+	mutex := f.d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+	var b []byte
+	var modTime time.Time
+	if op, ok := f.d.pendingRecords(collection)[key]; ok {
+		if op.b == nil {
+			return nil, fsInfo{}, fs.ErrNotExist
+		}
+		b, modTime = op.b, op.queued
+	} else {
+		path := f.d.recordPath(collection, key)
+		fi, err := os.Stat(path)
+		if err != nil || !fi.Mode().IsRegular() {
+			return nil, fsInfo{}, fs.ErrNotExist
+		}
+		if b, err = os.ReadFile(path); err != nil {
+			return nil, fsInfo{}, err
+		}
+		modTime = fi.ModTime()
+	}
+	b, err := f.d.mask(collection, b)
+	if err != nil {
+		return nil, fsInfo{}, err
+	}
+	return b, fsInfo{name: file, size: int64(len(b)), modTime: modTime}, nil
+}
+
+// fsInfo describes a collection or record of the view.
+type fsInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i fsInfo) Name() string       { return i.name }
+func (i fsInfo) Size() int64        { return i.size }
+func (i fsInfo) ModTime() time.Time { return i.modTime }
+func (i fsInfo) IsDir() bool        { return i.dir }
+func (i fsInfo) Sys() interface{}   { return nil }
+
+func (i fsInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+type fsFile struct {
+	info fsInfo
+	*bytes.Reader
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *fsFile) Close() error               { return nil }
+
+type fsDir struct {
+	info    fsInfo
+	entries []fs.DirEntry
+	off     int
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *fsDir) Close() error               { return nil }
+
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.off:]
+	if n <= 0 {
+		d.off = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.off += n
+	return rest[:n], nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cupcake08/go-database/dbtest"
+)
+
+func openStore(dir string) (dbtest.Store, error) {
+	return New(dir, &Options{Logger: NopLogger{}})
+}
+
+func FuzzNames(f *testing.F) { dbtest.FuzzNames(f, openStore) }
+
+func FuzzValues(f *testing.F) { dbtest.FuzzValues(f, openStore) }
+
+func TestProperties(t *testing.T) {
+	dbtest.Properties(t, openStore, 200, time.Now().UnixNano())
+}
+
+// FuzzKeys passes fuzzed keys to every other entry point taking a record
+// key. Each must either refuse the key with ErrInvalidKey or keep its
+// files inside the database directory.
+func FuzzKeys(f *testing.F) {
+	for _, key := range []string{"key", "..", "../escape", "a/b", `a\b`, "..\\..\\x", ".hidden", "", "x.json", "\x00", "a\nb"} {
+		f.Add(key)
+	}
+	root := f.TempDir()
+	d, err := New(filepath.Join(root, "db"), &Options{Logger: NopLogger{}})
+	if err != nil {
+		f.Fatal(err)
+	}
+	// Write and Delete of a write-behind driver queue, to apply later.
+	wb, err := New(filepath.Join(root, "wb"), &Options{Logger: NopLogger{}, WriteBehind: true})
+	if err != nil {
+		f.Fatal(err)
+	}
+	// A record beside the database that a traversing key would reach.
+	if err := os.WriteFile(filepath.Join(root, "escape.json"), []byte(`{}`), 0644); err != nil {
+		f.Fatal(err)
+	}
+	f.Fuzz(func(t *testing.T, key string) {
+		calls := map[string]func() error{
+			"WriteFrom":             func() error { return d.WriteFrom("users", key, strings.NewReader("data")) },
+			"ReadTo":                func() error { return d.ReadTo("users", key, io.Discard) },
+			"DeleteBlob":            func() error { return d.DeleteBlob("users", key) },
+			"PutAttachment":         func() error { return d.PutAttachment("users", key, "a.txt", strings.NewReader("data")) },
+			"Attachments":           func() error { _, err := d.Attachments("users", key); return err },
+			"Purge":                 func() error { return d.Purge("users", key) },
+			"Exclusive":             func() error { return d.Exclusive("users", key, func() error { return nil }) },
+			"Swap":                  func() error { _, _, err := d.Swap("users", key, map[string]int{"n": 1}); return err },
+			"Version":               func() error { _, err := d.Version("users", key); return err },
+			"Diff":                  func() error { _, err := d.Diff("users", key, map[string]int{}); return err },
+			"Expire":                func() error { return d.Expire("users", key, time.Hour) },
+			"Pin":                   func() error { return d.Pin("users", key) },
+			"Has":                   func() error { _, err := d.Has("users", key); return err },
+			"Stat":                  func() error { _, err := d.Stat("users", key); return err },
+			"Delete":                func() error { return d.Delete("users", key) },
+			"Write (write-behind)":  func() error { return wb.Write("users", key, map[string]int{"n": 1}) },
+			"Delete (write-behind)": func() error { return wb.Delete("users", key) },
+		}
+		for name, call := range calls {
+			err := call()
+			if d.checkResource(key) != nil && !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("%s(%q) = %v, want ErrInvalidKey", name, key, err)
+			}
+		}
+		if err := wb.Flush(); err != nil && d.checkResource(key) != nil {
+			t.Errorf("Flush after %q = %v; the key should have been refused when queued", key, err)
+		}
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if e.Name() != "db" && e.Name() != "wb" && e.Name() != "escape.json" {
+				t.Fatalf("key %q escaped the database directory: %s", key, e.Name())
+			}
+		}
+		if b, err := os.ReadFile(filepath.Join(root, "escape.json")); err != nil || !bytes.Equal(b, []byte(`{}`)) {
+			t.Fatalf("key %q reached a file beside the database: %q, %v", key, b, err)
+		}
+	})
+}
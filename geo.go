@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	geohashAlphabet  = "0123456789bcdefghjkmnpqrstuvwxyz"
+	geohashPrecision = 9
+	earthRadiusKm    = 6371.0
+)
+
+// GeoMatch is a record found by Near together with its distance from the
+// query point.
+type GeoMatch struct {
+	Key        string
+	DistanceKm float64
+}
+
+type geoEntry struct {
+	hash     string
+	key      string
+	lat, lng float64
+}
+
+// geoIndex keeps the entries of one collection sorted by geohash, so the
+// records inside a geohash cell form a contiguous run.
+type geoIndex struct {
+	mu       sync.RWMutex
+	latField string
+	lngField string
+	entries  []geoEntry
+}
+
+// IndexGeo indexes the latitude and longitude stored in the given fields
+// (dotted paths, numbers or numeric strings) of every record in collection,
+// so that Near can answer radius queries without scanning the collection.
+// The index is built from the current records and kept up to date by Write
+// and Delete for the lifetime of the driver.
+func (d *Driver) IndexGeo(collection, latField, lngField string) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	idx := &geoIndex{latField: latField, lngField: lngField}
+	records, err := d.scan(collection)
+	if err != nil {
+		return err
+	}
+	idx.entries = idx.build(records)
+
+	d.mu.Lock()
+	if d.geo == nil {
+		d.geo = make(map[string]*geoIndex)
+	}
+	d.geo[collection] = idx
+	d.mu.Unlock()
+	return nil
+}
+
+// Near returns the records of collection within radiusKm of lat/lng,
+// nearest first. The collection must have been indexed with IndexGeo.
+func (d *Driver) Near(collection string, lat, lng, radiusKm float64) ([]GeoMatch, error) {
+	// The comparisons are written so that NaN fails them, since
+	// coveringCells never terminates on a NaN or infinite input.
+	if !(lat >= -90 && lat <= 90) || !(lng >= -180 && lng <= 180) {
+		return nil, fmt.Errorf("invalid coordinate %v, %v", lat, lng)
+	}
+	if !(radiusKm >= 0) || math.IsInf(radiusKm, 1) {
+		return nil, fmt.Errorf("invalid radius %v", radiusKm)
+	}
+	d.mu.Lock()
+	idx := d.geo[collection]
+	d.mu.Unlock()
+	if idx == nil {
+		return nil, fmt.Errorf("collection %q has no geo index", collection)
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	var matches []GeoMatch
+	for _, cell := range coveringCells(lat, lng, radiusKm) {
+		i := sort.Search(len(idx.entries), func(i int) bool { return idx.entries[i].hash >= cell })
+		for ; i < len(idx.entries) && strings.HasPrefix(idx.entries[i].hash, cell); i++ {
+			e := idx.entries[i]
+			if dist := haversine(lat, lng, e.lat, e.lng); dist <= radiusKm {
+				matches = append(matches, GeoMatch{Key: e.key, DistanceKm: dist})
+			}
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].DistanceKm < matches[j].DistanceKm })
+	return matches, nil
+}
+
+func (d *Driver) geoUpdate(collection, key string, b []byte) {
+	d.mu.Lock()
+	idx := d.geo[collection]
+	d.mu.Unlock()
+	if idx == nil {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(key)
+	if e, ok := idx.entry(key, b); ok {
+		i := sort.Search(len(idx.entries), func(i int) bool { return idx.entries[i].hash >= e.hash })
+		idx.entries = append(idx.entries, geoEntry{})
+		copy(idx.entries[i+1:], idx.entries[i:])
+		idx.entries[i] = e
+	}
+}
+
+func (d *Driver) geoRemove(collection, key string) {
+	d.mu.Lock()
+	idx := d.geo[collection]
+	d.mu.Unlock()
+	if idx == nil {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if key == "" {
+		idx.entries = nil
+		return
+	}
+	idx.remove(key)
+}
+
+// build returns the sorted entries for records.
+func (idx *geoIndex) build(records []Record[json.RawMessage]) []geoEntry {
+	var entries []geoEntry
+	for _, r := range records {
+		if e, ok := idx.entry(r.Key, r.Value); ok {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].hash < entries[j].hash })
+	return entries
+}
+
+func (idx *geoIndex) remove(key string) {
+	for i, e := range idx.entries {
+		if e.key == key {
+			idx.entries = append(idx.entries[:i], idx.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// entry extracts the coordinates of a raw record. Records without valid
+// coordinates are not indexed.
+func (idx *geoIndex) entry(key string, b []byte) (geoEntry, bool) {
+	doc, err := decodeDoc(b)
+	if err != nil {
+		return geoEntry{}, false
+	}
+	lat, ok1 := lookupFloat(doc, idx.latField)
+	lng, ok2 := lookupFloat(doc, idx.lngField)
+	if !ok1 || !ok2 || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return geoEntry{}, false
+	}
+	return geoEntry{hash: geohash(lat, lng, geohashPrecision), key: key, lat: lat, lng: lng}, true
+}
+
+func lookupFloat(doc map[string]interface{}, path string) (float64, bool) {
+	v, ok := lookup(doc, path)
+	if !ok {
+		return 0, false
+	}
+	var s string
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case fmt.Stringer:
+		s = v.String()
+	case string:
+		s = v
+	default:
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil
+}
+
+// geohash encodes a coordinate as a geohash of the given length.
+func geohash(lat, lng float64, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lngRange := [2]float64{-180, 180}
+	var sb strings.Builder
+	bit, ch, even := 0, 0, true
+	for sb.Len() < precision {
+		r, v := &latRange, lat
+		if even {
+			r, v = &lngRange, lng
+		}
+		if mid := (r[0] + r[1]) / 2; v >= mid {
+			ch |= 1 << (4 - bit)
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		even = !even
+		if bit++; bit == 5 {
+			sb.WriteByte(geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return sb.String()
+}
+
+// cellSize returns the height and width in degrees of a geohash cell of the
+// given length.
+func cellSize(precision int) (latDeg, lngDeg float64) {
+	bits := 5 * precision
+	lngBits := (bits + 1) / 2
+	latBits := bits / 2
+	return 180 / math.Exp2(float64(latBits)), 360 / math.Exp2(float64(lngBits))
+}
+
+// coveringCells returns geohash prefixes whose cells together cover the
+// bounding box of the circle around lat/lng. The precision is the finest one
+// whose cells are still at least as large as the radius, which keeps the
+// number of cells small.
+func coveringCells(lat, lng, radiusKm float64) []string {
+	dLat := radiusKm / 111.32
+	dLng := 360.0
+	if c := math.Cos(lat * math.Pi / 180); c > 1e-6 {
+		dLng = math.Min(360, dLat/c)
+	}
+
+	precision := 1
+	for p := geohashPrecision; p >= 1; p-- {
+		if h, w := cellSize(p); h >= dLat && w >= dLng {
+			precision = p
+			break
+		}
+	}
+	h, w := cellSize(precision)
+
+	seen := make(map[string]bool)
+	var cells []string
+	minLat, maxLat := math.Max(-90, lat-dLat), math.Min(90, lat+dLat)
+	for y := minLat; ; y += h {
+		y = math.Min(y, maxLat)
+		for x := lng - dLng; ; x += w {
+			x = math.Min(x, lng+dLng)
+			nx := math.Mod(x+540, 360) - 180
+			if cell := geohash(y, nx, precision); !seen[cell] {
+				seen[cell] = true
+				cells = append(cells, cell)
+			}
+			if x >= lng+dLng {
+				break
+			}
+		}
+		if y >= maxLat {
+			break
+		}
+	}
+	return cells
+}
+
+// haversine returns the great-circle distance in kilometres between two
+// coordinates.
+func haversine(lat1, lng1, lat2, lng2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLng := (lng2 - lng1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNearInvalid(t *testing.T) {
+	d, err := New(t.TempDir(), &Options{Logger: NopLogger{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Write("places", "home", map[string]float64{"lat": 51.5, "lng": -0.1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.IndexGeo("places", "lat", "lng"); err != nil {
+		t.Fatal(err)
+	}
+	nan, inf := math.NaN(), math.Inf(1)
+	for _, q := range [][3]float64{
+		{nan, 0, 1}, {0, nan, 1}, {0, 0, nan},
+		{inf, 0, 1}, {0, -inf, 1}, {0, 0, inf},
+		{91, 0, 1}, {0, 1e17, 1}, {0, 0, -1},
+	} {
+		if _, err := d.Near("places", q[0], q[1], q[2]); err == nil {
+			t.Errorf("Near(%v, %v, %v): no error", q[0], q[1], q[2])
+		}
+	}
+	matches, err := d.Near("places", 51.5, -0.1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Key != "home" {
+		t.Errorf("Near = %v, want home", matches)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GitOptions turns the database directory into a git repository and
+// commits the changes made through the driver, giving history, blame and
+// replication by push. The metadata directory is kept out of the
+// repository. It needs the git command on the PATH.
+type GitOptions struct {
+	// BatchSize is how many changes are gathered into one commit. It
+	// defaults to 1, a commit per write or delete. Commits are made in the
+	// background, so changes arriving faster than git can commit them are
+	// folded into the next commit.
+	BatchSize int
+
+	// BatchInterval, when set, also commits whatever changes are pending
+	// this often, so small batches do not wait indefinitely.
+	BatchInterval time.Duration
+
+	// Message returns the commit message for a batch of changes. The
+	// default names the single change, or counts the changes and lists
+	// them in the body.
+	Message func(changes []GitChange) string
+
+	// AuthorName and AuthorEmail identify the commits. They default to
+	// "go-database" and "go-database@localhost".
+	AuthorName  string
+	AuthorEmail string
+
+	// Remote, when set, is pushed to after every commit. Failed pushes
+	// are logged and retried with the next commit.
+	Remote string
+}
+
+// GitChange is a change committed to the repository. An empty Key stands
+// for the whole collection.
+type GitChange struct {
+	Collection string
+	Key        string
+	Deleted    bool
+}
+
+func (c GitChange) String() string {
+	op := "write"
+	if c.Deleted {
+		op = "delete"
+	}
+	if c.Key == "" {
+		return op + " " + c.Collection
+	}
+	return op + " " + c.Collection + "/" + c.Key
+}
+
+// gitIgnore lists what must never be committed: driver metadata, the
+// temporary files of atomic writes and restore staging directories.
+var gitIgnore = []string{"/" + metaDirName + "/", "*.tmp", "/.restore-*/"}
+
+// gitRepo commits tracked changes in the background.
+type gitRepo struct {
+	opts    GitOptions
+	mu      sync.Mutex
+	pending []GitChange
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// openGit makes sure d.dir is a git repository ignoring the metadata
+// directory and starts the committer.
+func (d *Driver) openGit(opts GitOptions) error {
+	if _, err := exec.LookPath("git"); err != nil {
+		return fmt.Errorf("git mode: %w", err)
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1
+	}
+	if opts.AuthorName == "" {
+		opts.AuthorName = "go-database"
+	}
+	if opts.AuthorEmail == "" {
+		opts.AuthorEmail = "go-database@localhost"
+	}
+	if opts.Message == nil {
+		opts.Message = defaultGitMessage
+	}
+	g := &gitRepo{opts: opts, wake: make(chan struct{}, 1), stop: make(chan struct{}), done: make(chan struct{})}
+	if _, err := os.Stat(filepath.Join(d.dir, ".git")); os.IsNotExist(err) {
+		if _, err := d.git(g, "init", "--quiet"); err != nil {
+			return err
+		}
+	}
+	if err := d.ensureGitIgnore(); err != nil {
+		return err
+	}
+	d.repo = g
+	go d.runGit(g)
+	return nil
+}
+
+func (d *Driver) ensureGitIgnore() error {
+	path := filepath.Join(d.dir, ".gitignore")
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	have := make(map[string]bool)
+	for _, line := range strings.Split(string(b), "\n") {
+		have[strings.TrimSpace(line)] = true
+	}
+	var missing []string
+	for _, line := range gitIgnore {
+		if !have[line] {
+			missing = append(missing, line)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if len(b) > 0 && !bytes.HasSuffix(b, []byte("\n")) {
+		b = append(b, '\n')
+	}
+	b = append(b, strings.Join(missing, "\n")+"\n"...)
+	return d.writeFile(path, b)
+}
+
+func defaultGitMessage(changes []GitChange) string {
+	if len(changes) == 1 {
+		return changes[0].String()
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d changes\n\n", len(changes))
+	for _, c := range changes {
+		fmt.Fprintf(&sb, "- %s\n", c)
+	}
+	return sb.String()
+}
+
+// gitTrack queues a change for the next commit.
+func (d *Driver) gitTrack(collection, key string, deleted bool) {
+	g := d.repo
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	g.pending = append(g.pending, GitChange{Collection: collection, Key: key, Deleted: deleted})
+	full := len(g.pending) >= g.opts.BatchSize
+	g.mu.Unlock()
+	if full {
+		select {
+		case g.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (d *Driver) runGit(g *gitRepo) {
+	defer close(g.done)
+	var tick <-chan time.Time
+	if g.opts.BatchInterval > 0 {
+		t := time.NewTicker(g.opts.BatchInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		stopping := false
+		select {
+		case <-g.stop:
+			stopping = true
+		case <-g.wake:
+		case <-tick:
+		}
+		g.mu.Lock()
+		changes := g.pending
+		g.pending = nil
+		g.mu.Unlock()
+		if len(changes) > 0 {
+			if err := d.gitCommit(g, changes); err != nil {
+				d.log.Error("git commit failed: %v\n", err)
+			}
+		}
+		if stopping {
+			return
+		}
+	}
+}
+
+// gitCommit stages the working tree and commits it with a message for
+// changes. Nothing is committed if the tree did not change.
+func (d *Driver) gitCommit(g *gitRepo, changes []GitChange) error {
+	if _, err := d.git(g, "add", "--all"); err != nil {
+		return err
+	}
+	if _, err := d.git(g, "diff", "--cached", "--quiet"); err == nil {
+		return nil
+	}
+	if _, err := d.git(g, "commit", "--quiet", "--no-verify", "-m", g.opts.Message(changes)); err != nil {
+		return err
+	}
+	if g.opts.Remote != "" {
+		if _, err := d.git(g, "push", "--quiet", g.opts.Remote, "HEAD"); err != nil {
+			d.log.Warn("git push to %s failed: %v\n", g.opts.Remote, err)
+		}
+	}
+	return nil
+}
+
+func (d *Driver) git(g *gitRepo, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = d.dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME="+g.opts.AuthorName, "GIT_AUTHOR_EMAIL="+g.opts.AuthorEmail,
+		"GIT_COMMITTER_NAME="+g.opts.AuthorName, "GIT_COMMITTER_EMAIL="+g.opts.AuthorEmail,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return out, fmt.Errorf("git %s: %v: %s", args[0], err, msg)
+		}
+		return out, fmt.Errorf("git %s: %v", args[0], err)
+	}
+	return out, nil
+}
+
+// closeGit commits the pending changes and stops the committer.
+func (d *Driver) closeGit() {
+	if d.repo == nil {
+		return
+	}
+	close(d.repo.stop)
+	<-d.repo.done
+}
+
+// GitLog returns the commits that touched the record key of collection,
+// newest first, as "<hash> <subject>" lines. It needs Options.Git.
+func (d *Driver) GitLog(collection, key string) ([]string, error) {
+	if d.repo == nil {
+		return nil, fmt.Errorf("git mode is not enabled")
+	}
+	if err := d.checkKey(collection, key, "read history"); err != nil {
+		return nil, err
+	}
+	path := filepath.ToSlash(filepath.Join(collection, key+".json"))
+	out, err := d.git(d.repo, "log", "--format=%h %s", "--", path)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return nil, nil
+	}
+	return lines, nil
+}
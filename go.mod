@@ -1,5 +1,3 @@
 module github.com/cupcake08/go-database
 
 go 1.18
-
-require github.com/jcelliott/lumber v0.0.0-20160324203708-dd349441af25
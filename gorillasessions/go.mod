@@ -0,0 +1,8 @@
+module github.com/cupcake08/go-database/gorillasessions
+
+go 1.19
+
+require (
+	github.com/gorilla/securecookie v1.1.2
+	github.com/gorilla/sessions v1.2.2
+)
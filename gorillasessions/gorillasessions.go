@@ -0,0 +1,124 @@
+// Package gorillasessions is a github.com/gorilla/sessions store keeping
+// sessions in the database, through the sessions package of the database.
+// It lives in a module of its own so that the database does not depend on
+// gorilla:
+//
+//	store := gorillasessions.New(sessions.New(db, "sessions"), hashKey)
+//	s, err := store.Get(r, "session")
+//	s.Values["user"] = "alice"
+//	err = s.Save(r, w)
+//
+// The cookie only holds the session ID, signed, and encrypted too when a
+// block key is given, as with the stores of gorilla; the values are stored
+// in the database and expire with the session.
+package gorillasessions
+
+import (
+	"encoding/base32"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// Backend stores session data by token. The Sessions of the sessions
+// package of the database implements it.
+type Backend interface {
+	Find(token string) (b []byte, found bool, err error)
+	Commit(token string, b []byte, expiry time.Time) error
+	Delete(token string) error
+}
+
+// Store is a sessions.Store over a Backend.
+type Store struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options // defaults for new sessions
+	backend Backend
+}
+
+// New returns a store of the sessions in backend. keyPairs are the hash
+// and block keys of the cookie codecs, as for sessions.NewCookieStore.
+func New(backend Backend, keyPairs ...[]byte) *Store {
+	s := &Store{
+		Codecs:  securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{Path: "/", MaxAge: 86400 * 30},
+		backend: backend,
+	}
+	// Values are not kept in the cookie, so their size is not limited by
+	// it.
+	for _, c := range s.Codecs {
+		if sc, ok := c.(*securecookie.SecureCookie); ok {
+			sc.MaxLength(0)
+		}
+	}
+	return s
+}
+
+// Get returns the session name of r, loaded once per request; see
+// sessions.Registry.
+func (s *Store) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns the session name of r, a new one if r has none, it has
+// expired, or its cookie does not decode, in which case the error is
+// returned too, as by the stores of gorilla.
+func (s *Store) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if err := securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...); err != nil {
+		return session, err
+	}
+	b, found, err := s.backend.Find(session.ID)
+	if err != nil || !found {
+		return session, err
+	}
+	if err := securecookie.DecodeMulti(name, string(b), &session.Values, s.Codecs...); err != nil {
+		return session, err
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+// Save stores the session for its MaxAge and sets its cookie on w, or
+// deletes it when MaxAge is negative.
+func (s *Store) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if err := s.backend.Delete(session.ID); err != nil {
+			return err
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+	if session.ID == "" {
+		// The tokens of the sessions package are base64url; base32 without
+		// padding is in the same alphabet.
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+	data, err := securecookie.EncodeMulti(session.Name(), session.Values, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	expiry := time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second)
+	if session.Options.MaxAge == 0 {
+		// A browser session; keep it as long as new sessions last.
+		expiry = time.Now().Add(time.Duration(s.Options.MaxAge) * time.Second)
+	}
+	if err := s.backend.Commit(session.ID, []byte(data), expiry); err != nil {
+		return err
+	}
+	id, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), id, session.Options))
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// groupCommit shares directory syncs between concurrent writers, see
+// Options.GroupCommit. Each directory is synced by one goroutine at a
+// time; writers arriving meanwhile join the batch for the next sync.
+type groupCommit struct {
+	mu      sync.Mutex
+	window  time.Duration
+	dirs    map[string]*dirGroup
+	syncDir func(dir string) error
+}
+
+// dirGroup is the sync state of one directory.
+type dirGroup struct {
+	next *syncBatch // writers waiting for the next sync
+}
+
+type syncBatch struct {
+	done chan struct{}
+	err  error
+}
+
+// sync returns once dir has been synced after the call, with the error of
+// that sync.
+func (g *groupCommit) sync(dir string) error {
+	g.mu.Lock()
+	dg := g.dirs[dir]
+	if dg == nil {
+		dg = &dirGroup{}
+		g.dirs[dir] = dg
+		go g.run(dir, dg)
+	}
+	if dg.next == nil {
+		dg.next = &syncBatch{done: make(chan struct{})}
+	}
+	b := dg.next
+	g.mu.Unlock()
+	<-b.done
+	return b.err
+}
+
+// run syncs dir for one batch of writers after another, until no writer
+// waits.
+func (g *groupCommit) run(dir string, dg *dirGroup) {
+	for {
+		if g.window > 0 {
+			time.Sleep(g.window)
+		}
+		g.mu.Lock()
+		b := dg.next
+		if b == nil {
+			delete(g.dirs, dir)
+			g.mu.Unlock()
+			return
+		}
+		dg.next = nil
+		g.mu.Unlock()
+		b.err = g.syncDir(dir)
+		close(b.done)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// staleGuard is how old a guard file must be before it is taken to be left
+// over from a process that died while holding it.
+const staleGuard = 30 * time.Second
+
+// Exclusive runs fn while holding a guard on the record resource of
+// collection that excludes other Exclusive calls on the same record, in
+// this process and in any other process using the same database
+// directory. The guard is a file created with O_EXCL under the metadata
+// directory; a guard older than 30s is considered abandoned and broken, so
+// fn should be short. Unlike the collection lock, the guard does not block
+// Read or Write, which fn may call.
+func (d *Driver) Exclusive(collection, resource string, fn func() error) error {
+	if err := d.checkKey(collection, resource, "guard record"); err != nil {
+		return err
+	}
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	path := d.metaPath("guards", collection, resource)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	delay := time.Millisecond
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			f.Close()
+			break
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) > staleGuard {
+			os.Remove(path)
+			continue
+		}
+		time.Sleep(delay)
+		if delay < 50*time.Millisecond {
+			delay *= 2
+		}
+	}
+	defer os.Remove(path)
+	return fn()
+}
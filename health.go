@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Health is the outcome of the checks run by Driver.Health.
+type Health struct {
+	OK     bool
+	Checks []HealthCheck
+}
+
+// HealthCheck is the result of a single health check. Error is empty when
+// the check passed.
+type HealthCheck struct {
+	Name     string
+	OK       bool
+	Error    string `json:",omitempty"`
+	Duration time.Duration
+}
+
+type probe struct {
+	name string
+	fn   func() error
+}
+
+// Ping verifies that the database directory is reachable and writable by
+// creating and removing a probe file in it; only reachable for a read-only
+// driver.
+func (d *Driver) Ping() error {
+	fi, err := os.Stat(d.dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", d.dir)
+	}
+	if d.readOnly {
+		return nil
+	}
+	if err := os.MkdirAll(d.metaPath("tmp"), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(d.metaPath("tmp"), "ping-")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_, err = f.Write([]byte("ping"))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if rerr := os.Remove(name); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// Health runs every health check, for readiness and liveness probes. The
+// database is healthy when all checks pass.
+func (d *Driver) Health() Health {
+	checks := []probe{{"directory", d.Ping}}
+	if d.disk != nil {
+		checks = append(checks, probe{"disk", d.checkDisk})
+	}
+	if d.clog != nil {
+		checks = append(checks, probe{"checkpoints", d.checkCheckpoints})
+	}
+
+	h := Health{OK: true}
+	for _, c := range checks {
+		start := time.Now()
+		err := c.fn()
+		hc := HealthCheck{Name: c.name, OK: err == nil, Duration: time.Since(start)}
+		if err != nil {
+			hc.Error = err.Error()
+			h.OK = false
+		}
+		h.Checks = append(h.Checks, hc)
+	}
+	return h
+}
+
+// checkCheckpoints fails when the checkpoint worker has stopped or its
+// last checkpoint failed.
+func (d *Driver) checkCheckpoints() error {
+	select {
+	case <-d.clog.done:
+		return fmt.Errorf("checkpoint worker is not running")
+	default:
+	}
+	d.clog.cpMu.Lock()
+	defer d.clog.cpMu.Unlock()
+	return d.clog.err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// afterWrite is called with the collection lock held once a record has been
+// stored, so that in-memory structures derived from records stay current.
+func (d *Driver) afterWrite(collection, key string, b []byte) {
+	d.geoUpdate(collection, key, b)
+	d.indexUpdate(collection, key, b)
+	d.searchUpdate(collection, key, b)
+	d.bloomAdd(collection, key)
+	d.keyIndexPut(collection, key, int64(len(b)))
+	d.poolEvict(collection, key)
+	d.notify(collection, key)
+	d.observe(collection, key, false)
+	d.gitTrack(collection, key, false)
+}
+
+// afterDelete is called with the collection lock held once a record has been
+// removed. An empty key means the whole collection was removed.
+func (d *Driver) afterDelete(collection, key string) {
+	d.geoRemove(collection, key)
+	d.indexRemove(collection, key)
+	d.searchRemove(collection, key)
+	d.keyIndexRemove(collection, key)
+	if key == "" {
+		d.bloomReset(collection)
+	}
+	d.poolEvict(collection, key)
+	d.notify(collection, key)
+	d.observe(collection, key, true)
+	d.expiryRemove(collection, key)
+	d.pinRemove(collection, key)
+	d.gitTrack(collection, key, true)
+}
+
+// decodeDoc decodes a raw record into a generic document, keeping numbers as
+// json.Number so they survive a round trip unchanged.
+func decodeDoc(b []byte) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// lookup returns the value at a dotted field path such as "Address.City".
+func lookup(doc map[string]interface{}, path string) (interface{}, bool) {
+	var v interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
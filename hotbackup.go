@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// HotBackup writes a backup like Backup without holding collection locks
+// while files are copied. Record files are hard-linked into a staging
+// directory as they are, while every concurrent write and delete is
+// tracked; the tracked records are then re-copied, each collection under
+// its lock for only as long as its changed records take. Each collection in
+// the backup therefore reflects a single moment, that of its
+// reconciliation, as with Backup.
+func (d *Driver) HotBackup(w io.Writer, opts BackupOptions) (*Manifest, error) {
+	d.settle()
+	if err := os.MkdirAll(d.tmpDir(), 0755); err != nil {
+		return nil, err
+	}
+	staging, err := os.MkdirTemp(d.tmpDir(), "backup-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	cs := d.watch()
+	defer d.unwatch(cs)
+
+	names, err := d.Collections()
+	if err != nil {
+		return nil, err
+	}
+	for _, collection := range names {
+		if err := stageTree(d.collectionRoot(collection), staging, collection); err != nil {
+			return nil, err
+		}
+	}
+	if err := stageTree(d.dir, staging, metaDirName); err != nil {
+		return nil, err
+	}
+
+	// Collections changed during a reconciliation, such as ones just
+	// created, are reconciled in turn; changes to a collection after its
+	// own reconciliation are later than its moment and left out.
+	done := make(map[string]bool)
+	for {
+		var pending []string
+		for _, collection := range cs.collections() {
+			if !done[collection] {
+				pending = append(pending, collection)
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+		for _, collection := range pending {
+			done[collection] = true
+			if err := d.reconcile(staging, collection, cs); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return d.writeBackup(w, opts, func(tw *tar.Writer, m *Manifest) error {
+		return backupTree(tw, m, staging, "")
+	})
+}
+
+// reconcile brings the staged copies of the records of collection changed
+// so far up to date. The changes are taken under the collection lock, so
+// none made before it was taken are missed.
+func (d *Driver) reconcile(staging, collection string, cs *changeSet) error {
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	keys := cs.take(collection)
+
+	if keys[""] {
+		if err := os.RemoveAll(filepath.Join(staging, collection)); err != nil {
+			return err
+		}
+		return stageTree(d.collectionRoot(collection), staging, collection)
+	}
+	for key := range keys {
+		dst := filepath.Join(staging, collection, key+".json")
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := stageFile(d.recordPath(collection, key), dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stageTree links the files below src/rel into dst/rel, skipping those a
+// backup leaves out. Files that vanish while it runs are skipped too; the
+// change tracking catches them.
+func stageTree(src, dst, rel string) error {
+	return filepath.Walk(filepath.Join(src, rel), func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name, _ := filepath.Rel(src, path)
+		if fi.IsDir() {
+			if skipBackupDir(name) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if skipBackupFile(name, fi) {
+			return nil
+		}
+		return stageFile(path, filepath.Join(dst, name))
+	})
+}
+
+func stageFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := linkOrCopy(src, dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Extractor computes the value a record is indexed under from its decoded
+// document. It returns false when the record has no value for the index.
+type Extractor func(doc map[string]interface{}) (interface{}, bool)
+
+// Field extracts the value at a dotted field path.
+func Field(path string) Extractor {
+	return func(doc map[string]interface{}) (interface{}, bool) {
+		return lookup(doc, path)
+	}
+}
+
+// Lower lowercases the string extracted by e, for case-insensitive
+// lookups. Other values pass through unchanged.
+func Lower(e Extractor) Extractor {
+	return func(doc map[string]interface{}) (interface{}, bool) {
+		v, ok := e(doc)
+		if s, isString := v.(string); isString {
+			return strings.ToLower(s), ok
+		}
+		return v, ok
+	}
+}
+
+// Year extracts the year of the RFC 3339 timestamp extracted by e, for
+// lookups by year.
+func Year(e Extractor) Extractor {
+	return func(doc map[string]interface{}) (interface{}, bool) {
+		v, ok := e(doc)
+		s, isString := v.(string)
+		if !ok || !isString {
+			return nil, false
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, false
+		}
+		return t.Year(), true
+	}
+}
+
+// index maps the extracted values of the records of one collection to the
+// records' keys.
+type index struct {
+	mu      sync.RWMutex
+	extract Extractor
+	field   string // the field path of an IndexField index
+	values  map[string]map[string]bool
+	byKey   map[string]string
+}
+
+// CreateIndex indexes the records of collection by the value extract
+// computes for them, so that Lookup and FindByIndex can find records by
+// that value without scanning the collection. Like IndexGeo, the index is
+// built from the current records and kept up to date by Write and Delete
+// for the lifetime of the driver; register it again after reopening.
+func (d *Driver) CreateIndex(collection, name string, extract Extractor) error {
+	return d.createIndex(collection, name, &index{extract: extract})
+}
+
+// IndexField indexes the records of collection by the value at a dotted
+// field path, under the name of the path. Besides serving Lookup, such an
+// index lets Find and Query read only the records that can match a
+// condition on the field when IndexStats shows that to be cheaper than a
+// scan.
+func (d *Driver) IndexField(collection, field string) error {
+	return d.createIndex(collection, field, &index{extract: Field(field), field: field})
+}
+
+func (d *Driver) createIndex(collection, name string, idx *index) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+	if name == "" {
+		return fmt.Errorf("index name cannot be empty")
+	}
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if err := d.buildIndex(collection, idx); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	if d.indexes == nil {
+		d.indexes = make(map[string]map[string]*index)
+	}
+	if d.indexes[collection] == nil {
+		d.indexes[collection] = make(map[string]*index)
+	}
+	d.indexes[collection][name] = idx
+	d.mu.Unlock()
+	return nil
+}
+
+// buildIndex fills idx from the records of collection. The collection lock
+// must be held.
+func (d *Driver) buildIndex(collection string, idx *index) error {
+	records, err := d.scan(collection)
+	if err != nil {
+		return err
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.values = make(map[string]map[string]bool)
+	idx.byKey = make(map[string]string)
+	for _, r := range records {
+		idx.put(r.Key, r.Value)
+	}
+	return nil
+}
+
+// Lookup returns the sorted keys of the records of collection whose value
+// for the named index equals value. Numbers match regardless of their Go
+// type.
+func (d *Driver) Lookup(collection, name string, value interface{}) ([]string, error) {
+	idx, err := d.indexFor(collection, name)
+	if err != nil {
+		return nil, err
+	}
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	keys := make([]string, 0, len(idx.values[indexValue(value)]))
+	for key := range idx.values[indexValue(value)] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// FindByIndex returns the records found by Lookup.
+func (d *Driver) FindByIndex(collection, name string, value interface{}) ([]Record[json.RawMessage], error) {
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+	keys, err := d.Lookup(collection, name, value)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]Record[json.RawMessage], 0, len(keys))
+	for _, key := range keys {
+		path := d.recordPath(collection, key)
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if b, err = d.mask(collection, b); err != nil {
+			return nil, err
+		}
+		records = append(records, Record[json.RawMessage]{
+			Key:   key,
+			Meta:  Meta{Size: fi.Size(), ModTime: fi.ModTime()},
+			Value: b,
+		})
+	}
+	return records, nil
+}
+
+func (d *Driver) indexFor(collection, name string) (*index, error) {
+	d.mu.Lock()
+	idx := d.indexes[collection][name]
+	d.mu.Unlock()
+	if idx == nil {
+		return nil, fmt.Errorf("collection %q has no index %q", collection, name)
+	}
+	return idx, nil
+}
+
+func (idx *index) put(key string, b []byte) {
+	idx.remove(key)
+	doc, err := decodeDoc(b)
+	if err != nil {
+		return
+	}
+	v, ok := idx.extract(doc)
+	if !ok {
+		return
+	}
+	iv := indexValue(v)
+	if idx.values[iv] == nil {
+		idx.values[iv] = make(map[string]bool)
+	}
+	idx.values[iv][key] = true
+	idx.byKey[key] = iv
+}
+
+func (idx *index) remove(key string) {
+	iv, ok := idx.byKey[key]
+	if !ok {
+		return
+	}
+	delete(idx.values[iv], key)
+	if len(idx.values[iv]) == 0 {
+		delete(idx.values, iv)
+	}
+	delete(idx.byKey, key)
+}
+
+// indexValue is the canonical form values are indexed under, so that
+// json.Number("3") from a record and int 3 from a caller meet.
+func indexValue(v interface{}) string {
+	if f, ok := toNumber(v); ok {
+		return "n:" + strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	switch v := v.(type) {
+	case string:
+		return "s:" + v
+	case bool:
+		return "b:" + strconv.FormatBool(v)
+	case nil:
+		return "null"
+	}
+	b, _ := json.Marshal(v)
+	return "j:" + string(b)
+}
+
+func (d *Driver) indexUpdate(collection, key string, b []byte) {
+	d.mu.Lock()
+	indexes := d.indexes[collection]
+	d.mu.Unlock()
+	for _, idx := range indexes {
+		idx.mu.Lock()
+		idx.put(key, b)
+		idx.mu.Unlock()
+	}
+}
+
+// indexRemove drops key from the indexes of collection. An empty key
+// clears them.
+func (d *Driver) indexRemove(collection, key string) {
+	d.mu.Lock()
+	indexes := d.indexes[collection]
+	d.mu.Unlock()
+	for _, idx := range indexes {
+		idx.mu.Lock()
+		if key == "" {
+			idx.values = make(map[string]map[string]bool)
+			idx.byKey = make(map[string]string)
+		} else {
+			idx.remove(key)
+		}
+		idx.mu.Unlock()
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Meta describes the stored file of a record.
+type Meta struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// keyIndex is the in-memory list of the records of one collection.
+type keyIndex struct {
+	keys []string // sorted
+	meta map[string]Meta
+}
+
+func (ki *keyIndex) put(key string, m Meta) {
+	if _, ok := ki.meta[key]; !ok {
+		i := sort.SearchStrings(ki.keys, key)
+		ki.keys = append(ki.keys, "")
+		copy(ki.keys[i+1:], ki.keys[i:])
+		ki.keys[i] = key
+	}
+	ki.meta[key] = m
+}
+
+func (ki *keyIndex) remove(key string) {
+	if _, ok := ki.meta[key]; !ok {
+		return
+	}
+	delete(ki.meta, key)
+	i := sort.SearchStrings(ki.keys, key)
+	ki.keys = append(ki.keys[:i], ki.keys[i+1:]...)
+}
+
+// listCollection reads the key index of collection from disk.
+func (d *Driver) listCollection(collection string) (*keyIndex, error) {
+	files, err := os.ReadDir(d.collectionDir(collection))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	ki := &keyIndex{meta: make(map[string]Meta)}
+	for _, file := range files {
+		key, ok := d.recordKey(file)
+		if !ok {
+			continue
+		}
+		meta, err := entryMeta(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ki.keys = append(ki.keys, key)
+		ki.meta[key] = meta
+	}
+	sort.Strings(ki.keys)
+	return ki, nil
+}
+
+// recordKey returns the key of the record stored in a file of a collection
+// directory. ok is false for entries that are not records: directories,
+// files without the .json extension, such as the temporary files of atomic
+// writes, and hidden files, such as editor swap files, unless
+// Options.HiddenRecords is set.
+func (d *Driver) recordKey(entry os.DirEntry) (key string, ok bool) {
+	name := entry.Name()
+	if !entry.Type().IsRegular() || !strings.HasSuffix(name, ".json") {
+		return "", false
+	}
+	if strings.HasPrefix(name, ".") && !d.hidden {
+		return "", false
+	}
+	return strings.TrimSuffix(name, ".json"), true
+}
+
+// entryMeta returns the Meta of a record file listed by os.ReadDir, failing
+// with an error matching os.ErrNotExist if it was removed since.
+func entryMeta(entry os.DirEntry) (Meta, error) {
+	info, err := entry.Info()
+	if err != nil {
+		return Meta{}, err
+	}
+	return Meta{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// openKeyIndex loads the key index of every collection.
+func (d *Driver) openKeyIndex() error {
+	names, err := d.Collections()
+	if err != nil {
+		return err
+	}
+	d.keys = make(map[string]*keyIndex)
+	for _, collection := range names {
+		ki, err := d.listCollection(collection)
+		if err != nil {
+			return err
+		}
+		d.keys[collection] = ki
+	}
+	return nil
+}
+
+// keyIndexFor returns the key index of collection, from memory when
+// Options.KeyIndex is set and from a directory listing otherwise. The result
+// must only be read.
+func (d *Driver) keyIndexFor(collection string) (*keyIndex, error) {
+	if d.keys == nil {
+		return d.listCollection(collection)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if ki, ok := d.keys[collection]; ok {
+		return ki, nil
+	}
+	return &keyIndex{meta: map[string]Meta{}}, nil
+}
+
+func (d *Driver) keyIndexPut(collection, key string, size int64) {
+	if d.keys == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ki, ok := d.keys[collection]
+	if !ok {
+		ki = &keyIndex{meta: make(map[string]Meta)}
+		d.keys[collection] = ki
+	}
+	ki.put(key, Meta{Size: size, ModTime: d.now()})
+}
+
+func (d *Driver) keyIndexRemove(collection, key string) {
+	if d.keys == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if key == "" {
+		delete(d.keys, collection)
+	} else if ki, ok := d.keys[collection]; ok {
+		ki.remove(key)
+	}
+}
+
+// Keys returns the sorted keys of the records in collection.
+func (d *Driver) Keys(collection string) ([]string, error) {
+	return d.KeysWithPrefix(collection, "")
+}
+
+// KeysWithPrefix returns the sorted keys of collection starting with prefix.
+func (d *Driver) KeysWithPrefix(collection, prefix string) ([]string, error) {
+	if err := checkCollection(collection); err != nil {
+		return nil, err
+	}
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+	ki, err := d.keyIndexFor(collection)
+	if err != nil {
+		return nil, err
+	}
+	i := sort.SearchStrings(ki.keys, prefix)
+	j := i
+	for j < len(ki.keys) && strings.HasPrefix(ki.keys[j], prefix) {
+		j++
+	}
+	return append([]string(nil), ki.keys[i:j]...), nil
+}
+
+// Count returns the number of records in collection.
+func (d *Driver) Count(collection string) (int, error) {
+	if err := checkCollection(collection); err != nil {
+		return 0, err
+	}
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+	ki, err := d.keyIndexFor(collection)
+	if err != nil {
+		return 0, err
+	}
+	return len(ki.keys), nil
+}
+
+// Stat returns the size and modification time of a record.
+func (d *Driver) Stat(collection, resource string) (Meta, error) {
+	if err := checkCollection(collection); err != nil {
+		return Meta{}, err
+	}
+	if err := d.checkResource(resource); err != nil {
+		return Meta{}, err
+	}
+	if d.keys != nil {
+		mutex := d.getOrCreateMutex(collection)
+		mutex.Lock()
+		defer mutex.Unlock()
+		ki, _ := d.keyIndexFor(collection)
+		if m, ok := ki.meta[resource]; ok {
+			return m, nil
+		}
+		return Meta{}, notExist(d.recordPath(collection, resource))
+	}
+	fi, err := os.Stat(d.recordPath(collection, resource))
+	if err != nil {
+		return Meta{}, err
+	}
+	return Meta{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly || js
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// linkCount returns the number of hard links to f. ok is false if it
+// cannot be told.
+func linkCount(f *os.File) (n uint64, ok bool) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Nlink), true
+}
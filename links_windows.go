@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// linkCount returns the number of hard links to f. ok is false if it
+// cannot be told.
+func linkCount(f *os.File) (n uint64, ok bool) {
+	var info syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(syscall.Handle(f.Fd()), &info); err != nil {
+		return 0, false
+	}
+	return uint64(info.NumberOfLinks), true
+}
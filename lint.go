@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Issue is a data-quality problem found by a lint rule.
+type Issue struct {
+	Collection string
+	Key        string
+	// Field is the dotted path of the offending field, empty for problems
+	// with the record as a whole.
+	Field   string
+	Problem string
+}
+
+func (i Issue) String() string {
+	if i.Field == "" {
+		return fmt.Sprintf("%s/%s: %s", i.Collection, i.Key, i.Problem)
+	}
+	return fmt.Sprintf("%s/%s: %s: %s", i.Collection, i.Key, i.Field, i.Problem)
+}
+
+// LintRule checks a record and returns its problems. Rules only fill in
+// Field and Problem; Lint adds the collection and key.
+type LintRule func(value map[string]interface{}) []Issue
+
+// LintRequired reports the fields of fields, dotted paths, that a record
+// lacks or holds null or an empty string in.
+func LintRequired(fields ...string) LintRule {
+	return func(doc map[string]interface{}) []Issue {
+		var issues []Issue
+		for _, field := range fields {
+			if v, ok := lookup(doc, field); !ok || v == nil || v == "" {
+				issues = append(issues, Issue{Field: field, Problem: "is missing"})
+			}
+		}
+		return issues
+	}
+}
+
+// LintMatch reports a field holding anything but a string matching re,
+// such as a phone number of the wrong format. Records without the field
+// pass; combine it with LintRequired to require one.
+func LintMatch(field string, re *regexp.Regexp) LintRule {
+	return func(doc map[string]interface{}) []Issue {
+		v, ok := lookup(doc, field)
+		if !ok {
+			return nil
+		}
+		if s, isString := v.(string); !isString || !re.MatchString(s) {
+			return []Issue{{Field: field, Problem: fmt.Sprintf("does not match %s", re)}}
+		}
+		return nil
+	}
+}
+
+// AddLintRule registers rule to be run by Lint on every record of
+// collection.
+func (d *Driver) AddLintRule(collection string, rule LintRule) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.lintRules == nil {
+		d.lintRules = make(map[string][]LintRule)
+	}
+	d.lintRules[collection] = append(d.lintRules[collection], rule)
+	return nil
+}
+
+// Lint runs the rules registered for collection with AddLintRule over its
+// records and returns every problem found, in key order. Rules see the
+// records as stored, before masking. The records are taken from a
+// snapshot, so slow rules do not hold the collection lock. Records that
+// are not JSON objects are reported rather than failing the run.
+func (d *Driver) Lint(collection string) ([]Issue, error) {
+	d.mu.Lock()
+	rules := append([]LintRule(nil), d.lintRules[collection]...)
+	d.mu.Unlock()
+	s, err := d.Snapshot(collection)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	var issues []Issue
+	for _, key := range s.keys {
+		b, err := s.raw(key)
+		if err != nil {
+			return issues, err
+		}
+		doc, err := decodeDoc(b)
+		if err != nil {
+			issues = append(issues, Issue{Collection: collection, Key: key, Problem: fmt.Sprintf("is not a JSON object: %v", err)})
+			continue
+		}
+		for _, rule := range rules {
+			for _, issue := range rule(doc) {
+				issue.Collection, issue.Key = collection, key
+				issues = append(issues, issue)
+			}
+		}
+	}
+	return issues, nil
+}
+
+// lint checks the records of collections against rules given as flags
+// and fails if any has a problem:
+// lint [-dir path] [-required field,...] [-match field=regexp]... collection...
+func lint(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	dir := fs.String("dir", "./", "database directory")
+	required := fs.String("required", "", "comma-separated `fields` every record must hold")
+	var rules []LintRule
+	fs.Func("match", "`field=regexp` a string field must match; may be repeated", func(s string) error {
+		field, expr, ok := strings.Cut(s, "=")
+		if !ok || field == "" {
+			return fmt.Errorf("want field=regexp")
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, LintMatch(field, re))
+		return nil
+	})
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("lint: no collections given")
+	}
+	if *required != "" {
+		rules = append(rules, LintRequired(strings.Split(*required, ",")...))
+	}
+
+	db, err := New(*dir, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	n := 0
+	for _, collection := range fs.Args() {
+		for _, rule := range rules {
+			if err := db.AddLintRule(collection, rule); err != nil {
+				return err
+			}
+		}
+		issues, err := db.Lint(collection)
+		if err != nil {
+			return err
+		}
+		for _, issue := range issues {
+			fmt.Fprintln(out, issue)
+		}
+		n += len(issues)
+	}
+	if n > 0 {
+		return fmt.Errorf("%d problems found", n)
+	}
+	fmt.Fprintln(out, "no problems found")
+	return nil
+}
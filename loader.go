@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// WithLoader makes Read populate missing records of collection from load,
+// for collections that cache an external source such as an API or a
+// legacy database. When a Read finds no record, load is called with its
+// key under the collection lock, so concurrent Reads of a missing key load
+// it only once, and the value it returns is written as the record before
+// being read back. load returns a nil value when the source does not have
+// the record either, and Read then fails as it would without a loader;
+// errors from load are returned by Read. Loaded records are written
+// straight to disk even under Options.WriteBehind. A nil load removes the
+// loader.
+func (d *Driver) WithLoader(collection string, load func(key string) (interface{}, error)) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if load == nil {
+		delete(d.loaders, collection)
+		return nil
+	}
+	if d.loaders == nil {
+		d.loaders = make(map[string]func(key string) (interface{}, error))
+	}
+	d.loaders[collection] = load
+	return nil
+}
+
+func (d *Driver) loader(collection string) func(key string) (interface{}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.loaders[collection]
+}
+
+// load fills the missing record collection/key from load and decodes it
+// into v.
+func (d *Driver) load(collection, key string, v interface{}, load func(key string) (interface{}, error)) error {
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// Another Read may have loaded the record while this one waited for
+	// the lock.
+	if err := d.read(collection, key, v); !os.IsNotExist(err) {
+		return err
+	}
+	value, err := load(key)
+	if err != nil {
+		return fmt.Errorf("unable to load %s/%s: %w", collection, key, err)
+	}
+	if value == nil {
+		return notExist(d.recordPath(collection, key))
+	}
+	b, err := d.encode(value)
+	if err != nil {
+		return err
+	}
+	if err := d.write(collection, key, b); err != nil {
+		return err
+	}
+	d.log.Debug("Loaded '%s/%s'\n", collection, key)
+	return d.read(collection, key, v)
+}
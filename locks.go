@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// recordLock is an advisory lock on one record. ch holds a token while the
+// lock is held; refs counts holders and waiters so the entry can be dropped
+// when nobody needs it.
+type recordLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+// Lock blocks until the caller holds the advisory lock on the record
+// resource of collection and returns the function that releases it. The
+// lock only excludes other Lock callers: it lets an application serialize a
+// read-modify-write workflow spanning several calls, while Read and Write
+// keep working and still take their own, shorter locks.
+func (d *Driver) Lock(collection, resource string) func() {
+	l := d.recordLock(collection, resource)
+	l.ch <- struct{}{}
+	return d.unlocker(collection, resource, l)
+}
+
+// TryLock takes the advisory lock on a record like Lock if it is free and
+// reports whether it did.
+func (d *Driver) TryLock(collection, resource string) (func(), bool) {
+	l := d.recordLock(collection, resource)
+	select {
+	case l.ch <- struct{}{}:
+		return d.unlocker(collection, resource, l), true
+	default:
+		d.dropLock(collection, resource, l)
+		return nil, false
+	}
+}
+
+// LockTimeout takes the advisory lock on a record like Lock, giving up
+// with ErrLockTimeout after timeout.
+func (d *Driver) LockTimeout(collection, resource string, timeout time.Duration) (func(), error) {
+	l := d.recordLock(collection, resource)
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case l.ch <- struct{}{}:
+		return d.unlocker(collection, resource, l), nil
+	case <-t.C:
+		d.dropLock(collection, resource, l)
+		return nil, ErrLockTimeout
+	}
+}
+
+func (d *Driver) recordLock(collection, resource string) *recordLock {
+	id := collection + "/" + resource
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.locks == nil {
+		d.locks = make(map[string]*recordLock)
+	}
+	l, ok := d.locks[id]
+	if !ok {
+		l = &recordLock{ch: make(chan struct{}, 1)}
+		d.locks[id] = l
+	}
+	l.refs++
+	return l
+}
+
+func (d *Driver) dropLock(collection, resource string, l *recordLock) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if l.refs--; l.refs == 0 {
+		delete(d.locks, collection+"/"+resource)
+	}
+}
+
+// unlocker returns a release function that is safe to call more than once.
+func (d *Driver) unlocker(collection, resource string, l *recordLock) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-l.ch
+			d.dropLock(collection, resource, l)
+		})
+	}
+}
@@ -0,0 +1,197 @@
+// Package locks provides named, lease-style locks stored as records of a
+// collection, so that processes sharing a database directory can make sure
+// only one of them runs a job at a time. A lease expires after its TTL
+// unless renewed, so a crashed holder cannot block the others forever.
+package locks
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+)
+
+var (
+	// ErrHeld is returned by Acquire while another owner holds an
+	// unexpired lease on the lock.
+	ErrHeld = errors.New("lock is held by another owner")
+
+	// ErrLost is returned by Renew and Release when the lease has expired
+	// and been taken over, or was released.
+	ErrLost = errors.New("lease is no longer held")
+)
+
+// Store is the subset of the database driver the locks need.
+type Store interface {
+	Read(collection, resource string, v interface{}) error
+	Write(collection, resource string, v interface{}) error
+	Delete(collection, resource string) error
+	Exclusive(collection, resource string, fn func() error) error
+}
+
+// Lease is a held lock. Token increases every time the lock changes
+// hands, so it can be passed along with writes as a fencing token.
+type Lease struct {
+	Name    string
+	Owner   string
+	Token   int64
+	Expires time.Time
+}
+
+// Locks hands out leases on behalf of one owner.
+type Locks struct {
+	store      Store
+	collection string
+	owner      string
+}
+
+// New returns the locks stored in collection, acquired in the name of
+// owner. An empty owner is replaced by one made of the host name, process
+// ID and a random number.
+func New(store Store, collection, owner string) *Locks {
+	if owner == "" {
+		host, _ := os.Hostname()
+		owner = fmt.Sprintf("%s:%d:%x", host, os.Getpid(), rand.Int63())
+	}
+	return &Locks{store: store, collection: collection, owner: owner}
+}
+
+// Owner returns the name leases are acquired under.
+func (l *Locks) Owner() string {
+	return l.owner
+}
+
+// Acquire takes the lock name for ttl, failing with ErrHeld if another
+// owner holds it. Acquiring a lock already held by this owner extends it.
+func (l *Locks) Acquire(name string, ttl time.Duration) (*Lease, error) {
+	var lease *Lease
+	err := l.store.Exclusive(l.collection, name, func() error {
+		current, err := l.read(name)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		next := Lease{Name: name, Owner: l.owner, Token: 1, Expires: now.Add(ttl)}
+		if current != nil {
+			if current.Owner != l.owner && now.Before(current.Expires) {
+				return fmt.Errorf("%w: %s until %s", ErrHeld, current.Owner, current.Expires.Format(time.RFC3339))
+			}
+			next.Token = current.Token
+			if current.Owner != l.owner {
+				next.Token++
+			}
+		}
+		if err := l.store.Write(l.collection, name, next); err != nil {
+			return err
+		}
+		lease = &next
+		return nil
+	})
+	return lease, err
+}
+
+// Renew extends a lease by ttl from now.
+func (l *Locks) Renew(lease *Lease, ttl time.Duration) error {
+	return l.store.Exclusive(l.collection, lease.Name, func() error {
+		if err := l.check(lease); err != nil {
+			return err
+		}
+		next := *lease
+		next.Expires = time.Now().Add(ttl)
+		if err := l.store.Write(l.collection, lease.Name, next); err != nil {
+			return err
+		}
+		*lease = next
+		return nil
+	})
+}
+
+// Release gives up a lease.
+func (l *Locks) Release(lease *Lease) error {
+	return l.store.Exclusive(l.collection, lease.Name, func() error {
+		if err := l.check(lease); err != nil {
+			return err
+		}
+		return l.store.Delete(l.collection, lease.Name)
+	})
+}
+
+// Run calls fn while holding the lock name and reports whether it did. If
+// another owner holds the lock, fn is skipped and Run returns false with
+// no error. The lease is renewed every ttl/3 while fn runs.
+func (l *Locks) Run(name string, ttl time.Duration, fn func() error) (bool, error) {
+	lease, err := l.Acquire(name, ttl)
+	if errors.Is(err, ErrHeld) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	done := make(chan struct{})
+	renewed := make(chan error, 1)
+	go func() {
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				renewed <- nil
+				return
+			case <-ticker.C:
+				if err := l.Renew(lease, ttl); err != nil {
+					renewed <- err
+					return
+				}
+			}
+		}
+	}()
+	err = fn()
+	close(done)
+	if rerr := <-renewed; rerr != nil {
+		if err == nil {
+			err = rerr
+		}
+		return true, err
+	}
+	if rerr := l.Release(lease); err == nil {
+		err = rerr
+	}
+	return true, err
+}
+
+// Holder returns the current lease on the lock name, or nil if it is free
+// or expired.
+func (l *Locks) Holder(name string) (*Lease, error) {
+	lease, err := l.read(name)
+	if err != nil || lease == nil || !time.Now().Before(lease.Expires) {
+		return nil, err
+	}
+	return lease, nil
+}
+
+func (l *Locks) read(name string) (*Lease, error) {
+	var lease Lease
+	err := l.store.Read(l.collection, name, &lease)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// check fails with ErrLost unless lease is still the stored lease and has
+// not expired.
+func (l *Locks) check(lease *Lease) error {
+	current, err := l.read(lease.Name)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Owner != lease.Owner || current.Token != lease.Token || !time.Now().Before(current.Expires) {
+		return ErrLost
+	}
+	return nil
+}
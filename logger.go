@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Levels of a ConsoleLogger, from the most verbose.
+const (
+	LevelTrace = iota
+	LevelDebug
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelFatal
+)
+
+var levelNames = []string{"TRACE", "DEBUG", "INFO ", "WARN ", "ERROR", "FATAL"}
+
+// ConsoleLogger is the Logger used when Options.Logger is nil. It writes
+// messages of its level and above to an io.Writer, one per line, prefixed
+// with the time and level:
+//
+//	2006-01-02 15:04:05 INFO  Using './' (database already exist)
+//
+// Fatal only logs; it does not exit.
+type ConsoleLogger struct {
+	mu    sync.Mutex
+	out   io.Writer
+	level int
+}
+
+// NewConsoleLogger returns a logger writing messages of level and above to
+// w, or to standard output if w is nil.
+func NewConsoleLogger(w io.Writer, level int) *ConsoleLogger {
+	if w == nil {
+		w = os.Stdout
+	}
+	return &ConsoleLogger{out: w, level: level}
+}
+
+func (l *ConsoleLogger) Fatal(format string, v ...interface{}) { l.output(LevelFatal, format, v) }
+func (l *ConsoleLogger) Error(format string, v ...interface{}) { l.output(LevelError, format, v) }
+func (l *ConsoleLogger) Warn(format string, v ...interface{})  { l.output(LevelWarn, format, v) }
+func (l *ConsoleLogger) Info(format string, v ...interface{})  { l.output(LevelInfo, format, v) }
+func (l *ConsoleLogger) Debug(format string, v ...interface{}) { l.output(LevelDebug, format, v) }
+func (l *ConsoleLogger) Trace(format string, v ...interface{}) { l.output(LevelTrace, format, v) }
+
+func (l *ConsoleLogger) output(level int, format string, v []interface{}) {
+	if level < l.level {
+		return
+	}
+	msg := fmt.Sprintf(format, v...)
+	buf := make([]byte, 0, 27+len(msg))
+	buf = time.Now().AppendFormat(buf, "2006-01-02 15:04:05")
+	buf = append(buf, ' ')
+	buf = append(buf, levelNames[level]...)
+	buf = append(buf, ' ')
+	buf = append(buf, msg...)
+	if len(msg) > 0 && msg[len(msg)-1] != '\n' {
+		buf = append(buf, '\n')
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(buf)
+}
+
+// NopLogger is a Logger that discards every message, for embedded uses
+// where there is nowhere to log to.
+type NopLogger struct{}
+
+func (NopLogger) Fatal(string, ...interface{}) {}
+func (NopLogger) Error(string, ...interface{}) {}
+func (NopLogger) Warn(string, ...interface{})  {}
+func (NopLogger) Info(string, ...interface{})  {}
+func (NopLogger) Debug(string, ...interface{}) {}
+func (NopLogger) Trace(string, ...interface{}) {}
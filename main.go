@@ -3,13 +3,12 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sync"
-
-	"github.com/jcelliott/lumber"
+	"time"
 )
 
 type User struct {
@@ -40,37 +39,465 @@ type (
 	}
 
 	Driver struct {
-		mu      sync.Mutex
-		mutexes map[string]*sync.Mutex
-		dir     string
-		log     Logger
+		mu         sync.Mutex
+		mutexes    map[string]*collectionMutex
+		dir        string
+		log        Logger
+		masks      map[string]map[string]Masker
+		shred      bool
+		retry      RetryPolicy
+		sync       bool
+		maxSize    int64
+		casMu      sync.Mutex
+		casUploads map[string]bool // temporary files of casPut calls in progress
+		geo        map[string]*geoIndex
+		indexes    map[string]map[string]*index
+		locks      map[string]*recordLock
+		sched      *scheduler
+		bg         sync.WaitGroup
+		blooms     map[string]*bloom
+		keys       map[string]*keyIndex
+		sortBuffer int
+		watchMu    sync.Mutex
+		watchers   map[*changeSet]struct{}
+		obsMu      sync.Mutex
+		observers  map[*observer]struct{}
+		clog       *changeLog
+		pool       *handlePool
+		mmapMin    int64
+		hooks      *webhooks
+		wb         *writeBehind
+		codecs     map[reflect.Type]Codec
+		codecTypes sync.Map
+		canonical  bool
+		repo       *gitRepo
+		ttl        *expiry
+		pinned     *pins
+		strict     bool
+		hidden     bool
+		noUnknown  bool
+		types      map[string]reflect.Type
+		loaders    map[string]func(key string) (interface{}, error)
+		lintRules  map[string][]LintRule
+		openReport *Report
+		lock       *dirLock
+		clock      Clock
+		ids        func() string
+		search     SearchIndex
+		searchOnly map[string]bool // collections fed to search, nil for all
+		configMu   sync.Mutex
+		configs    map[string]CollectionConfig
+		workers    int
+		useNumber  bool
+		group      *groupCommit
+		backend    Backend
+		native     bool // backend is the operating system
+		disk       *diskGuard
+		placement  []Placement
+		readOnly   bool
+		opts       Options // as given to New, for OpenSnapshot
 	}
 )
 
 type Options struct {
+	// Logger receives the log messages of the driver. It defaults to a
+	// ConsoleLogger writing LevelInfo and above to standard output; use
+	// NopLogger to silence it.
 	Logger Logger
+
+	// Masks redacts string fields on every record handed out by Read and
+	// ReadAll, keyed by collection and then by dotted field path
+	// (e.g. "Address.City"). Open a separate Driver with masks set for
+	// support tooling that must not see full PII.
+	Masks map[string]map[string]Masker
+
+	// Shred makes Purge overwrite record files with zeros before removing
+	// them. Files hard-linked elsewhere, by CloneCollection, Snapshot or a
+	// checkpoint, are only removed, so the other copies stay intact.
+	Shred bool
+
+	// Retry controls how filesystem operations that fail with a transient
+	// error are retried. The zero value disables retries.
+	Retry RetryPolicy
+
+	// SyncWrites flushes every record and its directory to stable storage
+	// before Write returns.
+	SyncWrites bool
+
+	// GroupCommit makes concurrent Writes under SyncWrites share the sync
+	// of their collection's directory: each writer still flushes its own
+	// record, but the directory is synced once for every writer that
+	// finished while the previous sync ran, which raises durable write
+	// throughput under load. A lone writer waits for no one.
+	GroupCommit bool
+
+	// GroupCommitWindow delays each shared directory sync by this long so
+	// that more writers join it, trading latency for throughput.
+	GroupCommitWindow time.Duration
+
+	// Backend is the filesystem record files live in. It defaults to the
+	// operating system; see FaultBackend for testing against failures.
+	Backend Backend
+
+	// MaxRecordSize caps the encoded size of a record accepted by Write.
+	// Zero means no limit. Use WriteFrom for values that are too large to
+	// hold as a single JSON document.
+	MaxRecordSize int64
+
+	// BloomFilters keeps a bloom filter of the keys of every collection so
+	// that Has and Read can reject missing keys without a file stat. The
+	// filters are saved by Close and rebuilt on open if stale.
+	BloomFilters bool
+
+	// KeyIndex loads the keys, sizes and modification times of every record
+	// into memory at open, so Keys, Count, Has and Stat never hit the
+	// filesystem.
+	KeyIndex bool
+
+	// SortBufferSize is the number of records a sorted Query holds in
+	// memory before spilling sorted runs to temporary files. It defaults to
+	// 10000.
+	SortBufferSize int
+
+	// ChangeLog records every write and delete in a log under the metadata
+	// directory and takes periodic checkpoints of all collections, so that
+	// RestoreToTime can rebuild the records as of any moment.
+	ChangeLog bool
+
+	// CheckpointInterval is how often a checkpoint is taken when ChangeLog
+	// is set. It defaults to an hour.
+	CheckpointInterval time.Duration
+
+	// ChangeLogRetention is how far back RestoreToTime can go. Older
+	// checkpoints and log segments are removed. Zero keeps everything.
+	ChangeLogRetention time.Duration
+
+	// MaxOpenFiles keeps up to this many record files open between Reads,
+	// evicting the least recently read, to save an open and close per
+	// Read on hot records. It is capped at half the process's open-file
+	// limit. Zero disables pooling; it is always disabled on Windows.
+	MaxOpenFiles int
+
+	// MmapThreshold makes Read decode records of at least this many bytes
+	// straight from a read-only memory mapping of the file instead of
+	// copying them onto the heap first. Zero disables mapping. Platforms
+	// without mmap always read.
+	MmapThreshold int64
+
+	// WriteBehind makes Write and Delete return as soon as the mutation is
+	// queued, leaving a background writer to apply the queue in order.
+	// Read, Has, ReadAll, Find and Query see queued mutations at once, so
+	// callers always read their own writes; Keys, Count, Stat, indexes and
+	// change subscribers see them once applied. Operations that rewrite or
+	// copy records, such as transactions, WriteIf, snapshots and backups,
+	// wait for the queue first. Use Flush to wait for the disk and to
+	// learn of failed writes, which are otherwise only logged. Close
+	// applies whatever is still queued.
+	WriteBehind bool
+
+	// CoalesceWindow makes WriteBehind hold every queued mutation for the
+	// window before applying it, and turns WriteBehind on. When a key is
+	// written or deleted again while its mutation is held, the newer one
+	// replaces it, so a record updated many times a second, such as a
+	// status record, reaches the disk about once per window. Only the
+	// versions applied are seen by the change log, git, hooks, indexes and
+	// change subscribers; reads see the newest version at once, as with
+	// WriteBehind. A replacing mutation keeps the place in the queue of
+	// the one it replaces, so it can be applied before mutations of other
+	// keys made in between; the change log records the order applied and
+	// so always matches the disk. Flush, Close and the operations that wait
+	// for the queue apply held mutations without waiting out the window.
+	CoalesceWindow time.Duration
+
+	// Codecs overrides how values of the given types are stored, for
+	// example TimeUnix for time.Time or BigIntString for *big.Int. See
+	// Codec.
+	Codecs map[reflect.Type]Codec
+
+	// CanonicalJSON stores every record with the keys of all objects,
+	// including struct fields, in sorted order and one fixed layout, so
+	// that records kept under version control produce minimal diffs.
+	CanonicalJSON bool
+
+	// Git commits every write and delete to a git repository in the
+	// database directory. See GitOptions.
+	Git *GitOptions
+
+	// ReadOnly opens an existing database without changing it: writes,
+	// deletes and other changes fail with ErrReadOnly, expired records are
+	// not swept, webhooks are not delivered, and no lock is taken on the
+	// directory. It suits copies such as snapshots, see OpenSnapshot, and
+	// read-only media. Options that change the database, such as
+	// WriteBehind, ChangeLog and Git, are ignored, and RepairOnOpen only
+	// checks.
+	ReadOnly bool
+
+	// Placement keeps collections in directories other than the database
+	// directory, typically on other volumes: hot collections on an SSD,
+	// archives on a larger, slower disk. The first rule matching a
+	// collection applies; collections matching none, and the metadata
+	// directory with blobs and attachments, stay in the database
+	// directory. New moves the collections of the database directory that
+	// a rule places elsewhere, so rules can be added to an existing
+	// database; removing a rule strands the collections it placed, so move
+	// them back first. A placement directory belongs to one database.
+	// Collections placed elsewhere are not versioned by Git and not
+	// covered by MinFreeSpace.
+	Placement []Placement
+
+	// Strict requires collections to be created with CreateCollection
+	// before records are written to them. Writes to other collections fail
+	// with ErrUnknownCollection instead of creating a directory, so a
+	// mistyped name is caught. Collections already on disk count as
+	// created.
+	Strict bool
+
+	// StrictDecode makes reads fail when a record holds fields that the
+	// value it is decoded into does not declare, instead of dropping
+	// them. See also RegisterType.
+	StrictDecode bool
+
+	// HiddenRecords makes ReadAll, Keys, queries and the other listings
+	// include record files whose names start with a dot. They are skipped
+	// by default, being usually editor swap files or files of tools
+	// syncing the directory; set it to read such files intentionally.
+	HiddenRecords bool
+
+	// ExpiryInterval is how often records given an expiry with Expire are
+	// swept. It defaults to one minute.
+	ExpiryInterval time.Duration
+
+	// QueryConcurrency is how many goroutines Find and Query use to read,
+	// decode and filter the records of large collections, e.g.
+	// runtime.NumCPU(). Results are the same as with a single goroutine,
+	// which is what zero and one mean.
+	QueryConcurrency int
+
+	// UseNumber decodes numbers read into interface{} values, such as the
+	// fields of a map[string]interface{} record, as json.Number instead of
+	// float64, so that large integers keep every digit.
+	UseNumber bool
+
+	// MinFreeSpace makes Write and WriteFrom fail with ErrDiskFull, before
+	// touching any file, when the volume holding the database has fewer
+	// than this many bytes available, keeping room for the metadata and
+	// for operators to react. Zero disables the check. Writes that run
+	// out of space regardless fail with ErrDiskFull too, and leave no
+	// temporary file behind.
+	MinFreeSpace int64
+
+	// FreeSpaceWarning logs a warning and calls OnDiskAlert once the
+	// volume has fewer than this many bytes available, ahead of
+	// MinFreeSpace. Zero disables the warning.
+	FreeSpaceWarning int64
+
+	// OnDiskAlert is called on its own goroutine whenever the free space
+	// crosses FreeSpaceWarning or MinFreeSpace, in either direction.
+	OnDiskAlert func(DiskAlert)
+
+	// CheckOnOpen makes New run Check, logging every anomaly found; the
+	// report is kept for OpenReport. It reads every record, so opening
+	// takes as long as reading the whole database.
+	CheckOnOpen bool
+
+	// RepairOnOpen is CheckOnOpen with the repairs of Check applied.
+	RepairOnOpen bool
+
+	// SharedAccess lets the directory be opened while another Driver, in
+	// this process or another, has it open. By default New fails with
+	// ErrAlreadyOpen instead, since drivers sharing a directory do not
+	// see each other's locks, queues or in-memory indexes and can
+	// overwrite each other's writes. Set it only for drivers that
+	// coordinate some other way, such as read-only tooling.
+	SharedAccess bool
+
+	// Clock is the source of the time for the driver's timestamps and
+	// deadlines. It defaults to the system clock; see ManualClock.
+	Clock Clock
+
+	// IDGenerator makes the IDs of transactions and webhooks and the id
+	// function of seed templates. It defaults to random hex strings; see
+	// SequentialIDs. IDs must be unique and usable as file names.
+	IDGenerator func() string
+
+	// Search feeds every record written to a full-text index, queried
+	// with SearchQuery. See SearchIndex.
+	Search SearchIndex
+
+	// SearchCollections limits Search to the named collections. Empty
+	// means every collection.
+	SearchCollections []string
 }
 
-func New(dir string, options *Options) (*Driver, error) {
+func New(dir string, options *Options) (_ *Driver, err error) {
 	dir = filepath.Clean(dir)
 	opts := Options{}
 	if options != nil {
 		opts = *options
 	}
 	if opts.Logger == nil {
-		opts.Logger = lumber.NewConsoleLogger(lumber.INFO)
+		opts.Logger = NewConsoleLogger(nil, LevelInfo)
 	}
 	driver := Driver{
-		dir:     dir,
-		mutexes: make(map[string]*sync.Mutex),
-		log:     opts.Logger,
+		dir:        dir,
+		mutexes:    make(map[string]*collectionMutex),
+		log:        opts.Logger,
+		masks:      opts.Masks,
+		shred:      opts.Shred,
+		retry:      opts.Retry,
+		sync:       opts.SyncWrites,
+		maxSize:    opts.MaxRecordSize,
+		sortBuffer: opts.SortBufferSize,
+		pool:       newHandlePool(opts.MaxOpenFiles),
+		mmapMin:    opts.MmapThreshold,
+		codecs:     opts.Codecs,
+		canonical:  opts.CanonicalJSON,
+		strict:     opts.Strict,
+		hidden:     opts.HiddenRecords,
+		noUnknown:  opts.StrictDecode,
+		workers:    opts.QueryConcurrency,
+		useNumber:  opts.UseNumber,
+	}
+	if opts.Backend == nil {
+		opts.Backend = OSBackend{}
+	}
+	if driver.clock = opts.Clock; driver.clock == nil {
+		driver.clock = systemClock{}
+	}
+	if driver.ids = opts.IDGenerator; driver.ids == nil {
+		driver.ids = randomID
+	}
+	driver.search = opts.Search
+	if len(opts.SearchCollections) > 0 {
+		driver.searchOnly = make(map[string]bool)
+		for _, name := range opts.SearchCollections {
+			driver.searchOnly[name] = true
+		}
+	}
+	if driver.placement, err = checkPlacement(opts.Placement); err != nil {
+		return nil, err
+	}
+	driver.opts = opts
+	if opts.CoalesceWindow > 0 {
+		opts.WriteBehind = true
+	}
+	if driver.readOnly = opts.ReadOnly; driver.readOnly {
+		opts.SharedAccess = true
+		opts.WriteBehind, opts.ChangeLog, opts.Git = false, false, nil
+		opts.CheckOnOpen = opts.CheckOnOpen || opts.RepairOnOpen
+		opts.RepairOnOpen = false
+	}
+	driver.backend = opts.Backend
+	_, driver.native = opts.Backend.(OSBackend)
+	if opts.SyncWrites && opts.GroupCommit {
+		driver.group = &groupCommit{window: opts.GroupCommitWindow, dirs: make(map[string]*dirGroup), syncDir: opts.Backend.SyncDir}
 	}
 	if _, err := os.Stat(dir); err == nil {
 		opts.Logger.Debug("Using '%s' (database already exist)\n", dir)
-		return &driver, nil
+	} else if opts.ReadOnly {
+		return &driver, err
+	} else {
+		opts.Logger.Debug("Creating database '%s'...\n", dir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return &driver, err
+		}
+	}
+	if !opts.SharedAccess {
+		if driver.lock, err = driver.lockDir(); err != nil {
+			return &driver, err
+		}
+		defer func() {
+			if err != nil {
+				driver.lock.release()
+			}
+		}()
+	}
+	driver.disk = newDiskGuard(dir, opts)
+	if !opts.ReadOnly {
+		if leftovers, err := os.ReadDir(driver.metaPath("trash")); err == nil {
+			for _, fi := range leftovers {
+				driver.emptyTrash(driver.metaPath("trash", fi.Name()))
+			}
+		}
+		if err := driver.openPlacement(); err != nil {
+			return &driver, err
+		}
+	}
+	if err := driver.openWebhooks(); err != nil {
+		return &driver, err
+	}
+	if err := driver.openConfigs(); err != nil {
+		return &driver, err
+	}
+	if err := driver.openPins(); err != nil {
+		return &driver, err
+	}
+	if err := driver.openExpiry(opts.ExpiryInterval); err != nil {
+		return &driver, err
+	}
+	if opts.WriteBehind {
+		driver.startWriteBehind(opts.CoalesceWindow)
 	}
-	opts.Logger.Debug("Creating database '%s'...\n", dir)
-	return &driver, os.MkdirAll(dir, 0755)
+	if opts.BloomFilters {
+		if err := driver.openBlooms(); err != nil {
+			return &driver, err
+		}
+	}
+	if opts.KeyIndex {
+		if err := driver.openKeyIndex(); err != nil {
+			return &driver, err
+		}
+	}
+	if opts.ChangeLog {
+		if err := driver.openChangeLog(opts.CheckpointInterval, opts.ChangeLogRetention); err != nil {
+			return &driver, err
+		}
+	}
+	if opts.Git != nil {
+		if err := driver.openGit(*opts.Git); err != nil {
+			return &driver, err
+		}
+	}
+	if !opts.ReadOnly && !opts.SharedAccess {
+		// With SharedAccess, a journal may be that of a commit another
+		// process is applying.
+		if err := driver.recoverCommits(); err != nil {
+			return &driver, err
+		}
+	}
+	if opts.CheckOnOpen || opts.RepairOnOpen {
+		if err := driver.checkOnOpen(opts.RepairOnOpen); err != nil {
+			return &driver, err
+		}
+	}
+	return &driver, nil
+}
+
+// Close saves state kept in memory by the driver. The driver must not be
+// used afterwards.
+func (d *Driver) Close() error {
+	defer d.lock.release()
+	d.stopScheduler()
+	d.stopExpiry()
+	wbErr := d.stopWriteBehind()
+	d.closeGit()
+	d.stopWebhooks()
+	d.bg.Wait()
+	d.stopObservers()
+	if d.pool != nil {
+		d.pool.close()
+	}
+	if d.clog != nil {
+		if err := d.closeChangeLog(); err != nil {
+			return err
+		}
+	}
+	if d.blooms != nil && !d.readOnly {
+		if err := d.saveBlooms(); err != nil {
+			return err
+		}
+	}
+	return wbErr
 }
 
 func stat(path string) (fi os.FileInfo, err error) {
@@ -80,53 +507,168 @@ func stat(path string) (fi os.FileInfo, err error) {
 	return fi, err
 }
 
+// recordPath is the file a record is stored in.
+func (d *Driver) recordPath(collection, key string) string {
+	return filepath.Join(d.collectionDir(collection), key+".json")
+}
+
+func notExist(path string) error {
+	return &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+}
+
 func (d *Driver) Write(collection, resources string, v interface{}) error {
-	if collection == "" {
-		return fmt.Errorf("collection name cannot be empty")
+	if err := checkCollection(collection); err != nil {
+		return err
 	}
 	if resources == "" {
 		return fmt.Errorf("missing resource - unable to save record (no name)")
 	}
+	if err := d.checkResource(resources); err != nil {
+		return err
+	}
+	b, err := d.encode(v)
+	if err != nil {
+		return err
+	}
+	if d.wb != nil {
+		if b, err = d.format(b); err != nil {
+			return err
+		}
+		if err := d.checkWrite(collection, b); err != nil {
+			return err
+		}
+		return d.enqueue(collection, resources, b)
+	}
 	mutex := d.getOrCreateMutex(collection)
 	mutex.Lock()
-	defer mutex.Unlock()
-	dir := filepath.Join(d.dir, collection)
-	fnlPath := filepath.Join(dir, resources+".json")
-	tmpPath := fnlPath + ".tmp"
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	if d.group == nil {
+		defer mutex.Unlock()
+		return d.write(collection, resources, b)
+	}
+	// The directory is synced after the lock is released, so that the
+	// writers queueing for it share the sync.
+	err = d.writeRecord(collection, resources, b, true)
+	mutex.Unlock()
+	if err != nil {
 		return err
 	}
-	b, err := json.MarshalIndent(v, "", "\t")
+	return d.group.sync(d.collectionDir(collection))
+}
+
+// encode marshals v the way records are stored on disk.
+func encode(v interface{}) ([]byte, error) {
+	// The same output as json.MarshalIndent plus a newline, built in a
+	// pooled buffer so that only the result is allocated.
+	e := encoders.Get().(*encoder)
+	defer func() {
+		if e.buf.Cap() <= maxPooledBuffer {
+			encoders.Put(e)
+		}
+	}()
+	e.buf.Reset()
+	if err := e.enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), e.buf.Bytes()...), nil
+}
+
+// write stores an encoded record. The collection lock must be held.
+func (d *Driver) write(collection, resource string, b []byte) error {
+	return d.writeRecord(collection, resource, b, false)
+}
+
+// writeRecord is write, leaving the sync of the collection directory to
+// the caller when deferSync is set.
+func (d *Driver) writeRecord(collection, resource string, b []byte, deferSync bool) error {
+	if err := d.checkResource(resource); err != nil {
+		return err
+	}
+	b, err := d.format(b)
 	if err != nil {
 		return err
 	}
-	b = append(b, byte('\n'))
-	if err := ioutil.WriteFile(tmpPath, b, 0644); err != nil {
+	if err := d.checkWrite(collection, b); err != nil {
 		return err
 	}
-
-	return os.Rename(tmpPath, fnlPath)
+	if err := d.checkSpace(int64(len(b))); err != nil {
+		return err
+	}
+	dir := d.collectionDir(collection)
+	if err := d.mkdirAll(dir); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, resource+".json")
+	var existed bool
+	if d.hooked(collection) {
+		_, err := os.Stat(path)
+		existed = err == nil
+	}
+	write := d.writeFile
+	if deferSync {
+		write = d.replace
+	}
+	if err := write(path, b); err != nil {
+		return err
+	}
+	if err := d.logChange(collection, resource, b); err != nil {
+		return err
+	}
+	d.afterWrite(collection, resource, b)
+	d.emit(collection, resource, b, existed)
+	return nil
 }
 
 func (d *Driver) ReadAll(collection string) ([]string, error) {
-	if collection == "" {
-		return nil, fmt.Errorf("collection name cannot be empty")
+	if err := checkCollection(collection); err != nil {
+		return nil, err
 	}
-	dir := filepath.Join(d.dir, collection)
+	dir := d.collectionDir(collection)
 
-	if _, err := stat(dir); err != nil {
+	// Holding the collection lock keeps concurrent writes from showing up
+	// halfway through the listing. Use Snapshot for longer-lived views.
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	pending := d.pendingRecords(collection)
+	if _, err := stat(dir); err != nil && len(pending) == 0 {
 		return nil, err
 	}
 
-	files, err := ioutil.ReadDir(dir)
-	if err != nil {
+	files, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
 
 	var records []string
 
 	for _, file := range files {
-		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		key, ok := d.recordKey(file)
+		if !ok {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if os.IsNotExist(err) {
+			// Removed since the listing, for instance by a background
+			// Truncate.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if op, ok := pending[key]; ok {
+			delete(pending, key)
+			if data = op.b; data == nil {
+				continue
+			}
+		}
+		if data, err = d.mask(collection, data); err != nil {
+			return nil, err
+		}
+		records = append(records, string(data))
+	}
+	for _, r := range overlay(nil, pending) {
+		data, err := d.mask(collection, r.Value)
 		if err != nil {
 			return nil, err
 		}
@@ -136,58 +678,268 @@ func (d *Driver) ReadAll(collection string) ([]string, error) {
 	return records, nil
 }
 
+// scan reads every record of collection, including queued mutations (see
+// Options.WriteBehind), and returns them in key order. It does not take the
+// collection lock, but its result is only exact while the lock is held.
+func (d *Driver) scan(collection string) ([]Record[json.RawMessage], error) {
+	pending := d.pendingRecords(collection)
+	dir := d.collectionDir(collection)
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return overlay(nil, pending), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []Record[json.RawMessage]
+	for _, file := range files {
+		key, ok := d.recordKey(file)
+		if !ok {
+			continue
+		}
+		meta, err := entryMeta(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, Record[json.RawMessage]{
+			Key:   key,
+			Meta:  meta,
+			Value: data,
+		})
+	}
+	return overlay(records, pending), nil
+}
+
+// Delete removes the record resource of collection. It fails with an error
+// matching ErrNotFound if there is no such record. Use DeleteCollection to
+// remove a whole collection.
 func (d *Driver) Delete(collection, resource string) error {
-	path := filepath.Join(collection, resource)
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+	if resource == "" {
+		return fmt.Errorf("missing resource - unable to delete record (no name)")
+	}
+	if err := d.checkResource(resource); err != nil {
+		return err
+	}
+	if d.wb != nil {
+		return d.queueDelete(collection, resource)
+	}
 	mutex := d.getOrCreateMutex(collection)
 	mutex.Lock()
 	defer mutex.Unlock()
+	return d.delete(collection, resource)
+}
 
-	dir := filepath.Join(d.dir, path)
+// DeleteCollection removes collection with all of its records. It fails
+// with an error matching ErrNotFound if the collection does not exist.
+func (d *Driver) DeleteCollection(collection string) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+	d.settle()
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if err := d.delete(collection, ""); err != nil {
+		return err
+	}
+	return d.dropConfig(collection)
+}
+
+// delete removes a record, or the whole collection when resource is empty.
+// The collection lock must be held.
+func (d *Driver) delete(collection, resource string) error {
+	if err := d.checkResource(resource); err != nil {
+		return err
+	}
+	if err := d.checkFrozen(collection); err != nil {
+		return err
+	}
+	path := filepath.Join(collection, resource)
+	dir := filepath.Join(d.collectionDir(collection), resource)
 
 	switch fi, err := stat(dir); {
 	case fi == nil, err != nil:
-		return fmt.Errorf("unable to find file or dir named %v", path)
+		return fmt.Errorf("%w: %v", ErrNotFound, path)
 	case fi.Mode().IsDir():
-		return os.RemoveAll(dir)
+		if err := d.withRetry(func() error { return os.RemoveAll(dir) }); err != nil {
+			return err
+		}
+		if err := d.syncParent(dir); err != nil {
+			return err
+		}
+		if err := d.logChange(collection, resource, nil); err != nil {
+			return err
+		}
+		d.afterDelete(collection, resource)
+		d.emit(collection, resource, nil, true)
+		return d.dropAttachments(collection, resource)
 	case fi.Mode().IsRegular():
-		return os.RemoveAll(dir + ".json")
+		err := d.withRetry(func() error { return d.backend.Remove(dir + ".json") })
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := d.syncParent(dir); err != nil {
+			return err
+		}
+		if err := d.logChange(collection, resource, nil); err != nil {
+			return err
+		}
+		d.afterDelete(collection, resource)
+		d.emit(collection, resource, nil, true)
+		return d.dropAttachments(collection, resource)
 	}
 
 	return nil
 }
 
 func (d *Driver) Read(collection, resource string, v interface{}) error {
-	if collection == "" {
-		return fmt.Errorf("collection name cannot be empty")
+	if err := checkCollection(collection); err != nil {
+		return err
 	}
 	if resource == "" {
 		return fmt.Errorf("cissing resource - unable to read record (no name)")
 	}
+	if err := d.checkResource(resource); err != nil {
+		return err
+	}
+	err := d.read(collection, resource, v)
+	if os.IsNotExist(err) {
+		if load := d.loader(collection); load != nil {
+			return d.load(collection, resource, v, load)
+		}
+	}
+	return err
+}
 
-	record := filepath.Join(d.dir, collection, resource+".json")
+// read is Read without the loader.
+func (d *Driver) read(collection, resource string, v interface{}) error {
+	record := filepath.Join(d.collectionDir(collection), resource)
+	if b, ok := d.pendingRecord(collection, resource); ok {
+		if b == nil {
+			return notExist(record + ".json")
+		}
+		b, err := d.mask(collection, b)
+		if err != nil {
+			return err
+		}
+		return d.decodeRecord(collection, b, v)
+	}
+	if d.bloomMissing(collection, resource) {
+		return notExist(record + ".json")
+	}
 	if _, err := stat(record); err != nil {
 		return err
 	}
+	if d.streams(collection) {
+		return d.streamRecord(record+".json", v)
+	}
+
+	return d.withRecord(record+".json", func(b []byte) error {
+		b, err := d.mask(collection, b)
+		if err != nil {
+			return err
+		}
+		return d.decodeRecord(collection, b, v)
+	})
+}
+
+// ReadOrDefault decodes the record resource into v like Read, or def if
+// the record does not exist. def is copied into v through JSON, so it may
+// be a value of any type with the same encoding.
+func (d *Driver) ReadOrDefault(collection, resource string, v, def interface{}) error {
+	err := d.Read(collection, resource, v)
+	if !os.IsNotExist(err) {
+		return err
+	}
+	b, err := d.encode(def)
+	if err != nil {
+		return err
+	}
+	return d.decode(b, v)
+}
 
-	b, err := ioutil.ReadFile(record + ".json")
+// withRecord calls fn with the contents of a record file, read through
+// Options.Backend if one is set. Otherwise they are mapped into memory
+// when large enough for Options.MmapThreshold, or else read into a pooled
+// buffer, through the handle pool if enabled. fn must not retain b.
+func (d *Driver) withRecord(path string, fn func(b []byte) error) error {
+	if !d.native {
+		b, err := d.backend.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return fn(b)
+	}
+	if d.mmapMin > 0 {
+		if ok, err := mapFile(path, d.mmapMin, fn); ok {
+			return err
+		}
+	}
+	buf := getBuffer()
+	if len(d.codecs) == 0 {
+		// A codec may keep the bytes it decodes, so the buffer is only
+		// reused when there are none.
+		defer putBuffer(buf)
+	}
+	var err error
+	if d.pool != nil {
+		err = d.pool.readInto(path, buf)
+	} else {
+		err = readInto(path, buf)
+	}
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(b, &v)
+	return fn(buf.Bytes())
 }
 
-func (d *Driver) getOrCreateMutex(collection string) *sync.Mutex {
+func (d *Driver) getOrCreateMutex(collection string) *collectionMutex {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	m, ok := d.mutexes[collection]
 	if !ok {
-		m = &sync.Mutex{}
+		m = &collectionMutex{}
 		d.mutexes[collection] = m
 	}
 	return m
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "serve":
+			err = serve(os.Args[2:])
+		case "bench":
+			err = bench(os.Args[2:], os.Stdout)
+		case "reindex":
+			err = reindex(os.Args[2:], os.Stdout)
+		case "verify-indexes":
+			err = verifyIndexes(os.Args[2:], os.Stdout)
+		case "lint":
+			err = lint(os.Args[2:], os.Stdout)
+		default:
+			err = fmt.Errorf("unknown command %q", os.Args[1])
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	dir := "./"
 
 	db, err := New(dir, nil)
@@ -225,7 +977,7 @@ func main() {
 	// 	log.Fatal(err)
 	// }
 
-	if err = db.Delete("users", ""); err != nil {
+	if err = db.DeleteCollection("users"); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// Masker rewrites a string field before it leaves the driver.
+type Masker func(string) string
+
+// MaskLast keeps the last n characters of a value and replaces the rest
+// with '*', e.g. MaskLast(4) turns "9079897225" into "******7225".
+func MaskLast(n int) Masker {
+	return func(s string) string {
+		r := []rune(s)
+		if len(r) <= n {
+			return s
+		}
+		return strings.Repeat("*", len(r)-n) + string(r[len(r)-n:])
+	}
+}
+
+// MaskAll replaces every character of a value with '*'.
+func MaskAll() Masker {
+	return MaskLast(0)
+}
+
+// mask applies the masks configured for collection to a raw record. Records
+// of collections without masks are returned untouched.
+func (d *Driver) mask(collection string, b []byte) ([]byte, error) {
+	rules := d.masks[collection]
+	if len(rules) == 0 {
+		return b, nil
+	}
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	for field, m := range rules {
+		maskField(doc, strings.Split(field, "."), m)
+	}
+	out, err := json.MarshalIndent(doc, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, byte('\n')), nil
+}
+
+// maskField walks path through nested objects and masks the string found at
+// its end. Missing fields and non-string values are left alone.
+func maskField(doc map[string]interface{}, path []string, m Masker) {
+	v, ok := doc[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) > 1 {
+		if child, ok := v.(map[string]interface{}); ok {
+			maskField(child, path[1:], m)
+		}
+		return
+	}
+	if s, ok := v.(string); ok {
+		doc[path[0]] = m(s)
+	}
+}
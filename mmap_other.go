@@ -0,0 +1,7 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+func mapFile(path string, min int64, fn func(b []byte) error) (ok bool, err error) {
+	return false, nil
+}
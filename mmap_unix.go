@@ -0,0 +1,32 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the file at path read-only and calls fn with its contents.
+// The mapping is removed when fn returns, so fn must not retain b. ok is
+// false if the file could not be mapped and should be read instead.
+func mapFile(path string, min int64, fn func(b []byte) error) (ok bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return true, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return true, err
+	}
+	if fi.Size() < min || fi.Size() == 0 || int64(int(fi.Size())) != fi.Size() {
+		return false, nil
+	}
+	b, err := syscall.Mmap(int(f.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return false, nil
+	}
+	defer syscall.Munmap(b)
+	return true, fn(b)
+}
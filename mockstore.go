@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// MockStore is a Store for unit tests. Each method calls the function in
+// the field of the same name with a Func suffix, and panics if it is nil.
+// Every call is recorded in Calls.
+type MockStore struct {
+	WriteFunc            func(collection, resource string, v interface{}) error
+	ReadFunc             func(collection, resource string, v interface{}) error
+	ReadOrDefaultFunc    func(collection, resource string, v, def interface{}) error
+	ReadAllFunc          func(collection string) ([]string, error)
+	DeleteFunc           func(collection, resource string) error
+	DeleteCollectionFunc func(collection string) error
+	PurgeFunc            func(collection, resource string) error
+	WriteIfFunc          func(collection, resource string, v interface{}, cond Filter) error
+	ExclusiveFunc        func(collection, resource string, fn func() error) error
+	PushFunc             func(collection, resource, field string, values ...interface{}) error
+	AddToSetFunc         func(collection, resource, field string, values ...interface{}) error
+	PullFunc             func(collection, resource, field string, values ...interface{}) error
+	HasFunc              func(collection, resource string) (bool, error)
+	KeysFunc             func(collection string) ([]string, error)
+	KeysWithPrefixFunc   func(collection, prefix string) ([]string, error)
+	CountFunc            func(collection string) (int, error)
+	StatFunc             func(collection, resource string) (Meta, error)
+	CollectionsFunc      func() ([]string, error)
+	ReadAllMapFunc       func(collection string, out interface{}) error
+	ReadAllRecordsFunc   func(collection string) ([]Record[json.RawMessage], error)
+	FindFunc             func(collection string, filter Filter) ([]Record[json.RawMessage], error)
+	QueryFunc            func(collection string, q *Query) ([]Record[json.RawMessage], error)
+	PaginateFunc         func(collection string, q *Query, token string, size int) (*Page, error)
+	WriteFromFunc        func(collection, resource string, r io.Reader) error
+	ReadToFunc           func(collection, resource string, w io.Writer) error
+	DeleteBlobFunc       func(collection, resource string) error
+	PutAttachmentFunc    func(collection, key, name string, r io.Reader) error
+	GetAttachmentFunc    func(collection, key, name string) (io.ReadCloser, *Attachment, error)
+	AttachmentsFunc      func(collection, key string) ([]Attachment, error)
+	DeleteAttachmentFunc func(collection, key, name string) error
+	CloseFunc            func() error
+
+	mu    sync.Mutex
+	Calls []MockCall
+}
+
+// MockCall is a call made to a MockStore.
+type MockCall struct {
+	Method string
+	Args   []interface{}
+}
+
+func (m *MockStore) record(method string, args ...interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Calls = append(m.Calls, MockCall{Method: method, Args: args})
+}
+
+// CallsTo returns the calls made to method.
+func (m *MockStore) CallsTo(method string) []MockCall {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var calls []MockCall
+	for _, c := range m.Calls {
+		if c.Method == method {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+var _ Store = (*MockStore)(nil)
+
+func (m *MockStore) Write(collection, resource string, v interface{}) error {
+	m.record("Write", collection, resource, v)
+	if m.WriteFunc == nil {
+		panic("MockStore.WriteFunc is not set")
+	}
+	return m.WriteFunc(collection, resource, v)
+}
+
+func (m *MockStore) Read(collection, resource string, v interface{}) error {
+	m.record("Read", collection, resource, v)
+	if m.ReadFunc == nil {
+		panic("MockStore.ReadFunc is not set")
+	}
+	return m.ReadFunc(collection, resource, v)
+}
+
+func (m *MockStore) ReadOrDefault(collection, resource string, v, def interface{}) error {
+	m.record("ReadOrDefault", collection, resource, v, def)
+	if m.ReadOrDefaultFunc == nil {
+		panic("MockStore.ReadOrDefaultFunc is not set")
+	}
+	return m.ReadOrDefaultFunc(collection, resource, v, def)
+}
+
+func (m *MockStore) ReadAll(collection string) ([]string, error) {
+	m.record("ReadAll", collection)
+	if m.ReadAllFunc == nil {
+		panic("MockStore.ReadAllFunc is not set")
+	}
+	return m.ReadAllFunc(collection)
+}
+
+func (m *MockStore) Delete(collection, resource string) error {
+	m.record("Delete", collection, resource)
+	if m.DeleteFunc == nil {
+		panic("MockStore.DeleteFunc is not set")
+	}
+	return m.DeleteFunc(collection, resource)
+}
+
+func (m *MockStore) DeleteCollection(collection string) error {
+	m.record("DeleteCollection", collection)
+	if m.DeleteCollectionFunc == nil {
+		panic("MockStore.DeleteCollectionFunc is not set")
+	}
+	return m.DeleteCollectionFunc(collection)
+}
+
+func (m *MockStore) Purge(collection, resource string) error {
+	m.record("Purge", collection, resource)
+	if m.PurgeFunc == nil {
+		panic("MockStore.PurgeFunc is not set")
+	}
+	return m.PurgeFunc(collection, resource)
+}
+
+func (m *MockStore) WriteIf(collection, resource string, v interface{}, cond Filter) error {
+	m.record("WriteIf", collection, resource, v, cond)
+	if m.WriteIfFunc == nil {
+		panic("MockStore.WriteIfFunc is not set")
+	}
+	return m.WriteIfFunc(collection, resource, v, cond)
+}
+
+func (m *MockStore) Exclusive(collection, resource string, fn func() error) error {
+	m.record("Exclusive", collection, resource, fn)
+	if m.ExclusiveFunc == nil {
+		panic("MockStore.ExclusiveFunc is not set")
+	}
+	return m.ExclusiveFunc(collection, resource, fn)
+}
+
+func (m *MockStore) Push(collection, resource, field string, values ...interface{}) error {
+	m.record("Push", collection, resource, field, values)
+	if m.PushFunc == nil {
+		panic("MockStore.PushFunc is not set")
+	}
+	return m.PushFunc(collection, resource, field, values...)
+}
+
+func (m *MockStore) AddToSet(collection, resource, field string, values ...interface{}) error {
+	m.record("AddToSet", collection, resource, field, values)
+	if m.AddToSetFunc == nil {
+		panic("MockStore.AddToSetFunc is not set")
+	}
+	return m.AddToSetFunc(collection, resource, field, values...)
+}
+
+func (m *MockStore) Pull(collection, resource, field string, values ...interface{}) error {
+	m.record("Pull", collection, resource, field, values)
+	if m.PullFunc == nil {
+		panic("MockStore.PullFunc is not set")
+	}
+	return m.PullFunc(collection, resource, field, values...)
+}
+
+func (m *MockStore) Has(collection, resource string) (bool, error) {
+	m.record("Has", collection, resource)
+	if m.HasFunc == nil {
+		panic("MockStore.HasFunc is not set")
+	}
+	return m.HasFunc(collection, resource)
+}
+
+func (m *MockStore) Keys(collection string) ([]string, error) {
+	m.record("Keys", collection)
+	if m.KeysFunc == nil {
+		panic("MockStore.KeysFunc is not set")
+	}
+	return m.KeysFunc(collection)
+}
+
+func (m *MockStore) KeysWithPrefix(collection, prefix string) ([]string, error) {
+	m.record("KeysWithPrefix", collection, prefix)
+	if m.KeysWithPrefixFunc == nil {
+		panic("MockStore.KeysWithPrefixFunc is not set")
+	}
+	return m.KeysWithPrefixFunc(collection, prefix)
+}
+
+func (m *MockStore) Count(collection string) (int, error) {
+	m.record("Count", collection)
+	if m.CountFunc == nil {
+		panic("MockStore.CountFunc is not set")
+	}
+	return m.CountFunc(collection)
+}
+
+func (m *MockStore) Stat(collection, resource string) (Meta, error) {
+	m.record("Stat", collection, resource)
+	if m.StatFunc == nil {
+		panic("MockStore.StatFunc is not set")
+	}
+	return m.StatFunc(collection, resource)
+}
+
+func (m *MockStore) Collections() ([]string, error) {
+	m.record("Collections")
+	if m.CollectionsFunc == nil {
+		panic("MockStore.CollectionsFunc is not set")
+	}
+	return m.CollectionsFunc()
+}
+
+func (m *MockStore) ReadAllMap(collection string, out interface{}) error {
+	m.record("ReadAllMap", collection, out)
+	if m.ReadAllMapFunc == nil {
+		panic("MockStore.ReadAllMapFunc is not set")
+	}
+	return m.ReadAllMapFunc(collection, out)
+}
+
+func (m *MockStore) ReadAllRecords(collection string) ([]Record[json.RawMessage], error) {
+	m.record("ReadAllRecords", collection)
+	if m.ReadAllRecordsFunc == nil {
+		panic("MockStore.ReadAllRecordsFunc is not set")
+	}
+	return m.ReadAllRecordsFunc(collection)
+}
+
+func (m *MockStore) Find(collection string, filter Filter) ([]Record[json.RawMessage], error) {
+	m.record("Find", collection, filter)
+	if m.FindFunc == nil {
+		panic("MockStore.FindFunc is not set")
+	}
+	return m.FindFunc(collection, filter)
+}
+
+func (m *MockStore) Query(collection string, q *Query) ([]Record[json.RawMessage], error) {
+	m.record("Query", collection, q)
+	if m.QueryFunc == nil {
+		panic("MockStore.QueryFunc is not set")
+	}
+	return m.QueryFunc(collection, q)
+}
+
+func (m *MockStore) Paginate(collection string, q *Query, token string, size int) (*Page, error) {
+	m.record("Paginate", collection, q, token, size)
+	if m.PaginateFunc == nil {
+		panic("MockStore.PaginateFunc is not set")
+	}
+	return m.PaginateFunc(collection, q, token, size)
+}
+
+func (m *MockStore) WriteFrom(collection, resource string, r io.Reader) error {
+	m.record("WriteFrom", collection, resource, r)
+	if m.WriteFromFunc == nil {
+		panic("MockStore.WriteFromFunc is not set")
+	}
+	return m.WriteFromFunc(collection, resource, r)
+}
+
+func (m *MockStore) ReadTo(collection, resource string, w io.Writer) error {
+	m.record("ReadTo", collection, resource, w)
+	if m.ReadToFunc == nil {
+		panic("MockStore.ReadToFunc is not set")
+	}
+	return m.ReadToFunc(collection, resource, w)
+}
+
+func (m *MockStore) DeleteBlob(collection, resource string) error {
+	m.record("DeleteBlob", collection, resource)
+	if m.DeleteBlobFunc == nil {
+		panic("MockStore.DeleteBlobFunc is not set")
+	}
+	return m.DeleteBlobFunc(collection, resource)
+}
+
+func (m *MockStore) PutAttachment(collection, key, name string, r io.Reader) error {
+	m.record("PutAttachment", collection, key, name, r)
+	if m.PutAttachmentFunc == nil {
+		panic("MockStore.PutAttachmentFunc is not set")
+	}
+	return m.PutAttachmentFunc(collection, key, name, r)
+}
+
+func (m *MockStore) GetAttachment(collection, key, name string) (io.ReadCloser, *Attachment, error) {
+	m.record("GetAttachment", collection, key, name)
+	if m.GetAttachmentFunc == nil {
+		panic("MockStore.GetAttachmentFunc is not set")
+	}
+	return m.GetAttachmentFunc(collection, key, name)
+}
+
+func (m *MockStore) Attachments(collection, key string) ([]Attachment, error) {
+	m.record("Attachments", collection, key)
+	if m.AttachmentsFunc == nil {
+		panic("MockStore.AttachmentsFunc is not set")
+	}
+	return m.AttachmentsFunc(collection, key)
+}
+
+func (m *MockStore) DeleteAttachment(collection, key, name string) error {
+	m.record("DeleteAttachment", collection, key, name)
+	if m.DeleteAttachmentFunc == nil {
+		panic("MockStore.DeleteAttachmentFunc is not set")
+	}
+	return m.DeleteAttachmentFunc(collection, key, name)
+}
+
+func (m *MockStore) Close() error {
+	m.record("Close")
+	if m.CloseFunc == nil {
+		panic("MockStore.CloseFunc is not set")
+	}
+	return m.CloseFunc()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// ImportMongo reads documents in MongoDB extended JSON, as written by
+// mongoexport (one document per line, or a single array with --jsonArray),
+// and writes them into collection. Each document's _id becomes its resource
+// key; $oid, $date and the $number* wrappers are converted to plain
+// strings, RFC 3339 timestamps and numbers. It returns the number of
+// documents imported.
+func (d *Driver) ImportMongo(collection string, r io.Reader) (int, error) {
+	if err := checkCollection(collection); err != nil {
+		return 0, err
+	}
+	br := bufio.NewReader(r)
+	dec := json.NewDecoder(br)
+	dec.UseNumber()
+
+	array := false
+	if b, err := peekNonSpace(br); err == nil && b == '[' {
+		if _, err := dec.Token(); err != nil {
+			return 0, err
+		}
+		array = true
+	}
+
+	d.settle()
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	n := 0
+	for array && dec.More() || !array {
+		var doc map[string]interface{}
+		if err := dec.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return n, fmt.Errorf("document %d: %w", n+1, err)
+		}
+		key, err := mongoKey(doc["_id"])
+		if err != nil {
+			return n, fmt.Errorf("document %d: %w", n+1, err)
+		}
+		delete(doc, "_id")
+		b, err := encode(fromExtendedJSON(doc))
+		if err != nil {
+			return n, err
+		}
+		if err := d.write(collection, key, b); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b, br.UnreadByte()
+	}
+}
+
+// mongoKey turns an _id value into a resource key.
+func mongoKey(id interface{}) (string, error) {
+	switch v := fromExtendedJSON(id).(type) {
+	case nil:
+		return "", fmt.Errorf("missing _id")
+	case string:
+		if v == "" {
+			return "", fmt.Errorf("empty _id")
+		}
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	default:
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
+}
+
+// fromExtendedJSON replaces extended JSON type wrappers throughout v with
+// their plain JSON equivalents. Unknown wrappers are left untouched.
+func fromExtendedJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []interface{}:
+		for i := range v {
+			v[i] = fromExtendedJSON(v[i])
+		}
+		return v
+	case map[string]interface{}:
+		if len(v) == 1 {
+			for k, inner := range v {
+				if plain, ok := extendedValue(k, inner); ok {
+					return plain
+				}
+			}
+		}
+		for k := range v {
+			v[k] = fromExtendedJSON(v[k])
+		}
+		return v
+	}
+	return v
+}
+
+func extendedValue(wrapper string, v interface{}) (interface{}, bool) {
+	switch wrapper {
+	case "$oid", "$symbol":
+		s, ok := v.(string)
+		return s, ok
+	case "$numberLong", "$numberInt", "$numberDouble", "$numberDecimal":
+		s, ok := v.(string)
+		if !ok {
+			return nil, false
+		}
+		if f, err := strconv.ParseFloat(s, 64); err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			// NaN and Infinity have no JSON number form.
+			return s, true
+		}
+		return json.Number(s), true
+	case "$date":
+		switch t := fromExtendedJSON(v).(type) {
+		case string:
+			return t, true
+		case json.Number:
+			ms, err := t.Int64()
+			if err != nil {
+				return nil, false
+			}
+			return time.Unix(0, ms*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano), true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// ndjsonLine is one record of an NDJSON stream.
+type ndjsonLine struct {
+	Key   string
+	Value json.RawMessage
+}
+
+// ExportNDJSON writes every record of collection to w as newline-delimited
+// JSON, one {"Key": ..., "Value": ...} object per line, with masks applied.
+// The records are taken from a snapshot, so a slow writer does not hold
+// the collection lock. It returns the number of records written.
+func (d *Driver) ExportNDJSON(collection string, w io.Writer) (int, error) {
+	return d.exportNDJSON(collection, w, func(b []byte) ([]byte, error) {
+		return d.mask(collection, b)
+	})
+}
+
+// exportNDJSON writes the records of collection to w in the format of
+// ExportNDJSON, each passed through transform first.
+func (d *Driver) exportNDJSON(collection string, w io.Writer, transform func(b []byte) ([]byte, error)) (int, error) {
+	s, err := d.Snapshot(collection)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	n := 0
+	for _, key := range s.keys {
+		b, err := s.raw(key)
+		if err != nil {
+			return n, err
+		}
+		if b, err = transform(b); err != nil {
+			return n, fmt.Errorf("%s/%s: %w", collection, key, err)
+		}
+		var value bytes.Buffer
+		if err := json.Compact(&value, b); err != nil {
+			return n, fmt.Errorf("%s/%s: %w", collection, key, err)
+		}
+		if err := enc.Encode(ndjsonLine{Key: key, Value: value.Bytes()}); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, bw.Flush()
+}
+
+// ImportNDJSON writes the records read from r, in the format produced by
+// ExportNDJSON, into collection, replacing records with the same keys. It
+// returns the number of records imported; on error, the records before the
+// failing line have been written.
+func (d *Driver) ImportNDJSON(collection string, r io.Reader) (int, error) {
+	if err := checkCollection(collection); err != nil {
+		return 0, err
+	}
+	dec := json.NewDecoder(r)
+	d.settle()
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	n := 0
+	for {
+		var line ndjsonLine
+		if err := dec.Decode(&line); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, fmt.Errorf("line %d: %w", n+1, err)
+		}
+		if line.Key == "" {
+			return n, fmt.Errorf("line %d: missing Key", n+1)
+		}
+		if len(line.Value) == 0 {
+			return n, fmt.Errorf("line %d: missing Value", n+1)
+		}
+		var value bytes.Buffer
+		if err := json.Indent(&value, line.Value, "", "\t"); err != nil {
+			return n, fmt.Errorf("line %d: %w", n+1, err)
+		}
+		value.WriteByte('\n')
+		if err := d.write(collection, line.Key, value.Bytes()); err != nil {
+			return n, fmt.Errorf("line %d: %w", n+1, err)
+		}
+		n++
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Changes summarizes the changes made to a collection during one
+// observation window.
+type Changes struct {
+	Collection string
+	// Writes and Deletes count the records written and deleted, a record
+	// changed twice counting twice.
+	Writes  int
+	Deletes int
+	// Keys are the distinct keys changed, in sorted order.
+	Keys []string
+	// Dropped is set when the collection was deleted or truncated as a
+	// whole during the window.
+	Dropped bool
+	// First and Last are when the first and last change of the window
+	// were made.
+	First, Last time.Time
+}
+
+// observer collects changes for Observe and hands them out once per
+// window.
+type observer struct {
+	collection string
+	window     time.Duration
+	fn         func(Changes)
+	mu         sync.Mutex
+	pending    map[string]*Changes
+	keys       map[string]map[string]bool
+	timer      *time.Timer
+	deliverMu  sync.Mutex // serializes calls of fn
+}
+
+// Observe calls fn with a summary of the changes to collection, or to
+// every collection if it is empty, instead of once per change: the first
+// change after a quiet period opens a window of the given length, and
+// when it closes fn receives one Changes per collection changed, such as
+// "users: 37 writes". This suits consumers that only need to know that
+// something changed, such as a search reindexer. Calls of fn do not
+// overlap and happen on a goroutine of their own, so a slow fn delays
+// later windows but not writers. Changes are observed once stored, like
+// Keys sees them. The returned function stops the observer, dropping
+// whatever is pending; Close instead delivers it.
+func (d *Driver) Observe(collection string, window time.Duration, fn func(Changes)) (stop func()) {
+	o := &observer{collection: collection, window: window, fn: fn}
+	o.reset()
+	d.obsMu.Lock()
+	if d.observers == nil {
+		d.observers = make(map[*observer]struct{})
+	}
+	d.observers[o] = struct{}{}
+	d.obsMu.Unlock()
+	return func() {
+		d.obsMu.Lock()
+		delete(d.observers, o)
+		d.obsMu.Unlock()
+		o.mu.Lock()
+		if o.timer != nil {
+			o.timer.Stop()
+			o.timer = nil
+		}
+		o.reset()
+		o.mu.Unlock()
+	}
+}
+
+func (o *observer) reset() {
+	o.pending = make(map[string]*Changes)
+	o.keys = make(map[string]map[string]bool)
+}
+
+// observe passes a change to every observer of collection. An empty key
+// stands for the whole collection.
+func (d *Driver) observe(collection, key string, deleted bool) {
+	d.obsMu.Lock()
+	defer d.obsMu.Unlock()
+	if len(d.observers) == 0 {
+		return
+	}
+	now := d.now()
+	for o := range d.observers {
+		if o.collection == "" || o.collection == collection {
+			o.record(collection, key, deleted, now)
+		}
+	}
+}
+
+func (o *observer) record(collection, key string, deleted bool, now time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	c := o.pending[collection]
+	if c == nil {
+		c = &Changes{Collection: collection, First: now}
+		o.pending[collection] = c
+		o.keys[collection] = make(map[string]bool)
+	}
+	c.Last = now
+	switch {
+	case key == "":
+		c.Dropped = true
+	case deleted:
+		c.Deletes++
+		o.keys[collection][key] = true
+	default:
+		c.Writes++
+		o.keys[collection][key] = true
+	}
+	if o.timer == nil {
+		o.timer = time.AfterFunc(o.window, o.flush)
+	}
+}
+
+// flush hands the pending changes to fn, in collection order.
+func (o *observer) flush() {
+	o.deliverMu.Lock()
+	defer o.deliverMu.Unlock()
+	o.mu.Lock()
+	pending, keys := o.pending, o.keys
+	o.reset()
+	o.timer = nil
+	o.mu.Unlock()
+
+	names := make([]string, 0, len(pending))
+	for name := range pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := pending[name]
+		for key := range keys[name] {
+			c.Keys = append(c.Keys, key)
+		}
+		sort.Strings(c.Keys)
+		o.fn(*c)
+	}
+}
+
+// stopObservers delivers the pending changes of every observer, for
+// Close.
+func (d *Driver) stopObservers() {
+	d.obsMu.Lock()
+	observers := d.observers
+	d.observers = nil
+	d.obsMu.Unlock()
+	for o := range observers {
+		o.mu.Lock()
+		pending := o.timer != nil && o.timer.Stop()
+		o.mu.Unlock()
+		if pending {
+			o.flush()
+		}
+		// Wait for a delivery the timer may have started.
+		o.deliverMu.Lock()
+		o.deliverMu.Unlock()
+	}
+}
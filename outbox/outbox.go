@@ -0,0 +1,162 @@
+// Package outbox implements the transactional outbox pattern on top of the
+// database. A message is written to an outbox collection in the same
+// transaction as the records it describes, and a relay later hands pending
+// messages to a publisher and marks them sent:
+//
+//	tx := db.Begin(ReadCommitted)
+//	tx.Write("orders", id, order)
+//	box.Add(tx, "order.created", order)
+//	err := tx.Commit()
+//
+// Commit is all or nothing, so a message stays in the outbox exactly when
+// the records of its transaction do: a failed commit puts back what it
+// wrote, and one cut short by a crash is rolled back when the database is
+// next opened without SharedAccess. Reads do not wait for commits, though,
+// so a relay may see a message while its commit is still being applied,
+// and publish it even if the commit then fails.
+//
+// Messages are published at least once: a relay that stops between
+// publishing a message and marking it sent publishes it again.
+package outbox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Store is the subset of the database driver the relay needs.
+type Store interface {
+	Read(collection, resource string, v interface{}) error
+	Write(collection, resource string, v interface{}) error
+	Delete(collection, resource string) error
+	Keys(collection string) ([]string, error)
+}
+
+// Tx is the subset of a database transaction Add needs.
+type Tx interface {
+	Write(collection, key string, v interface{}) error
+}
+
+// Message is an entry of the outbox. Sent is zero until the relay has
+// published it.
+type Message struct {
+	ID      string
+	Topic   string
+	Payload json.RawMessage
+	Created time.Time
+	Sent    time.Time
+}
+
+// Outbox is an outbox stored in one collection. Messages are keyed so
+// that they sort in the order they were added.
+type Outbox struct {
+	store      Store
+	collection string
+}
+
+// New returns the outbox stored in collection.
+func New(store Store, collection string) *Outbox {
+	return &Outbox{store: store, collection: collection}
+}
+
+// Add buffers a message for topic in tx. It is stored when tx commits and
+// discarded if tx is rolled back.
+func (o *Outbox) Add(tx Tx, topic string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	r := make([]byte, 4)
+	rand.Read(r)
+	m := Message{
+		ID:      fmt.Sprintf("%020d-%s", time.Now().UnixNano(), hex.EncodeToString(r)),
+		Topic:   topic,
+		Payload: b,
+		Created: time.Now().UTC(),
+	}
+	return tx.Write(o.collection, m.ID, m)
+}
+
+// Pending returns the messages not yet sent, oldest first.
+func (o *Outbox) Pending() ([]Message, error) {
+	keys, err := o.store.Keys(o.collection)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Message
+	for _, key := range keys {
+		var m Message
+		if err := o.store.Read(o.collection, key, &m); err != nil {
+			return nil, err
+		}
+		if m.Sent.IsZero() {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// RelayOnce publishes the pending messages in order and marks each one
+// sent. It stops at the first message publish fails on, so that later
+// messages never overtake it, and returns the number sent.
+func (o *Outbox) RelayOnce(publish func(Message) error) (int, error) {
+	pending, err := o.Pending()
+	if err != nil {
+		return 0, err
+	}
+	for i, m := range pending {
+		if err := publish(m); err != nil {
+			return i, fmt.Errorf("publishing outbox message %s: %w", m.ID, err)
+		}
+		m.Sent = time.Now().UTC()
+		if err := o.store.Write(o.collection, m.ID, m); err != nil {
+			return i, err
+		}
+	}
+	return len(pending), nil
+}
+
+// Relay runs RelayOnce every poll until ctx is done. Failures are passed to
+// onError, which may be nil, and retried on the next round.
+func (o *Outbox) Relay(ctx context.Context, poll time.Duration, publish func(Message) error, onError func(error)) error {
+	t := time.NewTicker(poll)
+	defer t.Stop()
+	for {
+		if _, err := o.RelayOnce(publish); err != nil && onError != nil {
+			onError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Cleanup removes the messages sent before the given time and returns
+// how many it removed.
+func (o *Outbox) Cleanup(before time.Time) (int, error) {
+	keys, err := o.store.Keys(o.collection)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, key := range keys {
+		var m Message
+		if err := o.store.Read(o.collection, key, &m); err != nil {
+			return n, err
+		}
+		if m.Sent.IsZero() || !m.Sent.Before(before) {
+			continue
+		}
+		if err := o.store.Delete(o.collection, key); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
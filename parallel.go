@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// parallelMin is the fewest records Find and Query spread over workers;
+// below it, starting them costs more than it saves.
+const parallelMin = 64
+
+// scanJob is a record for a query worker to read: either a file, whose
+// metadata the worker stats unless the listing supplied it, or a queued
+// write whose value is already at hand.
+type scanJob struct {
+	rec  Record[json.RawMessage]
+	path string
+	stat bool
+}
+
+type scanResult struct {
+	seq int
+	it  *queryItem
+	err error
+}
+
+// parallel reports whether Find and Query should read collection with
+// workers, for the records plan found or, without a plan, all of them.
+// The collection lock must be held.
+func (d *Driver) parallel(collection string, keys []string, planned bool) bool {
+	if d.workers <= 1 {
+		return false
+	}
+	if planned {
+		return len(keys) >= parallelMin
+	}
+	ki, err := d.keyIndexFor(collection)
+	return err == nil && len(ki.keys) >= parallelMin
+}
+
+// scanJobs lists the records of collection for the workers in the order
+// scan returns them: the records plan found when planned is set, every
+// record otherwise. The collection lock must be held.
+func (d *Driver) scanJobs(collection string, keys []string, planned bool) ([]scanJob, error) {
+	pending := d.pendingRecords(collection)
+	var jobs []scanJob
+	if planned {
+		for _, key := range keys {
+			if op, ok := pending[key]; ok {
+				if op.b != nil {
+					jobs = append(jobs, scanJob{rec: pendingRecordOf(op)})
+				}
+				continue
+			}
+			jobs = append(jobs, scanJob{rec: Record[json.RawMessage]{Key: key}, path: d.recordPath(collection, key), stat: true})
+		}
+		return jobs, nil
+	}
+
+	dir := d.collectionDir(collection)
+	files, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, file := range files {
+		key, ok := d.recordKey(file)
+		if !ok {
+			continue
+		}
+		if op, ok := pending[key]; ok {
+			delete(pending, key)
+			if op.b != nil {
+				jobs = append(jobs, scanJob{rec: pendingRecordOf(op)})
+			}
+			continue
+		}
+		meta, err := entryMeta(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, scanJob{
+			rec:  Record[json.RawMessage]{Key: key, Meta: meta},
+			path: filepath.Join(dir, file.Name()),
+		})
+	}
+	if len(pending) > 0 {
+		for _, r := range overlay(nil, pending) {
+			jobs = append(jobs, scanJob{rec: r})
+		}
+		sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].rec.Key < jobs[j].rec.Key })
+	}
+	return jobs, nil
+}
+
+// matchParallel reads, masks, decodes and filters jobs with
+// Options.QueryConcurrency workers, and calls fn on the calling goroutine
+// for every record matching filter, with its position in jobs. Records
+// arrive in no particular order. Documents are only decoded when there is
+// a filter or decode is set. The first error stops the workers and is
+// returned. The collection lock must be held.
+func (d *Driver) matchParallel(collection string, jobs []scanJob, filter Filter, decode bool, fn func(seq int, it *queryItem) error) error {
+	n := d.workers
+	if n > len(jobs) {
+		n = len(jobs)
+	}
+	work := make(chan int)
+	results := make(chan scanResult, n)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seq := range work {
+				it, err := d.matchJob(collection, jobs[seq], filter, decode)
+				select {
+				case results <- scanResult{seq, it, err}:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		defer close(work)
+		for seq := range jobs {
+			select {
+			case work <- seq:
+			case <-done:
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var err error
+	for r := range results {
+		if err != nil || r.it == nil && r.err == nil {
+			continue
+		}
+		if err = r.err; err == nil {
+			err = fn(r.seq, r.it)
+		}
+		if err != nil {
+			close(done)
+		}
+	}
+	return err
+}
+
+// matchJob reads one record for matchParallel. It returns nil when the
+// record is gone or does not match filter.
+func (d *Driver) matchJob(collection string, job scanJob, filter Filter, decode bool) (*queryItem, error) {
+	r := job.rec
+	if job.path != "" {
+		if job.stat {
+			fi, err := os.Stat(job.path)
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			r.Meta = Meta{Size: fi.Size(), ModTime: fi.ModTime()}
+		}
+		b, err := os.ReadFile(job.path)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.Value = b
+	}
+	var err error
+	if r.Value, err = d.mask(collection, r.Value); err != nil {
+		return nil, err
+	}
+	it := &queryItem{rec: r}
+	if filter == nil && !decode {
+		return it, nil
+	}
+	if it.doc, err = decodeDoc(r.Value); err != nil {
+		return nil, fmt.Errorf("%s/%s: %w", collection, r.Key, err)
+	}
+	if filter != nil && !filter.Match(it.doc) {
+		return nil, nil
+	}
+	return it, nil
+}
+
+// findParallel is Find reading with workers: the matching records, in
+// the order scan returns them. The collection lock must be held.
+func (d *Driver) findParallel(collection string, keys []string, planned bool, filter Filter) ([]Record[json.RawMessage], error) {
+	jobs, err := d.scanJobs(collection, keys, planned)
+	if err != nil {
+		return nil, err
+	}
+	matched := make([]*queryItem, len(jobs))
+	err = d.matchParallel(collection, jobs, filter, false, func(seq int, it *queryItem) error {
+		matched[seq] = it
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var out []Record[json.RawMessage]
+	for _, it := range matched {
+		if it != nil {
+			out = append(out, it.rec)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// pins holds the records pinned with Pin, saved per collection under the
+// metadata directory as a sorted list of keys.
+type pins struct {
+	mu   sync.Mutex
+	keys map[string]map[string]bool
+}
+
+// openPins loads the saved pins.
+func (d *Driver) openPins() error {
+	p := &pins{keys: make(map[string]map[string]bool)}
+	files, err := os.ReadDir(d.metaPath("pins"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		b, err := os.ReadFile(d.metaPath("pins", file.Name()))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if err := json.Unmarshal(b, &keys); err != nil {
+			return fmt.Errorf("pins %s: %v", file.Name(), err)
+		}
+		set := make(map[string]bool, len(keys))
+		for _, key := range keys {
+			set[key] = true
+		}
+		p.keys[strings.TrimSuffix(file.Name(), ".json")] = set
+	}
+	d.pinned = p
+	return nil
+}
+
+// Pin exempts the record key of collection from automatic removal: expiry
+// sweeps and Archive leave it in place until Unpin. A pinned record whose
+// expiry has passed is removed by the first sweep after it is unpinned.
+// Delete, Purge and the other explicit removals are unaffected, and drop
+// the pin along with the record.
+func (d *Driver) Pin(collection, key string) error {
+	return d.setPinned(collection, key, true)
+}
+
+// Unpin undoes Pin.
+func (d *Driver) Unpin(collection, key string) error {
+	return d.setPinned(collection, key, false)
+}
+
+// Pinned reports whether the record key of collection is pinned.
+func (d *Driver) Pinned(collection, key string) bool {
+	d.pinned.mu.Lock()
+	defer d.pinned.mu.Unlock()
+	return d.pinned.keys[collection][key]
+}
+
+func (d *Driver) setPinned(collection, key string, pinned bool) error {
+	if err := d.checkKey(collection, key, "pin record"); err != nil {
+		return err
+	}
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if pinned {
+		if _, err := d.rawRecord(collection, key); err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("%w: %v", ErrNotFound, filepath.Join(collection, key))
+			}
+			return err
+		}
+	}
+
+	p := d.pinned
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.keys[collection][key] == pinned {
+		return nil
+	}
+	if pinned {
+		if p.keys[collection] == nil {
+			p.keys[collection] = make(map[string]bool)
+		}
+		p.keys[collection][key] = true
+	} else {
+		delete(p.keys[collection], key)
+	}
+	return d.savePins(collection)
+}
+
+// savePins writes the pins of collection. d.pinned.mu must be held.
+func (d *Driver) savePins(collection string) error {
+	path := d.metaPath("pins", collection+".json")
+	set := d.pinned.keys[collection]
+	if len(set) == 0 {
+		delete(d.pinned.keys, collection)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	b, err := encode(keys)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.metaPath("pins"), 0755); err != nil {
+		return err
+	}
+	return d.writeFile(path, b)
+}
+
+// pinRemove drops the pin of a deleted record, or of every record of
+// collection when key is empty.
+func (d *Driver) pinRemove(collection, key string) {
+	if d.pinned == nil {
+		return
+	}
+	d.pinned.mu.Lock()
+	defer d.pinned.mu.Unlock()
+	set, ok := d.pinned.keys[collection]
+	if !ok {
+		return
+	}
+	if key == "" {
+		delete(d.pinned.keys, collection)
+	} else if set[key] {
+		delete(set, key)
+	} else {
+		return
+	}
+	if err := d.savePins(collection); err != nil {
+		d.log.Error("saving pins of '%s': %v\n", collection, err)
+	}
+}
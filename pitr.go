@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checkpointLayout names checkpoints and log segments so that they sort by
+// time.
+const checkpointLayout = "20060102T150405.000000000Z"
+
+// changeLog appends every write and delete to the current log segment. A
+// new segment is started by each checkpoint, so a checkpoint and the
+// segments from its own onwards hold everything needed to rebuild any later
+// state.
+type changeLog struct {
+	mu        sync.Mutex
+	f         *os.File
+	sync      bool
+	interval  time.Duration
+	retention time.Duration
+	cpMu      sync.Mutex
+	err       error // last periodic checkpoint failure, guarded by cpMu
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+type logEntry struct {
+	Time       time.Time
+	Collection string
+	Key        string          `json:",omitempty"`
+	Deleted    bool            `json:",omitempty"`
+	Value      json.RawMessage `json:",omitempty"`
+}
+
+// checkpoint is a copy of every collection. Start is when its log segment
+// began and End when the copy was complete; the copy reflects some state in
+// between, which replaying its segment from the beginning corrects.
+type checkpoint struct {
+	ID    string `json:"-"`
+	Start time.Time
+	End   time.Time
+}
+
+// openChangeLog resumes the newest log segment, taking a first checkpoint if
+// there is none, and starts taking periodic checkpoints.
+func (d *Driver) openChangeLog(interval, retention time.Duration) error {
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	d.clog = &changeLog{sync: d.sync, interval: interval, retention: retention}
+	if err := os.MkdirAll(d.metaPath("pitr"), 0755); err != nil {
+		return err
+	}
+	segments, err := d.segments()
+	if err != nil {
+		return err
+	}
+	if len(segments) == 0 {
+		if err := d.Checkpoint(); err != nil {
+			return err
+		}
+	} else {
+		f, err := os.OpenFile(d.metaPath("pitr", segments[len(segments)-1]+".log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		d.clog.f = f
+	}
+
+	d.clog.stop = make(chan struct{})
+	d.clog.done = make(chan struct{})
+	go d.checkpointLoop()
+	return nil
+}
+
+func (d *Driver) checkpointLoop() {
+	defer close(d.clog.done)
+	ticker := time.NewTicker(d.clog.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.clog.stop:
+			return
+		case <-ticker.C:
+			err := d.Checkpoint()
+			if err != nil {
+				d.log.Error("checkpoint failed: %v\n", err)
+			}
+			d.clog.cpMu.Lock()
+			d.clog.err = err
+			d.clog.cpMu.Unlock()
+		}
+	}
+}
+
+// closeChangeLog stops periodic checkpoints and closes the current segment.
+func (d *Driver) closeChangeLog() error {
+	close(d.clog.stop)
+	<-d.clog.done
+	d.clog.mu.Lock()
+	defer d.clog.mu.Unlock()
+	return d.clog.f.Close()
+}
+
+// logChange appends a change to the log. It is called with the collection
+// lock held, so the changes to a record are logged in order. b is nil for
+// deletes.
+func (d *Driver) logChange(collection, key string, b []byte) error {
+	if d.clog == nil {
+		return nil
+	}
+	e := logEntry{Collection: collection, Key: key, Deleted: b == nil}
+	if b != nil {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, b); err != nil {
+			return err
+		}
+		e.Value = buf.Bytes()
+	}
+
+	d.clog.mu.Lock()
+	defer d.clog.mu.Unlock()
+	e.Time = d.now().UTC()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := d.clog.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if d.clog.sync {
+		return d.clog.f.Sync()
+	}
+	return nil
+}
+
+// Checkpoint starts a new log segment and copies every collection. Record
+// files are hard-linked where possible, so a checkpoint costs little space
+// until records are rewritten. Checkpoints are taken periodically when
+// Options.ChangeLog is set; calling Checkpoint shortens the log replayed by
+// RestoreToTime.
+func (d *Driver) Checkpoint() error {
+	if d.clog == nil {
+		return fmt.Errorf("change log is not enabled")
+	}
+	d.settle()
+	d.clog.cpMu.Lock()
+	defer d.clog.cpMu.Unlock()
+
+	d.clog.mu.Lock()
+	cp := checkpoint{Start: d.now().UTC()}
+	cp.ID = cp.Start.Format(checkpointLayout)
+	f, err := os.OpenFile(d.metaPath("pitr", cp.ID+".log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		d.clog.mu.Unlock()
+		return err
+	}
+	if d.clog.f != nil {
+		d.clog.f.Close()
+	}
+	d.clog.f = f
+	d.clog.mu.Unlock()
+
+	names, err := d.Collections()
+	if err != nil {
+		return err
+	}
+	for _, collection := range names {
+		if err := stageTree(d.collectionRoot(collection), d.metaPath("pitr", cp.ID), collection); err != nil {
+			return err
+		}
+	}
+	cp.End = d.now().UTC()
+	b, err := encode(cp)
+	if err != nil {
+		return err
+	}
+	if err := d.writeFile(d.metaPath("pitr", cp.ID+".json"), b); err != nil {
+		return err
+	}
+	return d.pruneChangeLog()
+}
+
+// pruneChangeLog removes the checkpoints and segments that are no longer
+// needed to restore any moment within the retention window.
+func (d *Driver) pruneChangeLog() error {
+	if d.clog.retention <= 0 {
+		return nil
+	}
+	cps, err := d.checkpoints()
+	if err != nil {
+		return err
+	}
+	horizon := d.now().Add(-d.clog.retention)
+	keep := -1
+	for i, cp := range cps {
+		if !cp.End.After(horizon) {
+			keep = i
+		}
+	}
+	if keep <= 0 {
+		return nil
+	}
+	segments, err := d.segments()
+	if err != nil {
+		return err
+	}
+	for _, id := range segments {
+		if id >= cps[keep].ID {
+			break
+		}
+		for _, path := range []string{id + ".json", id + ".log", id} {
+			if err := os.RemoveAll(d.metaPath("pitr", path)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// segments returns the IDs of the log segments in order.
+func (d *Driver) segments() ([]string, error) {
+	files, err := os.ReadDir(d.metaPath("pitr"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var ids []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".log") {
+			ids = append(ids, strings.TrimSuffix(file.Name(), ".log"))
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// checkpoints returns the completed checkpoints in order.
+func (d *Driver) checkpoints() ([]checkpoint, error) {
+	files, err := os.ReadDir(d.metaPath("pitr"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var cps []checkpoint
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		b, err := os.ReadFile(d.metaPath("pitr", file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		cp := checkpoint{ID: strings.TrimSuffix(file.Name(), ".json")}
+		if err := json.Unmarshal(b, &cp); err != nil {
+			return nil, err
+		}
+		cps = append(cps, cp)
+	}
+	sort.Slice(cps, func(i, j int) bool { return cps[i].ID < cps[j].ID })
+	return cps, nil
+}
+
+// RestoreToTime rolls every collection back or forward to its state at t,
+// which must lie within the retention window. The newest checkpoint
+// completed by t is copied and the log replayed onto it up to t; the
+// result then replaces the current collections. The restore is itself
+// logged, so later restores see it like any other change.
+func (d *Driver) RestoreToTime(t time.Time) error {
+	if d.clog == nil {
+		return fmt.Errorf("change log is not enabled")
+	}
+	d.settle()
+	cps, err := d.checkpoints()
+	if err != nil {
+		return err
+	}
+	var cp *checkpoint
+	for i := range cps {
+		if !cps[i].End.After(t) {
+			cp = &cps[i]
+		}
+	}
+	if cp == nil {
+		return fmt.Errorf("no checkpoint covers %v", t)
+	}
+
+	if err := os.MkdirAll(d.metaPath("tmp"), 0755); err != nil {
+		return err
+	}
+	staging, err := os.MkdirTemp(d.metaPath("tmp"), "pitr-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	if err := stageTree(d.metaPath("pitr", cp.ID), staging, ""); err != nil {
+		return err
+	}
+	if err := d.replay(staging, cp.ID, t); err != nil {
+		return err
+	}
+	if err := d.syncTree(staging); err != nil {
+		return err
+	}
+
+	names, err := d.Collections()
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(staging)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		seen[e.Name()] = true
+		if err := d.restoreCollection(staging, e.Name()); err != nil {
+			return err
+		}
+	}
+	for _, collection := range names {
+		if !seen[collection] {
+			if err := d.restoreCollection(staging, collection); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replay applies the logged changes from segment id onwards made up to t to
+// the copy of the collections in dir.
+func (d *Driver) replay(dir, id string, t time.Time) error {
+	segments, err := d.segments()
+	if err != nil {
+		return err
+	}
+	for _, seg := range segments {
+		if seg < id {
+			continue
+		}
+		err := readSegment(d.metaPath("pitr", seg+".log"), func(e logEntry) error {
+			if e.Time.After(t) {
+				return nil
+			}
+			path := filepath.Join(dir, e.Collection, e.Key)
+			if e.Deleted {
+				if err := os.RemoveAll(path); err != nil {
+					return err
+				}
+				return os.RemoveAll(path + ".json")
+			}
+			var buf bytes.Buffer
+			if err := json.Indent(&buf, e.Value, "", "\t"); err != nil {
+				return err
+			}
+			buf.WriteByte('\n')
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			return os.WriteFile(path+".json", buf.Bytes(), 0644)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSegment calls fn for every entry of a log segment. A last line cut
+// short by a crash is ignored.
+func readSegment(path string, fn func(logEntry) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var e logEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
+
+// restoreCollection replaces collection with its copy in staging, or
+// removes it if there is none, and logs the result.
+func (d *Driver) restoreCollection(staging, collection string) error {
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	dst := d.collectionDir(collection)
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	d.afterDelete(collection, "")
+	if err := d.logChange(collection, "", nil); err != nil {
+		return err
+	}
+	src := filepath.Join(staging, collection)
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return d.syncParent(dst)
+	}
+	if err := d.moveDir(src, dst); err != nil {
+		return err
+	}
+	return filepath.Walk(dst, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || !strings.HasSuffix(path, ".json") {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dst, path)
+		key := filepath.ToSlash(strings.TrimSuffix(rel, ".json"))
+		if err := d.logChange(collection, key, b); err != nil {
+			return err
+		}
+		d.afterWrite(collection, key, b)
+		return nil
+	})
+}
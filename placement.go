@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// trashDirName is the directory Truncate moves records out of the way to
+// in a placement directory, like the trash directory under the metadata
+// directory in the database directory.
+const trashDirName = ".trash"
+
+// Placement puts the collections matching Collections, a collection name
+// or a filepath.Match pattern such as "archive_*", in Dir instead of the
+// database directory. See Options.Placement.
+type Placement struct {
+	Collections string
+	Dir         string
+}
+
+// checkPlacement validates the placement rules for New and cleans their
+// directories.
+func checkPlacement(rules []Placement) ([]Placement, error) {
+	out := make([]Placement, len(rules))
+	for i, p := range rules {
+		if _, err := filepath.Match(p.Collections, ""); err != nil || p.Collections == "" {
+			return nil, fmt.Errorf("invalid placement pattern %q", p.Collections)
+		}
+		if p.Dir == "" {
+			return nil, fmt.Errorf("placement of %q has no directory", p.Collections)
+		}
+		out[i] = Placement{Collections: p.Collections, Dir: filepath.Clean(p.Dir)}
+	}
+	return out, nil
+}
+
+// collectionRoot returns the directory the directory of collection is in:
+// the Dir of the first placement rule matching it, or the database
+// directory.
+func (d *Driver) collectionRoot(collection string) string {
+	for _, p := range d.placement {
+		if ok, _ := filepath.Match(p.Collections, collection); ok {
+			return p.Dir
+		}
+	}
+	return d.dir
+}
+
+// collectionDir returns the directory holding the records of collection.
+func (d *Driver) collectionDir(collection string) string {
+	return filepath.Join(d.collectionRoot(collection), collection)
+}
+
+// collectionRoots returns the database directory followed by the distinct
+// placement directories.
+func (d *Driver) collectionRoots() []string {
+	roots := []string{d.dir}
+	for _, p := range d.placement {
+		seen := false
+		for _, root := range roots {
+			seen = seen || root == p.Dir
+		}
+		if !seen {
+			roots = append(roots, p.Dir)
+		}
+	}
+	return roots
+}
+
+// trashDir returns where Truncate moves the records of collection, on the
+// same volume as them so that it takes a rename.
+func (d *Driver) trashDir(collection string) string {
+	if root := d.collectionRoot(collection); root != d.dir {
+		return filepath.Join(root, trashDirName)
+	}
+	return d.metaPath("trash")
+}
+
+// openPlacement creates the placement directories, empties what Truncate
+// left in their trash, and moves the collections of the database directory
+// that a rule places elsewhere, such as after a rule was added.
+func (d *Driver) openPlacement() error {
+	for _, root := range d.collectionRoots()[1:] {
+		if err := d.mkdirAll(root); err != nil {
+			return err
+		}
+		if leftovers, err := os.ReadDir(filepath.Join(root, trashDirName)); err == nil {
+			for _, fi := range leftovers {
+				d.emptyTrash(filepath.Join(root, trashDirName, fi.Name()))
+			}
+		}
+	}
+	if len(d.placement) == 0 {
+		return nil
+	}
+	files, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !file.IsDir() || strings.HasPrefix(name, ".") || d.collectionRoot(name) == d.dir {
+			continue
+		}
+		src, dst := filepath.Join(d.dir, name), d.collectionDir(name)
+		if _, err := os.Stat(dst); err == nil {
+			return fmt.Errorf("collection %s is in both %s and %s", name, d.dir, d.collectionRoot(name))
+		}
+		d.log.Info("Moving collection '%s' to '%s'\n", name, dst)
+		if err := d.moveDir(src, dst); err != nil {
+			return fmt.Errorf("moving collection %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// moveDir moves the directory src to dst, which must not exist, copying it
+// when a rename cannot, such as between volumes. A copy is made next to
+// dst first and renamed into place, so dst never holds part of src.
+func (d *Driver) moveDir(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return d.syncParent(dst)
+	}
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".moving")
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+	if err := stageTree(src, tmp, ""); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := d.syncTree(tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := d.syncParent(dst); err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
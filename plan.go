@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+)
+
+// planIndexShare is the largest share of the records of a collection that
+// Find and Query read through an index. Past it, listing the directory and
+// reading every file in order is cheaper than reading that many records
+// one by one.
+const planIndexShare = 0.25
+
+// statsTop is how many of the most common values IndexStats reports per
+// index.
+const statsTop = 10
+
+// IndexStat describes an index of a collection as it stands after the
+// latest write.
+type IndexStat struct {
+	Collection string
+	Name       string
+	// Field is the field path of an index made with IndexField, which Find
+	// and Query plan with; it is empty for other extractors.
+	Field string
+	// Records is how many records have a value for the index, and Distinct
+	// how many different values they have.
+	Records  int
+	Distinct int
+	// Top is the head of the histogram of values: the most common ones,
+	// most common first, with how many records hold each.
+	Top []ValueCount
+}
+
+// ValueCount is a value of an index and how many records hold it.
+type ValueCount struct {
+	Value interface{}
+	Count int
+}
+
+// IndexStats returns the statistics of every index, by collection and
+// then name. The counts behind them are kept by every write and delete, so
+// reading them costs no scan.
+func (d *Driver) IndexStats() []IndexStat {
+	d.mu.Lock()
+	var stats []IndexStat
+	var indexes []*index
+	for collection, byName := range d.indexes {
+		for name, idx := range byName {
+			stats = append(stats, IndexStat{Collection: collection, Name: name})
+			indexes = append(indexes, idx)
+		}
+	}
+	d.mu.Unlock()
+
+	for i, idx := range indexes {
+		idx.mu.RLock()
+		s := &stats[i]
+		s.Field = idx.field
+		s.Records = len(idx.byKey)
+		s.Distinct = len(idx.values)
+		for iv, keys := range idx.values {
+			s.Top = append(s.Top, ValueCount{Value: indexedValue(iv), Count: len(keys)})
+		}
+		idx.mu.RUnlock()
+		sort.Slice(s.Top, func(i, j int) bool {
+			if s.Top[i].Count != s.Top[j].Count {
+				return s.Top[i].Count > s.Top[j].Count
+			}
+			return indexValue(s.Top[i].Value) < indexValue(s.Top[j].Value)
+		})
+		if len(s.Top) > statsTop {
+			s.Top = s.Top[:statsTop]
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Collection != stats[j].Collection {
+			return stats[i].Collection < stats[j].Collection
+		}
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+// indexedValue turns the canonical form of a value back into a value as
+// decodeDoc produces it. It is the inverse of indexValue.
+func indexedValue(iv string) interface{} {
+	switch {
+	case strings.HasPrefix(iv, "n:"):
+		return json.Number(iv[2:])
+	case strings.HasPrefix(iv, "s:"):
+		return iv[2:]
+	case strings.HasPrefix(iv, "b:"):
+		return iv == "b:true"
+	case iv == "null":
+		return nil
+	}
+	v, err := decodeJSON([]byte(strings.TrimPrefix(iv, "j:")))
+	if err != nil {
+		return nil
+	}
+	return v
+}
+
+// candidates returns the keys of the records whose indexed value satisfies
+// c. Every distinct value is tested the way c.Match tests a record, so the
+// result is exact whatever the types involved. ok is false for conditions
+// an index cannot answer, such as != which also matches records without
+// the field. idx.mu must be held.
+func (idx *index) candidates(c condition) (keys map[string]bool, ok bool) {
+	switch c.op {
+	case "==", ">", ">=", "<", "<=", "exists":
+	default:
+		return nil, false
+	}
+	keys = make(map[string]bool)
+	for iv, ks := range idx.values {
+		if !c.test(indexedValue(iv), true) {
+			continue
+		}
+		for key := range ks {
+			keys[key] = true
+		}
+	}
+	return keys, true
+}
+
+// fieldIndex returns the IndexField index of collection on field, if any.
+// Fields the driver masks are never planned with, since conditions see the
+// masked value while the index holds the stored one.
+func (d *Driver) fieldIndex(collection, field string) *index {
+	for masked := range d.masks[collection] {
+		if masked == field || strings.HasPrefix(field, masked+".") || strings.HasPrefix(masked, field+".") {
+			return nil
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, idx := range d.indexes[collection] {
+		if idx.field == field {
+			return idx
+		}
+	}
+	return nil
+}
+
+// plan decides how Find and Query read collection for filter. When the
+// IndexField indexes of collection narrow filter down to few enough
+// records, it returns their keys, in the order a scan would meet them,
+// with ok true; filter must still be applied to them. Otherwise the caller
+// scans. The collection lock must be held.
+func (d *Driver) plan(collection string, filter Filter) (keys []string, ok bool, err error) {
+	found, used, ok := d.narrow(collection, filter)
+	if !ok {
+		return nil, false, nil
+	}
+	ki, err := d.keyIndexFor(collection)
+	if err != nil {
+		return nil, false, err
+	}
+	if float64(len(found)) > planIndexShare*float64(len(ki.keys)) {
+		return nil, false, nil
+	}
+
+	// Queued writes are not indexed until they are applied, so their
+	// records are read as well and left to the filter.
+	pending := d.pendingRecords(collection)
+	for key := range pending {
+		found[key] = true
+	}
+	keys = make([]string, 0, len(found))
+	for key := range found {
+		if strings.HasPrefix(key, ".") && !d.hidden {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(pending) > 0 {
+		sort.Strings(keys)
+	} else {
+		sort.Slice(keys, func(i, j int) bool { return keys[i]+".json" < keys[j]+".json" })
+	}
+	d.log.Debug("Planned '%s' with indexes %s: %d of %d records\n", collection, strings.Join(used, ", "), len(keys), len(ki.keys))
+	return keys, true, nil
+}
+
+// narrow returns a superset of the keys of the records matching f, found
+// through the IndexField indexes of collection, and the fields of the
+// indexes used. ok is false when the indexes cannot narrow f down.
+//
+// A condition is answered by the index on its field. Of the parts of an
+// And, those an index answers are intersected, smallest first, and the
+// rest left to the filter: since the sets are held in memory, intersecting
+// costs far less than reading the records it rules out, so every usable
+// index takes part. An Or narrows only when every part does, to the union
+// of the parts.
+func (d *Driver) narrow(collection string, f Filter) (keys map[string]bool, used []string, ok bool) {
+	switch f := f.(type) {
+	case condition:
+		idx := d.fieldIndex(collection, f.field)
+		if idx == nil {
+			return nil, nil, false
+		}
+		idx.mu.RLock()
+		defer idx.mu.RUnlock()
+		if keys, ok = idx.candidates(f); !ok {
+			return nil, nil, false
+		}
+		return keys, []string{f.field}, true
+	case and:
+		var sets []map[string]bool
+		for _, part := range f {
+			if keys, fields, ok := d.narrow(collection, part); ok {
+				sets = append(sets, keys)
+				used = append(used, fields...)
+			}
+		}
+		if len(sets) == 0 {
+			return nil, nil, false
+		}
+		sort.Slice(sets, func(i, j int) bool { return len(sets[i]) < len(sets[j]) })
+		keys = sets[0]
+		for _, set := range sets[1:] {
+			for key := range keys {
+				if !set[key] {
+					delete(keys, key)
+				}
+			}
+		}
+		return keys, used, true
+	case or:
+		keys = make(map[string]bool)
+		for _, part := range f {
+			set, fields, ok := d.narrow(collection, part)
+			if !ok {
+				return nil, nil, false
+			}
+			for key := range set {
+				keys[key] = true
+			}
+			used = append(used, fields...)
+		}
+		return keys, used, len(f) > 0
+	}
+	return nil, nil, false
+}
+
+// readKeys returns the records of collection stored under keys, queued
+// writes included, leaving out the keys that have no record. The
+// collection lock must be held.
+func (d *Driver) readKeys(collection string, keys []string) ([]Record[json.RawMessage], error) {
+	pending := d.pendingRecords(collection)
+	records := make([]Record[json.RawMessage], 0, len(keys))
+	for _, key := range keys {
+		if op, ok := pending[key]; ok {
+			if op.b != nil {
+				records = append(records, pendingRecordOf(op))
+			}
+			continue
+		}
+		path := d.recordPath(collection, key)
+		fi, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		b, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, Record[json.RawMessage]{
+			Key:   key,
+			Meta:  Meta{Size: fi.Size(), ModTime: fi.ModTime()},
+			Value: b,
+		})
+	}
+	return records, nil
+}
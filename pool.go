@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// handlePool keeps recently read record files open, evicting the least
+// recently used one beyond max. Record files are never modified in place,
+// only replaced, so an open handle keeps returning the contents it was
+// opened with; writes and deletes evict the handles of the records they
+// touch.
+type handlePool struct {
+	mu    sync.Mutex
+	max   int
+	files map[string]*list.Element
+	lru   *list.List
+}
+
+type handle struct {
+	path    string
+	f       *os.File
+	size    int64
+	refs    int
+	evicted bool
+}
+
+// newHandlePool returns a pool of up to max handles, limited to half of the
+// process's open-file limit, or nil if pooling is not possible.
+func newHandlePool(max int) *handlePool {
+	if max <= 0 || !poolSupported {
+		return nil
+	}
+	if limit := openFileLimit(); limit > 0 && max > limit/2 {
+		max = limit / 2
+	}
+	return &handlePool{max: max, files: make(map[string]*list.Element), lru: list.New()}
+}
+
+// readInto appends the contents of the file at path to buf through a
+// pooled handle.
+func (p *handlePool) readInto(path string, buf *bytes.Buffer) error {
+	h, err := p.acquire(path)
+	if err != nil {
+		return err
+	}
+	defer p.release(h)
+	buf.Grow(int(h.size) + bytes.MinRead)
+	_, err = buf.ReadFrom(io.NewSectionReader(h.f, 0, h.size))
+	return err
+}
+
+// acquire returns the handle of path, opening it if needed. The file is
+// opened with the pool locked so that an eviction for a write that has
+// already replaced the file cannot be missed.
+func (p *handlePool) acquire(path string) (*handle, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.files[path]; ok {
+		p.lru.MoveToFront(e)
+		h := e.Value.(*handle)
+		h.refs++
+		return h, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	h := &handle{path: path, f: f, size: fi.Size(), refs: 1}
+	p.files[path] = p.lru.PushFront(h)
+	for p.lru.Len() > p.max {
+		p.remove(p.lru.Back())
+	}
+	return h, nil
+}
+
+func (p *handlePool) release(h *handle) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h.refs--
+	if h.evicted && h.refs == 0 {
+		h.f.Close()
+	}
+}
+
+// evict drops the handle of path, or of every file below path if dir is
+// set.
+func (p *handlePool) evict(path string, dir bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !dir {
+		if e, ok := p.files[path]; ok {
+			p.remove(e)
+		}
+		return
+	}
+	prefix := path + string(filepath.Separator)
+	for name, e := range p.files {
+		if strings.HasPrefix(name, prefix) {
+			p.remove(e)
+		}
+	}
+}
+
+// remove takes a handle out of the pool, closing it once no read uses it.
+func (p *handlePool) remove(e *list.Element) {
+	h := p.lru.Remove(e).(*handle)
+	delete(p.files, h.path)
+	h.evicted = true
+	if h.refs == 0 {
+		h.f.Close()
+	}
+}
+
+// close closes every pooled handle.
+func (p *handlePool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.lru.Len() > 0 {
+		p.remove(p.lru.Back())
+	}
+}
+
+// poolEvict drops pooled handles of a record that was written or deleted.
+// An empty key evicts the whole collection.
+func (d *Driver) poolEvict(collection, key string) {
+	if d.pool == nil {
+		return
+	}
+	if key == "" {
+		d.pool.evict(d.collectionDir(collection), true)
+		return
+	}
+	path := filepath.Join(d.collectionDir(collection), key)
+	d.pool.evict(path+".json", false)
+	d.pool.evict(path, true)
+}
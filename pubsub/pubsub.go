@@ -0,0 +1,231 @@
+// Package pubsub provides topics on top of the database: publishers append
+// messages to a topic collection and subscribers keep their offset in a
+// consumer collection. Delivery is at least once: a message is handed out
+// again until its subscriber acknowledges it, so handlers should be
+// idempotent.
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Store is the subset of the database driver the topics need.
+type Store interface {
+	Read(collection, resource string, v interface{}) error
+	Write(collection, resource string, v interface{}) error
+	Delete(collection, resource string) error
+	Exclusive(collection, resource string, fn func() error) error
+}
+
+// headKey is the record of the topic collection holding its offsets.
+const headKey = "head"
+
+// Message is a message published to a topic. Offsets start at 1 and
+// increase by one with every message.
+type Message struct {
+	Offset int64
+	Time   time.Time
+	Data   json.RawMessage
+}
+
+// Decode unmarshals the message data into v.
+func (m Message) Decode(v interface{}) error {
+	return json.Unmarshal(m.Data, v)
+}
+
+type head struct {
+	// First is the oldest offset not removed by Trim, Next the offset of
+	// the next message to be published.
+	First int64
+	Next  int64
+}
+
+type consumer struct {
+	Offset  int64
+	Updated time.Time
+}
+
+// Topic is a topic whose messages are the records of one collection, keyed
+// by zero-padded offset, next to a "head" record holding the offsets. The
+// offsets of its consumer groups are records of a second collection,
+// named after the group.
+type Topic struct {
+	store     Store
+	topic     string
+	consumers string
+}
+
+// New returns the topic stored in the collection topic, with consumer
+// offsets stored in the collection consumers.
+func New(store Store, topic, consumers string) *Topic {
+	return &Topic{store: store, topic: topic, consumers: consumers}
+}
+
+func messageKey(offset int64) string {
+	return fmt.Sprintf("%020d", offset)
+}
+
+// Publish appends v to the topic and returns its offset. Publishers in
+// other processes sharing the database are serialized, so offsets never
+// repeat.
+func (t *Topic) Publish(v interface{}) (int64, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	var offset int64
+	err = t.store.Exclusive(t.topic, headKey, func() error {
+		h, err := t.head()
+		if err != nil {
+			return err
+		}
+		offset = h.Next
+		m := Message{Offset: offset, Time: time.Now().UTC(), Data: data}
+		if err := t.store.Write(t.topic, messageKey(offset), m); err != nil {
+			return err
+		}
+		h.Next++
+		return t.store.Write(t.topic, headKey, h)
+	})
+	return offset, err
+}
+
+func (t *Topic) head() (head, error) {
+	h := head{First: 1, Next: 1}
+	err := t.store.Read(t.topic, headKey, &h)
+	if errors.Is(err, os.ErrNotExist) {
+		return h, nil
+	}
+	return h, err
+}
+
+// Trim removes the messages published before offset, for example the
+// lowest offset acknowledged by every consumer group. Subscribers behind
+// offset skip to it.
+func (t *Topic) Trim(offset int64) error {
+	return t.store.Exclusive(t.topic, headKey, func() error {
+		h, err := t.head()
+		if err != nil {
+			return err
+		}
+		if offset > h.Next {
+			offset = h.Next
+		}
+		for ; h.First < offset; h.First++ {
+			err := t.store.Delete(t.topic, messageKey(h.First))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		return t.store.Write(t.topic, headKey, h)
+	})
+}
+
+// Subscriber reads a topic on behalf of a consumer group. Subscribers of
+// the same group share its offset; running several of them may deliver a
+// message more than once.
+type Subscriber struct {
+	topic *Topic
+	group string
+}
+
+// Subscribe returns a subscriber for group. A new group starts at the
+// oldest message kept.
+func (t *Topic) Subscribe(group string) *Subscriber {
+	return &Subscriber{topic: t, group: group}
+}
+
+// Offset returns the offset of the last message acknowledged by the
+// group, or 0 if there is none.
+func (s *Subscriber) Offset() (int64, error) {
+	var c consumer
+	err := s.topic.store.Read(s.topic.consumers, s.group, &c)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	return c.Offset, err
+}
+
+// Fetch returns up to max of the messages after the group's offset, oldest
+// first. The same messages are returned again until they are acknowledged.
+func (s *Subscriber) Fetch(max int) ([]Message, error) {
+	offset, err := s.Offset()
+	if err != nil {
+		return nil, err
+	}
+	h, err := s.topic.head()
+	if err != nil {
+		return nil, err
+	}
+	next := offset + 1
+	if next < h.First {
+		next = h.First
+	}
+	var msgs []Message
+	for ; next < h.Next && len(msgs) < max; next++ {
+		var m Message
+		err := s.topic.store.Read(s.topic.topic, messageKey(next), &m)
+		if errors.Is(err, os.ErrNotExist) {
+			// Removed by a Trim running concurrently.
+			continue
+		}
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+// Ack acknowledges m and every message before it for the group.
+// Acknowledging an offset at or below the group's offset does nothing.
+func (s *Subscriber) Ack(m Message) error {
+	return s.topic.store.Exclusive(s.topic.consumers, s.group, func() error {
+		offset, err := s.Offset()
+		if err != nil || m.Offset <= offset {
+			return err
+		}
+		return s.topic.store.Write(s.topic.consumers, s.group, consumer{Offset: m.Offset, Updated: time.Now().UTC()})
+	})
+}
+
+// Receive calls handler with every message after the group's offset,
+// acknowledging each one the handler accepts, until ctx is done. When the
+// topic has no new messages, or the handler fails, Receive waits poll
+// before trying again; the failed message is the next one handed out.
+func (s *Subscriber) Receive(ctx context.Context, poll time.Duration, handler func(Message) error) error {
+	for {
+		msgs, err := s.Fetch(100)
+		if err != nil {
+			return err
+		}
+		wait := len(msgs) == 0
+		for _, m := range msgs {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err := handler(m); err != nil {
+				wait = true
+				break
+			}
+			if err := s.Ack(m); err != nil {
+				return err
+			}
+		}
+		if !wait {
+			continue
+		}
+		t := time.NewTimer(poll)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Purge permanently erases a record together with any temporary file left
+// over from an interrupted Write, a blob stored under the same name and its
+// attachments, so that a right-to-be-forgotten request leaves nothing
+// behind. With Options.Shred the file contents are overwritten and synced
+// before the files are unlinked, unless they are hard-linked elsewhere, as
+// by CloneCollection or Snapshot; see shred. With Options.ChangeLog, every
+// version of the record is also removed from the log segments and
+// checkpoints, so it can no longer be restored by RestoreToTime. Purge is
+// not supported in git mode, where earlier versions stay in the repository
+// history, and fails with ErrPurgeUnsupported.
+func (d *Driver) Purge(collection, resource string) error {
+	if err := d.checkKey(collection, resource, "purge record"); err != nil {
+		return err
+	}
+	if d.repo != nil {
+		return fmt.Errorf("%w: git mode keeps the history of %s/%s", ErrPurgeUnsupported, collection, resource)
+	}
+	d.settle()
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if err := d.checkFrozen(collection); err != nil {
+		return err
+	}
+
+	record := d.recordPath(collection, resource)
+	if _, err := os.Stat(record); err != nil {
+		return err
+	}
+	paths := []string{record, record + ".tmp", d.metaPath("blobs", collection, resource)}
+	for _, path := range paths {
+		if err := d.erase(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := d.syncParent(record); err != nil {
+		return err
+	}
+	if err := d.purgeChangeLog(collection, resource); err != nil {
+		return err
+	}
+	d.afterDelete(collection, resource)
+	d.emit(collection, resource, nil, true)
+
+	attachments := d.attachmentDir(collection, resource)
+	files, err := os.ReadDir(attachments)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".meta") {
+			continue
+		}
+		meta, err := readAttachmentMeta(filepath.Join(attachments, file.Name()))
+		if err != nil {
+			return err
+		}
+		if err := d.casPurge(meta.SHA256); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(attachments)
+}
+
+// purgeChangeLog removes every version of collection/resource from the
+// change log: its entries from the log segments and its copies from the
+// checkpoints. It is called with the collection lock held.
+func (d *Driver) purgeChangeLog(collection, resource string) (err error) {
+	if d.clog == nil {
+		return nil
+	}
+	d.clog.cpMu.Lock()
+	defer d.clog.cpMu.Unlock()
+	d.clog.mu.Lock()
+	defer d.clog.mu.Unlock()
+
+	segments, err := d.segments()
+	if err != nil || len(segments) == 0 {
+		return err
+	}
+	// The current segment is rewritten too; append to the new file after.
+	current := d.metaPath("pitr", segments[len(segments)-1]+".log")
+	d.clog.f.Close()
+	defer func() {
+		f, ferr := os.OpenFile(current, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if ferr != nil {
+			// Later changes fail to log on the closed file.
+			if err == nil {
+				err = ferr
+			}
+			return
+		}
+		d.clog.f = f
+	}()
+	for _, id := range segments {
+		if err := d.purgeSegment(d.metaPath("pitr", id+".log"), collection, resource); err != nil {
+			return err
+		}
+		copy := filepath.Join(d.metaPath("pitr", id), collection, resource+".json")
+		if err := d.erase(copy); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeSegment rewrites the log segment at path without the entries of
+// collection/resource. With Options.Shred, the old contents are shredded
+// once the rewritten segment has replaced them, so a crash leaves one or
+// the other.
+func (d *Driver) purgeSegment(path, collection, resource string) error {
+	var buf bytes.Buffer
+	found := false
+	err := readSegment(path, func(e logEntry) error {
+		if e.Collection == collection && e.Key == resource {
+			found = true
+			return nil
+		}
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+		return nil
+	})
+	if err != nil || !found {
+		return err
+	}
+	if !d.shred {
+		return d.writeFile(path, buf.Bytes())
+	}
+	old := path + ".purge"
+	if err := os.Link(path, old); err != nil {
+		return err
+	}
+	defer os.Remove(old)
+	if err := d.writeFile(path, buf.Bytes()); err != nil {
+		return err
+	}
+	return shred(old)
+}
+
+// erase removes path, shredding it first when Options.Shred is set.
+func (d *Driver) erase(path string) error {
+	if d.shred {
+		if err := shred(path); err != nil {
+			return err
+		}
+	}
+	return d.withRetry(func() error { return d.backend.Remove(path) })
+}
+
+// shred overwrites the contents of path with zeros and flushes them to disk.
+// A file with other hard links, such as a record shared with a clone, a
+// snapshot or a checkpoint, is left as it is: zeroing it would clear those
+// copies too. The contents are shredded when the last link is erased.
+func shred(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if n, ok := linkCount(f); ok && n > 1 {
+		return nil
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	zeros := make([]byte, 32*1024)
+	for left := fi.Size(); left > 0; {
+		n := int64(len(zeros))
+		if left < n {
+			n = left
+		}
+		if _, err := f.Write(zeros[:n]); err != nil {
+			return err
+		}
+		left -= n
+	}
+	return f.Sync()
+}
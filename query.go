@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// defaultSortBuffer is the number of records sorted in memory before a
+// query spills a sorted run to disk.
+const defaultSortBuffer = 10000
+
+// Direction is the order a sort key is applied in.
+type Direction int
+
+const (
+	Asc Direction = iota
+	Desc
+)
+
+type sortKey struct {
+	field string
+	dir   Direction
+}
+
+// Query describes a filtered, sorted and paginated read of a collection.
+// Build one with Where or SortBy and refine it with the chaining methods.
+type Query struct {
+	filter Filter
+	sort   []sortKey
+	less   func(a, b map[string]interface{}) bool
+	coll   Collator
+	offset int
+	limit  int
+	// after, when set, restricts results to items ordered after it.
+	after *queryItem
+}
+
+// Where starts a query returning the records that match f.
+func Where(f Filter) *Query {
+	return &Query{filter: f}
+}
+
+// SortBy starts a query returning every record ordered by field.
+func SortBy(field string, dir Direction) *Query {
+	return (&Query{}).ThenBy(field, dir)
+}
+
+// Where restricts the query to records matching f.
+func (q *Query) Where(f Filter) *Query {
+	q.filter = f
+	return q
+}
+
+// SortBy replaces the sort order of the query with field.
+func (q *Query) SortBy(field string, dir Direction) *Query {
+	q.sort = nil
+	return q.ThenBy(field, dir)
+}
+
+// ThenBy adds field as a tie-breaker after the existing sort keys.
+func (q *Query) ThenBy(field string, dir Direction) *Query {
+	q.sort = append(q.sort, sortKey{field, dir})
+	return q
+}
+
+// SortFunc orders records with a custom comparator, applied after the sort
+// keys. Records that compare equal are ordered by key.
+func (q *Query) SortFunc(less func(a, b map[string]interface{}) bool) *Query {
+	q.less = less
+	return q
+}
+
+// Collate sorts and filters string fields with c instead of comparing
+// their bytes.
+func (q *Query) Collate(c Collator) *Query {
+	q.coll = c
+	return q
+}
+
+// Skip drops the first n matching records.
+func (q *Query) Skip(n int) *Query {
+	q.offset = n
+	return q
+}
+
+// Limit caps the number of records returned. Zero means no limit.
+func (q *Query) Limit(n int) *Query {
+	q.limit = n
+	return q
+}
+
+// queryItem is a matched record with its decoded document, used for
+// comparisons.
+type queryItem struct {
+	rec Record[json.RawMessage]
+	doc map[string]interface{}
+}
+
+// cmp orders two items by the query's sort keys and comparator, then by key.
+func (q *Query) cmp(a, b *queryItem) int {
+	for _, k := range q.sort {
+		c := compareField(a.doc, b.doc, k.field, q.coll)
+		if k.dir == Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	if q.less != nil {
+		if q.less(a.doc, b.doc) {
+			return -1
+		}
+		if q.less(b.doc, a.doc) {
+			return 1
+		}
+	}
+	return strings.Compare(a.rec.Key, b.rec.Key)
+}
+
+// compareField orders two documents by one field. Missing values sort
+// first; values of different kinds fall back to comparing their text.
+func compareField(a, b map[string]interface{}, field string, coll Collator) int {
+	x, okx := lookup(a, field)
+	y, oky := lookup(b, field)
+	switch {
+	case !okx && !oky:
+		return 0
+	case !okx:
+		return -1
+	case !oky:
+		return 1
+	}
+	if c, ok := compare(x, y, coll); ok {
+		return c
+	}
+	return strings.Compare(fmt.Sprint(x), fmt.Sprint(y))
+}
+
+// Query runs q against collection. Results larger than
+// Options.SortBufferSize are sorted with an external merge sort over
+// temporary files, so the sort itself never holds more than that many
+// records in memory.
+func (d *Driver) Query(collection string, q *Query) ([]Record[json.RawMessage], error) {
+	if err := checkCollection(collection); err != nil {
+		return nil, err
+	}
+	if q == nil {
+		q = &Query{}
+	}
+	s := &sorter{d: d, q: q, max: d.sortBuffer}
+	if s.max <= 0 {
+		s.max = defaultSortBuffer
+	}
+	defer s.cleanup()
+
+	filter := q.filter
+	if q.coll != nil && filter != nil {
+		filter = Collate(q.coll, filter)
+	}
+	keep := func(it *queryItem) error {
+		if q.after != nil && q.cmp(it, q.after) <= 0 {
+			return nil
+		}
+		return s.add(it)
+	}
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	keys, planned, err := d.plan(collection, filter)
+	if err == nil && d.parallel(collection, keys, planned) {
+		var jobs []scanJob
+		if jobs, err = d.scanJobs(collection, keys, planned); err == nil {
+			err = d.matchParallel(collection, jobs, filter, true, func(_ int, it *queryItem) error {
+				return keep(it)
+			})
+		}
+	} else if err == nil {
+		err = d.eachPlanned(collection, keys, planned, func(r Record[json.RawMessage]) error {
+			var err error
+			if r.Value, err = d.mask(collection, r.Value); err != nil {
+				return err
+			}
+			doc, err := decodeDoc(r.Value)
+			if err != nil {
+				return fmt.Errorf("%s/%s: %w", collection, r.Key, err)
+			}
+			if filter != nil && !filter.Match(doc) {
+				return nil
+			}
+			return keep(&queryItem{rec: r, doc: doc})
+		})
+	}
+	mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return s.results()
+}
+
+// QueryAs is Query with the results decoded into T.
+func QueryAs[T any](d *Driver, collection string, q *Query) ([]Record[T], error) {
+	raw, err := d.Query(collection, q)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRecords[T](d, collection, raw)
+}
+
+// each calls fn for every record of collection, reading one file at a time,
+// and then for the records only queued so far (see Options.WriteBehind).
+// The collection lock must be held.
+func (d *Driver) each(collection string, fn func(Record[json.RawMessage]) error) error {
+	pending := d.pendingRecords(collection)
+	dir := d.collectionDir(collection)
+	files, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, file := range files {
+		key, ok := d.recordKey(file)
+		if !ok {
+			continue
+		}
+		r := Record[json.RawMessage]{Key: key}
+		if op, ok := pending[key]; ok {
+			delete(pending, key)
+			if op.b == nil {
+				continue
+			}
+			r = pendingRecordOf(op)
+		} else if r.Meta, err = entryMeta(file); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		} else if r.Value, err = os.ReadFile(filepath.Join(dir, file.Name())); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	for _, r := range overlay(nil, pending) {
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eachPlanned calls fn like each, but only for the records stored under
+// keys when plan found them. The collection lock must be held.
+func (d *Driver) eachPlanned(collection string, keys []string, planned bool, fn func(Record[json.RawMessage]) error) error {
+	if !planned {
+		return d.each(collection, fn)
+	}
+	records, err := d.readKeys(collection, keys)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sorter accumulates matched items, spilling sorted runs to disk once more
+// than max are buffered.
+type sorter struct {
+	d    *Driver
+	q    *Query
+	max  int
+	buf  []*queryItem
+	dir  string
+	runs []string
+}
+
+// spilled is the on-disk form of a record in a sorted run. Value is kept as
+// bytes so the record's formatting survives the round trip.
+type spilled struct {
+	Key   string
+	Meta  Meta
+	Value []byte
+}
+
+func (s *sorter) add(it *queryItem) error {
+	s.buf = append(s.buf, it)
+	if len(s.buf) < s.max {
+		return nil
+	}
+	return s.spill()
+}
+
+func (s *sorter) sortBuf() {
+	sort.Slice(s.buf, func(i, j int) bool { return s.q.cmp(s.buf[i], s.buf[j]) < 0 })
+}
+
+func (s *sorter) spill() error {
+	if s.dir == "" {
+		if err := os.MkdirAll(s.d.tmpDir(), 0755); err != nil {
+			return err
+		}
+		dir, err := os.MkdirTemp(s.d.tmpDir(), "sort-")
+		if err != nil {
+			return err
+		}
+		s.dir = dir
+	}
+	s.sortBuf()
+	path := filepath.Join(s.dir, fmt.Sprintf("run-%d", len(s.runs)))
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, it := range s.buf {
+		if err := enc.Encode(spilled{it.rec.Key, it.rec.Meta, it.rec.Value}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.runs = append(s.runs, path)
+	s.buf = s.buf[:0]
+	return nil
+}
+
+// results returns the sorted page selected by the query's offset and limit.
+func (s *sorter) results() ([]Record[json.RawMessage], error) {
+	out := []Record[json.RawMessage]{}
+	skip := s.q.offset
+	emit := func(it *queryItem) bool {
+		if skip > 0 {
+			skip--
+			return true
+		}
+		out = append(out, it.rec)
+		return s.q.limit <= 0 || len(out) < s.q.limit
+	}
+
+	if len(s.runs) == 0 {
+		s.sortBuf()
+		for _, it := range s.buf {
+			if !emit(it) {
+				break
+			}
+		}
+		return out, nil
+	}
+
+	if len(s.buf) > 0 {
+		if err := s.spill(); err != nil {
+			return nil, err
+		}
+	}
+	m := &merger{q: s.q}
+	for _, path := range s.runs {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r := &runReader{dec: json.NewDecoder(bufio.NewReader(f))}
+		if err := r.next(); err != nil {
+			return nil, err
+		}
+		if r.cur != nil {
+			m.runs = append(m.runs, r)
+		}
+	}
+	heap.Init(m)
+	for m.Len() > 0 {
+		r := m.runs[0]
+		if !emit(r.cur) {
+			break
+		}
+		if err := r.next(); err != nil {
+			return nil, err
+		}
+		if r.cur == nil {
+			heap.Pop(m)
+		} else {
+			heap.Fix(m, 0)
+		}
+	}
+	return out, nil
+}
+
+func (s *sorter) cleanup() {
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+	}
+}
+
+// runReader yields the items of one sorted run in order.
+type runReader struct {
+	dec *json.Decoder
+	cur *queryItem
+}
+
+func (r *runReader) next() error {
+	var sp spilled
+	if err := r.dec.Decode(&sp); err != nil {
+		if err == io.EOF {
+			r.cur = nil
+			return nil
+		}
+		return err
+	}
+	doc, err := decodeDoc(sp.Value)
+	if err != nil {
+		return err
+	}
+	r.cur = &queryItem{rec: Record[json.RawMessage]{Key: sp.Key, Meta: sp.Meta, Value: sp.Value}, doc: doc}
+	return nil
+}
+
+// merger is a heap of runs ordered by their current item.
+type merger struct {
+	q    *Query
+	runs []*runReader
+}
+
+func (m *merger) Len() int           { return len(m.runs) }
+func (m *merger) Less(i, j int) bool { return m.q.cmp(m.runs[i].cur, m.runs[j].cur) < 0 }
+func (m *merger) Swap(i, j int)      { m.runs[i], m.runs[j] = m.runs[j], m.runs[i] }
+func (m *merger) Push(x interface{}) { m.runs = append(m.runs, x.(*runReader)) }
+func (m *merger) Pop() interface{} {
+	r := m.runs[len(m.runs)-1]
+	m.runs = m.runs[:len(m.runs)-1]
+	return r
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// checkWritable fails with ErrReadOnly if the driver was opened with
+// Options.ReadOnly.
+func (d *Driver) checkWritable() error {
+	if d.readOnly {
+		return fmt.Errorf("%w: %s", ErrReadOnly, d.dir)
+	}
+	return nil
+}
+
+// tmpDir returns where scratch files such as query sort spills and backup
+// staging go: the tmp directory under the metadata directory, or the
+// system temporary directory for a read-only driver.
+func (d *Driver) tmpDir() string {
+	if d.readOnly {
+		return os.TempDir()
+	}
+	return d.metaPath("tmp")
+}
+
+// OpenSnapshot opens the database copy in dir read-only, with the options
+// d was opened with, such as masks, codecs and registered types, so that
+// reporting queries can run against a consistent historical copy while d
+// keeps serving writes. dir can be a checkpoint under the pitr directory of
+// the metadata directory, or a directory a backup was restored into. What
+// changes the copy is left out: write-behind, the change log, git,
+// placement, search, disk alerts and repairs. The returned driver must be
+// closed like any other.
+func (d *Driver) OpenSnapshot(dir string) (*Driver, error) {
+	opts := d.opts
+	opts.ReadOnly = true
+	opts.WriteBehind = false
+	opts.ChangeLog = false
+	opts.Git = nil
+	opts.Placement = nil
+	opts.Search = nil
+	opts.OnDiskAlert = nil
+	opts.RepairOnOpen = false
+	return New(dir, &opts)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+)
+
+// ReadAllMap decodes every record of collection into out, which must be a
+// pointer to a map with string keys (e.g. *map[string]User). Entries are
+// keyed by resource name, which is often not stored inside the record
+// itself. A nil map is allocated.
+func (d *Driver) ReadAllMap(collection string, out interface{}) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Map || rv.Elem().Type().Key().Kind() != reflect.String {
+		return fmt.Errorf("ReadAllMap needs a pointer to a map with string keys, got %T", out)
+	}
+	m := rv.Elem()
+	if m.IsNil() {
+		m.Set(reflect.MakeMap(m.Type()))
+	}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	records, err := d.scan(collection)
+	mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		b, err := d.mask(collection, r.Value)
+		if err != nil {
+			return err
+		}
+		v := reflect.New(m.Type().Elem())
+		if err := d.decodeRecord(collection, b, v.Interface()); err != nil {
+			return fmt.Errorf("%s/%s: %w", collection, r.Key, err)
+		}
+		m.SetMapIndex(reflect.ValueOf(r.Key).Convert(m.Type().Key()), v.Elem())
+	}
+	return nil
+}
+
+// Record is a stored record together with its key and file metadata, so
+// that callers can update or delete what they found.
+type Record[T any] struct {
+	Key   string
+	Meta  Meta
+	Value T
+}
+
+// Find returns the records of collection matching filter, in key order. A
+// nil filter matches every record. Filters see records after masking.
+func (d *Driver) Find(collection string, filter Filter) ([]Record[json.RawMessage], error) {
+	if err := checkCollection(collection); err != nil {
+		return nil, err
+	}
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	var records []Record[json.RawMessage]
+	keys, planned, err := d.plan(collection, filter)
+	if err == nil && d.parallel(collection, keys, planned) {
+		records, err = d.findParallel(collection, keys, planned, filter)
+		mutex.Unlock()
+		return records, err
+	}
+	if err == nil {
+		if planned {
+			records, err = d.readKeys(collection, keys)
+		} else {
+			records, err = d.scan(collection)
+		}
+	}
+	mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	out := records[:0]
+	for _, r := range records {
+		if r.Value, err = d.mask(collection, r.Value); err != nil {
+			return nil, err
+		}
+		if filter != nil {
+			doc, err := decodeDoc(r.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%s/%s: %w", collection, r.Key, err)
+			}
+			if !filter.Match(doc) {
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// ReadAllRecords returns every record of collection with its key and
+// metadata.
+func (d *Driver) ReadAllRecords(collection string) ([]Record[json.RawMessage], error) {
+	return d.Find(collection, nil)
+}
+
+// ReadManyConsistent returns the records of collection stored under keys,
+// in the order of keys, leaving out the keys that have no record. All of
+// them are read under the collection lock, so the result reflects a single
+// point in time: no write lands between two of the reads, which matters
+// when an invariant spans several records.
+func (d *Driver) ReadManyConsistent(collection string, keys []string) ([]Record[json.RawMessage], error) {
+	if err := checkCollection(collection); err != nil {
+		return nil, err
+	}
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, key := range keys {
+		if err := d.checkResource(key); err != nil {
+			return nil, err
+		}
+	}
+	pending := d.pendingRecords(collection)
+	out := make([]Record[json.RawMessage], 0, len(keys))
+	for _, key := range keys {
+		var r Record[json.RawMessage]
+		if op, ok := pending[key]; ok {
+			if op.b == nil {
+				continue
+			}
+			r = pendingRecordOf(op)
+		} else {
+			path := d.recordPath(collection, key)
+			fi, err := os.Stat(path)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if r.Value, err = os.ReadFile(path); err != nil {
+				return nil, err
+			}
+			r.Key, r.Meta = key, Meta{Size: fi.Size(), ModTime: fi.ModTime()}
+		}
+		var err error
+		if r.Value, err = d.mask(collection, r.Value); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// FindAs is Find with the matching records decoded into T.
+func FindAs[T any](d *Driver, collection string, filter Filter) ([]Record[T], error) {
+	raw, err := d.Find(collection, filter)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRecords[T](d, collection, raw)
+}
+
+func decodeRecords[T any](d *Driver, collection string, raw []Record[json.RawMessage]) ([]Record[T], error) {
+	out := make([]Record[T], len(raw))
+	for i, r := range raw {
+		out[i] = Record[T]{Key: r.Key, Meta: r.Meta}
+		if err := d.decodeRecord(collection, r.Value, &out[i].Value); err != nil {
+			return nil, fmt.Errorf("%s/%s: %w", collection, r.Key, err)
+		}
+	}
+	return out, nil
+}
+
+// Get reads the record resource of collection as a T.
+func Get[T any](s Store, collection, resource string) (T, error) {
+	var v T
+	err := s.Read(collection, resource, &v)
+	return v, err
+}
+
+// Put writes v as the record resource of collection.
+func Put[T any](s Store, collection, resource string, v T) error {
+	return s.Write(collection, resource, v)
+}
+
+// All returns every record of collection as a T.
+func All[T any](s Store, collection string) ([]T, error) {
+	raw, err := s.ReadAllRecords(collection)
+	if err != nil {
+		return nil, err
+	}
+	decode := func(b []byte, v interface{}) error { return json.Unmarshal(b, v) }
+	if d, ok := s.(*Driver); ok {
+		decode = func(b []byte, v interface{}) error { return d.decodeRecord(collection, b, v) }
+	}
+	out := make([]T, len(raw))
+	for i, r := range raw {
+		if err := decode(r.Value, &out[i]); err != nil {
+			return nil, fmt.Errorf("%s/%s: %w", collection, r.Key, err)
+		}
+	}
+	return out, nil
+}
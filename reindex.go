@@ -0,0 +1,314 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// IndexIssue is a disagreement between an index and the records it
+// covers.
+type IndexIssue struct {
+	Collection string
+	// Index is "keys", "bloom", "geo" or the name given to CreateIndex.
+	Index   string
+	Key     string
+	Problem string
+}
+
+func (i IndexIssue) String() string {
+	return fmt.Sprintf("%s/%s: %s index: %s", i.Collection, i.Key, i.Index, i.Problem)
+}
+
+// indexedCollections returns every collection on disk or known to an
+// in-memory index.
+func (d *Driver) indexedCollections() ([]string, error) {
+	names, err := d.Collections()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		seen[name] = true
+	}
+	d.mu.Lock()
+	for name := range d.keys {
+		seen[name] = true
+	}
+	for name := range d.blooms {
+		seen[name] = true
+	}
+	for name := range d.geo {
+		seen[name] = true
+	}
+	for name := range d.indexes {
+		seen[name] = true
+	}
+	d.mu.Unlock()
+	names = names[:0]
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// VerifyIndexes compares every index kept by the driver (key index, bloom
+// filters, geo and secondary indexes) with the records on disk and reports
+// where they have drifted apart, for example after a crash or after record
+// files were edited by hand. Use ReindexAll to repair them.
+func (d *Driver) VerifyIndexes() ([]IndexIssue, error) {
+	names, err := d.indexedCollections()
+	if err != nil {
+		return nil, err
+	}
+	var issues []IndexIssue
+	for _, collection := range names {
+		found, err := d.verifyCollection(collection)
+		if err != nil {
+			return nil, err
+		}
+		issues = append(issues, found...)
+	}
+	return issues, nil
+}
+
+func (d *Driver) verifyCollection(collection string) ([]IndexIssue, error) {
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var issues []IndexIssue
+	report := func(index, key, problem string) {
+		issues = append(issues, IndexIssue{collection, index, key, problem})
+	}
+	disk, err := d.listCollection(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	ki, keyed := d.keys[collection]
+	bf := d.blooms[collection]
+	geo := d.geo[collection]
+	indexes := make(map[string]*index, len(d.indexes[collection]))
+	for name, idx := range d.indexes[collection] {
+		indexes[name] = idx
+	}
+	d.mu.Unlock()
+
+	if d.keys != nil {
+		if !keyed {
+			ki = &keyIndex{meta: map[string]Meta{}}
+		}
+		for _, key := range disk.keys {
+			m, ok := ki.meta[key]
+			switch {
+			case !ok:
+				report("keys", key, "record is missing from the index")
+			case m.Size != disk.meta[key].Size:
+				report("keys", key, fmt.Sprintf("size is %d, index has %d", disk.meta[key].Size, m.Size))
+			}
+		}
+		for _, key := range ki.keys {
+			if _, ok := disk.meta[key]; !ok {
+				report("keys", key, "index lists a record that does not exist")
+			}
+		}
+	}
+
+	if d.blooms != nil {
+		for _, key := range disk.keys {
+			d.mu.Lock()
+			ok := bf != nil && bf.mayContain(key)
+			d.mu.Unlock()
+			if !ok {
+				report("bloom", key, "record is missing from the filter")
+			}
+		}
+	}
+
+	if geo == nil && len(indexes) == 0 {
+		return issues, nil
+	}
+	records, err := d.scan(collection)
+	if err != nil {
+		return nil, err
+	}
+	if geo != nil {
+		want := make(map[string]string)
+		for _, e := range geo.build(records) {
+			want[e.key] = e.hash
+		}
+		geo.mu.RLock()
+		got := make(map[string]string)
+		for _, e := range geo.entries {
+			got[e.key] = e.hash
+		}
+		geo.mu.RUnlock()
+		compareEntries(want, got, func(key, problem string) { report("geo", key, problem) })
+	}
+	for _, name := range sortedIndexNames(indexes) {
+		idx := indexes[name]
+		fresh := &index{extract: idx.extract, values: map[string]map[string]bool{}, byKey: map[string]string{}}
+		for _, r := range records {
+			fresh.put(r.Key, r.Value)
+		}
+		idx.mu.RLock()
+		got := make(map[string]string, len(idx.byKey))
+		for key, v := range idx.byKey {
+			got[key] = v
+		}
+		idx.mu.RUnlock()
+		compareEntries(fresh.byKey, got, func(key, problem string) { report(name, key, problem) })
+	}
+	return issues, nil
+}
+
+// compareEntries reports the differences between the entries an index
+// should hold and those it holds, both mapping record keys to values.
+func compareEntries(want, got map[string]string, report func(key, problem string)) {
+	keys := make([]string, 0, len(want)+len(got))
+	for key := range want {
+		keys = append(keys, key)
+	}
+	for key := range got {
+		if _, ok := want[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		w, inWant := want[key]
+		g, inGot := got[key]
+		switch {
+		case !inGot:
+			report(key, "record is missing from the index")
+		case !inWant:
+			report(key, "index holds a record it should not")
+		case w != g:
+			report(key, fmt.Sprintf("indexed under %s, record has %s", g, w))
+		}
+	}
+}
+
+func sortedIndexNames(indexes map[string]*index) []string {
+	names := make([]string, 0, len(indexes))
+	for name := range indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ReindexAll rebuilds every index kept by the driver from the records on
+// disk.
+func (d *Driver) ReindexAll() error {
+	names, err := d.indexedCollections()
+	if err != nil {
+		return err
+	}
+	for _, collection := range names {
+		if err := d.reindexCollection(collection); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Driver) reindexCollection(collection string) error {
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if d.keys != nil {
+		ki, err := d.listCollection(collection)
+		if err != nil {
+			return err
+		}
+		d.mu.Lock()
+		d.keys[collection] = ki
+		d.mu.Unlock()
+	}
+	if d.blooms != nil {
+		if err := d.rebuildBloom(collection, 0); err != nil {
+			return err
+		}
+	}
+
+	d.mu.Lock()
+	geo := d.geo[collection]
+	var indexes []*index
+	for _, idx := range d.indexes[collection] {
+		indexes = append(indexes, idx)
+	}
+	d.mu.Unlock()
+	if geo == nil && len(indexes) == 0 {
+		return nil
+	}
+	records, err := d.scan(collection)
+	if err != nil {
+		return err
+	}
+	if geo != nil {
+		entries := geo.build(records)
+		geo.mu.Lock()
+		geo.entries = entries
+		geo.mu.Unlock()
+	}
+	for _, idx := range indexes {
+		if err := d.buildIndex(collection, idx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reindex rebuilds the saved bloom filters of a database:
+// reindex [-dir path]
+func reindex(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	dir := fs.String("dir", "./", "database directory")
+	fs.Parse(args)
+
+	db, err := New(*dir, &Options{BloomFilters: true, KeyIndex: true})
+	if err != nil {
+		return err
+	}
+	if err := db.ReindexAll(); err != nil {
+		db.Close()
+		return err
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "indexes rebuilt")
+	return nil
+}
+
+// verifyIndexes checks the saved bloom filters of a database and fails if
+// any has drifted: verify-indexes [-dir path]
+func verifyIndexes(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("verify-indexes", flag.ExitOnError)
+	dir := fs.String("dir", "./", "database directory")
+	fs.Parse(args)
+
+	db, err := New(*dir, &Options{BloomFilters: true, KeyIndex: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	issues, err := db.VerifyIndexes()
+	if err != nil {
+		return err
+	}
+	for _, issue := range issues {
+		fmt.Fprintln(out, issue)
+	}
+	if len(issues) > 0 {
+		return fmt.Errorf("%d index problems found; run reindex to repair them", len(issues))
+	}
+	fmt.Fprintln(out, "indexes are consistent")
+	return nil
+}
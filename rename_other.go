@@ -0,0 +1,21 @@
+//go:build !windows
+
+package main
+
+import "os"
+
+// replaceFile moves src over dst. rename(2) replaces dst atomically on POSIX
+// filesystems.
+func replaceFile(src, dst string) error {
+	return os.Rename(src, dst)
+}
+
+// syncDir flushes directory metadata so a completed rename survives a crash.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	movefileReplaceExisting = 0x1
+	movefileWriteThrough    = 0x8
+)
+
+var procMoveFileExW = syscall.NewLazyDLL("kernel32.dll").NewProc("MoveFileExW")
+
+// replaceFile moves src over dst with MoveFileEx, which replaces an existing
+// dst in one operation and, with MOVEFILE_WRITE_THROUGH, does not return
+// until the move has been flushed to disk.
+func replaceFile(src, dst string) error {
+	from, err := syscall.UTF16PtrFromString(src)
+	if err != nil {
+		return err
+	}
+	to, err := syscall.UTF16PtrFromString(dst)
+	if err != nil {
+		return err
+	}
+	r, _, e := procMoveFileExW.Call(
+		uintptr(unsafe.Pointer(from)),
+		uintptr(unsafe.Pointer(to)),
+		movefileReplaceExisting|movefileWriteThrough,
+	)
+	if r == 0 {
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: e}
+	}
+	return nil
+}
+
+// syncDir is a no-op on Windows: directories cannot be flushed, and
+// MOVEFILE_WRITE_THROUGH already makes the rename durable.
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// respCollection holds the records of Redis keys without a colon.
+	respCollection = "redis"
+	// respMaxBulk, respMaxArgs and respMaxLine bound what a client may
+	// send in one command: the length of a bulk string, the number of
+	// arguments, and the length of a header or inline command line.
+	respMaxBulk = 64 << 20
+	respMaxArgs = 1 << 20
+	respMaxLine = 64 << 10
+	// respScanCount is how many keys SCAN returns when COUNT is not given.
+	respScanCount = 10
+)
+
+// errRESPQuit ends a connection after QUIT has been answered.
+var errRESPQuit = errors.New("quit")
+
+// ServeRESP accepts connections on l and serves them a subset of the
+// Redis protocol (RESP2), so that Redis clients and tools can read and
+// write records for simple use cases. A key "users:john" names the record
+// john of users; keys without a colon live in the collection "redis".
+//
+//	AUTH [default] token             see ServeRESPAuth
+//	PING [message], ECHO message, QUIT, SELECT 0
+//	GET key                          the record, see below
+//	SET key value [EX s|PX ms] [NX|XX] [KEEPTTL]
+//	DEL key..., EXISTS key...        the number of records removed or present
+//	SCAN cursor [MATCH glob] [COUNT n], KEYS glob
+//	HGETALL key, HGET key field      the fields of a record holding an object
+//
+// SET stores a value that is a JSON object or array as that document and
+// anything else as a JSON string; GET returns records holding a string
+// as that string and others as compact JSON. Expiry set with EX or PX
+// goes through Expire, so it has the resolution of the expiry sweep.
+// ServeRESP returns when accepting fails, such as when l is closed.
+//
+// ServeRESP does not authenticate anyone: use ServeRESPAuth, or listen on
+// a loopback address only.
+func (d *Driver) ServeRESP(l net.Listener) error {
+	return d.ServeRESPAuth(l, "")
+}
+
+// ServeRESPAuth is ServeRESP requiring clients to send AUTH token, or
+// AUTH default token, before any command but QUIT, as with the
+// requirepass setting of Redis. An empty token requires nothing.
+func (d *Driver) ServeRESPAuth(l net.Listener, token string) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go d.serveRESPConn(conn, token)
+	}
+}
+
+func (d *Driver) serveRESPConn(conn net.Conn, token string) {
+	defer conn.Close()
+	defer func() {
+		if v := recover(); v != nil {
+			d.log.Error("RESP connection from %s failed: %v\n", conn.RemoteAddr(), v)
+		}
+	}()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	authed := false
+	for {
+		args, err := readRESPCommand(r)
+		if err != nil {
+			if err != io.EOF {
+				writeRESPError(w, "ERR Protocol error: "+err.Error())
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		switch name := strings.ToUpper(args[0]); {
+		case name == "AUTH":
+			if respAuth(w, args, token) {
+				authed = true
+			}
+		case token != "" && !authed && name != "QUIT":
+			writeRESPError(w, "NOAUTH Authentication required.")
+		default:
+			err = d.respCommand(w, args)
+		}
+		if err == errRESPQuit {
+			w.Flush()
+			return
+		}
+		// Flush once the pipelined commands read so far are answered.
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// respAuth answers AUTH [username] password and reports whether it
+// authenticates the connection. The only user is "default", as in Redis
+// without ACLs.
+func respAuth(w *bufio.Writer, args []string, token string) bool {
+	switch {
+	case len(args) != 2 && len(args) != 3:
+		writeRESPError(w, "ERR wrong number of arguments for 'auth' command")
+		return false
+	case token == "":
+		writeRESPError(w, "ERR AUTH called without any password configured for the default user")
+		return false
+	}
+	user, password := "default", args[len(args)-1]
+	if len(args) == 3 {
+		user = args[1]
+	}
+	if user != "default" || !tokenEqual(password, token) {
+		writeRESPError(w, "WRONGPASS invalid username-password pair or user is disabled.")
+		return false
+	}
+	writeRESPSimple(w, "OK")
+	return true
+}
+
+// readRESPCommand reads a command, either an array of bulk strings or an
+// inline command as typed into telnet.
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	switch {
+	case err == nil && n == -1:
+		// A null array, which clients do not send as a command; ignored
+		// like an empty one.
+		return nil, nil
+	case err != nil || n < 0 || n > respMaxArgs:
+		return nil, fmt.Errorf("invalid multibulk length")
+	}
+	// The count is the client's word; grow as the arguments arrive.
+	capacity := n
+	if capacity > 64 {
+		capacity = 64
+	}
+	args := make([]string, 0, capacity)
+	for i := 0; i < n; i++ {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("expected '$', got %q", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > respMaxBulk {
+			return nil, fmt.Errorf("invalid bulk length")
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(b, []byte("\r\n")) {
+			return nil, fmt.Errorf("bulk string not terminated")
+		}
+		args = append(args, string(b[:size]))
+	}
+	return args, nil
+}
+
+// readRESPLine reads a line of at most respMaxLine bytes.
+func readRESPLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		frag, err := r.ReadSlice('\n')
+		if len(line)+len(frag) > respMaxLine {
+			return "", fmt.Errorf("line too long")
+		}
+		line = append(line, frag...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+func writeRESPError(w *bufio.Writer, msg string) {
+	w.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(msg) + "\r\n")
+}
+
+func writeRESPSimple(w *bufio.Writer, s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func writeRESPInt(w *bufio.Writer, n int) {
+	w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+func writeRESPBulk(w *bufio.Writer, s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func writeRESPNull(w *bufio.Writer) {
+	w.WriteString("$-1\r\n")
+}
+
+func writeRESPArray(w *bufio.Writer, items []string) {
+	w.WriteString("*" + strconv.Itoa(len(items)) + "\r\n")
+	for _, s := range items {
+		writeRESPBulk(w, s)
+	}
+}
+
+// respKey maps a Redis key onto a collection and record key.
+func (d *Driver) respKey(key string) (collection, resource string, err error) {
+	collection, resource, ok := strings.Cut(key, ":")
+	if !ok {
+		collection, resource = respCollection, key
+	}
+	if err := checkCollection(collection); err != nil {
+		return "", "", err
+	}
+	if resource == "" {
+		return "", "", fmt.Errorf("missing record key")
+	}
+	if err := d.checkResource(resource); err != nil {
+		return "", "", err
+	}
+	return collection, resource, nil
+}
+
+// respArity is the number of arguments of each command including its
+// name, or minus the least number for commands taking more.
+var respArity = map[string]int{
+	"PING": -1, "ECHO": 2, "QUIT": 1, "SELECT": 2, "COMMAND": -1,
+	"GET": 2, "SET": -3, "DEL": -2, "EXISTS": -2,
+	"SCAN": -2, "KEYS": 2, "HGETALL": 2, "HGET": 3,
+}
+
+// respCommand runs one command and writes its reply.
+func (d *Driver) respCommand(w *bufio.Writer, args []string) error {
+	name := strings.ToUpper(args[0])
+	n, ok := respArity[name]
+	if !ok {
+		writeRESPError(w, fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return nil
+	}
+	if (n > 0 && len(args) != n) || (n < 0 && len(args) < -n) {
+		writeRESPError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return nil
+	}
+
+	var err error
+	switch name {
+	case "PING":
+		if len(args) > 1 {
+			writeRESPBulk(w, args[1])
+		} else {
+			writeRESPSimple(w, "PONG")
+		}
+	case "ECHO":
+		writeRESPBulk(w, args[1])
+	case "QUIT":
+		writeRESPSimple(w, "OK")
+		return errRESPQuit
+	case "SELECT":
+		if args[1] != "0" {
+			writeRESPError(w, "ERR DB index is out of range")
+		} else {
+			writeRESPSimple(w, "OK")
+		}
+	case "COMMAND":
+		// Clients such as redis-cli ask for command docs on connect;
+		// answering with none makes them fall back to plain usage.
+		writeRESPArray(w, nil)
+	case "GET":
+		err = d.respGet(w, args[1])
+	case "SET":
+		err = d.respSet(w, args[1:])
+	case "DEL", "EXISTS":
+		err = d.respCount(w, name, args[1:])
+	case "SCAN":
+		err = d.respScan(w, args[1:])
+	case "KEYS":
+		var keys []string
+		if keys, err = d.respKeys(args[1]); err == nil {
+			writeRESPArray(w, keys)
+		}
+	case "HGETALL", "HGET":
+		err = d.respHash(w, args[1:])
+	}
+	if err != nil {
+		writeRESPError(w, "ERR "+err.Error())
+	}
+	return nil
+}
+
+func (d *Driver) respGet(w *bufio.Writer, key string) error {
+	collection, resource, err := d.respKey(key)
+	if err != nil {
+		return err
+	}
+	var raw json.RawMessage
+	if err := d.Read(collection, resource, &raw); err != nil {
+		if os.IsNotExist(err) {
+			writeRESPNull(w)
+			return nil
+		}
+		return err
+	}
+	writeRESPBulk(w, respValue(raw))
+	return nil
+}
+
+// respValue renders a stored JSON value for a Redis client: strings as
+// themselves, anything else as compact JSON.
+func respValue(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var buf bytes.Buffer
+	if json.Compact(&buf, raw) != nil {
+		return string(raw)
+	}
+	return buf.String()
+}
+
+func (d *Driver) respSet(w *bufio.Writer, args []string) error {
+	collection, resource, err := d.respKey(args[0])
+	if err != nil {
+		return err
+	}
+	var ttl time.Duration
+	var nx, xx, keepTTL bool
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX":
+			if i+1 == len(args) {
+				return fmt.Errorf("syntax error")
+			}
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid expire time in 'set' command")
+			}
+			if ttl = time.Duration(n) * time.Second; opt == "PX" {
+				ttl = time.Duration(n) * time.Millisecond
+			}
+		default:
+			return fmt.Errorf("syntax error")
+		}
+	}
+	if (nx && xx) || (keepTTL && ttl > 0) {
+		return fmt.Errorf("syntax error")
+	}
+
+	var v interface{} = args[1]
+	if t := bytes.TrimSpace([]byte(args[1])); len(t) > 0 && (t[0] == '{' || t[0] == '[') && json.Valid(t) {
+		v = json.RawMessage(t)
+	}
+	b, err := d.encode(v)
+	if err != nil {
+		return err
+	}
+	d.settle()
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	if nx || xx {
+		_, err := os.Stat(d.recordPath(collection, resource))
+		if exists := err == nil; (nx && exists) || (xx && !exists) {
+			mutex.Unlock()
+			writeRESPNull(w)
+			return nil
+		}
+	}
+	err = d.write(collection, resource, b)
+	mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if !keepTTL {
+		if err := d.Expire(collection, resource, ttl); err != nil {
+			return err
+		}
+	}
+	writeRESPSimple(w, "OK")
+	return nil
+}
+
+// respCount runs DEL or EXISTS and replies with how many keys it hit.
+func (d *Driver) respCount(w *bufio.Writer, name string, keys []string) error {
+	n := 0
+	for _, key := range keys {
+		collection, resource, err := d.respKey(key)
+		if err != nil {
+			return err
+		}
+		if name == "EXISTS" {
+			ok, err := d.Has(collection, resource)
+			if err != nil {
+				return err
+			}
+			if ok {
+				n++
+			}
+			continue
+		}
+		switch err := d.Delete(collection, resource); {
+		case err == nil:
+			n++
+		case !errors.Is(err, ErrNotFound):
+			return err
+		}
+	}
+	writeRESPInt(w, n)
+	return nil
+}
+
+// respKeys returns every Redis key matching the glob pattern, sorted.
+func (d *Driver) respKeys(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	collections, err := d.Collections()
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, collection := range collections {
+		if checkCollection(collection) != nil {
+			continue
+		}
+		keys, err := d.Keys(collection)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			name := collection + ":" + key
+			if collection == respCollection {
+				name = key
+			}
+			if ok, _ := path.Match(pattern, name); ok {
+				out = append(out, name)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// respScan runs SCAN. The cursor is the position in the sorted key list,
+// so keys written between calls may be seen twice or not at all, which
+// SCAN allows.
+func (d *Driver) respScan(w *bufio.Writer, args []string) error {
+	cursor, err := strconv.Atoi(args[0])
+	if err != nil || cursor < 0 {
+		return fmt.Errorf("invalid cursor")
+	}
+	pattern, count := "*", respScanCount
+	for i := 1; i < len(args); i++ {
+		if i+1 == len(args) {
+			return fmt.Errorf("syntax error")
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				return fmt.Errorf("value is not an integer or out of range")
+			}
+		case "TYPE":
+			// Every key is a string or hash in the sense of GET and
+			// HGETALL; the filter is accepted and ignored.
+		default:
+			return fmt.Errorf("syntax error")
+		}
+		i++
+	}
+	keys, err := d.respKeys(pattern)
+	if err != nil {
+		return err
+	}
+	if cursor > len(keys) {
+		cursor = len(keys)
+	}
+	end := cursor + count
+	next := strconv.Itoa(end)
+	if end >= len(keys) {
+		end, next = len(keys), "0"
+	}
+	w.WriteString("*2\r\n")
+	writeRESPBulk(w, next)
+	writeRESPArray(w, keys[cursor:end])
+	return nil
+}
+
+// respHash runs HGETALL key or HGET key field on a record holding an
+// object.
+func (d *Driver) respHash(w *bufio.Writer, args []string) error {
+	collection, resource, err := d.respKey(args[0])
+	if err != nil {
+		return err
+	}
+	var doc map[string]json.RawMessage
+	switch err := d.Read(collection, resource, &doc); {
+	case os.IsNotExist(err):
+		if len(args) == 2 {
+			writeRESPNull(w)
+		} else {
+			writeRESPArray(w, nil)
+		}
+		return nil
+	case err != nil:
+		w.WriteString("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n")
+		return nil
+	}
+	if len(args) == 2 {
+		if v, ok := doc[args[1]]; ok {
+			writeRESPBulk(w, respValue(v))
+		} else {
+			writeRESPNull(w)
+		}
+		return nil
+	}
+	fields := make([]string, 0, len(doc))
+	for field := range doc {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	items := make([]string, 0, 2*len(fields))
+	for _, field := range fields {
+		items = append(items, field, respValue(doc[field]))
+	}
+	writeRESPArray(w, items)
+	return nil
+}
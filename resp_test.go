@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+func TestRESPAuth(t *testing.T) {
+	d, err := New(t.TempDir(), &Options{Logger: NopLogger{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	client, server := net.Pipe()
+	defer client.Close()
+	go d.serveRESPConn(server, "s3cret")
+	r := bufio.NewReader(client)
+	for _, step := range []struct{ send, want string }{
+		{"SET users:ada 1", "-NOAUTH Authentication required."},
+		{"GET users:ada", "-NOAUTH Authentication required."},
+		{"AUTH wrong", "-WRONGPASS invalid username-password pair or user is disabled."},
+		{"AUTH admin s3cret", "-WRONGPASS invalid username-password pair or user is disabled."},
+		{"AUTH default s3cret", "+OK"},
+		{"SET users:ada 1", "+OK"},
+		{"EXISTS users:ada", ":1"},
+	} {
+		if _, err := client.Write([]byte(step.send + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		line, err := readRESPLine(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != step.want {
+			t.Fatalf("%s: got %q, want %q", step.send, line, step.want)
+		}
+	}
+}
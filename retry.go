@@ -0,0 +1,35 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy describes how transient filesystem errors (EBUSY, Windows
+// sharing violations, ...) are retried. Delays double after each attempt up
+// to MaxDelay, with full jitter applied.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// withRetry runs op until it succeeds, fails with a non-transient error or
+// the policy runs out of attempts.
+func (d *Driver) withRetry(op func() error) error {
+	delay := d.retry.BaseDelay
+	if delay <= 0 {
+		delay = 10 * time.Millisecond
+	}
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= d.retry.MaxAttempts || !isTransient(err) {
+			return err
+		}
+		d.log.Debug("retrying after transient error (attempt %d): %v\n", attempt, err)
+		d.sleep(time.Duration(rand.Int63n(int64(delay) + 1)))
+		if delay *= 2; d.retry.MaxDelay > 0 && delay > d.retry.MaxDelay {
+			delay = d.retry.MaxDelay
+		}
+	}
+}
@@ -0,0 +1,9 @@
+package main
+
+const poolSupported = true
+
+// openFileLimit returns 0: the host of a js/wasm program, such as Node.js,
+// does not tell it its limit on open files.
+func openFileLimit() int {
+	return 0
+}
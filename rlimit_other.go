@@ -0,0 +1,16 @@
+//go:build !windows && !js
+
+package main
+
+import "syscall"
+
+const poolSupported = true
+
+// openFileLimit returns the soft limit on open files, or 0 if unknown.
+func openFileLimit() int {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0
+	}
+	return int(rl.Cur)
+}
@@ -0,0 +1,9 @@
+package main
+
+// Open handles keep Windows from replacing record files, so handle pooling
+// is disabled there.
+const poolSupported = false
+
+func openFileLimit() int {
+	return 0
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// scheduler runs the jobs registered with Schedule. Last-run times are
+// saved under the metadata directory so that they survive restarts.
+type scheduler struct {
+	mu     sync.Mutex
+	jobs   map[string]*scheduledJob
+	wake   chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+	runner sync.WaitGroup
+}
+
+type scheduledJob struct {
+	name     string
+	schedule *cronSchedule
+	fn       func() error
+	next     time.Time
+	running  bool
+}
+
+// JobStatus is the persisted state of a scheduled job.
+type JobStatus struct {
+	LastRun   time.Time
+	LastError string `json:",omitempty"`
+}
+
+// Schedule runs fn at the times given by the cron expression spec, such as
+// "0 3 * * *" for 03:00 every day, "*/10 * * * *", "@hourly" or
+// "@every 90s". Times are local. The time of each job's last run is kept
+// in the metadata directory: a job whose run was missed while no driver
+// was open runs once as soon as it is scheduled again. A run is skipped if
+// the previous one is still going. Close stops the scheduler and waits for
+// running jobs.
+func (d *Driver) Schedule(spec, name string, fn func() error) error {
+	if name == "" {
+		return fmt.Errorf("job name cannot be empty")
+	}
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	s, err := parseCron(spec)
+	if err != nil {
+		return err
+	}
+	status, err := d.JobStatus(name)
+	if err != nil {
+		return err
+	}
+	now := d.now()
+	job := &scheduledJob{name: name, schedule: s, fn: fn, next: s.next(now)}
+	if !status.LastRun.IsZero() {
+		if missed := s.next(status.LastRun); !missed.IsZero() && missed.Before(now) {
+			job.next = now
+		}
+	}
+
+	d.mu.Lock()
+	if d.sched == nil {
+		d.sched = &scheduler{
+			jobs: make(map[string]*scheduledJob),
+			wake: make(chan struct{}, 1),
+			stop: make(chan struct{}),
+			done: make(chan struct{}),
+		}
+		go d.runScheduler(d.sched)
+	}
+	sched := d.sched
+	d.mu.Unlock()
+
+	sched.mu.Lock()
+	sched.jobs[name] = job
+	sched.mu.Unlock()
+	sched.poke()
+	return nil
+}
+
+// poke wakes the scheduler to look at its jobs again.
+func (s *scheduler) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Unschedule removes the job name. A run in progress is not interrupted.
+func (d *Driver) Unschedule(name string) {
+	d.mu.Lock()
+	sched := d.sched
+	d.mu.Unlock()
+	if sched == nil {
+		return
+	}
+	sched.mu.Lock()
+	delete(sched.jobs, name)
+	sched.mu.Unlock()
+}
+
+// JobStatus returns the saved state of the job name. A job that never ran
+// has a zero LastRun.
+func (d *Driver) JobStatus(name string) (JobStatus, error) {
+	var status JobStatus
+	b, err := os.ReadFile(d.metaPath("schedule", name+".json"))
+	if os.IsNotExist(err) {
+		return status, nil
+	}
+	if err != nil {
+		return status, err
+	}
+	err = json.Unmarshal(b, &status)
+	return status, err
+}
+
+func (d *Driver) runScheduler(s *scheduler) {
+	defer close(s.done)
+	for {
+		s.mu.Lock()
+		now := d.now()
+		var wait time.Duration = -1
+		for _, job := range s.jobs {
+			if job.next.IsZero() {
+				continue
+			}
+			if !job.next.After(now) {
+				if !job.running {
+					job.running = true
+					s.runner.Add(1)
+					go d.runJob(s, job)
+				}
+				job.next = job.schedule.next(now)
+				if job.next.IsZero() {
+					continue
+				}
+			}
+			if until := job.next.Sub(now); wait < 0 || until < wait {
+				wait = until
+			}
+		}
+		s.mu.Unlock()
+
+		var timer Timer
+		if wait >= 0 {
+			timer = d.clock.AfterFunc(wait, s.poke)
+		}
+		select {
+		case <-s.stop:
+		case <-s.wake:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+	}
+}
+
+func (d *Driver) runJob(s *scheduler, job *scheduledJob) {
+	defer s.runner.Done()
+	start := d.now()
+	err := job.fn()
+	status := JobStatus{LastRun: start}
+	if err != nil {
+		status.LastError = err.Error()
+		d.log.Error("scheduled job %s failed: %v\n", job.name, err)
+	}
+	if err := os.MkdirAll(d.metaPath("schedule"), 0755); err == nil {
+		if b, err := encode(status); err == nil {
+			if err := d.writeFile(d.metaPath("schedule", job.name+".json"), b); err != nil {
+				d.log.Error("saving state of job %s: %v\n", job.name, err)
+			}
+		}
+	}
+	s.mu.Lock()
+	job.running = false
+	s.mu.Unlock()
+}
+
+// stopScheduler stops starting jobs and waits for running ones.
+func (d *Driver) stopScheduler() {
+	d.mu.Lock()
+	s := d.sched
+	d.sched = nil
+	d.mu.Unlock()
+	if s == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	s.runner.Wait()
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// schemaSample is how many records InferSchema looks at, spread evenly
+// over the keys of the collection.
+const schemaSample = 1000
+
+// Schema describes the shape of the records of a collection as inferred by
+// InferSchema.
+type Schema struct {
+	Collection string
+	// Records is how many records were sampled.
+	Records int
+	// Fields lists every field seen, in path order. Array elements appear
+	// under the path of the array followed by "[]", e.g. "Tags[]".
+	Fields []SchemaField
+
+	root *schemaNode
+}
+
+// SchemaField is a field seen in the sampled records.
+type SchemaField struct {
+	Path string
+	// Count is how many of the values holding the field, records or
+	// enclosing objects, had it.
+	Count int
+	// Of is how many values could have held the field.
+	Of int
+	// Types counts the JSON types seen: "string", "integer", "number",
+	// "boolean", "object", "array" and "null".
+	Types map[string]int
+}
+
+// Conflict reports whether the field was seen with more than one type,
+// null aside. Integers and other numbers do not conflict.
+func (f SchemaField) Conflict() bool {
+	n := 0
+	for t := range f.Types {
+		if t != "null" && !(t == "integer" && f.Types["number"] > 0) {
+			n++
+		}
+	}
+	return n > 1
+}
+
+// Conflicts returns the fields seen with more than one type.
+func (s *Schema) Conflicts() []SchemaField {
+	var conflicts []SchemaField
+	for _, f := range s.Fields {
+		if f.Conflict() {
+			conflicts = append(conflicts, f)
+		}
+	}
+	return conflicts
+}
+
+// schemaNode accumulates the values seen at one path.
+type schemaNode struct {
+	seen   int // values at this path
+	types  map[string]int
+	fields map[string]*schemaNode
+	items  *schemaNode
+}
+
+func (n *schemaNode) add(v interface{}) {
+	n.seen++
+	if n.types == nil {
+		n.types = make(map[string]int)
+	}
+	n.types[jsonType(v)]++
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if n.fields == nil {
+			n.fields = make(map[string]*schemaNode)
+		}
+		for k, fv := range v {
+			child := n.fields[k]
+			if child == nil {
+				child = &schemaNode{}
+				n.fields[k] = child
+			}
+			child.add(fv)
+		}
+	case []interface{}:
+		if n.items == nil {
+			n.items = &schemaNode{}
+		}
+		for _, item := range v {
+			n.items.add(item)
+		}
+	}
+}
+
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if strings.ContainsAny(string(v), ".eE") {
+			return "number"
+		}
+		return "integer"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// InferSchema samples up to a thousand records of collection, spread over
+// its keys, and describes their fields: how often each occurs, with which
+// types, and where types conflict. Use JSONSchema or GoStruct on the
+// result to lock the collection down, e.g. with RegisterType.
+func (d *Driver) InferSchema(collection string) (*Schema, error) {
+	if err := checkCollection(collection); err != nil {
+		return nil, err
+	}
+	d.settle()
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+	ki, err := d.keyIndexFor(collection)
+	if err != nil {
+		return nil, err
+	}
+	keys := ki.keys
+	if len(keys) > schemaSample {
+		sampled := make([]string, schemaSample)
+		for i := range sampled {
+			sampled[i] = keys[i*len(keys)/schemaSample]
+		}
+		keys = sampled
+	}
+
+	s := &Schema{Collection: collection, root: &schemaNode{}}
+	for _, key := range keys {
+		b, err := d.rawRecord(collection, key)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := decodeJSON(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s/%s: %v", collection, key, err)
+		}
+		s.root.add(doc)
+		s.Records++
+	}
+	s.Fields = flattenSchema("", s.root, nil)
+	return s, nil
+}
+
+func flattenSchema(path string, n *schemaNode, fields []SchemaField) []SchemaField {
+	names := make([]string, 0, len(n.fields))
+	for name := range n.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	objects := n.types["object"]
+	for _, name := range names {
+		child := n.fields[name]
+		p := joinPath(path, name)
+		fields = append(fields, SchemaField{Path: p, Count: child.seen, Of: objects, Types: child.types})
+		fields = flattenSchema(p, child, fields)
+	}
+	if n.items != nil {
+		p := path + "[]"
+		fields = append(fields, SchemaField{Path: p, Count: n.items.seen, Of: n.items.seen, Types: n.items.types})
+		fields = flattenSchema(p, n.items, fields)
+	}
+	return fields
+}
+
+// JSONSchema returns a JSON Schema (draft 2020-12) matching the sampled
+// records. Fields present in every sampled object are required; fields
+// seen with several types accept all of them.
+func (s *Schema) JSONSchema() ([]byte, error) {
+	doc := s.root.jsonSchema()
+	doc["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	doc["title"] = s.Collection
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (n *schemaNode) jsonSchema() map[string]interface{} {
+	doc := make(map[string]interface{})
+	var types []string
+	for t := range n.types {
+		if t == "integer" && n.types["number"] > 0 {
+			continue
+		}
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	switch len(types) {
+	case 0:
+		return doc
+	case 1:
+		doc["type"] = types[0]
+	default:
+		doc["type"] = types
+	}
+	if n.fields != nil {
+		props := make(map[string]interface{}, len(n.fields))
+		var required []string
+		for name, child := range n.fields {
+			props[name] = child.jsonSchema()
+			if child.seen == n.types["object"] {
+				required = append(required, name)
+			}
+		}
+		doc["properties"] = props
+		if len(required) > 0 {
+			sort.Strings(required)
+			doc["required"] = required
+		}
+	}
+	if n.items != nil {
+		doc["items"] = n.items.jsonSchema()
+	}
+	return doc
+}
+
+// GoStruct returns the gofmt-ed source of a Go struct type called name
+// matching the sampled records. Optional fields get omitempty, fields
+// that may be null become pointers and conflicting fields interface{}.
+func (s *Schema) GoStruct(name string) (string, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// %s is a record of the %s collection.\ntype %s %s\n", name, s.Collection, name, s.root.goType())
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+	return string(src), nil
+}
+
+func (n *schemaNode) goType() string {
+	var kinds []string
+	for t := range n.types {
+		if t == "null" || (t == "integer" && n.types["number"] > 0) {
+			continue
+		}
+		kinds = append(kinds, t)
+	}
+	if len(kinds) != 1 {
+		return "interface{}"
+	}
+	var t string
+	switch kinds[0] {
+	case "string":
+		t = "string"
+	case "integer":
+		t = "int64"
+	case "number":
+		t = "float64"
+	case "boolean":
+		t = "bool"
+	case "array":
+		if n.items == nil || n.items.seen == 0 {
+			return "[]interface{}"
+		}
+		return "[]" + n.items.goType()
+	case "object":
+		t = n.goStruct()
+	}
+	if n.types["null"] > 0 {
+		return "*" + t
+	}
+	return t
+}
+
+func (n *schemaNode) goStruct() string {
+	names := make([]string, 0, len(n.fields))
+	for name := range n.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	sb.WriteString("struct {\n")
+	used := make(map[string]bool)
+	for _, name := range names {
+		child := n.fields[name]
+		field := goFieldName(name)
+		for used[field] {
+			field += "_"
+		}
+		used[field] = true
+		tag := ""
+		if field != name {
+			tag = name
+		}
+		if child.seen < n.types["object"] {
+			tag += ",omitempty"
+		}
+		fmt.Fprintf(&sb, "%s %s", field, child.goType())
+		if tag != "" {
+			fmt.Fprintf(&sb, " `json:%q`", tag)
+		}
+		sb.WriteString("\n")
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
+
+// goFieldName turns a JSON key into an exported Go identifier.
+func goFieldName(key string) string {
+	var sb strings.Builder
+	upper := true
+	for _, r := range key {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if sb.Len() == 0 && unicode.IsDigit(r) {
+			sb.WriteString("F")
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		sb.WriteRune(r)
+	}
+	if sb.Len() == 0 || !unicode.IsUpper([]rune(sb.String())[0]) {
+		return "F" + sb.String()
+	}
+	return sb.String()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+)
+
+// SearchIndex is a full-text index fed with the records of the driver,
+// set with Options.Search. The blevesearch module provides one backed by
+// an embedded Bleve index. Implementations must be safe for concurrent
+// use.
+type SearchIndex interface {
+	// Index adds or replaces the record key of collection.
+	Index(collection, key string, doc map[string]interface{}) error
+	// Delete removes the record key of collection, or every record of
+	// collection when key is empty.
+	Delete(collection, key string) error
+	// Search runs query, in whatever form the index understands, against
+	// the records of collection.
+	Search(collection string, query interface{}) (interface{}, error)
+}
+
+// searchUpdate feeds a stored record to the search index. Errors are
+// logged: the write has happened, and RebuildSearch catches the index up.
+func (d *Driver) searchUpdate(collection, key string, b []byte) {
+	if !d.searched(collection) {
+		return
+	}
+	b, err := d.mask(collection, b)
+	if err == nil {
+		var doc map[string]interface{}
+		if doc, err = decodeDoc(b); err == nil {
+			err = d.search.Index(collection, key, doc)
+		}
+	}
+	if err != nil {
+		d.log.Error("indexing '%s/%s' for search: %v\n", collection, key, err)
+	}
+}
+
+// searchRemove drops a deleted record, or a whole collection when key is
+// empty, from the search index.
+func (d *Driver) searchRemove(collection, key string) {
+	if !d.searched(collection) {
+		return
+	}
+	if err := d.search.Delete(collection, key); err != nil {
+		d.log.Error("removing '%s/%s' from search: %v\n", collection, key, err)
+	}
+}
+
+// searched reports whether collection is fed to the search index.
+func (d *Driver) searched(collection string) bool {
+	return d.search != nil && (d.searchOnly == nil || d.searchOnly[collection])
+}
+
+// SearchQuery runs query against the search index of collection and
+// returns the index's result; with the blevesearch module, query is a
+// bleve query or *bleve.SearchRequest, which can ask for facets, and the
+// result a *bleve.SearchResult with the hits ranked by relevance. The
+// index sees records after masking.
+func (d *Driver) SearchQuery(collection string, query interface{}) (interface{}, error) {
+	if err := checkCollection(collection); err != nil {
+		return nil, err
+	}
+	if !d.searched(collection) {
+		return nil, fmt.Errorf("collection %s is not indexed for search", collection)
+	}
+	return d.search.Search(collection, query)
+}
+
+// RebuildSearch replaces the search index entries of collection with its
+// current records, for collections written before Options.Search was set
+// or after indexing failed.
+func (d *Driver) RebuildSearch(collection string) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+	if !d.searched(collection) {
+		return fmt.Errorf("collection %s is not indexed for search", collection)
+	}
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	records, err := d.scan(collection)
+	if err != nil {
+		return err
+	}
+	if err := d.search.Delete(collection, ""); err != nil {
+		return err
+	}
+	for _, r := range records {
+		b, err := d.mask(collection, r.Value)
+		if err != nil {
+			return err
+		}
+		doc, err := decodeDoc(b)
+		if err != nil {
+			return fmt.Errorf("%s/%s: %w", collection, r.Key, err)
+		}
+		if err := d.search.Index(collection, r.Key, doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// seedFuncs returns the functions available to seed templates.
+func (d *Driver) seedFuncs() template.FuncMap {
+	return template.FuncMap{
+		"now": func() string { return d.now().UTC().Format(time.RFC3339) },
+		"env": os.Getenv,
+		"id":  d.newID,
+	}
+}
+
+// Seed loads the fixtures under dir in fsys, typically an embed.FS, into
+// collections that have no records yet, so demo environments and tests can
+// start from known data. Collections that already hold records are left
+// alone. The tree is laid out as
+//
+//	dir/<collection>.json         an object mapping keys to records
+//	dir/<collection>/<key>.json   a single record
+//
+// Files ending in .json.tmpl are first executed as text/template templates
+// with the functions now (the current UTC time in RFC 3339), env (an
+// environment variable) and id (a random hex string). Only JSON fixtures
+// are supported; YAML files are rejected rather than silently skipped.
+// Every fixture is parsed before anything is written.
+func (d *Driver) Seed(fsys fs.FS, dir string) error {
+	seeds := make(map[string]map[string]json.RawMessage)
+	add := func(collection, key string, rec json.RawMessage, name string) error {
+		if seeds[collection] == nil {
+			seeds[collection] = make(map[string]json.RawMessage)
+		}
+		if _, ok := seeds[collection][key]; ok {
+			return fmt.Errorf("seed %s: duplicate record %s/%s", name, collection, key)
+		}
+		seeds[collection][key] = rec
+		return nil
+	}
+	err := fs.WalkDir(fsys, dir, func(name string, de fs.DirEntry, err error) error {
+		if err != nil || de.IsDir() {
+			return err
+		}
+		base := path.Base(name)
+		switch ext := path.Ext(base); {
+		case ext == ".yaml" || ext == ".yml":
+			return fmt.Errorf("seed %s: YAML fixtures are not supported, use JSON", name)
+		case !strings.HasSuffix(base, ".json") && !strings.HasSuffix(base, ".json.tmpl"):
+			return nil
+		}
+		b, err := d.readSeed(fsys, name)
+		if err != nil {
+			return err
+		}
+
+		rel := name
+		if dir != "." {
+			rel = strings.TrimPrefix(name, dir+"/")
+		}
+		rel = strings.TrimSuffix(strings.TrimSuffix(rel, ".tmpl"), ".json")
+		collection, key, nested := strings.Cut(rel, "/")
+		if err := checkCollection(collection); err != nil {
+			return fmt.Errorf("seed %s: %v", name, err)
+		}
+		if nested {
+			if strings.Contains(key, "/") {
+				return fmt.Errorf("seed %s: fixtures nest at most one directory deep", name)
+			}
+			if !json.Valid(b) {
+				return fmt.Errorf("seed %s: invalid JSON", name)
+			}
+			return add(collection, key, b, name)
+		}
+		var records map[string]json.RawMessage
+		if err := json.Unmarshal(b, &records); err != nil {
+			return fmt.Errorf("seed %s: %v", name, err)
+		}
+		for key, rec := range records {
+			if err := add(collection, key, rec, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	collections := make([]string, 0, len(seeds))
+	for collection := range seeds {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+	for _, collection := range collections {
+		if err := d.seedCollection(collection, seeds[collection]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSeed returns the contents of a fixture, executing it first if it is
+// a template.
+func (d *Driver) readSeed(fsys fs.FS, name string) ([]byte, error) {
+	b, err := fs.ReadFile(fsys, name)
+	if err != nil || !strings.HasSuffix(name, ".tmpl") {
+		return b, err
+	}
+	t, err := template.New(name).Funcs(d.seedFuncs()).Parse(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("seed %s: %v", name, err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, nil); err != nil {
+		return nil, fmt.Errorf("seed %s: %v", name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// seedCollection writes records to collection unless it has records
+// already.
+func (d *Driver) seedCollection(collection string, records map[string]json.RawMessage) error {
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	ki, err := d.keyIndexFor(collection)
+	if err != nil {
+		return err
+	}
+	if len(ki.keys) > 0 {
+		d.log.Debug("Not seeding '%s' (collection has records)\n", collection)
+		return nil
+	}
+	for key, rec := range records {
+		b, err := encode(rec)
+		if err != nil {
+			return fmt.Errorf("seed %s/%s: %v", collection, key, err)
+		}
+		if err := d.write(collection, key, b); err != nil {
+			return err
+		}
+	}
+	d.log.Info("Seeded %d records into '%s'\n", len(records), collection)
+	return nil
+}
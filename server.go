@@ -0,0 +1,286 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Handler returns the HTTP interface of the database used in server mode.
+//
+//	GET  /healthz                   health checks as JSON; 503 when any check fails
+//	GET  /metrics                   lock contention and queue depths (see Stats)
+//	GET  /collections/{c}/export    the collection as NDJSON (see ExportNDJSON)
+//	POST /collections/{c}/import    load NDJSON into the collection (see ImportNDJSON)
+//	GET  /webhooks                  registered webhooks
+//	POST /webhooks                  register {"Collection", "URL", "Secret"} (see AddWebhook)
+//	DELETE /webhooks/{id}           unregister a webhook
+//	GET  /webhooks/dead             deliveries that ran out of attempts
+//	POST /webhooks/dead/{id}/retry  queue a dead letter again
+//
+// Import accepts a gzip-compressed body with Content-Encoding: gzip, and
+// export compresses its response when the client accepts gzip.
+//
+// The handler does not authenticate anyone: wrap it with RequireToken, or
+// serve it on a loopback address only, since import overwrites records,
+// export reads whole collections and webhooks make the server send
+// requests to any URL.
+func (d *Driver) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", d.serveHealth)
+	mux.HandleFunc("/metrics", d.serveMetrics)
+	mux.HandleFunc("/collections/", d.serveCollection)
+	mux.HandleFunc("/webhooks", d.serveWebhooks)
+	mux.HandleFunc("/webhooks/", d.serveWebhooks)
+	return mux
+}
+
+// RequireToken returns next answering 401 Unauthorized to requests that
+// do not carry "Authorization: Bearer token". /healthz is left open for
+// load balancers and orchestrators, which probe without credentials.
+func RequireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" && !tokenEqual(r.Header.Get("Authorization"), "Bearer "+token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tokenEqual compares a token a client sent with the one expected in
+// constant time, so that timing does not tell how much of it matched.
+func tokenEqual(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// isLoopback reports whether addr, a host:port to listen on, only accepts
+// connections from the local machine.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (d *Driver) serveCollection(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/collections/"), "/")
+	// Invalid names could reach the metadata directory or outside the
+	// database.
+	if len(parts) != 2 || checkCollection(parts[0]) != nil {
+		http.NotFound(w, r)
+		return
+	}
+	collection, action := parts[0], parts[1]
+	switch {
+	case action == "export" && r.Method == http.MethodGet:
+		d.serveExport(w, r, collection)
+	case action == "import" && r.Method == http.MethodPost:
+		d.serveImport(w, r, collection)
+	case action == "export" || action == "import":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (d *Driver) serveExport(w http.ResponseWriter, r *http.Request, collection string) {
+	if _, err := os.Stat(d.collectionDir(collection)); err != nil {
+		httpError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	var out io.Writer = w
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+	if _, err := d.ExportNDJSON(collection, out); err != nil {
+		d.log.Error("exporting %s: %v\n", collection, err)
+	}
+}
+
+func (d *Driver) serveImport(w http.ResponseWriter, r *http.Request, collection string) {
+	var in io.Reader = r.Body
+	switch r.Header.Get("Content-Encoding") {
+	case "":
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		in = gz
+	default:
+		http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+	n, err := d.ImportNDJSON(collection, in)
+	w.Header().Set("Content-Type", "application/json")
+	result := struct {
+		Imported int
+		Error    string `json:",omitempty"`
+	}{Imported: n}
+	if err != nil {
+		result.Error = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (d *Driver) serveWebhooks(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/webhooks"), "/")
+	parts := strings.Split(path, "/")
+	var v interface{}
+	status := http.StatusOK
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		v = d.Webhooks()
+	case path == "" && r.Method == http.MethodPost:
+		var req struct{ Collection, URL, Secret string }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkCollection(req.Collection); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h, err := d.AddWebhook(req.Collection, req.URL, req.Secret)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.Secret = ""
+		v, status = h, http.StatusCreated
+	case path == "dead" && r.Method == http.MethodGet:
+		dead, err := d.DeadLetters()
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		v = dead
+	case len(parts) == 3 && parts[0] == "dead" && parts[2] == "retry" && r.Method == http.MethodPost:
+		if err := d.RetryDeadLetter(parts[1]); err != nil {
+			httpError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case len(parts) == 1 && path != "dead" && r.Method == http.MethodDelete:
+		if err := d.RemoveWebhook(parts[0]); err != nil {
+			httpError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// httpError reports err with a status matching its cause.
+func httpError(w http.ResponseWriter, err error) {
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func (d *Driver) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h := d.Health()
+	w.Header().Set("Content-Type", "application/json")
+	if !h.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(h)
+}
+
+func (d *Driver) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s, err := d.Stats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.WriteMetrics(w)
+}
+
+// serve runs the database in server mode, also speaking the Redis
+// protocol if -resp is given:
+// serve [-dir path] [-addr host:port] [-token token] [-resp host:port]
+//
+// The HTTP interface listens on localhost unless told otherwise. Neither
+// it nor the Redis protocol listens elsewhere without a token, taken from
+// -token or the DATABASE_TOKEN environment variable, which HTTP clients
+// then send as a bearer token and Redis clients with AUTH.
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	dir := fs.String("dir", "./", "database directory")
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	token := fs.String("token", "", "bearer token HTTP clients must send; $DATABASE_TOKEN if not given")
+	respAddr := fs.String("resp", "", "address to serve the Redis protocol on, e.g. localhost:6379")
+	fs.Parse(args)
+
+	if *token == "" {
+		// Not the flag default, which -help would print.
+		*token = os.Getenv("DATABASE_TOKEN")
+	}
+	for _, a := range []string{*addr, *respAddr} {
+		if a != "" && *token == "" && !isLoopback(a) {
+			return fmt.Errorf("refusing to serve %s without a token: set -token or DATABASE_TOKEN, or listen on localhost", a)
+		}
+	}
+	db, err := New(*dir, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	db.StartWebhooks()
+	errc := make(chan error, 2)
+	if *respAddr != "" {
+		l, err := net.Listen("tcp", *respAddr)
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		go func() { errc <- db.ServeRESPAuth(l, *token) }()
+	}
+	h := db.Handler()
+	if *token != "" {
+		h = RequireToken(*token, h)
+	}
+	go func() { errc <- http.ListenAndServe(*addr, h) }()
+	return <-errc
+}
@@ -0,0 +1,363 @@
+// Package sessions keeps the sessions of a web application as records of
+// a dedicated collection, given to the expiry of the database so that
+// abandoned sessions are removed without a cleanup job of their own.
+//
+// Manager handles the session cookie for net/http handlers:
+//
+//	m := sessions.NewManager(sessions.New(db, "sessions"), nil)
+//	http.Handle("/", m.Middleware(handler))
+//
+//	// in handler
+//	s := sessions.FromContext(r.Context())
+//	s.Values["user"] = "alice"
+//
+// Sessions alone is a session store for other session managers: it has
+// the methods of the Store interface of github.com/alexedwards/scs/v2, and
+// the gorillasessions module adapts it to github.com/gorilla/sessions.
+package sessions
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Store is the subset of the database driver the sessions need.
+type Store interface {
+	Read(collection, resource string, v interface{}) error
+	Write(collection, resource string, v interface{}) error
+	Delete(collection, resource string) error
+	Keys(collection string) ([]string, error)
+	Expire(collection, key string, ttl time.Duration) error
+}
+
+// record is a session as stored.
+type record struct {
+	Data    []byte
+	Expires time.Time
+}
+
+// Sessions stores session data by token in one collection.
+type Sessions struct {
+	store      Store
+	collection string
+}
+
+// New returns the sessions stored in collection.
+func New(store Store, collection string) *Sessions {
+	return &Sessions{store: store, collection: collection}
+}
+
+// NewToken returns a new random session token.
+func NewToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// validToken reports whether token can be a record key. Tokens come from
+// cookies, so anything else is treated as an unknown session.
+func validToken(token string) bool {
+	if token == "" || len(token) > 128 {
+		return false
+	}
+	for _, r := range token {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Find returns the data of the session token. found is false if there is
+// no such session or it has expired.
+func (s *Sessions) Find(token string) (b []byte, found bool, err error) {
+	if !validToken(token) {
+		return nil, false, nil
+	}
+	var rec record
+	err = s.store.Read(s.collection, token, &rec)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if !time.Now().Before(rec.Expires) {
+		// Not swept yet.
+		return nil, false, nil
+	}
+	return rec.Data, true, nil
+}
+
+// Commit stores the data of the session token, to expire at expiry.
+func (s *Sessions) Commit(token string, b []byte, expiry time.Time) error {
+	if !validToken(token) {
+		return errors.New("sessions: invalid token")
+	}
+	if err := s.store.Write(s.collection, token, record{Data: b, Expires: expiry.UTC()}); err != nil {
+		return err
+	}
+	return s.store.Expire(s.collection, token, time.Until(expiry))
+}
+
+// Delete removes the session token, if it exists.
+func (s *Sessions) Delete(token string) error {
+	if !validToken(token) {
+		return nil
+	}
+	if err := s.store.Delete(s.collection, token); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// All returns the data of every unexpired session, by token.
+func (s *Sessions) All() (map[string][]byte, error) {
+	tokens, err := s.store.Keys(s.collection)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	all := make(map[string][]byte)
+	for _, token := range tokens {
+		b, found, err := s.Find(token)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			all[token] = b
+		}
+	}
+	return all, nil
+}
+
+// Options configures a Manager. Zero fields take the defaults given.
+type Options struct {
+	// CookieName is the name of the session cookie, "session" by default.
+	CookieName string
+	// MaxAge is how long a session lives after it was last saved, a day
+	// by default.
+	MaxAge time.Duration
+	// Path, Domain, Secure and SameSite are those of the cookie, which is
+	// always HttpOnly. Path is "/" by default and SameSite Lax.
+	Path     string
+	Domain   string
+	Secure   bool
+	SameSite http.SameSite
+}
+
+// Manager loads and saves the sessions of HTTP requests, identified by a
+// cookie holding their token.
+type Manager struct {
+	sessions *Sessions
+	opts     Options
+}
+
+// NewManager returns a manager of the sessions in s. A nil opts is the
+// zero Options.
+func NewManager(s *Sessions, opts *Options) *Manager {
+	m := &Manager{sessions: s}
+	if opts != nil {
+		m.opts = *opts
+	}
+	if m.opts.CookieName == "" {
+		m.opts.CookieName = "session"
+	}
+	if m.opts.MaxAge <= 0 {
+		m.opts.MaxAge = 24 * time.Hour
+	}
+	if m.opts.Path == "" {
+		m.opts.Path = "/"
+	}
+	if m.opts.SameSite == 0 {
+		m.opts.SameSite = http.SameSiteLaxMode
+	}
+	return m
+}
+
+// Session is the session of a request. Values must encode to JSON, and
+// are decoded as encoding/json decodes into interface{} values.
+type Session struct {
+	ID     string
+	Values map[string]interface{}
+	// IsNew is set when the request carried no valid session.
+	IsNew bool
+
+	old       string // the ID before Renew, to delete on Save
+	destroyed bool
+}
+
+// Renew gives the session a new ID, keeping its values, so that an ID
+// known before a login cannot be used after it. The old ID is removed by
+// Save.
+func (s *Session) Renew() error {
+	id, err := NewToken()
+	if err != nil {
+		return err
+	}
+	if s.old == "" && !s.IsNew {
+		s.old = s.ID
+	}
+	s.ID = id
+	return nil
+}
+
+// Load returns the session of r, or a new one if r has none or it has
+// expired.
+func (m *Manager) Load(r *http.Request) (*Session, error) {
+	if c, err := r.Cookie(m.opts.CookieName); err == nil {
+		b, found, err := m.sessions.Find(c.Value)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			s := &Session{ID: c.Value}
+			if err := json.Unmarshal(b, &s.Values); err != nil {
+				return nil, err
+			}
+			if s.Values == nil {
+				s.Values = make(map[string]interface{})
+			}
+			return s, nil
+		}
+	}
+	id, err := NewToken()
+	if err != nil {
+		return nil, err
+	}
+	return &Session{ID: id, Values: make(map[string]interface{}), IsNew: true}, nil
+}
+
+// Save stores the session for MaxAge from now and sets the cookie on w,
+// which must be done before the response header is written. A new
+// session without values is not stored.
+func (m *Manager) Save(w http.ResponseWriter, s *Session) error {
+	if s.destroyed || (s.IsNew && len(s.Values) == 0) {
+		return nil
+	}
+	b, err := json.Marshal(s.Values)
+	if err != nil {
+		return err
+	}
+	expiry := time.Now().Add(m.opts.MaxAge)
+	if err := m.sessions.Commit(s.ID, b, expiry); err != nil {
+		return err
+	}
+	if s.old != "" {
+		if err := m.sessions.Delete(s.old); err != nil {
+			return err
+		}
+		s.old = ""
+	}
+	s.IsNew = false
+	http.SetCookie(w, m.cookie(s.ID, expiry))
+	return nil
+}
+
+// Destroy removes the session and clears the cookie on w.
+func (m *Manager) Destroy(w http.ResponseWriter, s *Session) error {
+	for _, id := range []string{s.ID, s.old} {
+		if err := m.sessions.Delete(id); err != nil {
+			return err
+		}
+	}
+	s.destroyed = true
+	c := m.cookie("", time.Unix(0, 0))
+	c.MaxAge = -1
+	http.SetCookie(w, c)
+	return nil
+}
+
+func (m *Manager) cookie(value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     m.opts.CookieName,
+		Value:    value,
+		Path:     m.opts.Path,
+		Domain:   m.opts.Domain,
+		Expires:  expires.UTC(),
+		Secure:   m.opts.Secure,
+		HttpOnly: true,
+		SameSite: m.opts.SameSite,
+	}
+}
+
+type sessionKey struct{}
+
+// FromContext returns the session Middleware put in ctx, nil if none.
+func FromContext(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionKey{}).(*Session)
+	return s
+}
+
+// Middleware loads the session of every request into its context, see
+// FromContext, and saves it, extending it by MaxAge, when the handler
+// starts its response or returns. Failing to load the session answers
+// 500 Internal Server Error; failing to save it is answered likewise if
+// the handler has not started its response yet.
+func (m *Manager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := m.Load(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sw := &saveWriter{ResponseWriter: w, m: m, s: s}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), sessionKey{}, s)))
+		if !sw.saved {
+			if err := m.Save(w, s); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		}
+	})
+}
+
+// saveWriter saves the session before the response header is written,
+// while the cookie can still be set.
+type saveWriter struct {
+	http.ResponseWriter
+	m     *Manager
+	s     *Session
+	saved bool
+	err   error
+}
+
+func (sw *saveWriter) save() {
+	if !sw.saved {
+		sw.saved = true
+		sw.err = sw.m.Save(sw.ResponseWriter, sw.s)
+	}
+}
+
+func (sw *saveWriter) WriteHeader(status int) {
+	sw.save()
+	if sw.err != nil {
+		http.Error(sw.ResponseWriter, sw.err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *saveWriter) Write(b []byte) (int, error) {
+	if !sw.saved {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// Flush lets handlers that stream flush through the middleware.
+func (sw *saveWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		sw.save()
+		f.Flush()
+	}
+}
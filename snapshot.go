@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Snapshot is a point-in-time view of a collection. Writes and deletes
+// performed after the snapshot was taken are not visible through it.
+type Snapshot struct {
+	d          *Driver
+	collection string
+	dir        string
+	keys       []string
+	shared     bool // dir is the collection of a read-only driver
+}
+
+// Snapshot captures the current records of collection. Record files are
+// hard-linked into a private directory while the collection lock is held;
+// since Write replaces files instead of modifying them, and Options.Shred
+// leaves linked files alone, the links keep pointing at the captured
+// contents. Filesystems without hard links fall back to copying. Close
+// must be called to release the snapshot. A read-only driver reads its
+// records in place, as they cannot change.
+func (d *Driver) Snapshot(collection string) (*Snapshot, error) {
+	if err := checkCollection(collection); err != nil {
+		return nil, err
+	}
+	if d.readOnly {
+		ki, err := d.listCollection(collection)
+		if err != nil {
+			return nil, err
+		}
+		return &Snapshot{d: d, collection: collection, dir: d.collectionDir(collection), keys: ki.keys, shared: true}, nil
+	}
+	if err := os.MkdirAll(d.metaPath("snapshots"), 0755); err != nil {
+		return nil, err
+	}
+	d.settle()
+	dir, err := os.MkdirTemp(d.metaPath("snapshots"), "snap-")
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{d: d, collection: collection, dir: dir}
+
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+	ki, err := d.listCollection(collection)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	for _, key := range ki.keys {
+		src := d.recordPath(collection, key)
+		if err := linkOrCopy(src, filepath.Join(dir, key+".json")); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	s.keys = ki.keys
+	return s, nil
+}
+
+// Keys returns the sorted keys captured by the snapshot.
+func (s *Snapshot) Keys() []string {
+	return append([]string(nil), s.keys...)
+}
+
+// Read decodes the captured record resource into v.
+func (s *Snapshot) Read(resource string, v interface{}) error {
+	b, err := s.raw(resource)
+	if err != nil {
+		return err
+	}
+	if b, err = s.d.mask(s.collection, b); err != nil {
+		return err
+	}
+	return s.d.decodeRecord(s.collection, b, v)
+}
+
+// ReadAll returns every captured record, like Driver.ReadAll.
+func (s *Snapshot) ReadAll() ([]string, error) {
+	records := make([]string, 0, len(s.keys))
+	for _, key := range s.keys {
+		b, err := s.raw(key)
+		if err != nil {
+			return nil, err
+		}
+		if b, err = s.d.mask(s.collection, b); err != nil {
+			return nil, err
+		}
+		records = append(records, string(b))
+	}
+	return records, nil
+}
+
+func (s *Snapshot) raw(resource string) ([]byte, error) {
+	if err := s.d.checkResource(resource); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join(s.dir, resource+".json"))
+}
+
+// Close releases the files held by the snapshot.
+func (s *Snapshot) Close() error {
+	if s.shared {
+		return nil
+	}
+	return os.RemoveAll(s.dir)
+}
+
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(src, dst)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
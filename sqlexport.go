@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ExportSQL writes the whole database as an SQLite script, one table per
+// collection, which can be loaded with
+//
+//	sqlite3 data.db < dump.sql
+//
+// Every table has a "key" primary key and a "doc" column holding the record
+// as JSON, usable with SQLite's json_extract. When all records of a
+// collection have the same fields, each field (nested ones by dotted path,
+// e.g. "Address.City") additionally gets a column of its own, so the data
+// can be queried with plain SQL. ExportSQLite writes the same tables to a
+// database file instead.
+func (d *Driver) ExportSQL(w io.Writer) error {
+	names, err := d.Collections()
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "BEGIN TRANSACTION;")
+	for _, collection := range names {
+		if err := d.exportTable(bw, collection); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(bw, "COMMIT;")
+	return bw.Flush()
+}
+
+func (d *Driver) exportTable(w io.Writer, collection string) error {
+	t, err := d.sqlTable(collection)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s;\n", t.create())
+	for i, key := range t.keys {
+		values := []string{quoteString(key), quoteString(t.docs[i])}
+		for _, c := range t.columns {
+			values = append(values, sqlLiteral(t.rows[i][c]))
+		}
+		fmt.Fprintf(w, "INSERT INTO %s VALUES (%s);\n", quoteIdent(collection), strings.Join(values, ", "))
+	}
+	return nil
+}
+
+// sqlTable is a collection as exported, with its records in key order.
+type sqlTable struct {
+	name    string
+	keys    []string
+	docs    []string                 // the records as compact JSON
+	rows    []map[string]interface{} // the records flattened
+	columns []string                 // the flattened columns, if uniform
+}
+
+func (d *Driver) sqlTable(collection string) (*sqlTable, error) {
+	records, err := d.Find(collection, nil)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	t := &sqlTable{name: collection}
+	objects := true
+	for _, r := range records {
+		compact, err := compactJSON(r.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%s/%s: %w", collection, r.Key, err)
+		}
+		// A record that is an array or a scalar has no fields; the table
+		// keeps to the key and doc columns then.
+		row := make(map[string]interface{})
+		if doc, err := decodeDoc(r.Value); err == nil {
+			flatten(row, "", doc)
+		} else {
+			objects = false
+		}
+		t.keys = append(t.keys, r.Key)
+		t.docs = append(t.docs, compact)
+		t.rows = append(t.rows, row)
+	}
+	if objects {
+		t.columns = uniformColumns(t.rows)
+	}
+	return t, nil
+}
+
+// create returns the CREATE TABLE statement of t.
+func (t *sqlTable) create() string {
+	defs := []string{`"key" TEXT PRIMARY KEY`, `"doc" TEXT`}
+	for _, c := range t.columns {
+		defs = append(defs, quoteIdent(c)+" "+sqlType(t.rows[0][c]))
+	}
+	return fmt.Sprintf("CREATE TABLE %s (%s)", quoteIdent(t.name), strings.Join(defs, ", "))
+}
+
+// flatten copies the leaves of doc into out keyed by dotted path. Arrays are
+// leaves.
+func flatten(out map[string]interface{}, prefix string, doc map[string]interface{}) {
+	for k, v := range doc {
+		if child, ok := v.(map[string]interface{}); ok && len(child) > 0 {
+			flatten(out, prefix+k+".", child)
+			continue
+		}
+		out[prefix+k] = v
+	}
+}
+
+// uniformColumns returns the sorted field paths if every row has the same
+// set of them, and nil otherwise. Fields that would clash with the key and
+// doc columns or with each other disable flattening too; SQLite compares
+// column names regardless of case, so "Key" clashes with "key".
+func uniformColumns(rows []map[string]interface{}) []string {
+	if len(rows) == 0 {
+		return nil
+	}
+	var columns []string
+	seen := map[string]bool{"key": true, "doc": true}
+	for c := range rows[0] {
+		lc := strings.ToLower(c)
+		if seen[lc] {
+			return nil
+		}
+		seen[lc] = true
+		columns = append(columns, c)
+	}
+	for _, row := range rows[1:] {
+		if len(row) != len(columns) {
+			return nil
+		}
+		for _, c := range columns {
+			if _, ok := row[c]; !ok {
+				return nil
+			}
+		}
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+func sqlType(v interface{}) string {
+	switch v.(type) {
+	case json.Number:
+		return "NUMERIC"
+	case bool:
+		return "INTEGER"
+	}
+	return "TEXT"
+}
+
+func sqlLiteral(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case json.Number:
+		return v.String()
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case string:
+		return quoteString(v)
+	}
+	b, _ := json.Marshal(v)
+	return quoteString(string(b))
+}
+
+func quoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+func quoteString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func compactJSON(b []byte) (string, error) {
+	var sb strings.Builder
+	enc := json.NewEncoder(&sb)
+	var v json.RawMessage = b
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(sb.String()), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUniformColumns(t *testing.T) {
+	for _, tc := range []struct {
+		fields []string
+		want   []string
+	}{
+		{[]string{"Name", "Age"}, []string{"Age", "Name"}},
+		{[]string{"key"}, nil},
+		{[]string{"Key"}, nil},
+		{[]string{"Doc", "Name"}, nil},
+		{[]string{"name", "Name"}, nil},
+	} {
+		row := make(map[string]interface{})
+		for _, f := range tc.fields {
+			row[f] = "x"
+		}
+		if got := uniformColumns([]map[string]interface{}{row, row}); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("uniformColumns(%q) = %q, want %q", tc.fields, got, tc.want)
+		}
+	}
+}
+
+// sqlExportDB returns a database with a collection whose fields clash
+// with the doc column but for case, and one mixing an object record with
+// an array record.
+func sqlExportDB(t *testing.T) *Driver {
+	t.Helper()
+	d, err := New(t.TempDir(), &Options{Logger: NopLogger{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writes := []struct {
+		collection, key string
+		v               interface{}
+	}{
+		{"things", "a", map[string]string{"Doc": "x", "Name": "a"}},
+		{"things", "b", map[string]string{"Doc": "y", "Name": "b"}},
+		{"mixed", "a", map[string]int{"N": 1}},
+		{"mixed", "b", []int{1, 2}},
+		{"people", "ada", user{"Ada"}},
+	}
+	for _, w := range writes {
+		if err := d.Write(w.collection, w.key, w.v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return d
+}
+
+func TestExportSQL(t *testing.T) {
+	d := sqlExportDB(t)
+	defer d.Close()
+	if err := d.ExportSQL(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportSQLite(t *testing.T) {
+	d := sqlExportDB(t)
+	defer d.Close()
+	path := filepath.Join(t.TempDir(), "data.db")
+	if err := d.ExportSQLite(path); err != nil {
+		t.Fatal(err)
+	}
+	sqlite3, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Skip("sqlite3 not found to check the file")
+	}
+	script := `PRAGMA integrity_check;
+SELECT count(*) FROM things;
+SELECT count(*) FROM mixed;
+SELECT "Name" FROM people;`
+	cmd := exec.Command(sqlite3, path)
+	cmd.Stdin = strings.NewReader(script)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("sqlite3: %v\n%s", err, out)
+	}
+	if got, want := string(out), "ok\n2\n2\nAda\n"; got != want {
+		t.Fatalf("sqlite3 printed %q, want %q", got, want)
+	}
+}
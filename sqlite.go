@@ -0,0 +1,545 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// The SQLite file format, as far as ExportSQLite needs it: a database of
+// tables and their primary key indexes, written once, front to back, with
+// no free pages. See https://www.sqlite.org/fileformat2.html.
+const (
+	sqlitePageSize   = 4096
+	sqliteHeaderSize = 100
+	// sqliteVersion is the SQLite release the files claim to be written
+	// by, 3.40.1.
+	sqliteVersion = 3040001
+)
+
+// The types of b-tree pages.
+const (
+	pageIndexInterior = 0x02
+	pageTableInterior = 0x05
+	pageIndexLeaf     = 0x0a
+	pageTableLeaf     = 0x0d
+)
+
+// ExportSQLite writes the whole database to an SQLite database file at
+// path, with the tables ExportSQL creates, so that it can be opened with
+// the sqlite3 shell or any SQLite driver without loading a script:
+//
+//	sqlite3 data.db 'SELECT key, json_extract(doc, "$.Name") FROM users'
+//
+// The file is written beside path and renamed over it when complete.
+func (d *Driver) ExportSQLite(path string) error {
+	names, err := d.Collections()
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	err = d.writeSQLite(&sqliteFile{f: f, pages: 1}, names)
+	if err == nil && d.sync {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return diskError(err)
+	}
+	if err := d.withRetry(func() error { return replaceFile(tmp, path) }); err != nil {
+		return err
+	}
+	if d.sync {
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// writeSQLite writes a table per collection, then the schema, whose root is
+// page 1, behind the database header.
+func (d *Driver) writeSQLite(s *sqliteFile, names []string) error {
+	var schema [][]interface{}
+	for _, collection := range names {
+		t, err := d.sqlTable(collection)
+		if err != nil {
+			return err
+		}
+		table, index, err := s.writeTable(t)
+		if err != nil {
+			return err
+		}
+		// The index SQLite makes for a TEXT PRIMARY KEY, which it finds
+		// by name and expects without SQL of its own.
+		schema = append(schema,
+			[]interface{}{"table", t.name, t.name, int64(table), t.create()},
+			[]interface{}{"index", "sqlite_autoindex_" + t.name + "_1", t.name, int64(index), nil},
+		)
+	}
+	cells := make([][]byte, len(schema))
+	for i, row := range schema {
+		cell, err := s.tableCell(int64(i+1), sqliteRecord(row))
+		if err != nil {
+			return err
+		}
+		cells[i] = cell
+	}
+	page, err := s.tableTree(cells, seq(len(cells)), sqliteHeaderSize)
+	if err != nil {
+		return err
+	}
+	copy(page, s.header())
+	return s.writePage(1, page)
+}
+
+// writeTable writes the rows of t in key order, with rowids counting from
+// 1, and the primary key index over them. It returns the root pages of
+// both.
+func (s *sqliteFile) writeTable(t *sqlTable) (table, index uint32, err error) {
+	rows := make([][]byte, len(t.keys))
+	entries := make([][]byte, len(t.keys))
+	for i, key := range t.keys {
+		values := []interface{}{key, t.docs[i]}
+		for _, c := range t.columns {
+			values = append(values, sqliteValue(t.rows[i][c]))
+		}
+		if rows[i], err = s.tableCell(int64(i+1), sqliteRecord(values)); err != nil {
+			return 0, 0, err
+		}
+		if entries[i], err = s.indexCell(sqliteRecord([]interface{}{key, int64(i + 1)})); err != nil {
+			return 0, 0, err
+		}
+	}
+	root, err := s.tableTree(rows, seq(len(rows)), 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	table = s.alloc()
+	if err := s.writePage(table, root); err != nil {
+		return 0, 0, err
+	}
+	if index, err = s.indexTree(entries, nil); err != nil {
+		return 0, 0, err
+	}
+	return table, index, nil
+}
+
+// sqliteValue converts a flattened field to the value SQLite stores for
+// the literal sqlLiteral writes.
+func sqliteValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case json.Number:
+		if n, err := strconv.ParseInt(v.String(), 10, 64); err == nil {
+			return n
+		}
+		f, err := strconv.ParseFloat(v.String(), 64)
+		if err != nil {
+			return v.String()
+		}
+		// The NUMERIC affinity stores exact integers as integers.
+		if f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+			return int64(f)
+		}
+		return f
+	case bool:
+		if v {
+			return int64(1)
+		}
+		return int64(0)
+	case string:
+		return v
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// sqliteFile is an SQLite database file being written. Pages are numbered
+// from 1 and allocated in order; page 1 is reserved for the header and the
+// schema.
+type sqliteFile struct {
+	f     *os.File
+	pages uint32
+}
+
+func (s *sqliteFile) alloc() uint32 {
+	s.pages++
+	return s.pages
+}
+
+func (s *sqliteFile) writePage(pgno uint32, page []byte) error {
+	_, err := s.f.WriteAt(page, int64(pgno-1)*sqlitePageSize)
+	return err
+}
+
+// header returns the database header for the pages written so far.
+func (s *sqliteFile) header() []byte {
+	h := make([]byte, sqliteHeaderSize)
+	copy(h, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(h[16:], sqlitePageSize)
+	h[18], h[19] = 1, 1                   // rollback journal
+	h[21], h[22], h[23] = 64, 32, 32      // payload fractions
+	binary.BigEndian.PutUint32(h[24:], 1) // change counter
+	binary.BigEndian.PutUint32(h[28:], s.pages)
+	binary.BigEndian.PutUint32(h[40:], 1) // schema cookie
+	binary.BigEndian.PutUint32(h[44:], 4) // schema format
+	binary.BigEndian.PutUint32(h[56:], 1) // UTF-8
+	binary.BigEndian.PutUint32(h[92:], 1) // the change counter the size is valid for
+	binary.BigEndian.PutUint32(h[96:], sqliteVersion)
+	return h
+}
+
+// tableCell returns the leaf cell of a table row.
+func (s *sqliteFile) tableCell(rowid int64, record []byte) ([]byte, error) {
+	cell := appendVarint(nil, uint64(len(record)))
+	cell = appendVarint(cell, uint64(rowid))
+	return s.spill(cell, record, sqlitePageSize-35)
+}
+
+// indexCell returns the leaf cell of an index entry. Interior cells are
+// the same, behind the page number of their left child.
+func (s *sqliteFile) indexCell(record []byte) ([]byte, error) {
+	cell := appendVarint(nil, uint64(len(record)))
+	return s.spill(cell, record, (sqlitePageSize-12)*64/255-23)
+}
+
+// spill appends to cell as much of payload as its page keeps, at most max
+// bytes, and writes the rest to a chain of overflow pages whose first page
+// number ends the cell.
+func (s *sqliteFile) spill(cell, payload []byte, max int) ([]byte, error) {
+	const usable = sqlitePageSize
+	local := len(payload)
+	if local > max {
+		least := (usable-12)*32/255 - 23
+		local = least + (len(payload)-least)%(usable-4)
+		if local > max {
+			local = least
+		}
+	}
+	cell = append(cell, payload[:local]...)
+	rest := payload[local:]
+	if len(rest) == 0 {
+		return cell, nil
+	}
+	first := s.alloc()
+	page := make([]byte, sqlitePageSize)
+	for pgno := first; len(rest) > 0; {
+		n := len(rest)
+		if n > usable-4 {
+			n = usable - 4
+		}
+		next := uint32(0)
+		if n < len(rest) {
+			next = s.alloc()
+		}
+		binary.BigEndian.PutUint32(page, next)
+		copy(page[4:], rest[:n])
+		for i := 4 + n; i < len(page); i++ {
+			page[i] = 0
+		}
+		if err := s.writePage(pgno, page); err != nil {
+			return nil, err
+		}
+		rest, pgno = rest[n:], next
+	}
+	return appendUint32(cell, first), nil
+}
+
+// tableTree writes the pages of the b-tree of the table rows in cells,
+// ordered by their rowids, except its root page, which it returns for the
+// caller to write. offset is where the root page starts, after the
+// database header on page 1.
+func (s *sqliteFile) tableTree(cells [][]byte, rowids []int64, offset int) ([]byte, error) {
+	typ := byte(pageTableLeaf)
+	var children []uint32
+	for {
+		interior := typ == pageTableInterior
+		if cellsSize(cells, interior) <= sqlitePageSize-offset-pageHeaderSize(typ) {
+			if !interior {
+				return buildPage(typ, offset, cells, 0), nil
+			}
+			return buildPage(typ, offset, cells[:len(cells)-1], children[len(children)-1]), nil
+		}
+		// Write this level and go on with the one above, with a cell per
+		// page of it, keyed by the last rowid of the page.
+		var up [][]byte
+		var upRowids []int64
+		var upChildren []uint32
+		for _, r := range partition(cells, sqlitePageSize-pageHeaderSize(typ), interior) {
+			page := buildPage(typ, 0, cells[r[0]:r[1]], 0)
+			if interior {
+				page = buildPage(typ, 0, cells[r[0]:r[1]-1], children[r[1]-1])
+			}
+			pgno := s.alloc()
+			if err := s.writePage(pgno, page); err != nil {
+				return nil, err
+			}
+			rowid := rowids[r[1]-1]
+			up = append(up, appendVarint(appendUint32(nil, pgno), uint64(rowid)))
+			upRowids = append(upRowids, rowid)
+			upChildren = append(upChildren, pgno)
+		}
+		cells, rowids, children, typ = up, upRowids, upChildren, pageTableInterior
+	}
+}
+
+// partition splits cells into the ranges that fill pages of size bytes in
+// turn. On interior pages the last cell of each range is not stored but
+// stands for the right child, and a range is never left with that alone.
+func partition(cells [][]byte, size int, interior bool) [][2]int {
+	var ranges [][2]int
+	start, used := 0, 0
+	for i, cell := range cells {
+		cost := len(cell) + 2
+		if interior {
+			if i == start {
+				continue
+			}
+			cost = len(cells[i-1]) + 2
+		}
+		if used+cost > size {
+			ranges = append(ranges, [2]int{start, i})
+			start, used = i, 0
+			if !interior {
+				used = cost
+			}
+			continue
+		}
+		used += cost
+	}
+	ranges = append(ranges, [2]int{start, len(cells)})
+	if last := len(ranges) - 1; interior && last > 0 && ranges[last][1]-ranges[last][0] == 1 {
+		ranges[last-1][1]--
+		ranges[last][0]--
+	}
+	return ranges
+}
+
+// indexTree writes the pages of the b-tree of the index entries in cells,
+// in index order, except its root page, which it writes to a page of its
+// own, returned. In an index, the entries of interior pages are entries
+// like those of leaves, not copies of them.
+func (s *sqliteFile) indexTree(cells [][]byte, children []uint32) (uint32, error) {
+	typ := byte(pageIndexLeaf)
+	for {
+		interior := typ == pageIndexInterior
+		cost := func(i int) int {
+			if interior {
+				return 4 + len(cells[i]) + 2
+			}
+			return len(cells[i]) + 2
+		}
+		size := sqlitePageSize - pageHeaderSize(typ)
+		total := 0
+		for i := range cells {
+			total += cost(i)
+		}
+		if total <= size {
+			pgno := s.alloc()
+			return pgno, s.writePage(pgno, s.indexPage(typ, cells, children, 0, len(cells)))
+		}
+		// Split the entries into pages with one between each pair, which
+		// moves up to the level above.
+		var pages [][2]int
+		var dividers []int
+		for start := 0; start < len(cells); {
+			end, used := start, 0
+			for end < len(cells) && used+cost(end) <= size {
+				used += cost(end)
+				end++
+			}
+			pages = append(pages, [2]int{start, end})
+			if end == len(cells) {
+				break
+			}
+			dividers = append(dividers, end)
+			start = end + 1
+		}
+		if len(dividers) == len(pages) {
+			// The last entry went up, leaving no page after it; lower the
+			// divider by one entry instead.
+			last := len(pages) - 1
+			d := dividers[last]
+			pages[last][1]--
+			dividers[last] = d - 1
+			pages = append(pages, [2]int{d, d + 1})
+		}
+		var up [][]byte
+		var upChildren []uint32
+		for i, r := range pages {
+			pgno := s.alloc()
+			if err := s.writePage(pgno, s.indexPage(typ, cells, children, r[0], r[1])); err != nil {
+				return 0, err
+			}
+			upChildren = append(upChildren, pgno)
+			if i < len(dividers) {
+				up = append(up, cells[dividers[i]])
+			}
+		}
+		cells, children, typ = up, upChildren, pageIndexInterior
+	}
+}
+
+// indexPage returns the page of the entries cells[start:end], behind their
+// left children on interior pages, whose right child is children[end].
+func (s *sqliteFile) indexPage(typ byte, cells [][]byte, children []uint32, start, end int) []byte {
+	if typ == pageIndexLeaf {
+		return buildPage(typ, 0, cells[start:end], 0)
+	}
+	page := make([][]byte, 0, end-start)
+	for i := start; i < end; i++ {
+		page = append(page, append(appendUint32(nil, children[i]), cells[i]...))
+	}
+	return buildPage(typ, 0, page, children[end])
+}
+
+func pageHeaderSize(typ byte) int {
+	if typ == pageTableInterior || typ == pageIndexInterior {
+		return 12
+	}
+	return 8
+}
+
+// cellsSize is the room cells take on a page, with their pointers. On
+// interior table pages the last one is the right child instead.
+func cellsSize(cells [][]byte, interior bool) int {
+	if interior {
+		cells = cells[:len(cells)-1]
+	}
+	n := 0
+	for _, c := range cells {
+		n += len(c) + 2
+	}
+	return n
+}
+
+// buildPage lays out a b-tree page whose header starts at offset, with the
+// cell contents packed at its end in reverse order.
+func buildPage(typ byte, offset int, cells [][]byte, right uint32) []byte {
+	page := make([]byte, sqlitePageSize)
+	h := page[offset:]
+	h[0] = typ
+	binary.BigEndian.PutUint16(h[3:], uint16(len(cells)))
+	ptr, content := offset+pageHeaderSize(typ), sqlitePageSize
+	for _, c := range cells {
+		content -= len(c)
+		copy(page[content:], c)
+		binary.BigEndian.PutUint16(page[ptr:], uint16(content))
+		ptr += 2
+	}
+	binary.BigEndian.PutUint16(h[5:], uint16(content))
+	if pageHeaderSize(typ) == 12 {
+		binary.BigEndian.PutUint32(h[8:], right)
+	}
+	return page
+}
+
+// sqliteRecord encodes values, each nil, an int64, a float64 or a string,
+// in the record format: a header of serial types, then the values.
+func sqliteRecord(values []interface{}) []byte {
+	var types, body []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			types = appendVarint(types, 0)
+		case int64:
+			typ, n := intSerialType(v)
+			types = appendVarint(types, typ)
+			for i := n - 1; i >= 0; i-- {
+				body = append(body, byte(v>>(8*i)))
+			}
+		case float64:
+			types = appendVarint(types, 7)
+			body = appendUint64(body, math.Float64bits(v))
+		case string:
+			types = appendVarint(types, uint64(2*len(v)+13))
+			body = append(body, v...)
+		default:
+			panic(fmt.Sprintf("sqliteRecord: unsupported value %T", v))
+		}
+	}
+	// The header size counts its own varint.
+	n := len(types) + 1
+	for len(types)+varintLen(uint64(n)) != n {
+		n = len(types) + varintLen(uint64(n))
+	}
+	record := appendVarint(nil, uint64(n))
+	record = append(record, types...)
+	return append(record, body...)
+}
+
+// intSerialType returns the serial type of v and how many bytes it takes.
+func intSerialType(v int64) (uint64, int) {
+	switch {
+	case v == 0:
+		return 8, 0
+	case v == 1:
+		return 9, 0
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		return 1, 1
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		return 2, 2
+	case v >= -1<<23 && v < 1<<23:
+		return 3, 3
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		return 4, 4
+	case v >= -1<<47 && v < 1<<47:
+		return 5, 6
+	}
+	return 6, 8
+}
+
+// appendVarint appends v as an SQLite varint: big-endian groups of 7 bits
+// with the high bit set on all but the last, and a ninth byte of 8 bits
+// for values beyond 56 bits.
+func appendVarint(b []byte, v uint64) []byte {
+	if v >= 1<<56 {
+		var buf [9]byte
+		buf[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			buf[i] = byte(v&0x7f) | 0x80
+			v >>= 7
+		}
+		return append(b, buf[:]...)
+	}
+	var buf [8]byte
+	i := len(buf) - 1
+	buf[i] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		buf[i] = byte(v&0x7f) | 0x80
+	}
+	return append(b, buf[i:]...)
+}
+
+func varintLen(v uint64) int {
+	return len(appendVarint(nil, v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
+
+func seq(n int) []int64 {
+	s := make([]int64, n)
+	for i := range s {
+		s[i] = int64(i + 1)
+	}
+	return s
+}
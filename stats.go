@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// collectionMutex is the lock of a collection. It counts how often it was
+// taken and how long callers waited for it, for Stats.
+type collectionMutex struct {
+	acquired  uint64 // atomic; first to be 64-bit aligned on 32-bit platforms
+	contended uint64 // atomic
+	waitNanos int64  // atomic
+	maxWait   int64  // atomic
+	sync.Mutex
+}
+
+// Lock takes the lock, timing the wait if it is held by someone else.
+func (m *collectionMutex) Lock() {
+	atomic.AddUint64(&m.acquired, 1)
+	if m.TryLock() {
+		return
+	}
+	start := time.Now()
+	m.Mutex.Lock()
+	wait := int64(time.Since(start))
+	atomic.AddUint64(&m.contended, 1)
+	atomic.AddInt64(&m.waitNanos, wait)
+	for {
+		max := atomic.LoadInt64(&m.maxWait)
+		if wait <= max || atomic.CompareAndSwapInt64(&m.maxWait, max, wait) {
+			return
+		}
+	}
+}
+
+// Stats is a snapshot of what the driver is waiting on, to find out why
+// writes are slow under load. See Driver.Stats.
+type Stats struct {
+	Taken time.Time
+	// Locks has the lock statistics of every collection used since the
+	// driver was opened, by collection.
+	Locks []LockStats
+	// WriteQueue is how many mutations queued by Options.WriteBehind are
+	// not on disk yet, and WriteQueueAge how long the oldest has waited.
+	WriteQueue    int
+	WriteQueueAge time.Duration
+	// WriteCoalesced counts the mutations Options.CoalesceWindow folded
+	// into one queued earlier, each a write the disk was spared.
+	WriteCoalesced uint64
+	// ExpiryDue is how many records have expired but not been removed by
+	// a sweep yet, and ExpiryUndelivered how many removed ones still wait
+	// for an OnExpire callback to accept them.
+	ExpiryDue         int
+	ExpiryUndelivered int
+	// WebhookQueue is how many webhook deliveries wait to be attempted,
+	// and DeadLetters how many ran out of attempts.
+	WebhookQueue int
+	DeadLetters  int
+}
+
+// LockStats describes the lock of a collection: how often it was taken,
+// how often the taker had to wait for another holder, and how long those
+// waits took in total and at most.
+type LockStats struct {
+	Collection string
+	Acquired   uint64
+	Contended  uint64
+	Wait       time.Duration
+	MaxWait    time.Duration
+}
+
+// Stats returns a snapshot of the lock contention and queue depths of the
+// driver. Counters run from when the driver was opened. Counting the
+// queued webhook deliveries and expired records lists their directories,
+// so Stats is meant for occasional polling, such as by the /metrics
+// endpoint of Handler.
+func (d *Driver) Stats() (Stats, error) {
+	s := Stats{Taken: d.now()}
+	d.mu.Lock()
+	for collection, m := range d.mutexes {
+		s.Locks = append(s.Locks, LockStats{
+			Collection: collection,
+			Acquired:   atomic.LoadUint64(&m.acquired),
+			Contended:  atomic.LoadUint64(&m.contended),
+			Wait:       time.Duration(atomic.LoadInt64(&m.waitNanos)),
+			MaxWait:    time.Duration(atomic.LoadInt64(&m.maxWait)),
+		})
+	}
+	d.mu.Unlock()
+	sort.Slice(s.Locks, func(i, j int) bool { return s.Locks[i].Collection < s.Locks[j].Collection })
+
+	if wb := d.wb; wb != nil {
+		wb.mu.Lock()
+		s.WriteQueue = len(wb.queue)
+		if len(wb.queue) > 0 {
+			s.WriteQueueAge = d.now().Sub(wb.queue[0].queued)
+		}
+		s.WriteCoalesced = wb.coalesced
+		wb.mu.Unlock()
+	}
+	if e := d.ttl; e != nil {
+		e.mu.Lock()
+		for _, keys := range e.at {
+			for _, at := range keys {
+				if !s.Taken.Before(at) {
+					s.ExpiryDue++
+				}
+			}
+		}
+		e.mu.Unlock()
+	}
+	var err error
+	if s.ExpiryUndelivered, err = countFiles(d.metaPath("expired")); err != nil {
+		return s, err
+	}
+	if s.WebhookQueue, err = countFiles(d.metaPath("webhooks", "queue")); err != nil {
+		return s, err
+	}
+	if s.DeadLetters, err = countFiles(d.metaPath("webhooks", "dead")); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// countFiles counts the JSON files in dir, which need not exist.
+func countFiles(dir string) (int, error) {
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, file := range files {
+		if filepath.Ext(file.Name()) == ".json" {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// WriteMetrics writes s in the Prometheus text exposition format.
+func (s Stats) WriteMetrics(w io.Writer) error {
+	var err error
+	printf := func(format string, args ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, args...)
+		}
+	}
+	perLock := func(name, kind, help string, value func(LockStats) string) {
+		printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, l := range s.Locks {
+			printf("%s{collection=%q} %s\n", name, l.Collection, value(l))
+		}
+	}
+	seconds := func(d time.Duration) string { return fmt.Sprint(d.Seconds()) }
+	perLock("godb_lock_acquired_total", "counter", "Times the collection lock was taken.", func(l LockStats) string { return fmt.Sprint(l.Acquired) })
+	perLock("godb_lock_contended_total", "counter", "Times taking the collection lock had to wait.", func(l LockStats) string { return fmt.Sprint(l.Contended) })
+	perLock("godb_lock_wait_seconds_total", "counter", "Time spent waiting for the collection lock.", func(l LockStats) string { return seconds(l.Wait) })
+	perLock("godb_lock_wait_seconds_max", "gauge", "Longest wait for the collection lock.", func(l LockStats) string { return seconds(l.MaxWait) })
+	gauge := func(name, help string, value interface{}) {
+		printf("# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, value)
+	}
+	gauge("godb_write_queue_depth", "Write-behind mutations not on disk yet.", s.WriteQueue)
+	gauge("godb_write_queue_age_seconds", "Age of the oldest queued write-behind mutation.", seconds(s.WriteQueueAge))
+	printf("# HELP godb_write_coalesced_total Write-behind mutations folded into one queued earlier.\n# TYPE godb_write_coalesced_total counter\ngodb_write_coalesced_total %d\n", s.WriteCoalesced)
+	gauge("godb_expiry_due", "Expired records not removed by a sweep yet.", s.ExpiryDue)
+	gauge("godb_expiry_undelivered", "Expired records waiting for an OnExpire callback.", s.ExpiryUndelivered)
+	gauge("godb_webhook_queue_depth", "Webhook deliveries waiting to be attempted.", s.WebhookQueue)
+	gauge("godb_webhook_dead_letters", "Webhook deliveries that ran out of attempts.", s.DeadLetters)
+	return err
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Store is the data access API of the database. Driver implements it;
+// MockStore and alternative implementations can stand in for it in code
+// that reads and writes records. Operational methods such as backups,
+// checkpoints and transactions are only available on Driver.
+type Store interface {
+	Write(collection, resource string, v interface{}) error
+	Read(collection, resource string, v interface{}) error
+	ReadOrDefault(collection, resource string, v, def interface{}) error
+	ReadAll(collection string) ([]string, error)
+	Delete(collection, resource string) error
+	DeleteCollection(collection string) error
+	Purge(collection, resource string) error
+	WriteIf(collection, resource string, v interface{}, cond Filter) error
+	Exclusive(collection, resource string, fn func() error) error
+
+	Push(collection, resource, field string, values ...interface{}) error
+	AddToSet(collection, resource, field string, values ...interface{}) error
+	Pull(collection, resource, field string, values ...interface{}) error
+
+	Has(collection, resource string) (bool, error)
+	Keys(collection string) ([]string, error)
+	KeysWithPrefix(collection, prefix string) ([]string, error)
+	Count(collection string) (int, error)
+	Stat(collection, resource string) (Meta, error)
+	Collections() ([]string, error)
+
+	ReadAllMap(collection string, out interface{}) error
+	ReadAllRecords(collection string) ([]Record[json.RawMessage], error)
+	Find(collection string, filter Filter) ([]Record[json.RawMessage], error)
+	Query(collection string, q *Query) ([]Record[json.RawMessage], error)
+	Paginate(collection string, q *Query, token string, size int) (*Page, error)
+
+	WriteFrom(collection, resource string, r io.Reader) error
+	ReadTo(collection, resource string, w io.Writer) error
+	DeleteBlob(collection, resource string) error
+
+	PutAttachment(collection, key, name string, r io.Reader) error
+	GetAttachment(collection, key, name string) (io.ReadCloser, *Attachment, error)
+	Attachments(collection, key string) ([]Attachment, error)
+	DeleteAttachment(collection, key, name string) error
+
+	Close() error
+}
+
+var _ Store = (*Driver)(nil)
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// streamBufferSize is the size of the buffered reader Read decodes
+// records from.
+const streamBufferSize = 32 << 10
+
+// newDecoder returns a JSON decoder over r, keeping numbers as json.Number
+// when Options.UseNumber is set.
+func (d *Driver) newDecoder(r io.Reader) *json.Decoder {
+	dec := json.NewDecoder(r)
+	if d.useNumber {
+		dec.UseNumber()
+	}
+	return dec
+}
+
+// unmarshal is json.Unmarshal honoring Options.UseNumber.
+func (d *Driver) unmarshal(b []byte, v interface{}) error {
+	if !d.useNumber {
+		return json.Unmarshal(b, v)
+	}
+	return decodeOne(d.newDecoder(bytes.NewReader(b)), v)
+}
+
+// decodeOne decodes the single JSON value read by dec into v, failing like
+// json.Unmarshal when anything but white space follows it.
+func decodeOne(dec *json.Decoder, v interface{}) error {
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("invalid data after top-level value")
+	}
+	return nil
+}
+
+// streams reports whether Read can decode records of collection straight
+// from the file, which holds a record in memory only once, as the decoder
+// fills its buffer, rather than as a copy of the file and again while
+// decoding. That requires nothing else to see the bytes first: no masks,
+// codecs or registered type, no memory mapping and no Backend other than
+// the operating system.
+func (d *Driver) streams(collection string) bool {
+	if !d.native || len(d.masks[collection]) > 0 || len(d.codecs) > 0 || d.mmapMin > 0 {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.types[collection] == nil
+}
+
+// streamRecord decodes the record file at path into v through a buffered
+// reader from a pool, using the handle pool if enabled.
+func (d *Driver) streamRecord(path string, v interface{}) error {
+	var r io.Reader
+	if d.pool != nil {
+		h, err := d.pool.acquire(path)
+		if err != nil {
+			return err
+		}
+		defer d.pool.release(h)
+		r = io.NewSectionReader(h.f, 0, h.size)
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	br := getStreamReader(r)
+	defer putStreamReader(br)
+	dec := d.newDecoder(br)
+	if d.noUnknown {
+		dec.DisallowUnknownFields()
+	}
+	return decodeOne(dec, &v)
+}
@@ -0,0 +1,217 @@
+// Package timeseries stores points keyed by timestamp on top of the
+// database. Points are spread over time-bucketed collections so that range
+// queries and retention only touch the buckets they need.
+package timeseries
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Store is the subset of the database driver a Series needs.
+type Store interface {
+	Write(collection, resource string, v interface{}) error
+	Read(collection, resource string, v interface{}) error
+	ReadAll(collection string) ([]string, error)
+	DeleteCollection(collection string) error
+}
+
+// Point is a single timestamped observation.
+type Point struct {
+	Time  time.Time
+	Value float64
+	Tags  map[string]string `json:",omitempty"`
+}
+
+// Aggregate reduces the values falling into one downsampling window.
+type Aggregate func(values []float64) float64
+
+// Series is a named time series. Each bucket of the series is stored as its
+// own collection named "<series>-<bucket start>", and the list of buckets is
+// kept in the record "buckets" of the collection named after the series.
+type Series struct {
+	mu     sync.Mutex
+	store  Store
+	name   string
+	bucket time.Duration
+}
+
+type registry struct {
+	Buckets []int64
+}
+
+// New returns the series name stored in store, bucketed by the given
+// duration (e.g. time.Hour or 24*time.Hour). The bucket must be positive.
+func New(store Store, name string, bucket time.Duration) (*Series, error) {
+	if bucket <= 0 {
+		return nil, fmt.Errorf("bucket %v is not positive", bucket)
+	}
+	return &Series{store: store, name: name, bucket: bucket}, nil
+}
+
+// Add stores p. Points with the same timestamp replace each other.
+func (s *Series) Add(p Point) error {
+	if p.Time.IsZero() {
+		return fmt.Errorf("point has no timestamp")
+	}
+	p.Time = p.Time.UTC()
+	start := p.Time.Truncate(s.bucket)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reg, err := s.registry()
+	if err != nil {
+		return err
+	}
+	i := sort.Search(len(reg.Buckets), func(i int) bool { return reg.Buckets[i] >= start.UnixNano() })
+	if i == len(reg.Buckets) || reg.Buckets[i] != start.UnixNano() {
+		reg.Buckets = append(reg.Buckets, 0)
+		copy(reg.Buckets[i+1:], reg.Buckets[i:])
+		reg.Buckets[i] = start.UnixNano()
+		if err := s.store.Write(s.name, "buckets", reg); err != nil {
+			return err
+		}
+	}
+	return s.store.Write(s.collection(start), fmt.Sprintf("%020d", p.Time.UnixNano()), p)
+}
+
+// Between returns the points with from <= Time < to in time order.
+func (s *Series) Between(from, to time.Time) ([]Point, error) {
+	s.mu.Lock()
+	reg, err := s.registry()
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var points []Point
+	for _, b := range reg.Buckets {
+		start := time.Unix(0, b).UTC()
+		if !start.Add(s.bucket).After(from) || !start.Before(to) {
+			continue
+		}
+		records, err := s.store.ReadAll(s.collection(start))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			var p Point
+			if err := json.Unmarshal([]byte(r), &p); err != nil {
+				return nil, err
+			}
+			if !p.Time.Before(from) && p.Time.Before(to) {
+				points = append(points, p)
+			}
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	return points, nil
+}
+
+// Downsample returns one point per step-sized window between from and to,
+// holding the aggregate of the values in that window. Empty windows are
+// omitted. The step must be positive.
+func (s *Series) Downsample(from, to time.Time, step time.Duration, agg Aggregate) ([]Point, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("step %v is not positive", step)
+	}
+	points, err := s.Between(from, to)
+	if err != nil {
+		return nil, err
+	}
+	var out []Point
+	for i := 0; i < len(points); {
+		window := from.Add(points[i].Time.Sub(from) / step * step)
+		var values []float64
+		for ; i < len(points) && points[i].Time.Before(window.Add(step)); i++ {
+			values = append(values, points[i].Value)
+		}
+		out = append(out, Point{Time: window, Value: agg(values)})
+	}
+	return out, nil
+}
+
+// Prune deletes every bucket that lies entirely before now minus retention
+// and returns the number of buckets removed.
+func (s *Series) Prune(retention time.Duration) (int, error) {
+	cutoff := time.Now().Add(-retention)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reg, err := s.registry()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, b := range reg.Buckets {
+		start := time.Unix(0, b).UTC()
+		if start.Add(s.bucket).After(cutoff) {
+			break
+		}
+		if err := s.store.DeleteCollection(s.collection(start)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return n, err
+		}
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	reg.Buckets = reg.Buckets[n:]
+	return n, s.store.Write(s.name, "buckets", reg)
+}
+
+func (s *Series) collection(start time.Time) string {
+	return s.name + "-" + start.Format("20060102T150405")
+}
+
+func (s *Series) registry() (*registry, error) {
+	reg := &registry{}
+	if err := s.store.Read(s.name, "buckets", reg); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return reg, nil
+}
+
+// Mean is the arithmetic mean of the values.
+func Mean(values []float64) float64 {
+	return Sum(values) / float64(len(values))
+}
+
+// Sum is the total of the values.
+func Sum(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum
+}
+
+// Min is the smallest of the values.
+func Min(values []float64) float64 {
+	min := values[0]
+	for _, v := range values[1:] {
+		if v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+// Max is the largest of the values.
+func Max(values []float64) float64 {
+	max := values[0]
+	for _, v := range values[1:] {
+		if v > max {
+			max = v
+		}
+	}
+	return max
+}
@@ -0,0 +1,93 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"io/fs"
+	"testing"
+	"time"
+)
+
+// memStore is an in-memory Store.
+type memStore map[string]map[string][]byte
+
+func (m memStore) Write(collection, resource string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if m[collection] == nil {
+		m[collection] = map[string][]byte{}
+	}
+	m[collection][resource] = b
+	return nil
+}
+
+func (m memStore) Read(collection, resource string, v interface{}) error {
+	b, ok := m[collection][resource]
+	if !ok {
+		return fs.ErrNotExist
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (m memStore) ReadAll(collection string) ([]string, error) {
+	c, ok := m[collection]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	var out []string
+	for _, b := range c {
+		out = append(out, string(b))
+	}
+	return out, nil
+}
+
+func (m memStore) DeleteCollection(collection string) error {
+	delete(m, collection)
+	return nil
+}
+
+func TestNewBucket(t *testing.T) {
+	for _, bucket := range []time.Duration{0, -time.Hour} {
+		if _, err := New(memStore{}, "cpu", bucket); err == nil {
+			t.Errorf("New with bucket %v: no error", bucket)
+		}
+	}
+	if _, err := New(memStore{}, "cpu", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	s, err := New(memStore{}, "cpu", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, v := range []float64{1, 3, 5, 7} {
+		if err := s.Add(Point{Time: from.Add(time.Duration(i) * 30 * time.Minute), Value: v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	to := from.Add(2 * time.Hour)
+
+	for _, step := range []time.Duration{0, -time.Minute} {
+		if _, err := s.Downsample(from, to, step, Mean); err == nil {
+			t.Errorf("Downsample with step %v: no error", step)
+		}
+	}
+
+	got, err := s.Downsample(from, to, time.Hour, Mean)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Point{{Time: from, Value: 2}, {Time: from.Add(time.Hour), Value: 6}}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if !got[i].Time.Equal(want[i].Time) || got[i].Value != want[i].Value {
+			t.Errorf("point %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+}
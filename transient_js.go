@@ -0,0 +1,14 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isTransient reports the errors the host filesystem of a js/wasm program
+// returns for a file that is briefly busy. There is no ETXTBSY there.
+func isTransient(err error) bool {
+	return errors.Is(err, syscall.EBUSY) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EINTR)
+}
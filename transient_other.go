@@ -0,0 +1,15 @@
+//go:build !windows && !js
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func isTransient(err error) bool {
+	return errors.Is(err, syscall.EBUSY) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.ETXTBSY) ||
+		errors.Is(err, syscall.EINTR)
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+const (
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+)
+
+// isTransient reports errors Windows returns while another process (often a
+// virus scanner or indexer) briefly holds the file open.
+func isTransient(err error) bool {
+	return errors.Is(err, errorSharingViolation) ||
+		errors.Is(err, errorLockViolation) ||
+		errors.Is(err, syscall.ERROR_ACCESS_DENIED)
+}
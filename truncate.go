@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Truncate removes every record of collection together with its blobs,
+// attachments and index entries, but keeps the collection itself along
+// with its configuration: masks, geo and secondary indexes stay registered
+// and simply become empty. With background set, the files are moved out of
+// the way under the collection lock and removed by a background goroutine,
+// so truncating a huge collection returns at once; Close waits for the
+// removal, and removals interrupted by a crash finish at the next open.
+func (d *Driver) Truncate(collection string, background bool) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+	d.settle()
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if err := d.checkFrozen(collection); err != nil {
+		return err
+	}
+
+	dir := d.collectionDir(collection)
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrNotFound, collection)
+		}
+		return err
+	}
+	if err := d.dropAttachments(collection, ""); err != nil {
+		return err
+	}
+	// The records go to a trash on their own volume, so that moving them
+	// takes a rename even when Options.Placement puts them elsewhere.
+	var trashes []string
+	for i, path := range []string{dir, d.metaPath("blobs", collection)} {
+		root := d.metaPath("trash")
+		if i == 0 {
+			root = d.trashDir(collection)
+		}
+		if len(trashes) == 0 || filepath.Dir(trashes[0]) != root {
+			if err := os.MkdirAll(root, 0755); err != nil {
+				return err
+			}
+			trash, err := os.MkdirTemp(root, "truncate-")
+			if err != nil {
+				return err
+			}
+			trashes = append(trashes, trash)
+		}
+		err := os.Rename(path, filepath.Join(trashes[len(trashes)-1], fmt.Sprint(i)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := d.syncParent(d.metaPath("blobs", collection)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := d.mkdirAll(dir); err != nil {
+		return err
+	}
+	if err := d.logChange(collection, "", nil); err != nil {
+		return err
+	}
+	d.afterDelete(collection, "")
+	d.emit(collection, "", nil, true)
+
+	for _, trash := range trashes {
+		if !background {
+			if err := os.RemoveAll(trash); err != nil {
+				return err
+			}
+			continue
+		}
+		d.emptyTrash(trash)
+	}
+	return nil
+}
+
+// emptyTrash removes path in the background. Close waits for it.
+func (d *Driver) emptyTrash(path string) {
+	d.bg.Add(1)
+	go func() {
+		defer d.bg.Done()
+		if err := os.RemoveAll(path); err != nil {
+			d.log.Error("removing %s: %v\n", path, err)
+		}
+	}()
+}
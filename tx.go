@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// IsolationLevel selects what a transaction sees of concurrent commits.
+type IsolationLevel int
+
+const (
+	// ReadCommitted reads the latest committed version of every record.
+	ReadCommitted IsolationLevel = iota
+	// SnapshotIsolation reads every collection as it was when the
+	// transaction first touched it, and fails the commit with ErrTxConflict
+	// if a record it writes was changed by someone else in the meantime.
+	SnapshotIsolation
+)
+
+// Tx buffers writes and deletes until Commit. Readers never block writers:
+// snapshot reads are served from hard-linked record versions (see Snapshot)
+// and read-committed reads do not take the collection lock.
+type Tx struct {
+	mu       sync.Mutex
+	d        *Driver
+	id       string
+	level    IsolationLevel
+	ops      []txOp
+	snaps    map[string]*Snapshot
+	saves    []savepoint
+	prepared bool
+	unlock   func()
+	done     bool
+}
+
+// savepoint remembers how many operations were buffered when it was set.
+type savepoint struct {
+	name string
+	ops  int
+}
+
+// txOp is a buffered mutation. A nil Value deletes the record; it is left
+// out of journals, which would otherwise store it as null and read it
+// back as a write of null.
+type txOp struct {
+	Collection string
+	Key        string
+	Value      json.RawMessage `json:",omitempty"`
+}
+
+// txJournal is the on-disk form of a prepared transaction, or of one
+// being committed, which also holds Undo, the operations putting back the
+// records as they were before it.
+type txJournal struct {
+	ID   string
+	Ops  []txOp
+	Undo []txOp `json:",omitempty"`
+}
+
+// Begin starts a transaction with the given isolation level.
+func (d *Driver) Begin(level IsolationLevel) *Tx {
+	return &Tx{d: d, id: d.newID(), level: level, snaps: make(map[string]*Snapshot)}
+}
+
+// ID identifies the transaction, including across restarts once it has been
+// prepared.
+func (tx *Tx) ID() string {
+	return tx.id
+}
+
+// Write buffers a write of v to collection/key.
+func (tx *Tx) Write(collection, key string, v interface{}) error {
+	if err := tx.d.checkKey(collection, key, "save record"); err != nil {
+		return err
+	}
+	b, err := tx.d.encode(v)
+	if err != nil {
+		return err
+	}
+	if err := tx.d.checkWrite(collection, b); err != nil {
+		return err
+	}
+	return tx.push(txOp{Collection: collection, Key: key, Value: b})
+}
+
+// Delete buffers the removal of collection/key.
+func (tx *Tx) Delete(collection, key string) error {
+	if err := tx.d.checkKey(collection, key, "delete record"); err != nil {
+		return err
+	}
+	if err := tx.d.checkFrozen(collection); err != nil {
+		return err
+	}
+	return tx.push(txOp{Collection: collection, Key: key})
+}
+
+func (tx *Tx) push(op txOp) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	if tx.prepared {
+		return ErrTxPrepared
+	}
+	if tx.level == SnapshotIsolation {
+		// Pin the collection so the commit can detect conflicting writes.
+		if _, err := tx.snapshot(op.Collection); err != nil {
+			return err
+		}
+	}
+	tx.ops = append(tx.ops, op)
+	return nil
+}
+
+// Read decodes collection/key into v, seeing the transaction's own buffered
+// writes first.
+func (tx *Tx) Read(collection, key string, v interface{}) error {
+	tx.mu.Lock()
+	b, err := tx.raw(collection, key)
+	tx.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if b, err = tx.d.mask(collection, b); err != nil {
+		return err
+	}
+	return tx.d.decodeRecord(collection, b, v)
+}
+
+// ReadAll returns every record of collection as seen by the transaction, in
+// key order.
+func (tx *Tx) ReadAll(collection string) ([]string, error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	view := make(map[string][]byte)
+	if tx.level == SnapshotIsolation {
+		s, err := tx.snapshot(collection)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range s.keys {
+			if view[key], err = s.raw(key); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		records, err := tx.d.scan(collection)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			view[r.Key] = r.Value
+		}
+	}
+	for _, op := range tx.ops {
+		if op.Collection != collection {
+			continue
+		}
+		if op.Value == nil {
+			delete(view, op.Key)
+		} else {
+			view[op.Key] = op.Value
+		}
+	}
+
+	keys := make([]string, 0, len(view))
+	for key := range view {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	records := make([]string, 0, len(keys))
+	for _, key := range keys {
+		b, err := tx.d.mask(collection, view[key])
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, string(b))
+	}
+	return records, nil
+}
+
+// raw returns the bytes of collection/key as seen by the transaction. tx.mu
+// must be held.
+func (tx *Tx) raw(collection, key string) ([]byte, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	if err := tx.d.checkResource(key); err != nil {
+		return nil, err
+	}
+	for i := len(tx.ops) - 1; i >= 0; i-- {
+		if op := tx.ops[i]; op.Collection == collection && op.Key == key {
+			if op.Value == nil {
+				return nil, notExist(tx.d.recordPath(collection, key))
+			}
+			return op.Value, nil
+		}
+	}
+	return tx.base(collection, key)
+}
+
+// base returns the bytes of collection/key as seen by the transaction
+// before its own writes. tx.mu must be held.
+func (tx *Tx) base(collection, key string) ([]byte, error) {
+	if tx.level == SnapshotIsolation {
+		s, err := tx.snapshot(collection)
+		if err != nil {
+			return nil, err
+		}
+		return s.raw(key)
+	}
+	return tx.d.rawRecord(collection, key)
+}
+
+// snapshot returns the snapshot of collection, taking it on first use. tx.mu
+// must be held.
+func (tx *Tx) snapshot(collection string) (*Snapshot, error) {
+	if s, ok := tx.snaps[collection]; ok {
+		return s, nil
+	}
+	s, err := tx.d.Snapshot(collection)
+	if err != nil {
+		return nil, err
+	}
+	tx.snaps[collection] = s
+	return s, nil
+}
+
+// Prepare is the first phase of a two-phase commit. It checks that the
+// transaction can commit, locks the collections it touches and records the
+// buffered mutations in a journal, so that a later Commit is guaranteed to
+// apply them even if the process restarts in between (see PreparedTxs). No
+// further mutations may be buffered afterwards. The collection locks are
+// held until Commit or Abort.
+func (tx *Tx) Prepare() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	if tx.prepared {
+		return nil
+	}
+	tx.unlock = tx.d.lockCollections(tx.ops)
+	if err := tx.check(); err != nil {
+		tx.unlock()
+		tx.unlock = nil
+		return err
+	}
+	b, err := json.Marshal(txJournal{ID: tx.id, Ops: tx.ops})
+	if err == nil {
+		if err = os.MkdirAll(tx.d.metaPath("tx"), 0755); err == nil {
+			err = tx.d.writeFile(tx.journalPath(), b)
+		}
+	}
+	if err != nil {
+		tx.unlock()
+		tx.unlock = nil
+		return err
+	}
+	tx.prepared = true
+	return nil
+}
+
+// Commit applies the buffered mutations. The collections involved are
+// locked in name order for the duration of the commit, so other writers
+// observe either none or all of the transaction's changes. The commit is
+// atomic on disk as well: the records it touches are journalled first,
+// and put back as they were if applying fails, or, after a crash, when
+// the database is next opened without Options.SharedAccess. A deleted
+// record's attachments are not put back. Committing a prepared
+// transaction completes the two-phase commit: its journal stays until
+// every mutation is applied, so that Commit can be retried.
+func (tx *Tx) Commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	defer tx.finish()
+
+	if tx.unlock == nil {
+		tx.unlock = tx.d.lockCollections(tx.ops)
+	}
+	if !tx.prepared {
+		if err := tx.check(); err != nil {
+			return err
+		}
+	}
+	if !tx.prepared {
+		return tx.d.commit(tx.id, tx.ops)
+	}
+	if err := tx.d.apply(tx.ops); err != nil {
+		return err
+	}
+	return os.Remove(tx.journalPath())
+}
+
+// commitPath is where the journal of the commit id is kept while it is
+// applied.
+func (d *Driver) commitPath(id string) string {
+	return d.metaPath("tx", "commit", id+".json")
+}
+
+// commit applies ops all or none, journalling them with the operations
+// undoing them first. The locks of every collection involved must be
+// held.
+func (d *Driver) commit(id string, ops []txOp) error {
+	undo, err := d.undoOps(ops)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(txJournal{ID: id, Ops: ops, Undo: undo})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.metaPath("tx", "commit"), 0755); err != nil {
+		return err
+	}
+	path := d.commitPath(id)
+	if err := d.writeFile(path, b); err != nil {
+		return err
+	}
+	if err := d.apply(ops); err != nil {
+		if uerr := d.apply(undo); uerr != nil {
+			return fmt.Errorf("%w; rolling back: %v (left to the next open)", err, uerr)
+		}
+		if rerr := os.Remove(path); rerr != nil {
+			d.log.Error("removing journal of rolled back transaction %s: %v\n", id, rerr)
+		}
+		return err
+	}
+	return os.Remove(path)
+}
+
+// undoOps returns the operations putting back the records ops touch as
+// they are now.
+func (d *Driver) undoOps(ops []txOp) ([]txOp, error) {
+	seen := make(map[string]map[string]bool)
+	var undo []txOp
+	for _, op := range ops {
+		if seen[op.Collection][op.Key] {
+			continue
+		}
+		if seen[op.Collection] == nil {
+			seen[op.Collection] = make(map[string]bool)
+		}
+		seen[op.Collection][op.Key] = true
+		b, err := os.ReadFile(d.recordPath(op.Collection, op.Key))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		undo = append(undo, txOp{Collection: op.Collection, Key: op.Key, Value: b})
+	}
+	return undo, nil
+}
+
+// recoverCommits rolls back the commits a crash interrupted, found by
+// their journals.
+func (d *Driver) recoverCommits() error {
+	files, err := os.ReadDir(d.metaPath("tx", "commit"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		path := d.metaPath("tx", "commit", file.Name())
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var j txJournal
+		if err := json.Unmarshal(b, &j); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		unlock := d.lockCollections(j.Undo)
+		err = d.apply(j.Undo)
+		unlock()
+		if err != nil {
+			return fmt.Errorf("rolling back transaction %s: %w", j.ID, err)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		d.log.Info("Rolled back interrupted transaction %s\n", j.ID)
+	}
+	return nil
+}
+
+// check verifies that no record written by the transaction was changed
+// since its snapshot. The collection locks must be held.
+func (tx *Tx) check() error {
+	if tx.level != SnapshotIsolation {
+		return nil
+	}
+	for _, op := range tx.ops {
+		if s, ok := tx.snaps[op.Collection]; ok && tx.changedSinceSnapshot(s, op.Collection, op.Key) {
+			return fmt.Errorf("%w: %s/%s", ErrTxConflict, op.Collection, op.Key)
+		}
+	}
+	return nil
+}
+
+// Abort discards the transaction, forgetting its journal if it was
+// prepared. It is the same as Rollback.
+func (tx *Tx) Abort() error {
+	return tx.Rollback()
+}
+
+func (tx *Tx) journalPath() string {
+	return tx.d.metaPath("tx", tx.id+".json")
+}
+
+// PreparedTxs returns the transactions that were prepared but neither
+// committed nor aborted, typically by a process that crashed in between.
+// The coordinator decides whether to Commit or Abort each of them.
+func (d *Driver) PreparedTxs() ([]*Tx, error) {
+	files, err := os.ReadDir(d.metaPath("tx"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var txs []*Tx
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		b, err := os.ReadFile(d.metaPath("tx", file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var j txJournal
+		if err := json.Unmarshal(b, &j); err != nil {
+			return nil, err
+		}
+		txs = append(txs, &Tx{d: d, id: j.ID, level: ReadCommitted, ops: j.Ops, prepared: true})
+	}
+	return txs, nil
+}
+
+// Savepoint marks the current state of the transaction under name so that
+// RollbackTo can later undo everything buffered after it. Setting an existing
+// name again moves that savepoint.
+func (tx *Tx) Savepoint(name string) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	if tx.prepared {
+		return ErrTxPrepared
+	}
+	for i, sp := range tx.saves {
+		if sp.name == name {
+			tx.saves = append(tx.saves[:i], tx.saves[i+1:]...)
+			break
+		}
+	}
+	tx.saves = append(tx.saves, savepoint{name: name, ops: len(tx.ops)})
+	return nil
+}
+
+// RollbackTo discards the mutations buffered since the savepoint name was
+// set, along with any savepoints set after it. The savepoint itself remains
+// and can be rolled back to again.
+func (tx *Tx) RollbackTo(name string) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	if tx.prepared {
+		return ErrTxPrepared
+	}
+	for i := len(tx.saves) - 1; i >= 0; i-- {
+		if sp := tx.saves[i]; sp.name == name {
+			tx.ops = tx.ops[:sp.ops]
+			tx.saves = tx.saves[:i+1]
+			return nil
+		}
+	}
+	return fmt.Errorf("no savepoint named %q", name)
+}
+
+// Rollback discards the buffered mutations.
+func (tx *Tx) Rollback() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.finish()
+	if tx.prepared {
+		if err := os.Remove(tx.journalPath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *Tx) finish() {
+	tx.done = true
+	if tx.unlock != nil {
+		tx.unlock()
+		tx.unlock = nil
+	}
+	for _, s := range tx.snaps {
+		s.Close()
+	}
+	tx.snaps = nil
+}
+
+// changedSinceSnapshot compares the live record with the version captured by
+// the transaction's snapshot. The collection lock must be held.
+func (tx *Tx) changedSinceSnapshot(s *Snapshot, collection, key string) bool {
+	before, err1 := s.raw(key)
+	after, err2 := os.ReadFile(tx.d.recordPath(collection, key))
+	if os.IsNotExist(err1) && os.IsNotExist(err2) {
+		return false
+	}
+	return err1 != nil || err2 != nil || !bytes.Equal(before, after)
+}
+
+// lockCollections takes the locks of every collection touched by ops in name
+// order and returns a function releasing them.
+func (d *Driver) lockCollections(ops []txOp) func() {
+	d.settle()
+	names := make([]string, len(ops))
+	for i, op := range ops {
+		names[i] = op.Collection
+	}
+	return d.lockNames(names...)
+}
+
+// lockNames locks the given collections in sorted order, so that callers
+// locking overlapping sets cannot deadlock, and returns the unlock function.
+func (d *Driver) lockNames(collections ...string) func() {
+	seen := make(map[string]bool)
+	var names []string
+	for _, name := range collections {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	mutexes := make([]*collectionMutex, len(names))
+	for i, name := range names {
+		mutexes[i] = d.getOrCreateMutex(name)
+		mutexes[i].Lock()
+	}
+	return func() {
+		for i := len(mutexes) - 1; i >= 0; i-- {
+			mutexes[i].Unlock()
+		}
+	}
+}
+
+// apply performs ops in order. The locks of every collection involved must
+// be held. Deleting a missing record is not an error.
+func (d *Driver) apply(ops []txOp) error {
+	for _, op := range ops {
+		if op.Value != nil {
+			if err := d.write(op.Collection, op.Key, op.Value); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := os.Stat(d.recordPath(op.Collection, op.Key)); os.IsNotExist(err) {
+			continue
+		}
+		if err := d.delete(op.Collection, op.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+)
+
+// RegisterType makes every record read from collection be checked against
+// the type of prototype, typically a struct value or a pointer to one:
+// records holding fields the type does not declare, or values of the
+// wrong JSON type, fail to read with an error matching ErrSchemaMismatch,
+// whatever the caller decodes them into. This surfaces schema drift when
+// it starts instead of when the silently dropped fields are missed. A nil
+// prototype removes the check.
+func (d *Driver) RegisterType(collection string, prototype interface{}) error {
+	if err := checkCollection(collection); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if prototype == nil {
+		delete(d.types, collection)
+		return nil
+	}
+	t := reflect.TypeOf(prototype)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if d.types == nil {
+		d.types = make(map[string]reflect.Type)
+	}
+	d.types[collection] = t
+	return nil
+}
+
+// decodeRecord decodes a record of collection into v like decode,
+// after checking it against the type registered for collection, and with
+// unknown fields rejected when Options.StrictDecode is set.
+func (d *Driver) decodeRecord(collection string, b []byte, v interface{}) error {
+	d.mu.Lock()
+	t := d.types[collection]
+	d.mu.Unlock()
+	if t != nil {
+		if err := d.strictDecode(b, reflect.New(t).Interface()); err != nil {
+			return fmt.Errorf("%w: %v", ErrSchemaMismatch, err)
+		}
+	}
+	if d.noUnknown {
+		return d.strictDecode(b, v)
+	}
+	return d.decode(b, v)
+}
+
+// strictDecode decodes b into v like decode, failing on object keys that
+// match no field of the destination struct. Values of types with a codec
+// decode as usual.
+func (d *Driver) strictDecode(b []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if len(d.codecs) > 0 && rv.Kind() == reflect.Ptr && !rv.IsNil() && d.hasCodec(rv.Type().Elem()) {
+		return d.decodeValue(b, rv.Elem())
+	}
+	dec := d.newDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// update applies fn to the decoded record collection/resource and stores the
+// result, all under the collection lock.
+func (d *Driver) update(collection, resource string, fn func(doc map[string]interface{}) error) error {
+	if err := d.checkKey(collection, resource, "update record"); err != nil {
+		return err
+	}
+	d.settle()
+	mutex := d.getOrCreateMutex(collection)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	current, err := os.ReadFile(d.recordPath(collection, resource))
+	if err != nil {
+		return err
+	}
+	doc, err := decodeDoc(current)
+	if err != nil {
+		return err
+	}
+	if err := fn(doc); err != nil {
+		return err
+	}
+	b, err := encode(doc)
+	if err != nil {
+		return err
+	}
+	return d.write(collection, resource, b)
+}
+
+// Push appends values to the array field of collection/resource, creating
+// the array if the field is missing.
+func (d *Driver) Push(collection, resource, field string, values ...interface{}) error {
+	norm, err := normalize(values)
+	if err != nil {
+		return err
+	}
+	return d.update(collection, resource, func(doc map[string]interface{}) error {
+		arr, err := arrayField(doc, field)
+		if err != nil {
+			return err
+		}
+		return setField(doc, field, append(arr, norm...))
+	})
+}
+
+// AddToSet appends the values not already present in the array field of
+// collection/resource.
+func (d *Driver) AddToSet(collection, resource, field string, values ...interface{}) error {
+	norm, err := normalize(values)
+	if err != nil {
+		return err
+	}
+	return d.update(collection, resource, func(doc map[string]interface{}) error {
+		arr, err := arrayField(doc, field)
+		if err != nil {
+			return err
+		}
+		for _, v := range norm {
+			if indexOf(arr, v) < 0 {
+				arr = append(arr, v)
+			}
+		}
+		return setField(doc, field, arr)
+	})
+}
+
+// Pull removes every occurrence of values from the array field of
+// collection/resource.
+func (d *Driver) Pull(collection, resource, field string, values ...interface{}) error {
+	norm, err := normalize(values)
+	if err != nil {
+		return err
+	}
+	return d.update(collection, resource, func(doc map[string]interface{}) error {
+		arr, err := arrayField(doc, field)
+		if err != nil {
+			return err
+		}
+		kept := arr[:0]
+		for _, v := range arr {
+			if indexOf(norm, v) < 0 {
+				kept = append(kept, v)
+			}
+		}
+		return setField(doc, field, kept)
+	})
+}
+
+// normalize round-trips values through JSON so they compare equal to the
+// values decoded from stored records.
+func normalize(values []interface{}) ([]interface{}, error) {
+	b, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	var out []interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return out, dec.Decode(&out)
+}
+
+func indexOf(arr []interface{}, v interface{}) int {
+	for i, x := range arr {
+		if reflect.DeepEqual(x, v) {
+			return i
+		}
+	}
+	return -1
+}
+
+func arrayField(doc map[string]interface{}, field string) ([]interface{}, error) {
+	v, ok := lookup(doc, field)
+	if !ok || v == nil {
+		return nil, nil
+	}
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("field %q is not an array", field)
+	}
+	return arr, nil
+}
+
+// setField stores v at a dotted field path, creating intermediate objects.
+func setField(doc map[string]interface{}, path string, v interface{}) error {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := doc[part]
+		if !ok || child == nil {
+			m := make(map[string]interface{})
+			doc[part], doc = m, m
+			continue
+		}
+		if doc, ok = child.(map[string]interface{}); !ok {
+			return fmt.Errorf("field %q is not an object", part)
+		}
+	}
+	doc[parts[len(parts)-1]] = v
+	return nil
+}
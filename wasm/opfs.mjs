@@ -0,0 +1,656 @@
+// opfs.mjs keeps the files of a database built with GOOS=js GOARCH=wasm in
+// the origin private file system of the browser. The os package of such a
+// program calls the Node.js-style fs object of the global scope for every
+// file operation, records and metadata alike, and reads its flag constants
+// once, when the program starts; installOPFS installs that object, so it
+// has to be awaited before wasm_exec.js is loaded:
+//
+//	import { installOPFS } from "./opfs.mjs";
+//	await installOPFS();
+//	await import("./wasm_exec.js");
+//	const go = new Go();
+//	const { instance } = await WebAssembly.instantiateStreaming(fetch("main.wasm"), go.importObject);
+//	go.run(instance);
+//
+// Paths are resolved from the root of the origin private file system, and
+// the program opens its database at a path such as "/db".
+//
+// An open file is held in memory and written back, as a whole, by Sync and
+// Close; the origin private file system commits it atomically then, so a
+// record is never seen half written. Unsynced writes are lost, as on any
+// system, if the page goes away first. Renaming a file copies it, since the
+// origin private file system cannot replace a file by moving another over
+// it, and hard links are not supported, so the database copies files where
+// it would link them.
+
+const O_WRONLY = 1;
+const O_RDWR = 2;
+const O_CREAT = 64;
+const O_EXCL = 128;
+const O_TRUNC = 512;
+const O_APPEND = 1024;
+const O_DIRECTORY = 65536;
+
+const S_IFDIR = 0o040000;
+const S_IFREG = 0o100000;
+
+// fsError returns an error the os package maps to the errno code.
+function fsError(code, path) {
+	const err = new Error(`${code}: ${path}`);
+	err.code = code;
+	return err;
+}
+
+// mapError turns the DOMException of a failed file system call into the
+// error of Node.js for it.
+function mapError(err, path) {
+	if (typeof err.code === "string") {
+		return err;
+	}
+	switch (err.name) {
+	case "NotFoundError":
+		return fsError("ENOENT", path);
+	case "TypeMismatchError":
+		return fsError("ENOTDIR", path);
+	case "InvalidModificationError":
+		return fsError("ENOTEMPTY", path);
+	case "NotAllowedError":
+	case "NoModificationAllowedError":
+		return fsError("EACCES", path);
+	case "QuotaExceededError":
+		return fsError("ENOSPC", path);
+	default:
+		return fsError("EIO", path);
+	}
+}
+
+// split returns the names of the entries along path.
+function split(path) {
+	const names = [];
+	for (const name of path.split("/")) {
+		if (name === "" || name === ".") {
+			continue;
+		}
+		if (name === "..") {
+			names.pop();
+			continue;
+		}
+		names.push(name);
+	}
+	return names;
+}
+
+// installOPFS installs the fs object, keeping its files in root, the root
+// directory of the origin private file system unless options.root is
+// another FileSystemDirectoryHandle.
+export async function installOPFS(options = {}) {
+	const root = options.root ?? await navigator.storage.getDirectory();
+	const decoder = new TextDecoder("utf-8");
+
+	// nodes are the files open by path. An open file is loaded on first
+	// use and shared by the descriptors opened on it.
+	const nodes = new Map();
+	// fds are the open descriptors.
+	const fds = new Map();
+	let nextFd = 3;
+	// inodes numbers the paths stat has been asked about, for os.SameFile.
+	const inodes = new Map();
+
+	// Operations run one at a time, in the order they are called, as the
+	// os package expects of a file system.
+	let queue = Promise.resolve();
+	function run(op, callback) {
+		queue = queue.then(op).then(
+			(result) => callback(null, result),
+			(err) => callback(err),
+		);
+	}
+
+	// dir returns the directory at names.
+	async function dir(names, path) {
+		let d = root;
+		try {
+			for (const name of names) {
+				d = await d.getDirectoryHandle(name);
+			}
+		} catch (err) {
+			throw mapError(err, path);
+		}
+		return d;
+	}
+
+	// lookup returns the entry at path, with its parent directory and
+	// name, or null if there is none.
+	async function lookup(path) {
+		const names = split(path);
+		if (names.length === 0) {
+			return { kind: "directory", handle: root, parent: null, name: "" };
+		}
+		const name = names.pop();
+		const parent = await dir(names, path);
+		try {
+			return { kind: "file", handle: await parent.getFileHandle(name), parent, name };
+		} catch (err) {
+			if (err.name !== "TypeMismatchError") {
+				if (err.name === "NotFoundError") {
+					return null;
+				}
+				throw mapError(err, path);
+			}
+		}
+		return { kind: "directory", handle: await parent.getDirectoryHandle(name), parent, name };
+	}
+
+	async function mustLookup(path) {
+		const e = await lookup(path);
+		if (e === null) {
+			throw fsError("ENOENT", path);
+		}
+		return e;
+	}
+
+	function key(path) {
+		return "/" + split(path).join("/");
+	}
+
+	function inode(path) {
+		const k = key(path);
+		if (!inodes.has(k)) {
+			inodes.set(k, inodes.size + 1);
+		}
+		return inodes.get(k);
+	}
+
+	function stats(path, kind, size, mtime) {
+		return {
+			dev: 1,
+			ino: inode(path),
+			mode: kind === "directory" ? S_IFDIR | 0o755 : S_IFREG | 0o644,
+			nlink: 1,
+			uid: 0,
+			gid: 0,
+			rdev: 0,
+			size,
+			blksize: 4096,
+			blocks: Math.ceil(size / 512),
+			atimeMs: mtime,
+			mtimeMs: mtime,
+			ctimeMs: mtime,
+			isDirectory() {
+				return kind === "directory";
+			},
+		};
+	}
+
+	// load reads the content of node, unless it has been already.
+	async function load(node) {
+		if (node.data === null) {
+			const file = await node.handle.getFile();
+			node.data = new Uint8Array(await file.arrayBuffer());
+			node.size = node.data.length;
+		}
+	}
+
+	// resize makes node size bytes long, growing its buffer as needed.
+	function resize(node, size) {
+		if (size > node.data.length) {
+			const data = new Uint8Array(Math.max(size, 2 * node.data.length));
+			data.set(node.data.subarray(0, node.size));
+			node.data = data;
+		} else if (size < node.size) {
+			node.data.fill(0, size, node.size);
+		}
+		node.size = size;
+		node.dirty = true;
+	}
+
+	// flush writes the content of node back, if it changed and the file
+	// still exists.
+	async function flush(node, path) {
+		if (!node.dirty || node.removed) {
+			return;
+		}
+		try {
+			await writeFile(node.handle, node.data.subarray(0, node.size));
+		} catch (err) {
+			throw mapError(err, path);
+		}
+		node.dirty = false;
+		node.mtime = Date.now();
+	}
+
+	async function writeFile(handle, data) {
+		const w = await handle.createWritable();
+		try {
+			await w.write(data);
+		} catch (err) {
+			await w.abort();
+			throw err;
+		}
+		await w.close();
+	}
+
+	async function content(e, path) {
+		const node = nodes.get(key(path));
+		if (node !== undefined) {
+			await load(node);
+			return node.data.slice(0, node.size);
+		}
+		const file = await e.handle.getFile();
+		return new Uint8Array(await file.arrayBuffer());
+	}
+
+	// copy copies the entry e to the new entry name of parent, recursively
+	// for directories.
+	async function copy(e, path, parent, name) {
+		if (e.kind === "file") {
+			const h = await parent.getFileHandle(name, { create: true });
+			await writeFile(h, await content(e, path));
+			return h;
+		}
+		const d = await parent.getDirectoryHandle(name, { create: true });
+		for await (const [child, handle] of e.handle.entries()) {
+			await copy({ kind: handle.kind, handle }, path + "/" + child, d, child);
+		}
+		return d;
+	}
+
+	async function isEmpty(d) {
+		for await (const _ of d.keys()) {
+			return false;
+		}
+		return true;
+	}
+
+	// fileOf returns the open file fd.
+	function fileOf(fd) {
+		const f = fds.get(fd);
+		if (f === undefined) {
+			throw fsError("EBADF", String(fd));
+		}
+		return f;
+	}
+
+	function regular(f) {
+		if (f.node === null) {
+			throw fsError("EISDIR", f.path);
+		}
+		return f.node;
+	}
+
+	let output = "";
+	function writeOutput(fd, buf) {
+		output += decoder.decode(buf);
+		const nl = output.lastIndexOf("\n");
+		if (nl !== -1) {
+			(fd === 2 ? console.error : console.log)(output.substring(0, nl));
+			output = output.substring(nl + 1);
+		}
+		return buf.length;
+	}
+
+	const fs = {
+		constants: { O_WRONLY, O_RDWR, O_CREAT, O_TRUNC, O_APPEND, O_EXCL, O_DIRECTORY },
+
+		writeSync(fd, buf) {
+			if (fd !== 1 && fd !== 2) {
+				throw fsError("ENOSYS", "writeSync");
+			}
+			return writeOutput(fd, buf);
+		},
+
+		open(path, flags, mode, callback) {
+			run(async () => {
+				let e = await lookup(path);
+				if (e !== null && flags & O_CREAT && flags & O_EXCL) {
+					throw fsError("EEXIST", path);
+				}
+				if (e === null) {
+					if (!(flags & O_CREAT)) {
+						throw fsError("ENOENT", path);
+					}
+					const names = split(path);
+					const name = names.pop();
+					const parent = await dir(names, path);
+					try {
+						e = { kind: "file", handle: await parent.getFileHandle(name, { create: true }) };
+					} catch (err) {
+						throw mapError(err, path);
+					}
+				}
+				const writable = (flags & (O_WRONLY | O_RDWR)) !== 0;
+				let node = null;
+				if (e.kind === "directory") {
+					if (writable) {
+						throw fsError("EISDIR", path);
+					}
+				} else {
+					if (flags & O_DIRECTORY) {
+						throw fsError("ENOTDIR", path);
+					}
+					const k = key(path);
+					node = nodes.get(k);
+					if (node === undefined) {
+						const file = await e.handle.getFile();
+						node = { handle: e.handle, data: null, size: file.size, mtime: file.lastModified, dirty: false, removed: false, refs: 0 };
+						nodes.set(k, node);
+					}
+					node.refs++;
+					if (flags & O_TRUNC && writable) {
+						node.data ??= new Uint8Array(0);
+						resize(node, 0);
+					}
+				}
+				const fd = nextFd++;
+				fds.set(fd, { path, node, pos: 0, append: (flags & O_APPEND) !== 0 });
+				return fd;
+			}, callback);
+		},
+
+		close(fd, callback) {
+			run(async () => {
+				const f = fileOf(fd);
+				fds.delete(fd);
+				if (f.node === null) {
+					return;
+				}
+				f.node.refs--;
+				try {
+					await flush(f.node, f.path);
+				} finally {
+					if (f.node.refs === 0 && nodes.get(key(f.path)) === f.node) {
+						nodes.delete(key(f.path));
+					}
+				}
+			}, callback);
+		},
+
+		fsync(fd, callback) {
+			run(async () => {
+				const f = fileOf(fd);
+				if (f.node !== null) {
+					await flush(f.node, f.path);
+				}
+			}, callback);
+		},
+
+		read(fd, buf, offset, length, position, callback) {
+			run(async () => {
+				const f = fileOf(fd);
+				const node = regular(f);
+				await load(node);
+				const pos = position ?? f.pos;
+				const n = Math.max(0, Math.min(length, node.size - pos));
+				buf.set(node.data.subarray(pos, pos + n), offset);
+				if (position === null) {
+					f.pos += n;
+				}
+				return n;
+			}, callback);
+		},
+
+		write(fd, buf, offset, length, position, callback) {
+			if (fd === 1 || fd === 2) {
+				callback(null, writeOutput(fd, buf.subarray(offset, offset + length)));
+				return;
+			}
+			// The buffer is memory of the program, which may reuse it once
+			// the call returns.
+			const b = buf.slice(offset, offset + length);
+			run(async () => {
+				const f = fileOf(fd);
+				const node = regular(f);
+				await load(node);
+				let pos = position ?? f.pos;
+				if (position === null && f.append) {
+					pos = node.size;
+				}
+				if (pos + b.length > node.size) {
+					resize(node, pos + b.length);
+				}
+				node.data.set(b, pos);
+				node.dirty = true;
+				if (position === null) {
+					f.pos = pos + b.length;
+				}
+				return b.length;
+			}, callback);
+		},
+
+		ftruncate(fd, length, callback) {
+			run(async () => {
+				const node = regular(fileOf(fd));
+				await load(node);
+				resize(node, length);
+			}, callback);
+		},
+
+		truncate(path, length, callback) {
+			run(async () => {
+				const e = await mustLookup(path);
+				if (e.kind === "directory") {
+					throw fsError("EISDIR", path);
+				}
+				const node = nodes.get(key(path));
+				if (node !== undefined) {
+					await load(node);
+					resize(node, length);
+					await flush(node, path);
+					return;
+				}
+				const data = await content(e, path);
+				const resized = new Uint8Array(length);
+				resized.set(data.subarray(0, length));
+				await writeFile(e.handle, resized);
+			}, callback);
+		},
+
+		fstat(fd, callback) {
+			run(async () => {
+				const f = fileOf(fd);
+				if (f.node === null) {
+					return stats(f.path, "directory", 0, 0);
+				}
+				return stats(f.path, "file", f.node.size, f.node.mtime);
+			}, callback);
+		},
+
+		stat(path, callback) {
+			run(async () => {
+				const e = await mustLookup(path);
+				if (e.kind === "directory") {
+					return stats(path, "directory", 0, 0);
+				}
+				const node = nodes.get(key(path));
+				if (node !== undefined) {
+					return stats(path, "file", node.size, node.mtime);
+				}
+				const file = await e.handle.getFile();
+				return stats(path, "file", file.size, file.lastModified);
+			}, callback);
+		},
+
+		lstat(path, callback) {
+			fs.stat(path, callback);
+		},
+
+		readdir(path, callback) {
+			run(async () => {
+				const e = await mustLookup(path);
+				if (e.kind !== "directory") {
+					throw fsError("ENOTDIR", path);
+				}
+				const names = [];
+				for await (const name of e.handle.keys()) {
+					names.push(name);
+				}
+				return names;
+			}, callback);
+		},
+
+		mkdir(path, perm, callback) {
+			run(async () => {
+				const names = split(path);
+				if (names.length === 0 || await lookup(path) !== null) {
+					throw fsError("EEXIST", path);
+				}
+				const name = names.pop();
+				const parent = await dir(names, path);
+				try {
+					await parent.getDirectoryHandle(name, { create: true });
+				} catch (err) {
+					throw mapError(err, path);
+				}
+			}, callback);
+		},
+
+		rmdir(path, callback) {
+			run(async () => {
+				const e = await mustLookup(path);
+				if (e.kind !== "directory") {
+					throw fsError("ENOTDIR", path);
+				}
+				if (e.parent === null) {
+					throw fsError("EACCES", path);
+				}
+				if (!await isEmpty(e.handle)) {
+					throw fsError("ENOTEMPTY", path);
+				}
+				try {
+					await e.parent.removeEntry(e.name);
+				} catch (err) {
+					throw mapError(err, path);
+				}
+			}, callback);
+		},
+
+		unlink(path, callback) {
+			run(async () => {
+				const e = await mustLookup(path);
+				if (e.kind === "directory") {
+					throw fsError("EISDIR", path);
+				}
+				try {
+					await e.parent.removeEntry(e.name);
+				} catch (err) {
+					throw mapError(err, path);
+				}
+				const node = nodes.get(key(path));
+				if (node !== undefined) {
+					node.removed = true;
+					nodes.delete(key(path));
+				}
+			}, callback);
+		},
+
+		rename(from, to, callback) {
+			run(async () => {
+				const src = await mustLookup(from);
+				if (src.parent === null) {
+					throw fsError("EACCES", from);
+				}
+				const fromKey = key(from);
+				const toKey = key(to);
+				if (fromKey === toKey) {
+					return;
+				}
+				if (toKey.startsWith(fromKey + "/")) {
+					throw fsError("EINVAL", to);
+				}
+				const dst = await lookup(to);
+				const names = split(to);
+				const name = names.pop();
+				const parent = await dir(names, to);
+				if (dst !== null) {
+					if (src.kind === "file" && dst.kind === "directory") {
+						throw fsError("EISDIR", to);
+					}
+					if (src.kind === "directory") {
+						if (dst.kind !== "directory") {
+							throw fsError("ENOTDIR", to);
+						}
+						if (!await isEmpty(dst.handle)) {
+							throw fsError("ENOTEMPTY", to);
+						}
+						await parent.removeEntry(name);
+					}
+				}
+				let handle;
+				try {
+					// For a file, the new content replaces the old one
+					// atomically, when the copy is closed.
+					handle = await copy(src, from, parent, name);
+					await src.parent.removeEntry(src.name, { recursive: true });
+				} catch (err) {
+					throw mapError(err, to);
+				}
+				// Files open under the old path stay open under the new one,
+				// and an open file replaced is no longer there.
+				const old = nodes.get(toKey);
+				if (old !== undefined) {
+					old.removed = true;
+					nodes.delete(toKey);
+				}
+				for (const [k, node] of [...nodes]) {
+					if (k !== fromKey && !k.startsWith(fromKey + "/")) {
+						continue;
+					}
+					const moved = toKey + k.substring(fromKey.length);
+					const names = split(moved);
+					const file = names.pop();
+					node.handle = await (await dir(names, to)).getFileHandle(file);
+					// The copy has the content.
+					node.dirty = false;
+					nodes.delete(k);
+					nodes.set(moved, node);
+				}
+				for (const f of fds.values()) {
+					const k = key(f.path);
+					if (k === fromKey || k.startsWith(fromKey + "/")) {
+						f.path = toKey + k.substring(fromKey.length);
+					}
+				}
+			}, callback);
+		},
+
+		link(path, link, callback) {
+			callback(fsError("ENOSYS", link));
+		},
+
+		symlink(path, link, callback) {
+			callback(fsError("ENOSYS", link));
+		},
+
+		readlink(path, callback) {
+			callback(fsError("EINVAL", path));
+		},
+
+		chmod(path, mode, callback) {
+			run(() => mustLookup(path).then(() => {}), callback);
+		},
+
+		fchmod(fd, mode, callback) {
+			run(async () => {
+				fileOf(fd);
+			}, callback);
+		},
+
+		chown(path, uid, gid, callback) {
+			fs.chmod(path, 0, callback);
+		},
+
+		fchown(fd, uid, gid, callback) {
+			fs.fchmod(fd, 0, callback);
+		},
+
+		lchown(path, uid, gid, callback) {
+			fs.chmod(path, 0, callback);
+		},
+
+		utimes(path, atime, mtime, callback) {
+			fs.chmod(path, 0, callback);
+		},
+	};
+
+	globalThis.fs = fs;
+}
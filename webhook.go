@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookMaxAttempts is how many times a delivery is tried before it is
+	// moved to the dead letters.
+	webhookMaxAttempts = 8
+	webhookMaxBackoff  = time.Hour
+	webhookTimeout     = 10 * time.Second
+	webhookPoll        = time.Second
+)
+
+// Webhook is a URL that receives the changes made to one collection.
+type Webhook struct {
+	ID         string
+	Collection string
+	URL        string
+	// Secret signs every delivery. It is never returned by Webhooks.
+	Secret  string `json:",omitempty"`
+	Created time.Time
+}
+
+// WebhookEvent is the body POSTed to a webhook. Type is "create", "update"
+// or "delete"; a delete with an empty Key means the whole collection was
+// removed. Value is the record as Read would return it and is omitted for
+// deletes.
+type WebhookEvent struct {
+	ID         string
+	Type       string
+	Collection string
+	Key        string
+	Time       time.Time
+	Value      json.RawMessage `json:",omitempty"`
+}
+
+// WebhookDelivery is an event queued for one webhook.
+type WebhookDelivery struct {
+	ID          string
+	Webhook     string
+	Event       WebhookEvent
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string `json:",omitempty"`
+}
+
+// webhooks holds the registered webhooks and the dispatcher delivering to
+// them. Webhooks, pending deliveries and dead letters are kept under the
+// metadata directory, so nothing is lost across restarts.
+type webhooks struct {
+	mu     sync.Mutex
+	hooks  map[string]*Webhook
+	seq    uint64
+	client *http.Client
+	wake   chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// openWebhooks loads the registered webhooks.
+func (d *Driver) openWebhooks() error {
+	d.hooks = &webhooks{
+		hooks:  make(map[string]*Webhook),
+		client: &http.Client{Timeout: webhookTimeout},
+		wake:   make(chan struct{}, 1),
+	}
+	files, err := os.ReadDir(d.metaPath("webhooks", "hooks"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		b, err := os.ReadFile(d.metaPath("webhooks", "hooks", file.Name()))
+		if err != nil {
+			return err
+		}
+		var h Webhook
+		if err := json.Unmarshal(b, &h); err != nil {
+			return fmt.Errorf("webhook %s: %v", file.Name(), err)
+		}
+		d.hooks.hooks[h.ID] = &h
+	}
+	return nil
+}
+
+// AddWebhook registers url to receive a signed POST of a WebhookEvent for
+// every record created, updated or deleted in collection. Each request
+// carries an X-Webhook-Signature header of the form "sha256=<hex>", the
+// HMAC-SHA256 of the body keyed by secret. Deliveries that fail or get a
+// non-2xx response are retried with exponential backoff; after eight tries
+// they are kept as dead letters (see DeadLetters).
+//
+// Events are queued whenever a webhook is registered, but only sent while
+// StartWebhooks is running, as it does in server mode. Restores replace
+// collections without sending events.
+func (d *Driver) AddWebhook(collection, rawURL, secret string) (Webhook, error) {
+	if err := checkCollection(collection); err != nil {
+		return Webhook{}, err
+	}
+	if err := d.checkWritable(); err != nil {
+		return Webhook{}, err
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return Webhook{}, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Webhook{}, fmt.Errorf("webhook URL %q must be absolute http or https", rawURL)
+	}
+	h := Webhook{ID: d.newID(), Collection: collection, URL: rawURL, Secret: secret, Created: d.now()}
+	b, err := encode(h)
+	if err != nil {
+		return Webhook{}, err
+	}
+	if err := os.MkdirAll(d.metaPath("webhooks", "hooks"), 0755); err != nil {
+		return Webhook{}, err
+	}
+	if err := d.writeFile(d.metaPath("webhooks", "hooks", h.ID+".json"), b); err != nil {
+		return Webhook{}, err
+	}
+	d.hooks.mu.Lock()
+	d.hooks.hooks[h.ID] = &h
+	d.hooks.mu.Unlock()
+	return h, nil
+}
+
+// RemoveWebhook unregisters the webhook id and drops its pending
+// deliveries. Its dead letters are kept.
+func (d *Driver) RemoveWebhook(id string) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	d.hooks.mu.Lock()
+	_, ok := d.hooks.hooks[id]
+	delete(d.hooks.hooks, id)
+	d.hooks.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: webhook %s", ErrNotFound, id)
+	}
+	return os.Remove(d.metaPath("webhooks", "hooks", id+".json"))
+}
+
+// Webhooks returns the registered webhooks, oldest first, without their
+// secrets.
+func (d *Driver) Webhooks() []Webhook {
+	d.hooks.mu.Lock()
+	defer d.hooks.mu.Unlock()
+	list := make([]Webhook, 0, len(d.hooks.hooks))
+	for _, h := range d.hooks.hooks {
+		h := *h
+		h.Secret = ""
+		list = append(list, h)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// DeadLetters returns the deliveries that ran out of attempts, oldest
+// first.
+func (d *Driver) DeadLetters() ([]WebhookDelivery, error) {
+	return d.deliveries("dead")
+}
+
+// RetryDeadLetter queues the dead letter id for delivery again with a fresh
+// set of attempts.
+func (d *Driver) RetryDeadLetter(id string) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	path := d.metaPath("webhooks", "dead", id+".json")
+	dl, err := readDelivery(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: dead letter %s", ErrNotFound, id)
+	}
+	if err != nil {
+		return err
+	}
+	dl.Attempts, dl.NextAttempt, dl.LastError = 0, time.Time{}, ""
+	if err := d.saveDelivery("queue", dl); err != nil {
+		return err
+	}
+	d.wakeWebhooks()
+	return os.Remove(path)
+}
+
+// emit queues an event for the webhooks of collection. b is nil for
+// deletes; existed tells creates from updates.
+func (d *Driver) emit(collection, key string, b []byte, existed bool) {
+	if d.hooks == nil {
+		return
+	}
+	d.hooks.mu.Lock()
+	var targets []string
+	for id, h := range d.hooks.hooks {
+		if h.Collection == collection {
+			targets = append(targets, id)
+		}
+	}
+	d.hooks.mu.Unlock()
+	if len(targets) == 0 {
+		return
+	}
+
+	e := WebhookEvent{Type: "create", Collection: collection, Key: key, Time: d.now().UTC()}
+	switch {
+	case b == nil:
+		e.Type = "delete"
+	case existed:
+		e.Type = "update"
+	}
+	if b != nil {
+		masked, err := d.mask(collection, b)
+		if err != nil {
+			d.log.Error("webhook event for %s/%s: %v\n", collection, key, err)
+			return
+		}
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, masked); err != nil {
+			d.log.Error("webhook event for %s/%s: %v\n", collection, key, err)
+			return
+		}
+		e.Value = buf.Bytes()
+	}
+	e.ID = d.deliveryID()
+	for _, id := range targets {
+		dl := WebhookDelivery{ID: d.deliveryID(), Webhook: id, Event: e}
+		if err := d.saveDelivery("queue", dl); err != nil {
+			d.log.Error("queueing webhook event for %s/%s: %v\n", collection, key, err)
+		}
+	}
+	d.wakeWebhooks()
+}
+
+// hooked reports whether collection has a webhook, so that writers only
+// look up whether a record existed when an event will be sent.
+func (d *Driver) hooked(collection string) bool {
+	if d.hooks == nil {
+		return false
+	}
+	d.hooks.mu.Lock()
+	defer d.hooks.mu.Unlock()
+	for _, h := range d.hooks.hooks {
+		if h.Collection == collection {
+			return true
+		}
+	}
+	return false
+}
+
+// deliveryID returns a unique ID that sorts in creation order.
+func (d *Driver) deliveryID() string {
+	d.hooks.mu.Lock()
+	d.hooks.seq++
+	seq := d.hooks.seq
+	d.hooks.mu.Unlock()
+	return fmt.Sprintf("%020d-%06d", d.now().UnixNano(), seq%1000000)
+}
+
+func (d *Driver) saveDelivery(dir string, dl WebhookDelivery) error {
+	b, err := encode(dl)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.metaPath("webhooks", dir), 0755); err != nil {
+		return err
+	}
+	return d.writeFile(d.metaPath("webhooks", dir, dl.ID+".json"), b)
+}
+
+func readDelivery(path string) (WebhookDelivery, error) {
+	var dl WebhookDelivery
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return dl, err
+	}
+	err = json.Unmarshal(b, &dl)
+	return dl, err
+}
+
+// deliveries returns the deliveries saved in dir, oldest first.
+func (d *Driver) deliveries(dir string) ([]WebhookDelivery, error) {
+	files, err := os.ReadDir(d.metaPath("webhooks", dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []WebhookDelivery
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		dl, err := readDelivery(d.metaPath("webhooks", dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, dl)
+	}
+	return list, nil
+}
+
+// StartWebhooks starts sending queued events to their webhooks in the
+// background until Close. Deliveries to one webhook are sent in order: a
+// delivery waiting for a retry holds back the later ones.
+func (d *Driver) StartWebhooks() {
+	if d.readOnly {
+		return
+	}
+	d.hooks.mu.Lock()
+	defer d.hooks.mu.Unlock()
+	if d.hooks.stop != nil {
+		return
+	}
+	d.hooks.stop = make(chan struct{})
+	d.hooks.done = make(chan struct{})
+	go d.deliverWebhooks(d.hooks.stop, d.hooks.done)
+}
+
+func (d *Driver) wakeWebhooks() {
+	select {
+	case d.hooks.wake <- struct{}{}:
+	default:
+	}
+}
+
+// stopWebhooks stops the dispatcher and waits for the delivery in flight.
+func (d *Driver) stopWebhooks() {
+	if d.hooks == nil {
+		return
+	}
+	d.hooks.mu.Lock()
+	stop, done := d.hooks.stop, d.hooks.done
+	d.hooks.stop, d.hooks.done = nil, nil
+	d.hooks.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+func (d *Driver) deliverWebhooks(stop, done chan struct{}) {
+	defer close(done)
+	t := time.NewTicker(webhookPoll)
+	defer t.Stop()
+	for {
+		if err := d.deliverPending(stop); err != nil {
+			d.log.Error("delivering webhooks: %v\n", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-d.hooks.wake:
+		case <-t.C:
+		}
+	}
+}
+
+// deliverPending makes one pass over the queue, sending every delivery that
+// is due and not held back by an earlier one to the same webhook.
+func (d *Driver) deliverPending(stop chan struct{}) error {
+	queue, err := d.deliveries("queue")
+	if err != nil {
+		return err
+	}
+	held := make(map[string]bool)
+	for _, dl := range queue {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		path := d.metaPath("webhooks", "queue", dl.ID+".json")
+		d.hooks.mu.Lock()
+		h, ok := d.hooks.hooks[dl.Webhook]
+		var hook Webhook
+		if ok {
+			hook = *h
+		}
+		d.hooks.mu.Unlock()
+		if !ok {
+			os.Remove(path)
+			continue
+		}
+		if held[dl.Webhook] || d.now().Before(dl.NextAttempt) {
+			held[dl.Webhook] = true
+			continue
+		}
+
+		err := d.post(hook, dl)
+		if err == nil {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			continue
+		}
+		held[dl.Webhook] = true
+		dl.Attempts++
+		dl.LastError = err.Error()
+		if dl.Attempts >= webhookMaxAttempts {
+			d.log.Warn("webhook %s: giving up on delivery %s: %v\n", hook.ID, dl.ID, err)
+			if err := d.saveDelivery("dead", dl); err != nil {
+				return err
+			}
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			// The dead letter no longer holds back later deliveries.
+			held[dl.Webhook] = false
+			continue
+		}
+		backoff := webhookMaxBackoff
+		if dl.Attempts < 20 {
+			if b := time.Second << (dl.Attempts - 1); b < backoff {
+				backoff = b
+			}
+		}
+		dl.NextAttempt = d.now().Add(backoff)
+		if err := d.saveDelivery("queue", dl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// post sends one delivery, failing unless the webhook answers with a 2xx
+// status.
+func (d *Driver) post(h Webhook, dl WebhookDelivery) error {
+	body, err := json.Marshal(dl.Event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, []byte(h.Secret))
+	mac.Write(body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-ID", h.ID)
+	req.Header.Set("X-Webhook-Delivery", dl.ID)
+	req.Header.Set("X-Webhook-Event", dl.Event.Type)
+	req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	resp, err := d.hooks.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// writeBehindMax is how many queued mutations make Write and Delete wait
+// for the background writer to catch up.
+const writeBehindMax = 10000
+
+// pendingOp is a queued mutation. A nil b deletes the record. taken is set
+// once the background writer has picked it up, after which it can no
+// longer be coalesced.
+type pendingOp struct {
+	seq        uint64
+	collection string
+	key        string
+	b          []byte
+	queued     time.Time
+	taken      bool
+}
+
+// writeBehind queues the writes and deletes made with Options.WriteBehind
+// and applies them in order in the background. latest holds the newest
+// queued mutation of every key; a mutation leaves it only once applied,
+// with the collection lock held, so that under the lock the records on
+// disk overlaid with latest are exactly the records callers wrote.
+//
+// With a coalescing window, see Options.CoalesceWindow, mutations are held
+// for the window before being applied, and a mutation of a key already
+// queued replaces the queued one in place instead of joining the queue.
+// urgent is the newest seq settle waits for, applied without waiting out
+// the window.
+type writeBehind struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	queue     []*pendingOp
+	latest    map[string]map[string]*pendingOp
+	queued    uint64
+	applied   uint64
+	urgent    uint64
+	coalesced uint64
+	window    time.Duration
+	clock     Clock
+	timer     Timer // wakes the writer when the head is due
+	err       error
+	closed    bool
+	done      chan struct{}
+}
+
+func (d *Driver) startWriteBehind(window time.Duration) {
+	wb := &writeBehind{latest: make(map[string]map[string]*pendingOp), window: window, clock: d.clock, done: make(chan struct{})}
+	wb.cond = sync.NewCond(&wb.mu)
+	d.wb = wb
+	go d.runWriteBehind(wb)
+}
+
+// enqueue queues a mutation, waiting while the queue is full.
+func (d *Driver) enqueue(collection, key string, b []byte) error {
+	wb := d.wb
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	if op := wb.latest[collection][key]; wb.window > 0 && op != nil && !op.taken && !wb.closed {
+		op.b = b
+		wb.coalesced++
+		return nil
+	}
+	for len(wb.queue) >= writeBehindMax && !wb.closed {
+		wb.cond.Wait()
+	}
+	if wb.closed {
+		return fmt.Errorf("unable to queue %s/%s: driver is closed", collection, key)
+	}
+	wb.queued++
+	op := &pendingOp{seq: wb.queued, collection: collection, key: key, b: b, queued: d.now()}
+	wb.queue = append(wb.queue, op)
+	if wb.latest[collection] == nil {
+		wb.latest[collection] = make(map[string]*pendingOp)
+	}
+	wb.latest[collection][key] = op
+	wb.cond.Broadcast()
+	return nil
+}
+
+func (d *Driver) runWriteBehind(wb *writeBehind) {
+	defer close(wb.done)
+	for {
+		wb.mu.Lock()
+		for !wb.due() {
+			wb.cond.Wait()
+		}
+		if len(wb.queue) == 0 {
+			wb.mu.Unlock()
+			return
+		}
+		op := wb.queue[0]
+		op.taken = true
+		wb.queue[0] = nil
+		wb.queue = wb.queue[1:]
+		wb.mu.Unlock()
+
+		mutex := d.getOrCreateMutex(op.collection)
+		mutex.Lock()
+		var err error
+		if op.b != nil {
+			err = d.write(op.collection, op.key, op.b)
+		} else if err = d.delete(op.collection, op.key); errors.Is(err, ErrNotFound) {
+			err = nil
+		}
+		wb.mu.Lock()
+		if keys := wb.latest[op.collection]; keys[op.key] == op {
+			delete(keys, op.key)
+			if len(keys) == 0 {
+				delete(wb.latest, op.collection)
+			}
+		}
+		wb.applied = op.seq
+		if err != nil {
+			d.log.Error("write-behind of %s/%s failed: %v\n", op.collection, op.key, err)
+			if wb.err == nil {
+				wb.err = fmt.Errorf("write-behind of %s/%s: %w", op.collection, op.key, err)
+			}
+		}
+		wb.cond.Broadcast()
+		wb.mu.Unlock()
+		mutex.Unlock()
+	}
+}
+
+// due reports whether the background writer should apply the head of the
+// queue, or stop if the queue is empty. If the head is still held by the
+// coalescing window, a timer wakes the writer once it is due. wb.mu must
+// be held.
+func (wb *writeBehind) due() bool {
+	if len(wb.queue) == 0 {
+		return wb.closed
+	}
+	op := wb.queue[0]
+	wait := wb.window - wb.clock.Now().Sub(op.queued)
+	if wait <= 0 || wb.closed || op.seq <= wb.urgent {
+		return true
+	}
+	if wb.timer == nil {
+		wb.timer = wb.clock.AfterFunc(wait, func() {
+			wb.mu.Lock()
+			wb.timer = nil
+			wb.cond.Broadcast()
+			wb.mu.Unlock()
+		})
+	}
+	return false
+}
+
+// Flush waits until every write and delete queued so far with
+// Options.WriteBehind is on disk, and returns the first error met applying
+// them since the last Flush. It returns nil at once when write-behind is
+// off.
+func (d *Driver) Flush() error {
+	if d.wb == nil {
+		return nil
+	}
+	d.settle()
+	d.wb.mu.Lock()
+	defer d.wb.mu.Unlock()
+	err := d.wb.err
+	d.wb.err = nil
+	return err
+}
+
+// settle waits until the mutations queued so far are applied. Operations
+// that read records from disk and write them back, or copy them, settle
+// first so they never miss a queued mutation nor get overwritten by one.
+// No collection lock may be held.
+func (d *Driver) settle() {
+	wb := d.wb
+	if wb == nil {
+		return
+	}
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	target := wb.queued
+	if target > wb.urgent {
+		wb.urgent = target
+		wb.cond.Broadcast()
+	}
+	for wb.applied < target {
+		wb.cond.Wait()
+	}
+}
+
+// stopWriteBehind applies what is left in the queue and stops the
+// background writer.
+func (d *Driver) stopWriteBehind() error {
+	wb := d.wb
+	if wb == nil {
+		return nil
+	}
+	wb.mu.Lock()
+	wb.closed = true
+	wb.cond.Broadcast()
+	wb.mu.Unlock()
+	<-wb.done
+	return wb.err
+}
+
+// pendingRecord returns the queued value of a record. ok is false if
+// nothing is queued for it; a queued delete returns ok with a nil value.
+func (d *Driver) pendingRecord(collection, key string) (b []byte, ok bool) {
+	if d.wb == nil {
+		return nil, false
+	}
+	d.wb.mu.Lock()
+	defer d.wb.mu.Unlock()
+	op, ok := d.wb.latest[collection][key]
+	if !ok {
+		return nil, false
+	}
+	return op.b, true
+}
+
+// pendingRecords returns the newest queued mutation of every key of
+// collection. The result is only exact while the collection lock is held.
+func (d *Driver) pendingRecords(collection string) map[string]*pendingOp {
+	if d.wb == nil {
+		return nil
+	}
+	d.wb.mu.Lock()
+	defer d.wb.mu.Unlock()
+	if len(d.wb.latest[collection]) == 0 {
+		return nil
+	}
+	ops := make(map[string]*pendingOp, len(d.wb.latest[collection]))
+	for key, op := range d.wb.latest[collection] {
+		ops[key] = op
+	}
+	return ops
+}
+
+// pendingCollections returns the collections with queued mutations.
+func (d *Driver) pendingCollections() []string {
+	if d.wb == nil {
+		return nil
+	}
+	d.wb.mu.Lock()
+	defer d.wb.mu.Unlock()
+	names := make([]string, 0, len(d.wb.latest))
+	for collection := range d.wb.latest {
+		names = append(names, collection)
+	}
+	return names
+}
+
+// overlay applies the queued mutations of collection to records read from
+// disk, keeping them in key order.
+func overlay(records []Record[json.RawMessage], pending map[string]*pendingOp) []Record[json.RawMessage] {
+	if len(pending) == 0 {
+		return records
+	}
+	out := records[:0]
+	for _, r := range records {
+		op, ok := pending[r.Key]
+		if !ok {
+			out = append(out, r)
+			continue
+		}
+		delete(pending, r.Key)
+		if op.b != nil {
+			out = append(out, pendingRecordOf(op))
+		}
+	}
+	for _, op := range pending {
+		if op.b != nil {
+			out = append(out, pendingRecordOf(op))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+func pendingRecordOf(op *pendingOp) Record[json.RawMessage] {
+	return Record[json.RawMessage]{
+		Key:   op.key,
+		Meta:  Meta{Size: int64(len(op.b)), ModTime: op.queued},
+		Value: op.b,
+	}
+}
+
+// queueDelete queues the delete of a record, failing like Delete when the
+// caller could not see the record.
+func (d *Driver) queueDelete(collection, resource string) error {
+	if err := d.checkFrozen(collection); err != nil {
+		return err
+	}
+	path := filepath.Join(collection, resource)
+	if b, ok := d.pendingRecord(collection, resource); ok {
+		if b == nil {
+			return fmt.Errorf("%w: %v", ErrNotFound, path)
+		}
+	} else if _, err := os.Stat(d.recordPath(collection, resource)); err != nil {
+		return fmt.Errorf("%w: %v", ErrNotFound, path)
+	}
+	return d.enqueue(collection, resource, nil)
+}